@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/oklog/ulid/v2"
+
+	"go.angaros.io/internal/api"
+	"go.angaros.io/internal/broadcast"
+)
+
+type command struct {
+	name        string
+	args        string
+	description string
+	run         func(args []string) error
+}
+
+var commands = []command{
+	{name: "broadcast create", args: "[flags]", description: "create a new broadcast", run: cmdBroadcastCreate},
+	{name: "broadcast list", description: "list broadcasts", run: cmdBroadcastList},
+	{name: "broadcast show", args: "<ID>", description: "show details of a broadcast", run: cmdBroadcastShow},
+	{name: "broadcast sends", args: "<ID>", description: "show the send results of a broadcast", run: cmdBroadcastSends},
+	{name: "broadcast pause", args: "<ID>", description: "pause a broadcast", run: cmdBroadcastSetState("broadcast pause", broadcast.PauseTx)},
+	{name: "broadcast resume", args: "<ID>", description: "resume a paused broadcast", run: cmdBroadcastSetState("broadcast resume", broadcast.ResumeTx)},
+	{name: "broadcast cancel", args: "<ID>", description: "cancel a broadcast permanently", run: cmdBroadcastSetState("broadcast cancel", broadcast.CancelTx)},
+	{name: "broadcast delete", args: "<ID>", description: "delete a broadcast", run: cmdBroadcastDelete},
+	{name: "list add", args: "[flags]", description: "create a new contact list", run: cmdListAdd},
+	{name: "list list", description: "list contact lists", run: cmdListList},
+	{name: "list import", args: "[flags] <ID>", description: "import contacts from a file into a contact list", run: cmdListImport},
+	{name: "list contacts", args: "[flags] <ID>", description: "show the contacts of a contact list", run: cmdListContacts},
+	{name: "list merge", args: "<source ID> <destination ID>", description: "move the contacts of a list into another list and delete it", run: cmdListMerge},
+	{name: "list delete", args: "<ID>", description: "delete a contact list and its contacts", run: cmdListDelete},
+	{name: "suppression add", args: "[flags] <recipient>...", description: "add recipients to the suppression list", run: cmdSuppressionAdd},
+	{name: "suppression import", args: "[flags]", description: "add the recipients of a file to the suppression list", run: cmdSuppressionImport},
+	{name: "suppression list", description: "list suppressed recipients", run: cmdSuppressionList},
+	{name: "suppression delete", args: "<recipient>", description: "remove a recipient from the suppression list", run: cmdSuppressionDelete},
+	{name: "smtp add", args: "[flags]", description: "add a new SMTP account", run: cmdSMTPAdd},
+	{name: "smtp list", description: "list SMTP accounts", run: cmdSMTPList},
+	{name: "smtp test", args: "[flags] <ID>", description: "test the connection to an SMTP server and optionally send a test message", run: cmdSMTPTest},
+	{name: "identity add", args: "[flags]", description: "add a new email identity", run: cmdIdentityAdd},
+	{name: "identity list", description: "list email identities", run: cmdIdentityList},
+	{name: "identity dkim", args: "[flags] <email>", description: "configure DKIM signing of an email identity and print the DNS record", run: cmdIdentityDKIM},
+	{name: "bounce set", args: "[flags]", description: "configure the mailbox that receives bounces. Without -host bounce processing is disabled", run: cmdBounceSet},
+	{name: "bounce show", description: "show the bounce mailbox", run: cmdBounceShow},
+	{name: "bounce check", description: "process the new messages of the bounce mailbox now", run: cmdBounceCheck},
+	{name: "reply set", args: "[flags]", description: "configure the collection of SMS replies and the opt-out keywords", run: cmdReplySet},
+	{name: "reply show", description: "show the reply settings", run: cmdReplyShow},
+	{name: "reply check", description: "read the SMS replies from the devices of broadcasts now", run: cmdReplyCheck},
+	{name: "reply list", args: "[flags]", description: "list the SMS replies to broadcasts", run: cmdReplyList},
+	{name: "api token", args: "[--regenerate]", description: "print the token of the HTTP API", run: cmdAPIToken},
+	{name: "run", args: "[--no-gui]", description: "start the dispatcher (and the GUI unless --no-gui is set)", run: cmdRun},
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [flags] [command]\n\n", filepath.Base(os.Args[0]))
+	fmt.Fprintln(out, "If no command is given, the GUI is started.")
+	fmt.Fprintln(out, "\nCommands:")
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", cmd.name, cmd.args, cmd.description)
+	}
+	tw.Flush()
+	fmt.Fprintln(out, "\nRun a command with -h to see its flags.")
+	fmt.Fprintln(out, "\nFlags:")
+	flag.PrintDefaults()
+}
+
+func runCommand(args []string) error {
+	for _, cmd := range commands {
+		nameFields := strings.Fields(cmd.name)
+		if len(args) < len(nameFields) {
+			continue
+		}
+		if strings.Join(args[:len(nameFields)], " ") == cmd.name {
+			return cmd.run(args[len(nameFields):])
+		}
+	}
+	return fmt.Errorf("unknown command '%s'. Run with -help to see available commands", strings.Join(args, " "))
+}
+
+func newFlagSet(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s %s\n", filepath.Base(os.Args[0]), name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// stringsFlag is a flag that can be set more than once
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// parseArgID parses the single positional argument of a command as a ULID
+func parseArgID(fs *flag.FlagSet) (ulid.ULID, error) {
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return ulid.ULID{}, fmt.Errorf("expected 1 argument, got %d", fs.NArg())
+	}
+	id, err := ulid.ParseStrict(fs.Arg(0))
+	if err != nil {
+		return ulid.ULID{}, fmt.Errorf("invalid ID %s: %s", fs.Arg(0), err)
+	}
+	return id, nil
+}
+
+func cmdRun(args []string) error {
+	fs := newFlagSet("run", "[--no-gui]")
+	flagNoGUI := fs.Bool("no-gui", false, "run the dispatcher without the GUI until interrupted")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if !*flagNoGUI {
+		startGUI()
+		return nil
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	loggerInfo.Println("dispatcher started without GUI")
+	waitServices := startServices(ctx)
+	// returns after ctx is cancelled and running broadcasts have stopped
+	broadcast.Dispatcher(ctx, db, loggerInfo, loggerDebug)
+	// the database is closed when the command returns
+	waitServices()
+	loggerInfo.Println("dispatcher stopped")
+	return nil
+}
+
+func cmdAPIToken(args []string) error {
+	fs := newFlagSet("api token", "[--regenerate]")
+	flagRegenerate := fs.Bool("regenerate", false, "replace the token with a new one. Clients using the old token will stop working")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	var token string
+	var err error
+	if *flagRegenerate {
+		token, err = api.RegenerateToken(db)
+	} else {
+		token, err = api.GetOrCreateToken(db)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println(token)
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"go.angaros.io/internal/bounce"
+	"go.angaros.io/internal/dbutil"
+)
+
+func cmdBounceSet(args []string) error {
+	fs := newFlagSet("bounce set", "[flags]")
+	var (
+		flagProtocol   = fs.String("protocol", "IMAP", "protocol: "+strings.Join(bounce.Protocols, " or "))
+		flagHost       = fs.String("host", "", "mail server host (required). Empty disables bounce processing")
+		flagPort       = fs.Uint("port", 0, "mail server port (0 = default port of the protocol and connection encryption)")
+		flagEncryption = fs.String("encryption", "TLS", "connection encryption: TLS, STARTTLS or INSECURE")
+		flagUsername   = fs.String("username", "", "username")
+		flagPassword   = fs.String("password", "", "password")
+		flagFolder     = fs.String("folder", "", "IMAP folder (empty = INBOX)")
+		flagDelete     = fs.Bool("delete", false, "delete the bounces after processing them")
+		flagSuppress   = fs.Bool("suppress", false, "add recipients with a hard bounce to the suppression list")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *flagHost == "" {
+		var m bounce.SettingMailbox
+		if err := dbutil.DeleteByTableKey(db, m.DBTable(), m.DBKey()); err != nil {
+			return fmt.Errorf("cannot write to database: %s", err)
+		}
+		fmt.Println("bounce processing disabled")
+		return nil
+	}
+	if *flagPort > 65535 {
+		return fmt.Errorf("invalid port: %d", *flagPort)
+	}
+	m := bounce.SettingMailbox{
+		Protocol:             strings.ToUpper(*flagProtocol),
+		Host:                 *flagHost,
+		Port:                 uint16(*flagPort),
+		ConnectionEncryption: *flagEncryption,
+		Username:             *flagUsername,
+		Password:             *flagPassword,
+		Folder:               *flagFolder,
+		DeleteBounces:        *flagDelete,
+		SuppressHardBounces:  *flagSuppress,
+	}
+	if err := m.Validate(); err != nil {
+		return fmt.Errorf("invalid bounce mailbox: %s", err)
+	}
+	if err := dbutil.UpsertSaveable(db, m); err != nil {
+		return fmt.Errorf("cannot write to database: %s", err)
+	}
+	return nil
+}
+
+func cmdBounceShow(args []string) error {
+	fs := newFlagSet("bounce show", "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	var m bounce.SettingMailbox
+	if err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		m, err = bounce.GetMailboxTx(tx)
+		return err
+	}); err != nil {
+		return err
+	}
+	if !m.Enabled() {
+		fmt.Println("bounce processing is disabled")
+		return nil
+	}
+	fmt.Printf("protocol:       %s\n", m.Protocol)
+	fmt.Printf("server:         %s (%s)\n", m.Addr(), m.ConnectionEncryption)
+	fmt.Printf("username:       %s\n", m.Username)
+	if m.Protocol == "IMAP" {
+		folder := m.Folder
+		if folder == "" {
+			folder = "INBOX"
+		}
+		fmt.Printf("folder:         %s\n", folder)
+	}
+	fmt.Printf("delete bounces: %v\n", m.DeleteBounces)
+	fmt.Printf("suppress hard:  %v\n", m.SuppressHardBounces)
+	return nil
+}
+
+func cmdBounceCheck(args []string) error {
+	fs := newFlagSet("bounce check", "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	var m bounce.SettingMailbox
+	if err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		m, err = bounce.GetMailboxTx(tx)
+		return err
+	}); err != nil {
+		return err
+	}
+	if !m.Enabled() {
+		return fmt.Errorf("bounce processing is disabled. Configure it with 'bounce set'")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	report, err := bounce.Process(ctx, db, m, loggerDebug)
+	fmt.Printf("%d messages read, %d bounces found, %d matched to broadcasts, %d recipients suppressed\n", report.Messages, report.Bounces, report.Matched, report.Suppressed)
+	return err
+}
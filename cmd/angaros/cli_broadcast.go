@@ -0,0 +1,284 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/oklog/ulid/v2"
+	bolt "go.etcd.io/bbolt"
+
+	"go.angaros.io/internal/broadcast"
+	"go.angaros.io/internal/contactlist"
+	"go.angaros.io/internal/dbutil"
+	"go.angaros.io/internal/phone"
+)
+
+func cmdBroadcastCreate(args []string) error {
+	fs := newFlagSet("broadcast create", "[flags]")
+	var (
+		flagContacts        = fs.String("contacts", "", "path to contacts file (.txt or .csv) (required unless -list is set)")
+		flagType            = fs.String("type", "", "contacts file type: txt (single column) or csv (multiple columns). Detected from the file extension if empty")
+		flagDelimiter       = fs.String("delimiter", "", "CSV delimiter (empty = comma)")
+		flagHeader          = fs.Bool("header", false, "CSV has header")
+		flagRecipientColumn = fs.String("recipient-column", "", "CSV recipient column (name or number)")
+		flagList            = fs.String("list", "", "ID of the contact list to send to instead of a contacts file. The contacts are copied when the broadcast starts")
+		flagTags            = fs.String("tags", "", "comma separated tags. Only contacts of the list with all these tags are included")
+		flagSubject         = fs.String("subject", "", "message subject (leave empty for SMS)")
+		flagBody            = fs.String("body", "", "path to message body file (required). Files ending in .html are sent as HTML")
+		flagHTML            = fs.Bool("html", false, "send the message body as HTML with a generated plain text alternative (email only)")
+		flagGateway         = fs.String("gateway", "", "email of the email identity or Android ID of the saved device (required)")
+		flagSendHours       = fs.String("send-hours", "", "time ranges in 24 hour format e.g. '9-13 15-17'. If not set, value from settings is used")
+		flagTimezone        = fs.String("timezone", "", "time zone e.g. Europe/Athens. If not set, value from settings is used")
+		flagDateFrom        = fs.String("date-from", "", "send date start e.g. 2021-08-16")
+		flagDateTo          = fs.String("date-to", "", "send date end e.g. 2021-08-16")
+		flagCountry         = fs.String("country", "", "country code (e.g. GR) of phone numbers without a country code. If not set, value from settings is used")
+		flagContactAttach   = fs.String("contact-attach", "", "path of a file attached to the message of each contact, e.g. '{{.invoice_file}}'. The paths are relative to the directory of the contacts file and must be inside it (email only)")
+		flagBatch           = fs.Int("batch", 0, "maximum number of consecutive contacts with identical messages sent in one SMTP transaction, up to 100. The recipients are hidden (email only)")
+		flagSIM             = fs.Int("sim", 0, "subscription ID of the SIM that sends the messages. If not set, the SIM of the saved device is used (android only)")
+		flagAttach          stringsFlag
+	)
+	fs.Var(&flagAttach, "attach", "path of a file attached to every message. Can be repeated. Images referenced in the HTML body as cid:filename are inline (email only)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if (*flagContacts == "") == (*flagList == "") || *flagBody == "" || *flagGateway == "" {
+		fs.Usage()
+		return fmt.Errorf("flags -body, -gateway and one of -contacts or -list are required")
+	}
+
+	if _, ok := phone.CallingCode(*flagCountry); *flagCountry != "" && !ok {
+		return fmt.Errorf("unknown country code %s", *flagCountry)
+	}
+
+	in := broadcast.Input{
+		MsgSubject:     *flagSubject,
+		SendHours:      *flagSendHours,
+		Timezone:       *flagTimezone,
+		SendDateFrom:   *flagDateFrom,
+		SendDateTo:     *flagDateTo,
+		DefaultCountry: strings.ToUpper(*flagCountry),
+		BatchSize:      *flagBatch,
+		SubscriptionID: *flagSIM,
+	}
+	if *flagList != "" {
+		listID, err := ulid.ParseStrict(*flagList)
+		if err != nil {
+			return fmt.Errorf("invalid list ID %s: %s", *flagList, err)
+		}
+		in.ContactListID = listID
+		in.ContactListTags = contactlist.ParseTags(*flagTags)
+	} else {
+		contacts, err := readContactsFile(*flagContacts, *flagType, *flagDelimiter, *flagHeader, *flagRecipientColumn)
+		if err != nil {
+			return err
+		}
+		in.Contacts = contacts
+		in.Filename = filepath.Base(*flagContacts)
+	}
+
+	// read message body
+	body, err := ioutil.ReadFile(*flagBody)
+	if err != nil {
+		return fmt.Errorf("failed to read message body file: %s", err)
+	}
+	in.MsgBody = string(body)
+	in.MsgBodyHTML = *flagHTML || broadcast.IsHTMLFilename(*flagBody)
+
+	// read attachments
+	for _, path := range flagAttach {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read attachment: %s", err)
+		}
+		a, err := broadcast.NewAttachment(path, data)
+		if err != nil {
+			return err
+		}
+		in.Attachments = append(in.Attachments, a)
+	}
+	in.ContactAttachment = *flagContactAttach
+	if *flagContacts != "" {
+		in.ContactAttachmentDir = filepath.Dir(*flagContacts)
+	}
+
+	var b broadcast.Broadcast
+	var rejected []broadcast.RejectedContact
+	if err := db.Update(func(tx *bolt.Tx) error {
+		gateway, err := broadcast.GetGatewayTx(tx, []byte(*flagGateway))
+		if err != nil {
+			return err
+		}
+		in.GatewayType = gateway.DBTable()
+		in.GatewayKey = gateway.DBKey()
+		if in.ContactListID != (ulid.ULID{}) {
+			var l contactlist.List
+			err := dbutil.GetByKeyTx(tx, in.ContactListID[:], &l)
+			if err != nil { // don't ignore dbutil.ErrNotFound
+				return fmt.Errorf("failed to read contact list %s: %s", in.ContactListID, err)
+			}
+			listContacts, err := contactlist.ContactsTx(tx, in.ContactListID, in.ContactListTags)
+			if err != nil {
+				return err
+			}
+			if len(listContacts) == 0 {
+				return fmt.Errorf("no contacts in the list have these tags")
+			}
+		}
+		if in.DefaultCountry == "" {
+			in.DefaultCountry, err = broadcast.GetDefaultCountryTx(tx)
+			if err != nil {
+				return err
+			}
+		}
+		b, rejected, err = broadcast.NewFromInput(in)
+		if len(rejected) > 0 {
+			fmt.Fprintf(os.Stderr, "%d contacts rejected:\n%s\n", len(rejected), broadcast.RejectedContactsString(rejected))
+		}
+		if err != nil {
+			return fmt.Errorf("cannot create broadcast: %s", err)
+		}
+		return broadcast.SaveTx(tx, b)
+	}); err != nil {
+		return err
+	}
+	fmt.Println(b.ID.String())
+	return nil
+}
+
+// readContactsFile reads the contacts from the file at path.
+// If fileType is empty, it is detected from the file extension.
+func readContactsFile(path, fileType, delimiter string, hasHeader bool, recipientColumn string) ([]broadcast.Contact, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read contacts file: %s", err)
+	}
+	contactsFile := broadcast.ContactsFile{
+		Content:         string(content),
+		Type:            fileType,
+		HasHeader:       hasHeader,
+		RecipientColumn: recipientColumn,
+	}
+	if contactsFile.Type == "" {
+		contactsFile.Type = broadcast.ContactsFileTypeFromFilename(path)
+	}
+	if len(delimiter) > 0 {
+		contactsFile.Delimiter = rune(delimiter[0])
+	}
+	return contactsFile.ReadContacts()
+}
+
+func cmdBroadcastList(args []string) error {
+	fs := newFlagSet("broadcast list", "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSTATUS\tCONTACTS\tFILE\tSUBJECT")
+	if err := db.View(func(tx *bolt.Tx) error {
+		return dbutil.ForEachReverseTx(tx, &broadcast.Broadcast{}, func(k []byte, v interface{}) error {
+			b := v.(broadcast.Broadcast)
+			if err := b.ReadStatusFromTx(tx); err != nil {
+				return fmt.Errorf("failed to read status of broadcast %s: %s", b.ID, err)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", b.ID, b.GetStatus(), len(b.Contacts), b.MsgBodyFile, b.MsgSubject)
+			return nil
+		})
+	}); err != nil {
+		return fmt.Errorf("database error: %s", err)
+	}
+	return tw.Flush()
+}
+
+func cmdBroadcastShow(args []string) error {
+	fs := newFlagSet("broadcast show", "<ID>")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	id, err := parseArgID(fs)
+	if err != nil {
+		return err
+	}
+	return db.View(func(tx *bolt.Tx) error {
+		var b broadcast.Broadcast
+		err := dbutil.GetByKeyTx(tx, id[:], &b)
+		if err != nil { // don't ignore dbutil.ErrNotFound
+			return fmt.Errorf("failed to read broadcast %s: %s", id, err)
+		}
+		details, err := b.DetailsString(tx)
+		if err != nil {
+			return err
+		}
+		fmt.Print(details)
+		return nil
+	})
+}
+
+func cmdBroadcastSends(args []string) error {
+	fs := newFlagSet("broadcast sends", "<ID>")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	id, err := parseArgID(fs)
+	if err != nil {
+		return err
+	}
+	return db.View(func(tx *bolt.Tx) error {
+		var b broadcast.Broadcast
+		err := dbutil.GetByKeyTx(tx, id[:], &b)
+		if err != nil { // don't ignore dbutil.ErrNotFound
+			return fmt.Errorf("failed to read broadcast %s: %s", id, err)
+		}
+		return dbutil.ForEachPrefixTx(tx, &broadcast.Send{}, b.ID[:], func(k []byte, v interface{}) error {
+			bSend := v.(broadcast.Send)
+			var recipient string
+			if bSend.Index < len(b.Contacts) {
+				recipient = b.Contacts[bSend.Index].Recipient
+			}
+			fmt.Printf("%s (%s)\n", bSend, recipient)
+			return nil
+		})
+	})
+}
+
+func cmdBroadcastDelete(args []string) error {
+	fs := newFlagSet("broadcast delete", "<ID>")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	id, err := parseArgID(fs)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		var b broadcast.Broadcast
+		err := dbutil.GetByKeyTx(tx, id[:], &b)
+		if err != nil { // don't ignore dbutil.ErrNotFound
+			return fmt.Errorf("failed to read broadcast %s: %s", id, err)
+		}
+		return broadcast.DeleteTx(tx, id[:])
+	})
+}
+
+// cmdBroadcastSetState returns a command that changes the state of a broadcast using setStateTx
+func cmdBroadcastSetState(name string, setStateTx func(tx *bolt.Tx, key []byte) error) func(args []string) error {
+	return func(args []string) error {
+		fs := newFlagSet(name, "<ID>")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		id, err := parseArgID(fs)
+		if err != nil {
+			return err
+		}
+		if err := db.Update(func(tx *bolt.Tx) error {
+			return setStateTx(tx, id[:])
+		}); err != nil {
+			return fmt.Errorf("failed to change state of broadcast %s: %s", id, err)
+		}
+		return nil
+	}
+}
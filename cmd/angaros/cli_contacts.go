@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/oklog/ulid/v2"
+	bolt "go.etcd.io/bbolt"
+
+	"go.angaros.io/internal/contactlist"
+	"go.angaros.io/internal/dbutil"
+	"go.angaros.io/internal/suppression"
+)
+
+func cmdListAdd(args []string) error {
+	fs := newFlagSet("list add", "[flags]")
+	flagName := fs.String("name", "", "name of the list (required)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	l, err := contactlist.NewList(strings.TrimSpace(*flagName))
+	if err != nil {
+		fs.Usage()
+		return fmt.Errorf("cannot create list: %s", err)
+	}
+	if err := dbutil.InsertSaveable(db, l); err != nil {
+		return fmt.Errorf("failed to save list: %s", err)
+	}
+	fmt.Println(l.ID.String())
+	return nil
+}
+
+func cmdListList(args []string) error {
+	fs := newFlagSet("list list", "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tCONTACTS")
+	if err := db.View(func(tx *bolt.Tx) error {
+		return dbutil.ForEachReverseTx(tx, &contactlist.List{}, func(k []byte, v interface{}) error {
+			l := v.(contactlist.List)
+			if err := l.ReadSizeFromTx(tx); err != nil {
+				return fmt.Errorf("failed to count contacts of list %s: %s", l.ID, err)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%d\n", l.ID, l.Name, l.GetSize())
+			return nil
+		})
+	}); err != nil {
+		return fmt.Errorf("database error: %s", err)
+	}
+	return tw.Flush()
+}
+
+func cmdListImport(args []string) error {
+	fs := newFlagSet("list import", "[flags] <ID>")
+	var (
+		flagContacts        = fs.String("contacts", "", "path to contacts file (.txt or .csv) (required)")
+		flagType            = fs.String("type", "", "contacts file type: txt (single column) or csv (multiple columns). Detected from the file extension if empty")
+		flagDelimiter       = fs.String("delimiter", "", "CSV delimiter (empty = comma)")
+		flagHeader          = fs.Bool("header", false, "CSV has header")
+		flagRecipientColumn = fs.String("recipient-column", "", "CSV recipient column (name or number)")
+		flagTags            = fs.String("tags", "", "comma separated tags to add to the imported contacts")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	id, err := parseArgID(fs)
+	if err != nil {
+		return err
+	}
+	if *flagContacts == "" {
+		fs.Usage()
+		return fmt.Errorf("flag -contacts is required")
+	}
+	contacts, err := readContactsFile(*flagContacts, *flagType, *flagDelimiter, *flagHeader, *flagRecipientColumn)
+	if err != nil {
+		return err
+	}
+	var result contactlist.ImportResult
+	if err := db.Update(func(tx *bolt.Tx) error {
+		var err error
+		result, err = contactlist.ImportTx(tx, id, contactsToList(contacts), contactlist.ParseTags(*flagTags))
+		return err
+	}); err != nil {
+		return fmt.Errorf("failed to import contacts: %s", err)
+	}
+	fmt.Println(result)
+	return nil
+}
+
+func cmdListContacts(args []string) error {
+	fs := newFlagSet("list contacts", "[flags] <ID>")
+	flagTags := fs.String("tags", "", "comma separated tags. Only contacts with all these tags are shown")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	id, err := parseArgID(fs)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "RECIPIENT\tTAGS\tKEYWORDS")
+	if err := db.View(func(tx *bolt.Tx) error {
+		contacts, err := contactlist.ContactsTx(tx, id, contactlist.ParseTags(*flagTags))
+		if err != nil {
+			return err
+		}
+		for _, c := range contacts {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", c.Recipient, c.TagsString(), c.KeywordsString())
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	return tw.Flush()
+}
+
+func cmdListMerge(args []string) error {
+	fs := newFlagSet("list merge", "<source ID> <destination ID>")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return fmt.Errorf("expected 2 arguments, got %d", fs.NArg())
+	}
+	var ids [2]ulid.ULID
+	for i := range ids {
+		var err error
+		ids[i], err = ulid.ParseStrict(fs.Arg(i))
+		if err != nil {
+			return fmt.Errorf("invalid ID %s: %s", fs.Arg(i), err)
+		}
+	}
+	var result contactlist.ImportResult
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if err := checkContactListUnusedTx(tx, ids[0]); err != nil {
+			return err
+		}
+		var err error
+		result, err = contactlist.MergeTx(tx, ids[0], ids[1])
+		return err
+	}); err != nil {
+		return fmt.Errorf("failed to merge lists: %s", err)
+	}
+	fmt.Println(result)
+	return nil
+}
+
+func cmdListDelete(args []string) error {
+	fs := newFlagSet("list delete", "<ID>")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	id, err := parseArgID(fs)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		var l contactlist.List
+		err := dbutil.GetByKeyTx(tx, id[:], &l)
+		if err != nil { // don't ignore dbutil.ErrNotFound
+			return fmt.Errorf("failed to read list %s: %s", id, err)
+		}
+		if err := checkContactListUnusedTx(tx, id); err != nil {
+			return err
+		}
+		return contactlist.DeleteTx(tx, id)
+	})
+}
+
+func cmdSuppressionAdd(args []string) error {
+	fs := newFlagSet("suppression add", "[flags] <recipient>...")
+	flagReason := fs.String("reason", suppression.ReasonManual, "reason of the suppression")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("expected at least 1 recipient")
+	}
+	var added int
+	if err := db.Update(func(tx *bolt.Tx) error {
+		var err error
+		added, err = suppression.ImportTx(tx, fs.Args(), *flagReason)
+		return err
+	}); err != nil {
+		return err
+	}
+	fmt.Printf("%d recipients added, %d already suppressed\n", added, fs.NArg()-added)
+	return nil
+}
+
+func cmdSuppressionImport(args []string) error {
+	fs := newFlagSet("suppression import", "[flags]")
+	var (
+		flagContacts        = fs.String("contacts", "", "path to contacts file (.txt or .csv) (required)")
+		flagType            = fs.String("type", "", "contacts file type: txt (single column) or csv (multiple columns). Detected from the file extension if empty")
+		flagDelimiter       = fs.String("delimiter", "", "CSV delimiter (empty = comma)")
+		flagHeader          = fs.Bool("header", false, "CSV has header")
+		flagRecipientColumn = fs.String("recipient-column", "", "CSV recipient column (name or number)")
+		flagReason          = fs.String("reason", suppression.ReasonImported, "reason of the suppression")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *flagContacts == "" {
+		fs.Usage()
+		return fmt.Errorf("flag -contacts is required")
+	}
+	contacts, err := readContactsFile(*flagContacts, *flagType, *flagDelimiter, *flagHeader, *flagRecipientColumn)
+	if err != nil {
+		return err
+	}
+	recipients := make([]string, 0, len(contacts))
+	for _, c := range contacts {
+		recipients = append(recipients, c.Recipient)
+	}
+	var added int
+	if err := db.Update(func(tx *bolt.Tx) error {
+		var err error
+		added, err = suppression.ImportTx(tx, recipients, *flagReason)
+		return err
+	}); err != nil {
+		return err
+	}
+	fmt.Printf("%d recipients added, %d already suppressed\n", added, len(recipients)-added)
+	return nil
+}
+
+func cmdSuppressionList(args []string) error {
+	fs := newFlagSet("suppression list", "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "RECIPIENT\tREASON\tDATE")
+	if err := dbutil.ForEach(db, &suppression.Entry{}, func(k []byte, v interface{}) error {
+		e := v.(suppression.Entry)
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", e.Recipient, e.Reason, e.CreatedAtString())
+		return nil
+	}); err != nil {
+		return fmt.Errorf("database error: %s", err)
+	}
+	return tw.Flush()
+}
+
+func cmdSuppressionDelete(args []string) error {
+	fs := newFlagSet("suppression delete", "<recipient>")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected 1 argument, got %d", fs.NArg())
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		e, err := suppression.GetTx(tx, fs.Arg(0))
+		if err != nil { // don't ignore dbutil.ErrNotFound
+			return fmt.Errorf("failed to read suppressed recipient %s: %s", fs.Arg(0), err)
+		}
+		return dbutil.DeleteByTableKeyTx(tx, e.DBTable(), e.DBKey())
+	})
+}
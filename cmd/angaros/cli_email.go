@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	crand "crypto/rand"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	bolt "go.etcd.io/bbolt"
+
+	"go.angaros.io/internal/dbutil"
+	"go.angaros.io/internal/gateway/email"
+)
+
+func cmdSMTPAdd(args []string) error {
+	fs := newFlagSet("smtp add", "[flags]")
+	var (
+		flagMode        = fs.String("mode", email.ModeRelay, "relay: send through the SMTP server, direct: deliver to the MX servers of the recipients without a relay")
+		flagHost        = fs.String("host", "", "SMTP server host (required in relay mode)")
+		flagPort        = fs.Int("port", 0, "SMTP server port (0 = default port of the connection encryption, or 25 in direct mode)")
+		flagUsername    = fs.String("username", "", "username")
+		flagPassword    = fs.String("password", "", "password")
+		flagEncryption  = fs.String("encryption", "TLS", "connection encryption: TLS, STARTTLS or INSECURE")
+		flagAuth        = fs.String("auth", "PLAIN", "authentication: "+strings.Join(email.AuthTypes, ", "))
+		flagLimitMinute = fs.Int("limit-minute", 0, "send limit per minute (0 = no limit)")
+		flagLimitHour   = fs.Int("limit-hour", 0, "send limit per hour (0 = no limit)")
+		flagLimitDay    = fs.Int("limit-day", 0, "send limit per day (0 = no limit)")
+		flagHeloName    = fs.String("helo", "", "host name sent in EHLO (empty = host name of this computer). Required in direct mode: the name of the PTR record of the sending IP address")
+		flagProxy       = fs.String("proxy", "", "proxy URL e.g. socks5://proxy.example.com:1080 or http://proxy.example.com:3128 for HTTP CONNECT (empty = no proxy)")
+		flagProxyUser   = fs.String("proxy-username", "", "proxy username")
+		flagProxyPass   = fs.String("proxy-password", "", "proxy password")
+		flagReuseLimit  = fs.Int("reuse-limit", 0, "SMTP connection reuse count limit (0 or 1 disables connection reuse. In direct mode 0 means 100 messages per recipient domain)")
+
+		flagOAuth2TokenURL     = fs.String("oauth2-token-url", "", "OAuth2 token endpoint, for XOAUTH2")
+		flagOAuth2ClientID     = fs.String("oauth2-client-id", "", "OAuth2 client ID, for XOAUTH2")
+		flagOAuth2ClientSecret = fs.String("oauth2-client-secret", "", "OAuth2 client secret, for XOAUTH2")
+		flagOAuth2RefreshToken = fs.String("oauth2-refresh-token", "", "OAuth2 refresh token, for XOAUTH2")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	id, err := ulid.New(ulid.Timestamp(time.Now()), crand.Reader)
+	if err != nil {
+		return fmt.Errorf("cannot create ID: %s", err)
+	}
+	a := email.SMTPAccount{
+		ID:                        id,
+		Mode:                      *flagMode,
+		HeloName:                  *flagHeloName,
+		Host:                      *flagHost,
+		Port:                      *flagPort,
+		Username:                  *flagUsername,
+		Password:                  *flagPassword,
+		ConnectionEncryption:      *flagEncryption,
+		AuthType:                  *flagAuth,
+		LimitPerMinute:            *flagLimitMinute,
+		LimitPerHour:              *flagLimitHour,
+		LimitPerDay:               *flagLimitDay,
+		ConnectionReuseCountLimit: *flagReuseLimit,
+		Proxy:                     *flagProxy,
+		ProxyUsername:             *flagProxyUser,
+		ProxyPassword:             *flagProxyPass,
+		OAuth2: email.OAuth2{
+			TokenURL:     *flagOAuth2TokenURL,
+			ClientID:     *flagOAuth2ClientID,
+			ClientSecret: *flagOAuth2ClientSecret,
+		},
+	}
+	if err := a.Validate(); err != nil {
+		return fmt.Errorf("invalid SMTP account: %s", err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		return email.SaveSMTPAccountTx(tx, a, *flagOAuth2RefreshToken)
+	}); err != nil {
+		return fmt.Errorf("cannot write to database: %s", err)
+	}
+	fmt.Println(a.ID.String())
+	return nil
+}
+
+func cmdSMTPList(args []string) error {
+	fs := newFlagSet("smtp list", "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tMODE\tHOST\tPORT\tUSERNAME\tAUTH")
+	err := dbutil.ForEachReverse(db, &email.SMTPAccount{}, func(k []byte, v interface{}) error {
+		a := v.(email.SMTPAccount)
+		mode := a.Mode
+		if mode == "" {
+			mode = email.ModeRelay
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\n", a.ID, mode, a.Host, a.Port, a.Username, a.AuthType)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("database error: %s", err)
+	}
+	return tw.Flush()
+}
+
+func cmdSMTPTest(args []string) error {
+	fs := newFlagSet("smtp test", "[flags] <ID>")
+	flagTo := fs.String("to", "", "send a test message to this email address if the connection test succeeds")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected 1 argument, got %d", fs.NArg())
+	}
+	id, err := ulid.ParseStrict(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("failed to parse SMTP ULID: %s", err)
+	}
+	c, err := email.NewSenderClientFromAccountKey(db, id[:])
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	steps, err := c.Test(ctx)
+	fmt.Print(formatTestSteps(steps))
+	if err != nil {
+		return fmt.Errorf("test failed: %s", err)
+	}
+	defer c.PostSend(ctx)
+	if *flagTo != "" {
+		if err := c.Send(ctx, *flagTo, testMessage, testMessageBroadcastID); err != nil {
+			return fmt.Errorf("failed to send test message: %s", err)
+		}
+		fmt.Println("test message sent to", *flagTo)
+	}
+	return nil
+}
+
+func cmdIdentityAdd(args []string) error {
+	fs := newFlagSet("identity add", "[flags]")
+	var (
+		flagEmail = fs.String("email", "", "email address (required)")
+		flagName  = fs.String("name", "", "name")
+		flagSMTP  = fs.String("smtp", "", "ID of the SMTP account used to send emails")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *flagEmail == "" {
+		fs.Usage()
+		return fmt.Errorf("flag -email is required")
+	}
+	id := email.Identity{
+		Email: *flagEmail,
+		Name:  *flagName,
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		if *flagSMTP != "" {
+			smtpID, err := ulid.ParseStrict(*flagSMTP)
+			if err != nil {
+				return fmt.Errorf("failed to parse SMTP ULID: %s", err)
+			}
+			var a email.SMTPAccount
+			err = dbutil.GetByKeyTx(tx, smtpID[:], &a)
+			if err != nil { // don't ignore dbutil.ErrNotFound
+				return fmt.Errorf("failed to read SMTP account %s: %s", smtpID, err)
+			}
+			id.SMTPKey = smtpID[:]
+		}
+		err := dbutil.InsertSaveableTx(tx, id)
+		if errors.Is(err, dbutil.ErrKeyExists) {
+			return fmt.Errorf("email identity %s already exists", id.Email)
+		} else if err != nil {
+			return fmt.Errorf("cannot write to database: %s", err)
+		}
+		return nil
+	})
+}
+
+func cmdIdentityList(args []string) error {
+	fs := newFlagSet("identity list", "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "EMAIL\tNAME\tSMTP\tDKIM")
+	err := dbutil.ForEach(db, &email.Identity{}, func(k []byte, v interface{}) error {
+		id := v.(email.Identity)
+		var smtpID ulid.ULID
+		var smtpIDString string
+		if err := smtpID.UnmarshalBinary(id.SMTPKey); err == nil {
+			smtpIDString = smtpID.String()
+		}
+		var dkimString string
+		if id.DKIM.Enabled() {
+			dkimString = id.DKIM.RecordName(id.Email)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", id.Email, id.Name, smtpIDString, dkimString)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("database error: %s", err)
+	}
+	return tw.Flush()
+}
+
+func cmdIdentityDKIM(args []string) error {
+	fs := newFlagSet("identity dkim", "[flags] <email>")
+	var (
+		flagSelector = fs.String("selector", "", "DKIM selector (required unless -disable is set)")
+		flagDomain   = fs.String("domain", "", "signing domain. If empty, the domain of the email is used")
+		flagGenerate = fs.String("generate", "", "generate a new private key: rsa or ed25519")
+		flagKey      = fs.String("key", "", "path to a PEM encoded RSA or Ed25519 private key to import")
+		flagDisable  = fs.Bool("disable", false, "stop signing emails and delete the key")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected 1 argument, got %d", fs.NArg())
+	}
+	if *flagGenerate != "" && *flagKey != "" {
+		return fmt.Errorf("set only one of -generate or -key")
+	}
+	if !*flagDisable && *flagSelector == "" {
+		fs.Usage()
+		return fmt.Errorf("flag -selector is required")
+	}
+	var privateKey []byte
+	var err error
+	if *flagGenerate != "" {
+		privateKey, err = email.GenerateDKIMKey(*flagGenerate)
+	} else if *flagKey != "" {
+		var pemBytes []byte
+		pemBytes, err = ioutil.ReadFile(*flagKey)
+		if err != nil {
+			return fmt.Errorf("failed to read key: %s", err)
+		}
+		privateKey, err = email.ParseDKIMKeyPEM(pemBytes)
+	}
+	if err != nil {
+		return err
+	}
+	var id email.Identity
+	if err := db.Update(func(tx *bolt.Tx) error {
+		err := dbutil.GetByKeyTx(tx, []byte(fs.Arg(0)), &id)
+		if err != nil { // don't ignore dbutil.ErrNotFound
+			return fmt.Errorf("failed to read email identity %s: %s", fs.Arg(0), err)
+		}
+		if *flagDisable {
+			id.DKIM = email.DKIM{}
+		} else {
+			if privateKey == nil {
+				privateKey = id.DKIM.PrivateKey
+			}
+			if privateKey == nil {
+				return fmt.Errorf("identity has no DKIM key, set -generate or -key")
+			}
+			id.DKIM = email.DKIM{Domain: *flagDomain, Selector: *flagSelector, PrivateKey: privateKey}
+			if err := id.DKIM.Validate(); err != nil {
+				return err
+			}
+		}
+		return dbutil.UpsertSaveableTx(tx, id)
+	}); err != nil {
+		return err
+	}
+	if !id.DKIM.Enabled() {
+		return nil
+	}
+	record, err := id.DKIM.Record()
+	if err != nil {
+		return err
+	}
+	fmt.Println("Publish the following DNS TXT record:")
+	fmt.Printf("%s\tTXT\t\"%s\"\n", id.DKIM.RecordName(id.Email), record)
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	bolt "go.etcd.io/bbolt"
+
+	"go.angaros.io/internal/broadcast"
+	"go.angaros.io/internal/dbutil"
+	"go.angaros.io/internal/reply"
+)
+
+func cmdReplySet(args []string) error {
+	fs := newFlagSet("reply set", "[flags]")
+	var (
+		flagWindow   = fs.Int("window", reply.DefaultWindowHours, "hours after a message was sent that a message from the contact is a reply to it. 0 disables reply collection")
+		flagKeywords = fs.String("keywords", strings.Join(reply.DefaultOptOutKeywords, ","), "comma separated opt-out keywords. A reply that is one of them adds the contact to the suppression list. Empty disables opt-outs")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	s := reply.SettingReplies{
+		OptOutKeywords: reply.ParseKeywords(*flagKeywords),
+		WindowHours:    *flagWindow,
+	}
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	if err := dbutil.UpsertSaveable(db, s); err != nil {
+		return fmt.Errorf("cannot write to database: %s", err)
+	}
+	return nil
+}
+
+func cmdReplyShow(args []string) error {
+	fs := newFlagSet("reply show", "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	var s reply.SettingReplies
+	if err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		s, err = reply.GetSettingTx(tx)
+		return err
+	}); err != nil {
+		return err
+	}
+	if !s.Enabled() {
+		fmt.Println("reply collection is disabled")
+		return nil
+	}
+	fmt.Printf("window:   %d hours\n", s.WindowHours)
+	fmt.Printf("keywords: %s\n", strings.Join(s.OptOutKeywords, ", "))
+	return nil
+}
+
+func cmdReplyCheck(args []string) error {
+	fs := newFlagSet("reply check", "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	var s reply.SettingReplies
+	if err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		s, err = reply.GetSettingTx(tx)
+		return err
+	}); err != nil {
+		return err
+	}
+	if !s.Enabled() {
+		return fmt.Errorf("reply collection is disabled. Configure it with 'reply set'")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	report, err := reply.Process(ctx, db, s, loggerDebug)
+	fmt.Printf("%d devices read, %d messages received, %d new replies, %d contacts opted out\n", report.Devices, report.Messages, report.Replies, report.OptOuts)
+	return err
+}
+
+func cmdReplyList(args []string) error {
+	fs := newFlagSet("reply list", "[flags]")
+	flagBroadcast := fs.String("broadcast", "", "ID of the broadcast. If not set, the replies to every broadcast are listed")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	var prefix []byte
+	if *flagBroadcast != "" {
+		id, err := ulid.ParseStrict(*flagBroadcast)
+		if err != nil {
+			return fmt.Errorf("invalid broadcast ID %s: %s", *flagBroadcast, err)
+		}
+		prefix = id[:]
+	}
+	return db.View(func(tx *bolt.Tx) error {
+		return dbutil.ForEachPrefixTx(tx, &broadcast.Reply{}, prefix, func(k []byte, v interface{}) error {
+			r := v.(broadcast.Reply)
+			fmt.Printf("%s %s\n", r.BroadcastID, r)
+			return nil
+		})
+	})
+}
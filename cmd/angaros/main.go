@@ -4,6 +4,7 @@ import (
 	"context"
 	crand "crypto/rand"
 	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -11,6 +12,7 @@ import (
 	mrand "math/rand"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"fyne.io/fyne/v2"
@@ -19,7 +21,11 @@ import (
 	"fyne.io/fyne/v2/theme"
 	bolt "go.etcd.io/bbolt"
 
+	"go.angaros.io/internal/api"
+	"go.angaros.io/internal/bounce"
 	"go.angaros.io/internal/broadcast"
+	"go.angaros.io/internal/reply"
+	"go.angaros.io/internal/unsubscribe"
 )
 
 const (
@@ -32,9 +38,20 @@ var (
 	loggerInfo  *log.Logger
 	loggerDebug *log.Logger
 	logger      = log.Default()
+	apiAddr     string
+	// apiAttachmentDir is the directory of the per-contact attachments of broadcasts created via the API
+	apiAttachmentDir string
+	// unsubscribeAddr is the listen address of the public unsubscribe endpoint
+	unsubscribeAddr string
 )
 
 func main() {
+	os.Exit(run())
+}
+
+// run returns the exit code of the program.
+// It is separate from main so that deferred functions run before os.Exit is called.
+func run() int {
 	// random seed
 	var b [8]byte
 	if _, err := crand.Read(b[:]); err != nil {
@@ -46,7 +63,7 @@ func main() {
 	configDir, err := os.UserConfigDir()
 	if err != nil {
 		logger.Println("failed to locate config directory:", err)
-		return
+		return 1
 	}
 	var (
 		flagDebug   = flag.Bool("debug", false, "verbose output for debugging")
@@ -54,14 +71,18 @@ func main() {
 		flagHelp    = flag.Bool("help", false, "Print usage")
 		flagDB      = flag.String("db", filepath.Join(configDir, appID, "data.db"), "path to database")
 	)
+	flag.StringVar(&apiAddr, "api", "", "serve the HTTP API on this address (e.g. 127.0.0.1:8025). Disabled if empty")
+	flag.StringVar(&apiAttachmentDir, "api-attachment-dir", "", "directory of the per-contact attachments of broadcasts created via the API. Disabled if empty")
+	flag.StringVar(&unsubscribeAddr, "unsubscribe", "", "serve the unsubscribe endpoint on this address (e.g. 127.0.0.1:8026), behind an https reverse proxy. Disabled if empty")
+	flag.Usage = usage
 	flag.Parse()
 	switch {
 	case *flagVersion:
 		fmt.Println(appVersion)
-		return
+		return 0
 	case *flagHelp:
-		flag.PrintDefaults()
-		return
+		flag.Usage()
+		return 0
 	}
 	if *flagDebug {
 		logger.Println("debug enabled")
@@ -75,13 +96,18 @@ func main() {
 	// create database directory if it does not exist
 	if err := os.MkdirAll(filepath.Dir(*flagDB), 0700); err != nil {
 		loggerInfo.Printf("failed to create directory '%s': %s", *flagDB, err)
-		return
+		return 1
 	}
 	// open database
 	db, err = bolt.Open(*flagDB, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if errors.Is(err, bolt.ErrTimeout) {
+		loggerInfo.Printf("failed to open database: %s is in use by another process, e.g. a running Angaros. "+
+			"While Angaros is running, use its HTTP API (start it with -api) instead of the command line", *flagDB)
+		return 1
+	}
 	if err != nil {
 		loggerInfo.Println("failed to open database:", err)
-		return
+		return 1
 	}
 	defer func() {
 		if err := db.Close(); err != nil {
@@ -89,16 +115,77 @@ func main() {
 		}
 	}()
 
+	// run command if given, otherwise start GUI
+	if flag.NArg() > 0 {
+		err := runCommand(flag.Args())
+		if err != nil && !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			return 1
+		}
+		return 0
+	}
+	startGUI()
+	return 0
+}
+
+func startGUI() {
 	// start distpatcher
-	go broadcast.Dispatcher(context.Background(), db, loggerInfo, loggerDebug)
+	ctx, cancel := context.WithCancel(context.Background())
+	dispatcherDone := make(chan struct{})
+	go func() {
+		defer close(dispatcherDone)
+		broadcast.Dispatcher(ctx, db, loggerInfo, loggerDebug)
+	}()
+	// start API, unsubscribe endpoint and pollers
+	waitServices := startServices(ctx)
+	// stop dispatcher and services and wait for running broadcasts and services to stop before closing the database
+	defer func() {
+		cancel()
+		<-dispatcherDone
+		waitServices()
+	}()
 
 	// start GUI
 	a := app.NewWithID(appID)
 	w := a.NewWindow("Angaros")
 	w.SetMaster()
 	a.Settings().SetTheme(theme.LightTheme())
-	tabs := container.NewAppTabs(tabBroadcasts(w), tabSMSAndroid(w), tabEmail(w), tabAbout(w))
+	tabs := container.NewAppTabs(tabBroadcasts(w), tabContacts(w), tabSMSAndroid(w), tabEmail(w), tabAbout(w))
 	w.SetContent(tabs)
 	w.Resize(fyne.NewSize(1280, 720))
 	w.ShowAndRun()
 }
+
+// startServices starts the HTTP API and the unsubscribe endpoint if their addresses are set, and the pollers of bounces and replies.
+// The returned function waits for them to stop after ctx is cancelled, so that the database is not closed while they use it.
+func startServices(ctx context.Context) (wait func()) {
+	var wg sync.WaitGroup
+	start := func(f func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f()
+		}()
+	}
+	if apiAddr != "" {
+		start(func() { startAPI(ctx) })
+	}
+	if unsubscribeAddr != "" {
+		start(func() { startUnsubscribe(ctx) })
+	}
+	start(func() { bounce.Poll(ctx, db, loggerInfo, loggerDebug) })
+	start(func() { reply.Poll(ctx, db, loggerInfo, loggerDebug) })
+	return wg.Wait
+}
+
+func startAPI(ctx context.Context) {
+	if err := api.ListenAndServe(ctx, apiAddr, db, apiAttachmentDir, loggerInfo, loggerDebug); err != nil {
+		loggerInfo.Println("API server failed:", err)
+	}
+}
+
+func startUnsubscribe(ctx context.Context) {
+	if err := unsubscribe.ListenAndServe(ctx, unsubscribeAddr, db, loggerInfo); err != nil {
+		loggerInfo.Println("unsubscribe server failed:", err)
+	}
+}
@@ -7,6 +7,6 @@ import (
 )
 
 func tabBroadcasts(w fyne.Window) *container.TabItem {
-	subTabs := container.NewAppTabs(tabBroadcastsSendQueue(w), tabBroadcastsSettings(w))
+	subTabs := container.NewAppTabs(tabBroadcastsSendQueue(w), tabBroadcastsReplies(w), tabBroadcastsSettings(w))
 	return container.NewTabItemWithIcon("Broadcasts", theme.MailSendIcon(), container.NewMax(subTabs))
 }
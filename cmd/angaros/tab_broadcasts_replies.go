@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+	bolt "go.etcd.io/bbolt"
+
+	"go.angaros.io/internal/broadcast"
+	"go.angaros.io/internal/dbutil"
+	container2 "go.angaros.io/internal/fyneutil/container"
+	"go.angaros.io/internal/fyneutil/form"
+	widget2 "go.angaros.io/internal/fyneutil/widget"
+	"go.angaros.io/internal/reply"
+)
+
+func tabBroadcastsReplies(w fyne.Window) *container.TabItem {
+	refreshChan := make(chan struct{}, 1)
+	checkBtn := widget.NewButtonWithIcon("Check now", theme.ViewRefreshIcon(), func() {
+		var s reply.SettingReplies
+		if err := db.View(func(tx *bolt.Tx) error {
+			var err error
+			s, err = reply.GetSettingTx(tx)
+			return err
+		}); err != nil {
+			logAndShowError(fmt.Errorf("database error: %s", err), w)
+			return
+		}
+		if !s.Enabled() {
+			logAndShowError(fmt.Errorf("reply collection is disabled, set the reply window in the settings"), w)
+			return
+		}
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+			defer cancel()
+			report, err := reply.Process(ctx, db, s, loggerDebug)
+			refreshChan <- struct{}{}
+			if err != nil {
+				logAndShowError(fmt.Errorf("failed to read replies: %s", err), w)
+				return
+			}
+			dialog.ShowInformation("Replies", fmt.Sprintf("%d devices read, %d new replies, %d contacts opted out", report.Devices, report.Replies, report.OptOuts), w)
+		}()
+	})
+	settingsBtn := widget.NewButtonWithIcon("Settings", theme.SettingsIcon(), func() {
+		repliesSettings(w)
+	})
+	tablePage := container2.NewTable(
+		w,
+		refreshChan,
+		[]widget2.TableAttribute{
+			{Name: "Actions", Actions: true},
+			{Name: "Date", Field: "ReceivedAtString", Width: 150},
+			{Name: "Broadcast", Field: "BroadcastID", Width: 250},
+			{Name: "Contact", Field: "ContactNumber", Width: 75},
+			{Name: "From", Field: "From", Width: 150},
+			{Name: "Message", Field: "Body", Width: 300},
+			{Name: "Opt-out", Field: "OptOut", Width: 75},
+		},
+		[]widget2.Action{
+			{
+				Name: "Delete",
+				Func: func(v dbutil.Saveable, refreshChan chan<- struct{}) func() {
+					return func() {
+						content := widget.NewLabel("Are you sure you want to delete this reply?\nAn opted out contact stays in the suppression list.")
+						dialog.ShowCustomConfirm("Delete Reply", "Confirm", "Cancel", content, func(submit bool) {
+							if submit {
+								if err := dbutil.DeleteByTableKey(db, v.DBTable(), v.DBKey()); err != nil {
+									logAndShowError(fmt.Errorf("cannot write to database: %s", err), w)
+								}
+								refreshChan <- struct{}{}
+							}
+						}, w)
+					}
+				},
+			},
+		},
+		func(refreshChan <-chan struct{}, t *widget2.Table, noticeLabel *widget.Label) {
+			for range refreshChan {
+				values := make([]dbutil.Saveable, 0)
+				err := dbutil.ForEach(db, &broadcast.Reply{}, func(k []byte, v interface{}) error {
+					vCasted, ok := v.(broadcast.Reply)
+					if !ok {
+						return fmt.Errorf("value %v is not a reply", v)
+					}
+					values = append(values, vCasted)
+					return nil
+				})
+				if err != nil {
+					err = fmt.Errorf("cannot read replies: %s", err)
+					loggerInfo.Println(err)
+					noticeLabel.SetText(err.Error())
+				} else {
+					noticeLabel.SetText(fmt.Sprintf("%d replies", len(values)))
+				}
+				t.UpdateAndRefresh(values)
+			}
+		},
+	)
+	refreshChan <- struct{}{}
+	top := container.NewHBox(checkBtn, settingsBtn)
+	content := container.NewBorder(top, nil, nil, nil, tablePage)
+	return container.NewTabItemWithIcon("Replies", theme.MailReplyIcon(), content)
+}
+
+func repliesSettings(w fyne.Window) {
+	var s reply.SettingReplies
+	if err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		s, err = reply.GetSettingTx(tx)
+		return err
+	}); err != nil {
+		logAndShowError(fmt.Errorf("database error: %s", err), w)
+		return
+	}
+	fields := []form.FormField{
+		{Name: "Reply window (hours)", ExistingValue: strconv.Itoa(s.WindowHours), Description: "a message from a contact within this time after a broadcast sent to it is a reply. 0 disables reply collection"},
+		{Name: "Opt-out keywords", ExistingValue: strings.Join(s.OptOutKeywords, ", "), Description: "comma separated. A reply that is one of them adds the contact to the suppression list.\nCase, accents and punctuation are ignored. Empty disables opt-outs"},
+	}
+	form.ShowFormPopup(w, "Replies", "SMS replies are read from the inbox of the devices of broadcasts", fields, func(inputValues []string) error {
+		windowHours, err := strconv.Atoi(strings.TrimSpace(inputValues[0]))
+		if err != nil {
+			return logAndReturnError(fmt.Errorf("invalid reply window: %s", err))
+		}
+		s := reply.SettingReplies{
+			OptOutKeywords: reply.ParseKeywords(inputValues[1]),
+			WindowHours:    windowHours,
+		}
+		if err := s.Validate(); err != nil {
+			return logAndReturnError(err)
+		}
+		if err := dbutil.UpsertSaveable(db, s); err != nil {
+			return logAndReturnError(fmt.Errorf("failed to update record on database: %s", err))
+		}
+		return nil
+	})
+}
@@ -2,8 +2,8 @@ package main
 
 import (
 	"bufio"
-	crand "crypto/rand"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"path/filepath"
 	"strconv"
@@ -22,11 +22,13 @@ import (
 	bolt "go.etcd.io/bbolt"
 
 	"go.angaros.io/internal/broadcast"
+	"go.angaros.io/internal/contactlist"
 	"go.angaros.io/internal/dbutil"
 	container2 "go.angaros.io/internal/fyneutil/container"
 	"go.angaros.io/internal/fyneutil/form"
 	widget2 "go.angaros.io/internal/fyneutil/widget"
 	"go.angaros.io/internal/gateway/email"
+	"go.angaros.io/internal/gateway/sms"
 	"go.angaros.io/internal/gateway/sms/android"
 	"go.angaros.io/internal/tzdb"
 )
@@ -112,7 +114,11 @@ func tabBroadcastsSendQueue(w fyne.Window) *container.TabItem {
 						widget2.ShowModal(w, "Sent", "", "Close", widget.NewLabel(buf.String()), nil)
 					}
 				},
-			}, {
+			},
+			broadcastSetStateAction(w, "Pause", "", broadcast.PauseTx),
+			broadcastSetStateAction(w, "Resume", "", broadcast.ResumeTx),
+			broadcastSetStateAction(w, "Cancel", "Are you sure you want to cancel this broadcast? A cancelled broadcast cannot be resumed.", broadcast.CancelTx),
+			{
 				Name: "Delete",
 				Func: func(v dbutil.Saveable, refreshChan chan<- struct{}) func() {
 					return func() {
@@ -120,19 +126,7 @@ func tabBroadcastsSendQueue(w fyne.Window) *container.TabItem {
 						dialog.ShowCustomConfirm("Delete Broadcast", "Confirm", "Cancel", content, func(submit bool) {
 							if submit {
 								if err := db.Update(func(tx *bolt.Tx) error {
-									err := dbutil.DeleteByTableKeyTx(tx, broadcast.Broadcast{}.DBTable(), v.DBKey())
-									if err != nil {
-										return fmt.Errorf("failed to delete Broadcast: %s", err)
-									}
-									err = dbutil.DeleteByTableKeyTx(tx, broadcast.Run{}.DBTable(), v.DBKey())
-									if err != nil {
-										return fmt.Errorf("failed to delete Run: %s", err)
-									}
-									err = dbutil.DeletePrefixTx(tx, broadcast.Send{}.DBTable(), v.DBKey())
-									if err != nil {
-										return fmt.Errorf("failed to delete Send: %s", err)
-									}
-									return nil
+									return broadcast.DeleteTx(tx, v.DBKey())
 								}); err != nil {
 									logAndShowError(fmt.Errorf("database error: %s", err), w)
 								}
@@ -180,30 +174,73 @@ func tabBroadcastsSendQueue(w fyne.Window) *container.TabItem {
 	return container.NewTabItemWithIcon("Send Queue", theme.MailSendIcon(), content)
 }
 
-func showBroadcastWizard1(w fyne.Window, refreshChan chan struct{}) {
-	var m sync.Mutex
-	var fileStringBuilder strings.Builder
-	var filename string
-	delimiterEntry := widget.NewEntry()
-	delimiterEntry.SetPlaceHolder("empty = comma")
-	hasHeaderCheck := widget.NewCheck("", nil)
-	recipientColumnEntry := widget.NewEntry()
-	recipientColumnEntry.SetPlaceHolder("e.g. 'email' or '2'")
-	optionFileTypeSingleColumn := ".txt (single column)"
-	optionFileTypeCSV := ".csv (multiple columns)"
-	fileTypeRadio := widget.NewRadioGroup([]string{optionFileTypeSingleColumn, optionFileTypeCSV}, func(selection string) {
+// broadcastSetStateAction returns a table action that changes the state of a broadcast using setStateTx.
+// If confirmText is not empty, the user is asked to confirm first.
+func broadcastSetStateAction(w fyne.Window, name string, confirmText string, setStateTx func(tx *bolt.Tx, key []byte) error) widget2.Action {
+	return widget2.Action{
+		Name: name,
+		Func: func(v dbutil.Saveable, refreshChan chan<- struct{}) func() {
+			setState := func() {
+				if err := db.Update(func(tx *bolt.Tx) error {
+					return setStateTx(tx, v.DBKey())
+				}); err != nil {
+					logAndShowError(fmt.Errorf("failed to %s broadcast: %s", strings.ToLower(name), err), w)
+				}
+				refreshChan <- struct{}{}
+			}
+			return func() {
+				if confirmText == "" {
+					setState()
+					return
+				}
+				content := widget.NewLabel(confirmText)
+				dialog.ShowCustomConfirm(name+" Broadcast", "Confirm", "Back", content, func(submit bool) {
+					if submit {
+						setState()
+					}
+				}, w)
+			}
+		},
+	}
+}
+
+// contactsFileForm shows the file selection and the options needed to read contacts from a file
+type contactsFileForm struct {
+	m                    sync.Mutex
+	fileStringBuilder    strings.Builder
+	filename             string
+	fileBtn              *widget.Button
+	fileTypeRadio        *widget.RadioGroup
+	delimiterEntry       *widget.Entry
+	hasHeaderCheck       *widget.Check
+	recipientColumnEntry *widget.Entry
+}
+
+const (
+	optionFileTypeSingleColumn = ".txt (single column)"
+	optionFileTypeCSV          = ".csv (multiple columns)"
+)
+
+func newContactsFileForm(w fyne.Window) *contactsFileForm {
+	cf := &contactsFileForm{}
+	cf.delimiterEntry = widget.NewEntry()
+	cf.delimiterEntry.SetPlaceHolder("empty = comma")
+	cf.hasHeaderCheck = widget.NewCheck("", nil)
+	cf.recipientColumnEntry = widget.NewEntry()
+	cf.recipientColumnEntry.SetPlaceHolder("e.g. 'email' or '2'")
+	cf.fileTypeRadio = widget.NewRadioGroup([]string{optionFileTypeSingleColumn, optionFileTypeCSV}, func(selection string) {
 		if selection == optionFileTypeSingleColumn {
-			delimiterEntry.Disable()
-			hasHeaderCheck.Disable()
-			recipientColumnEntry.Disable()
+			cf.delimiterEntry.Disable()
+			cf.hasHeaderCheck.Disable()
+			cf.recipientColumnEntry.Disable()
 		} else if selection == optionFileTypeCSV {
-			delimiterEntry.Enable()
-			hasHeaderCheck.Enable()
-			recipientColumnEntry.Enable()
+			cf.delimiterEntry.Enable()
+			cf.hasHeaderCheck.Enable()
+			cf.recipientColumnEntry.Enable()
 		}
 	})
-	fileTypeRadio.Required = true
-	fileBtn := widget.NewButtonWithIcon("File (.txt or .csv)", theme.FileIcon(), func() {
+	cf.fileTypeRadio.Required = true
+	cf.fileBtn = widget.NewButtonWithIcon("File (.txt or .csv)", theme.FileIcon(), func() {
 		go func() {
 			d := dialog.NewFileOpen(func(file fyne.URIReadCloser, err error) {
 				if err != nil {
@@ -216,24 +253,24 @@ func showBroadcastWizard1(w fyne.Window, refreshChan chan struct{}) {
 				}
 				go func() {
 					// lock mutex because we write to fileStringBuilder. is it needed?
-					m.Lock()
-					defer m.Unlock()
-					filename = file.URI().Name()
+					cf.m.Lock()
+					defer cf.m.Unlock()
+					cf.filename = file.URI().Name()
 					scanner := bufio.NewScanner(file)
-					fileStringBuilder.Reset()
+					cf.fileStringBuilder.Reset()
 					for scanner.Scan() {
-						fileStringBuilder.WriteString(scanner.Text())
-						fileStringBuilder.WriteString("\n")
+						cf.fileStringBuilder.WriteString(scanner.Text())
+						cf.fileStringBuilder.WriteString("\n")
 					}
 					if err := scanner.Err(); err != nil {
 						logAndShowError(fmt.Errorf("Error reading file: %s", err), w)
 						return
 					}
-					loggerDebug.Println("uploaded file:", filename)
-					if strings.HasSuffix(filename, ".txt") {
-						fileTypeRadio.SetSelected(optionFileTypeSingleColumn)
-					} else if strings.HasSuffix(filename, ".csv") {
-						fileTypeRadio.SetSelected(optionFileTypeCSV)
+					loggerDebug.Println("uploaded file:", cf.filename)
+					if strings.HasSuffix(cf.filename, ".txt") {
+						cf.fileTypeRadio.SetSelected(optionFileTypeSingleColumn)
+					} else if strings.HasSuffix(cf.filename, ".csv") {
+						cf.fileTypeRadio.SetSelected(optionFileTypeCSV)
 					}
 
 					// remember directory
@@ -258,69 +295,152 @@ func showBroadcastWizard1(w fyne.Window, refreshChan chan struct{}) {
 			d.Show()
 		}()
 	})
-	f := &widget.Form{}
-	f.Append("Contacts:", fileBtn)
-	f.Append("File type:", fileTypeRadio)
-	f.Append("CSV Delimiter:", delimiterEntry)
-	f.Append("CSV has header:", hasHeaderCheck)
-	f.Append("Recipient column (name or number):", recipientColumnEntry)
-	form.ShowCustomPopup(w, "New Broadcast - Step 1/2", "", "Next", "Cancel", f, func() error {
-		// lock mutex because we read from fileStringBuilder
-		m.Lock()
-		defer m.Unlock()
-		fileContent := fileStringBuilder.String()
-		if fileContent == "" {
-			return logAndReturnError(fmt.Errorf("Please select a file first"))
+	return cf
+}
+
+func (cf *contactsFileForm) appendTo(f *widget.Form) {
+	f.Append("Contacts:", cf.fileBtn)
+	f.Append("File type:", cf.fileTypeRadio)
+	f.Append("CSV Delimiter:", cf.delimiterEntry)
+	f.Append("CSV has header:", cf.hasHeaderCheck)
+	f.Append("Recipient column (name or number):", cf.recipientColumnEntry)
+}
+
+func (cf *contactsFileForm) setEnabled(enabled bool) {
+	for _, wid := range []fyne.Disableable{cf.fileBtn, cf.fileTypeRadio, cf.delimiterEntry, cf.hasHeaderCheck, cf.recipientColumnEntry} {
+		if enabled {
+			wid.Enable()
+		} else {
+			wid.Disable()
 		}
-		var err error
-		var contacts []broadcast.Contact
-		if fileTypeRadio.Selected == optionFileTypeSingleColumn {
-			contacts, err = broadcast.ReadContactsFromReader(strings.NewReader(fileContent))
-			if err != nil {
-				return logAndReturnError(fmt.Errorf("Error reading file: %s", err))
-			}
-		} else if fileTypeRadio.Selected == optionFileTypeCSV {
-			// input: delimiter
-			var delimiter rune
-			if len(delimiterEntry.Text) > 0 {
-				delimiter = rune(delimiterEntry.Text[0])
-			}
+	}
+	if enabled {
+		// disable CSV options if needed
+		cf.fileTypeRadio.OnChanged(cf.fileTypeRadio.Selected)
+	}
+}
 
-			// input: hasHeader
-			hasHeader := hasHeaderCheck.Checked
+// readContacts returns the filename and the contacts read from the selected file
+func (cf *contactsFileForm) readContacts() (string, []broadcast.Contact, error) {
+	// lock mutex because we read from fileStringBuilder
+	cf.m.Lock()
+	defer cf.m.Unlock()
+	fileContent := cf.fileStringBuilder.String()
+	if fileContent == "" {
+		return "", nil, fmt.Errorf("Please select a file first")
+	}
+	contactsFile := broadcast.ContactsFile{
+		Content:         fileContent,
+		HasHeader:       cf.hasHeaderCheck.Checked,
+		RecipientColumn: cf.recipientColumnEntry.Text,
+	}
+	if cf.fileTypeRadio.Selected == optionFileTypeSingleColumn {
+		contactsFile.Type = broadcast.ContactsFileTypeSingleColumn
+	} else if cf.fileTypeRadio.Selected == optionFileTypeCSV {
+		contactsFile.Type = broadcast.ContactsFileTypeCSV
+	} else {
+		return "", nil, fmt.Errorf("Please select file type")
+	}
+	if len(cf.delimiterEntry.Text) > 0 {
+		contactsFile.Delimiter = rune(cf.delimiterEntry.Text[0])
+	}
+	contacts, err := contactsFile.ReadContacts()
+	if err != nil {
+		return "", nil, err
+	}
+	return cf.filename, contacts, nil
+}
 
-			// input: recipient column
-			var recipientColumnInt int
-			var recipientColumnStr string
-			recipientColumnEntryStr := recipientColumnEntry.Text
-			if recipientColumnEntryStr != "" {
-				recipientColumnInt, err = strconv.Atoi(recipientColumnEntryStr)
-				if err != nil {
-					recipientColumnStr = recipientColumnEntryStr
-				}
-			}
+// broadcastWizardContacts holds the contacts selected in step 1 of the new broadcast wizard
+type broadcastWizardContacts struct {
+	filename string
+	// contacts are used for the message examples if a contact list is selected
+	contacts        []broadcast.Contact
+	contactListID   ulid.ULID
+	contactListTags []string
+}
 
-			// input: file
-			contacts, err = broadcast.ReadContactsFromReaderCSV(strings.NewReader(fileContent), delimiter, hasHeader, recipientColumnStr, recipientColumnInt)
-			if err != nil {
-				return logAndReturnError(fmt.Errorf("Cannot read contacts from file: %s", err))
+func showBroadcastWizard1(w fyne.Window, refreshChan chan struct{}) {
+	cf := newContactsFileForm(w)
+
+	// retrieve all contact lists
+	lists := make([]contactlist.List, 0)
+	err := dbutil.ForEachReverse(db, &contactlist.List{}, func(k []byte, v interface{}) error {
+		lists = append(lists, v.(contactlist.List))
+		return nil
+	})
+	if err != nil {
+		logAndShowError(fmt.Errorf("cannot read contact lists from database: %s", err), w)
+	}
+	listStrings := make([]string, 0, len(lists))
+	for _, l := range lists {
+		listStrings = append(listStrings, l.String())
+	}
+	listSelect := widget.NewSelect(listStrings, nil)
+	tagsEntry := widget.NewEntry()
+	tagsEntry.SetPlaceHolder("Optional. e.g. customers, newsletter")
+
+	optionSourceFile := "File"
+	optionSourceList := "Contact list"
+	sourceRadio := widget.NewRadioGroup([]string{optionSourceFile, optionSourceList}, func(selection string) {
+		cf.setEnabled(selection == optionSourceFile)
+		if selection == optionSourceList {
+			listSelect.Enable()
+			tagsEntry.Enable()
+		} else {
+			listSelect.Disable()
+			tagsEntry.Disable()
+		}
+	})
+	sourceRadio.Horizontal = true
+	sourceRadio.Required = true
+	sourceRadio.SetSelected(optionSourceFile)
+
+	f := &widget.Form{}
+	f.Append("Send to:", sourceRadio)
+	cf.appendTo(f)
+	f.Append("Contact list:", listSelect)
+	f.Append("Tags:", tagsEntry)
+	f.Append("", widget.NewLabel("Optional. Only contacts with all these tags are included.\nThe contacts are copied from the list when the broadcast starts."))
+	form.ShowCustomPopup(w, "New Broadcast - Step 1/2", "", "Next", "Cancel", f, func() error {
+		var wc broadcastWizardContacts
+		if sourceRadio.Selected == optionSourceList {
+			if listSelect.SelectedIndex() < 0 {
+				return logAndReturnError(fmt.Errorf("Please select a contact list"))
+			}
+			wc.contactListID = lists[listSelect.SelectedIndex()].ID
+			wc.contactListTags = contactlist.ParseTags(tagsEntry.Text)
+			var listContacts []contactlist.Contact
+			if err := db.View(func(tx *bolt.Tx) error {
+				var err error
+				listContacts, err = contactlist.ContactsTx(tx, wc.contactListID, wc.contactListTags)
+				return err
+			}); err != nil {
+				return logAndReturnError(fmt.Errorf("cannot read contact list: %s", err))
 			}
-			if len(contacts) == 0 {
-				return logAndReturnError(fmt.Errorf("no contacts found on file"))
+			if len(listContacts) == 0 {
+				return logAndReturnError(fmt.Errorf("No contacts in the list have these tags"))
 			}
+			wc.contacts = broadcast.ContactsFromList(listContacts)
 		} else {
-			return logAndReturnError(fmt.Errorf("Please select file type"))
+			filename, contacts, err := cf.readContacts()
+			if err != nil {
+				return logAndReturnError(err)
+			}
+			wc.filename = filename
+			wc.contacts = contacts
 		}
 		// start new goroutine, otherwise it won't show
-		go func(w fyne.Window, filename string, contacts []broadcast.Contact, refreshChan chan struct{}) {
-			showBroadcastWizard2(w, filename, contacts, refreshChan)
-		}(w, filename, contacts, refreshChan)
+		go func(w fyne.Window, wc broadcastWizardContacts, refreshChan chan struct{}) {
+			showBroadcastWizard2(w, wc, refreshChan)
+		}(w, wc, refreshChan)
 		return nil
 	})
 }
 
-func showBroadcastWizard2(w fyne.Window, filename string, contacts []broadcast.Contact, refreshChan chan struct{}) {
+func showBroadcastWizard2(w fyne.Window, wc broadcastWizardContacts, refreshChan chan struct{}) {
 	var m sync.Mutex
+	contacts := wc.contacts
 
 	msgSubjectInput := widget.NewEntry()
 	msgSubjectInput.SetPlaceHolder("Subject (leave empty for SMS)")
@@ -344,8 +464,41 @@ func showBroadcastWizard2(w fyne.Window, filename string, contacts []broadcast.C
 
 	msgBodyExample := widget.NewLabel("")
 	msgBodyExample.Wrapping = fyne.TextWrapBreak
+	msgSegmentsLabel := widget.NewLabel("")
 	var msgBodyFileStringBuilder strings.Builder
-	msgBodyFileBtn := widget.NewButtonWithIcon("File (.txt)", theme.FileIcon(), func() {
+	// renderBodyExample must be called with m locked
+	renderBodyExample := func(isHTML bool) {
+		if msgBodyFileStringBuilder.Len() == 0 {
+			return
+		}
+		msgTmpl, err := broadcast.ParseBodyTemplate(msgBodyFileStringBuilder.String(), isHTML)
+		if err != nil {
+			loggerDebug.Println("failed to parse msgBodyFileStringBuilder.String()")
+			msgBodyExample.SetText("invalid syntax")
+			msgSegmentsLabel.SetText("")
+			return
+		}
+		msg, err := generateMessageRandomContact(contacts, msgTmpl)
+		if err != nil {
+			msgBodyExample.SetText(fmt.Sprintf("message generation failed: %s", err))
+			return
+		}
+		if isHTML {
+			// show the generated text alternative
+			msg = email.HTMLToText(msg)
+			msgSegmentsLabel.SetText("")
+		} else {
+			msgSegmentsLabel.SetText(smsSegmentsSummary(contacts, msgTmpl, msg))
+		}
+		msgBodyExample.SetText(msg)
+	}
+	msgBodyHTMLCheck := widget.NewCheck("HTML (email only, a plain text alternative is generated)", func(checked bool) {
+		// lock mutex because we read from msgBodyFileStringBuilder
+		m.Lock()
+		defer m.Unlock()
+		renderBodyExample(checked)
+	})
+	msgBodyFileBtn := widget.NewButtonWithIcon("File (.txt, .html)", theme.FileIcon(), func() {
 		go func() {
 			d := dialog.NewFileOpen(func(file fyne.URIReadCloser, err error) {
 				if err != nil {
@@ -357,6 +510,7 @@ func showBroadcastWizard2(w fyne.Window, filename string, contacts []broadcast.C
 					return
 				}
 				go func() {
+					msgBodyHTMLCheck.SetChecked(broadcast.IsHTMLFilename(file.URI().Name()))
 					// lock mutex because we write to msgBodyFileStringBuilder
 					m.Lock()
 					defer m.Unlock()
@@ -370,18 +524,7 @@ func showBroadcastWizard2(w fyne.Window, filename string, contacts []broadcast.C
 						logAndShowError(fmt.Errorf("Error reading file: %s", err), w)
 						return
 					}
-					msgTmpl, err := template.New("msg").Parse(msgBodyFileStringBuilder.String())
-					if err != nil {
-						loggerDebug.Println("failed to parse msgBodyFileStringBuilder.String()")
-						msgBodyExample.SetText("invalid syntax")
-						return
-					}
-					msg, err := generateMessageRandomContact(contacts, msgTmpl)
-					if err != nil {
-						msgBodyExample.SetText(fmt.Sprintf("message generation failed: %s", err))
-						return
-					}
-					msgBodyExample.SetText(msg)
+					renderBodyExample(msgBodyHTMLCheck.Checked)
 
 					// remember directory
 					broadcastsDirectoryMutex.Lock()
@@ -390,7 +533,7 @@ func showBroadcastWizard2(w fyne.Window, filename string, contacts []broadcast.C
 					loggerDebug.Println("set broadcastsDirectoryCopy =", broadcastsDirectoryCopy)
 				}()
 			}, w)
-			d.SetFilter(storage.NewExtensionFileFilter([]string{".txt"}))
+			d.SetFilter(storage.NewExtensionFileFilter([]string{".txt", ".html", ".htm"}))
 
 			// set location to remembered directory
 			broadcastsDirectoryMutex.Lock()
@@ -412,6 +555,66 @@ func showBroadcastWizard2(w fyne.Window, filename string, contacts []broadcast.C
 		}()
 	})
 
+	var attachments []broadcast.Attachment
+	attachmentsLabel := widget.NewLabel("Optional. Images referenced in the HTML body as cid:filename are inline")
+	attachmentsLabel.Wrapping = fyne.TextWrapBreak
+	// updateAttachmentsLabel must be called with m locked
+	updateAttachmentsLabel := func() {
+		if len(attachments) == 0 {
+			attachmentsLabel.SetText("Optional. Images referenced in the HTML body as cid:filename are inline")
+			return
+		}
+		names := make([]string, 0, len(attachments))
+		for _, a := range attachments {
+			names = append(names, a.String())
+		}
+		attachmentsLabel.SetText(strings.Join(names, "\n"))
+	}
+	attachmentAddBtn := widget.NewButtonWithIcon("Add", theme.ContentAddIcon(), func() {
+		d := dialog.NewFileOpen(func(file fyne.URIReadCloser, err error) {
+			if err != nil {
+				logAndShowError(fmt.Errorf("Failed to select file: %s", err), w)
+				return
+			}
+			if file == nil {
+				// user clicked "Cancel"
+				return
+			}
+			go func() {
+				defer file.Close()
+				data, err := ioutil.ReadAll(file)
+				if err != nil {
+					logAndShowError(fmt.Errorf("Error reading file: %s", err), w)
+					return
+				}
+				a, err := broadcast.NewAttachment(file.URI().Name(), data)
+				if err != nil {
+					logAndShowError(err, w)
+					return
+				}
+				// lock mutex because we write to attachments
+				m.Lock()
+				defer m.Unlock()
+				attachments = append(attachments, a)
+				updateAttachmentsLabel()
+			}()
+		}, w)
+		d.Show()
+	})
+	attachmentClearBtn := widget.NewButtonWithIcon("Clear", theme.ContentClearIcon(), func() {
+		// lock mutex because we write to attachments
+		m.Lock()
+		defer m.Unlock()
+		attachments = nil
+		updateAttachmentsLabel()
+	})
+	contactAttachmentEntry := widget.NewEntry()
+	contactAttachmentEntry.SetPlaceHolder("Optional. File path e.g. {{.invoice_file}}")
+	batchSizeEntry := widget.NewEntry()
+	batchSizeEntry.SetPlaceHolder("Optional. Up to 100")
+	subscriptionIDEntry := widget.NewEntry()
+	subscriptionIDEntry.SetPlaceHolder("Optional. If not set, the SIM of the device is used")
+
 	gateways := make([]dbutil.Saveable, 0)
 	err := dbutil.ForEach(db, &email.Identity{}, func(k []byte, v interface{}) error {
 		emailID := v.(email.Identity)
@@ -476,8 +679,17 @@ func showBroadcastWizard2(w fyne.Window, filename string, contacts []broadcast.C
 	f.Append("Subject:", msgSubjectInput)
 	f.Append("Subject example:", msgSubjectExample)
 	f.Append("Message body:", msgBodyFileBtn)
+	f.Append("", msgBodyHTMLCheck)
 	f.Append("Message example:", msgBodyExample)
+	f.Append("SMS segments:", msgSegmentsLabel)
+	f.Append("Attachments:", container.NewBorder(nil, nil, container.NewHBox(attachmentAddBtn, attachmentClearBtn), nil, attachmentsLabel))
+	f.Append("Attachment per contact:", contactAttachmentEntry)
+	f.Append("", widget.NewLabel("Optional. Relative paths are relative to the directory of the contacts file"))
 	f.Append("Gateway:", gatewaySelect)
+	f.Append("Batch size:", batchSizeEntry)
+	f.Append("", widget.NewLabel("Optional. Consecutive contacts with identical messages are sent\nin one transaction, with hidden recipients (email only)"))
+	f.Append("SIM subscription ID:", subscriptionIDEntry)
+	f.Append("", widget.NewLabel("Optional. The SIM that sends the messages (android only)"))
 	f.Append("Send hours:", sendHoursEntry)
 	f.Append("", widget.NewLabel("Optional. If not set, value from settings is used"))
 	f.Append("Time zone:", timezoneValue)
@@ -490,90 +702,128 @@ func showBroadcastWizard2(w fyne.Window, filename string, contacts []broadcast.C
 		// lock mutex because we read from msgBodyFileStringBuilder, timezoneSelected
 		m.Lock()
 		defer m.Unlock()
-		msgSubject := msgSubjectInput.Text
-		_, err := template.New("msg_subject").Parse(msgSubject)
-		if err != nil {
-			return logAndReturnError(fmt.Errorf("failed to parse message subject: %s", err))
-		}
-		_, err = template.New("msg_body").Parse(msgBodyFileStringBuilder.String())
-		if err != nil {
-			return logAndReturnError(fmt.Errorf("failed to parse message body: %s", err))
+		loggerDebug.Printf("gatewaySelect.SelectedIndex(): %v\n", gatewaySelect.SelectedIndex())
+		gatewaySelectedIndex := gatewaySelect.SelectedIndex()
+		if gatewaySelectedIndex > -1 {
+			gatewaySelected = gateways[gatewaySelectedIndex]
+			loggerDebug.Println("gateway selected:", gatewaySelected)
+		} else {
+			return logAndReturnError(fmt.Errorf("Please select a gateway"))
 		}
-		var sendHours broadcast.TimeRanges
-		if sendHoursEntry.Text != "" {
-			sendHours, err = broadcast.ParseTimeRanges(sendHoursEntry.Text)
+		var batchSize int
+		if s := strings.TrimSpace(batchSizeEntry.Text); s != "" {
+			var err error
+			batchSize, err = strconv.Atoi(s)
 			if err != nil {
-				return logAndReturnError(fmt.Errorf("invalid time ranges: %s", err))
+				return logAndReturnError(fmt.Errorf("invalid batch size: %s", err))
 			}
 		}
-		var timezoneSelected2 string
-		var loc *time.Location
-		if timezoneSelected != "" {
-			fields := strings.Fields(timezoneSelected)
-			if len(fields) == 0 {
-				return logAndReturnError(fmt.Errorf("invalid time zone"))
-			}
-			tzName := fields[0]
-			loc, err = time.LoadLocation(tzName)
+		var subscriptionID int
+		if s := strings.TrimSpace(subscriptionIDEntry.Text); s != "" {
+			var err error
+			subscriptionID, err = strconv.Atoi(s)
 			if err != nil {
-				return logAndReturnError(fmt.Errorf("invalid time zone: %s", err))
+				return logAndReturnError(fmt.Errorf("invalid SIM subscription ID: %s", err))
 			}
-			timezoneSelected2 = tzName
 		}
-		if loc == nil {
-			loc = time.Now().Location()
-		}
-		var sendDate1 time.Time
-		if sendDate1Entry.Text != "" {
-			sendDate1, err = time.ParseInLocation("2006-01-02", sendDate1Entry.Text, loc)
-			if err != nil {
-				return logAndReturnError(fmt.Errorf("invalid date: %s", err))
-			}
-			loggerDebug.Println("dateFrom parsed:", sendDate1)
+		in := broadcast.Input{
+			Filename:     wc.filename,
+			MsgSubject:   msgSubjectInput.Text,
+			MsgBody:      msgBodyFileStringBuilder.String(),
+			MsgBodyHTML:  msgBodyHTMLCheck.Checked,
+			GatewayType:  gatewaySelected.DBTable(),
+			GatewayKey:   gatewaySelected.DBKey(),
+			SendHours:    sendHoursEntry.Text,
+			Timezone:     timezoneSelected,
+			SendDateFrom: sendDate1Entry.Text,
+			SendDateTo:   sendDate2Entry.Text,
+
+			Attachments:       attachments,
+			ContactAttachment: strings.TrimSpace(contactAttachmentEntry.Text),
+			BatchSize:         batchSize,
+			SubscriptionID:    subscriptionID,
 		}
-		var sendDate2 time.Time
-		if sendDate2Entry.Text != "" {
-			sendDate2, err = time.ParseInLocation("2006-01-02", sendDate2Entry.Text, loc)
-			if err != nil {
-				return logAndReturnError(fmt.Errorf("invalid date: %s", err))
-			}
+		if wc.filename != "" {
+			broadcastsDirectoryMutex.Lock()
+			in.ContactAttachmentDir = broadcastsDirectoryContacts
+			broadcastsDirectoryMutex.Unlock()
 		}
-		loggerDebug.Printf("gatewaySelect.SelectedIndex(): %v\n", gatewaySelect.SelectedIndex())
-		gatewaySelectedIndex := gatewaySelect.SelectedIndex()
-		if gatewaySelectedIndex > -1 {
-			gatewaySelected = gateways[gatewaySelectedIndex]
-			loggerDebug.Println("gateway selected:", gatewaySelected)
+		if wc.contactListID != (ulid.ULID{}) {
+			in.ContactListID = wc.contactListID
+			in.ContactListTags = wc.contactListTags
 		} else {
-			return logAndReturnError(fmt.Errorf("Please select a gateway"))
+			in.Contacts = contacts
 		}
-		id, err := ulid.New(ulid.Timestamp(time.Now()), crand.Reader)
+		if err := db.View(func(tx *bolt.Tx) error {
+			var err error
+			in.DefaultCountry, err = broadcast.GetDefaultCountryTx(tx)
+			return err
+		}); err != nil {
+			return logAndReturnError(err)
+		}
+		b, rejected, err := broadcast.NewFromInput(in)
 		if err != nil {
+			if len(rejected) > 0 {
+				err = fmt.Errorf("%s\n\n%s", err, broadcast.RejectedContactsString(rejected))
+			}
 			return logAndReturnError(fmt.Errorf("Cannot create broadcast: %s", err))
 		}
-		b := broadcast.Broadcast{
-			ID:           id,
-			Contacts:     contacts,
-			MsgSubject:   msgSubject,
-			MsgBody:      msgBodyFileStringBuilder.String(),
-			MsgBodyFile:  filename,
-			GatewayType:  gatewaySelected.DBTable(),
-			GatewayKey:   gatewaySelected.DBKey(),
-			SendDateFrom: sendDate1,
-			SendDateTo:   sendDate2,
-			SendHours:    sendHours,
-			Timezone:     timezoneSelected2,
-			CreatedAt:    time.Now(),
+		save := func() error {
+			err := db.Update(func(tx *bolt.Tx) error {
+				return broadcast.SaveTx(tx, b)
+			})
+			if err != nil {
+				return logAndReturnError(fmt.Errorf("cannot save broadcast: %s", err))
+			}
+			broadcast.Wake()
+			refreshChan <- struct{}{}
+			return nil
 		}
-		err = dbutil.UpsertSaveable(db, b)
-		if err != nil {
-			return logAndReturnError(fmt.Errorf("cannot save broadcast: %s", err))
+		if len(rejected) > 0 {
+			// let the user review the rejected contacts before saving
+			showRejectedContacts(w, rejected, len(b.Contacts), func() {
+				if err := save(); err != nil {
+					dialog.ShowError(err, w)
+				}
+			})
+			return nil
 		}
-		refreshChan <- struct{}{}
-		return nil
+		return save()
 	})
 }
 
-func generateMessageRandomContact(contacts []broadcast.Contact, msgTmpl *template.Template) (string, error) {
+// showRejectedContacts shows the contacts that will not be added to the broadcast and calls onSave if the user confirms
+func showRejectedContacts(w fyne.Window, rejected []broadcast.RejectedContact, valid int, onSave func()) {
+	report := widget.NewMultiLineEntry()
+	report.SetText(broadcast.RejectedContactsString(rejected))
+	report.Wrapping = fyne.TextWrapOff
+	label := widget.NewLabel(fmt.Sprintf("%d contacts were rejected and will not receive the message.\nSave the broadcast with the remaining %d contacts?", len(rejected), valid))
+	content := container.NewBorder(label, nil, nil, nil, report)
+	d := dialog.NewCustomConfirm("Rejected Contacts", "Save", "Cancel", content, func(submit bool) {
+		if submit {
+			onSave()
+		}
+	}, w)
+	d.Resize(fyne.NewSize(600, 400))
+	d.Show()
+}
+
+// smsSegmentsSummary returns the encoding and the number of SMS segments of the example message, and the total of all contacts
+func smsSegmentsSummary(contacts []broadcast.Contact, msgTmpl broadcast.BodyTemplate, example string) string {
+	encoding, segments := sms.CountSegments(strings.TrimSpace(example))
+	var total int
+	for _, c := range contacts {
+		var buf strings.Builder
+		if err := msgTmpl.Execute(&buf, c.Keywords); err != nil {
+			return fmt.Sprintf("%s, %d in this message", encoding, segments)
+		}
+		_, n := sms.CountSegments(strings.TrimSpace(buf.String()))
+		total += n
+	}
+	return fmt.Sprintf("%s, %d in this message, %d in total for %d contacts", encoding, segments, total, len(contacts))
+}
+
+func generateMessageRandomContact(contacts []broadcast.Contact, msgTmpl broadcast.BodyTemplate) (string, error) {
 	if msgTmpl == nil {
 		return "", nil
 	}
@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
@@ -14,6 +15,7 @@ import (
 	"go.angaros.io/internal/broadcast"
 	"go.angaros.io/internal/dbutil"
 	"go.angaros.io/internal/fyneutil/form"
+	"go.angaros.io/internal/phone"
 	"go.angaros.io/internal/tzdb"
 )
 
@@ -36,6 +38,7 @@ func tabBroadcastsSettings(w fyne.Window) *container.TabItem {
 			if err != nil {
 				return logAndReturnError(fmt.Errorf("database error: %s", err))
 			}
+			broadcast.Wake()
 			// refreshChan <- struct{}{}
 			labelUpdates <- broadcast.SettingSendHours(sendHours).String()
 			return nil
@@ -46,6 +49,7 @@ func tabBroadcastsSettings(w fyne.Window) *container.TabItem {
 			logAndShowError(fmt.Errorf("database error: %s", err), w)
 			return
 		}
+		broadcast.Wake()
 		// refreshChan <- struct{}{}
 		labelUpdates <- ""
 	})
@@ -65,6 +69,7 @@ func tabBroadcastsSettings(w fyne.Window) *container.TabItem {
 			if err != nil {
 				return logAndReturnError(fmt.Errorf("database error: %s", err))
 			}
+			broadcast.Wake()
 			// refreshChan <- struct{}{}
 			labelUpdates <- tzName
 			return nil
@@ -75,28 +80,59 @@ func tabBroadcastsSettings(w fyne.Window) *container.TabItem {
 			logAndShowError(fmt.Errorf("database error: %s", err), w)
 			return
 		}
+		broadcast.Wake()
 		// refreshChan <- struct{}{}
 		labelUpdates <- ""
 	})
 
+	defaultCountryValue := form.NewValue(w, "Country of phone numbers without a country code.\nIf not set, the country of the time zone is used", func(labelUpdates chan<- string) {
+		form.ShowEntryCompletionPopup(w, "Default country", "Search by country name or code and select a result", "", "", countryOptions(), form.FilterOptions, func(inputText string) error {
+			fields := strings.Fields(inputText)
+			if len(fields) == 0 {
+				return logAndReturnError(fmt.Errorf("invalid country"))
+			}
+			country := strings.ToUpper(fields[0])
+			if _, ok := phone.CallingCode(country); !ok {
+				return logAndReturnError(fmt.Errorf("unknown country %s", fields[0]))
+			}
+			err := dbutil.UpsertSaveable(db, broadcast.SettingDefaultCountry(country))
+			if err != nil {
+				return logAndReturnError(fmt.Errorf("database error: %s", err))
+			}
+			labelUpdates <- country
+			return nil
+		})
+	}, func(labelUpdates chan<- string) {
+		err := dbutil.UpsertSaveable(db, broadcast.SettingDefaultCountry(""))
+		if err != nil {
+			logAndShowError(fmt.Errorf("database error: %s", err), w)
+			return
+		}
+		labelUpdates <- ""
+	})
+
 	f := &widget.Form{}
 	f.Append("Send hours:", sendHoursValue)
 	f.Append("Time zone:", timezoneValue)
+	f.Append("Default country:", defaultCountryValue)
 
 	go func() {
 		for range refreshChan {
 			var settingSendHours broadcast.SettingSendHours
 			var settingTimezone broadcast.SettingTimezone
+			var settingDefaultCountry broadcast.SettingDefaultCountry
 			err := dbutil.GetMulti(
 				db,
 				dbutil.KeyPointer{Key: settingSendHours.DBKey(), Pointer: &settingSendHours},
 				dbutil.KeyPointer{Key: settingTimezone.DBKey(), Pointer: &settingTimezone},
+				dbutil.KeyPointer{Key: settingDefaultCountry.DBKey(), Pointer: &settingDefaultCountry},
 			)
 			if err != nil && !errors.Is(err, dbutil.ErrNotFound) {
 				loggerDebug.Println("dbutil.GetMulti failed:", err)
 			}
 			sendHoursValue.Objects[0].(*widget.Label).SetText(fmt.Sprintf("%v", settingSendHours))
 			timezoneValue.Objects[0].(*widget.Label).SetText(fmt.Sprintf("%v", settingTimezone))
+			defaultCountryValue.Objects[0].(*widget.Label).SetText(fmt.Sprintf("%v", settingDefaultCountry))
 		}
 	}()
 
@@ -104,3 +140,19 @@ func tabBroadcastsSettings(w fyne.Window) *container.TabItem {
 
 	return container.NewTabItemWithIcon("Settings", theme.SettingsIcon(), container.NewScroll(f))
 }
+
+// countryOptions returns the countries as "<code> <name>" sorted by name
+func countryOptions() []string {
+	codes := make([]string, 0, len(tzdb.CountryNameByCode))
+	for code := range tzdb.CountryNameByCode {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool {
+		return tzdb.CountryNameByCode[codes[i]] < tzdb.CountryNameByCode[codes[j]]
+	})
+	options := make([]string, 0, len(codes))
+	for _, code := range codes {
+		options = append(options, code+" "+tzdb.CountryNameByCode[code])
+	}
+	return options
+}
@@ -0,0 +1,12 @@
+package main
+
+import (
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/theme"
+)
+
+func tabContacts(w fyne.Window) *container.TabItem {
+	subTabs := container.NewAppTabs(tabContactsLists(w), tabContactsSuppression(w))
+	return container.NewTabItemWithIcon("Contacts", theme.FileTextIcon(), container.NewMax(subTabs))
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+	"github.com/oklog/ulid/v2"
+	bolt "go.etcd.io/bbolt"
+
+	"go.angaros.io/internal/broadcast"
+	"go.angaros.io/internal/contactlist"
+	"go.angaros.io/internal/dbutil"
+	container2 "go.angaros.io/internal/fyneutil/container"
+	"go.angaros.io/internal/fyneutil/form"
+	widget2 "go.angaros.io/internal/fyneutil/widget"
+)
+
+func tabContactsLists(w fyne.Window) *container.TabItem {
+	refreshChan := make(chan struct{}, 1)
+	newListBtn := widget.NewButtonWithIcon("New List", theme.ContentAddIcon(), func() {
+		form.ShowEntryPopup(w, "New Contact List", "Name of the list", "e.g. Customers", "", func(inputText string) error {
+			l, err := contactlist.NewList(strings.TrimSpace(inputText))
+			if err != nil {
+				return logAndReturnError(fmt.Errorf("cannot create list: %s", err))
+			}
+			if err := dbutil.InsertSaveable(db, l); err != nil {
+				return logAndReturnError(fmt.Errorf("cannot write to database: %s", err))
+			}
+			refreshChan <- struct{}{}
+			return nil
+		})
+	})
+	tablePage := container2.NewTable(
+		w,
+		refreshChan,
+		[]widget2.TableAttribute{
+			{Name: "Actions", Actions: true},
+			{Name: "ID", Field: "ID", Width: 270},
+			{Name: "Name", Field: "Name", Width: 250},
+			{Name: "Contacts", Field: "GetSize", Width: 100},
+		},
+		[]widget2.Action{
+			{
+				Name: "Contacts",
+				Func: func(v dbutil.Saveable, refreshChan chan<- struct{}) func() {
+					return func() {
+						showContactListWindow(v.(contactlist.List), refreshChan)
+					}
+				},
+			}, {
+				Name: "Import",
+				Func: func(v dbutil.Saveable, refreshChan chan<- struct{}) func() {
+					return func() {
+						showContactListImport(w, v.(contactlist.List).ID, refreshChan)
+					}
+				},
+			}, {
+				Name: "Merge",
+				Func: func(v dbutil.Saveable, refreshChan chan<- struct{}) func() {
+					return func() {
+						showContactListMerge(w, v.(contactlist.List), refreshChan)
+					}
+				},
+			}, {
+				Name: "Rename",
+				Func: func(v dbutil.Saveable, refreshChan chan<- struct{}) func() {
+					return func() {
+						l := v.(contactlist.List)
+						form.ShowEntryPopup(w, "Rename Contact List", "Name of the list", "", l.Name, func(inputText string) error {
+							name := strings.TrimSpace(inputText)
+							if name == "" {
+								return logAndReturnError(fmt.Errorf("name is empty"))
+							}
+							if err := db.Update(func(tx *bolt.Tx) error {
+								var existing contactlist.List
+								if err := dbutil.GetByKeyTx(tx, l.DBKey(), &existing); err != nil { // don't ignore dbutil.ErrNotFound
+									return err
+								}
+								existing.Name = name
+								return dbutil.UpsertSaveableTx(tx, existing)
+							}); err != nil {
+								return logAndReturnError(fmt.Errorf("cannot write to database: %s", err))
+							}
+							refreshChan <- struct{}{}
+							return nil
+						})
+					}
+				},
+			}, {
+				Name: "Delete",
+				Func: func(v dbutil.Saveable, refreshChan chan<- struct{}) func() {
+					return func() {
+						content := widget.NewLabel("Are you sure you want to delete this list and all its contacts?")
+						dialog.ShowCustomConfirm("Delete Contact List", "Confirm", "Cancel", content, func(submit bool) {
+							if submit {
+								if err := db.Update(func(tx *bolt.Tx) error {
+									listID := v.(contactlist.List).ID
+									if err := checkContactListUnusedTx(tx, listID); err != nil {
+										return err
+									}
+									return contactlist.DeleteTx(tx, listID)
+								}); err != nil {
+									logAndShowError(fmt.Errorf("cannot delete list: %s", err), w)
+								}
+								refreshChan <- struct{}{}
+							}
+						}, w)
+					}
+				},
+			},
+		},
+		func(refreshChan <-chan struct{}, t *widget2.Table, noticeLabel *widget.Label) {
+			for range refreshChan {
+				values := make([]dbutil.Saveable, 0)
+				err := db.View(func(tx *bolt.Tx) error {
+					return dbutil.ForEachReverseTx(tx, &contactlist.List{}, func(k []byte, v interface{}) error {
+						vCasted, ok := v.(contactlist.List)
+						if !ok {
+							return fmt.Errorf("value %v is not a contact list", v)
+						}
+						if err := vCasted.ReadSizeFromTx(tx); err != nil {
+							return fmt.Errorf("vCasted.ReadSizeFromTx() failed: %s", err)
+						}
+						values = append(values, vCasted)
+						return nil
+					})
+				})
+				if err != nil {
+					err = fmt.Errorf("cannot read contact lists: %s", err)
+					loggerInfo.Println(err)
+					noticeLabel.SetText(err.Error())
+				} else {
+					noticeLabel.SetText("")
+				}
+				t.UpdateAndRefresh(values)
+			}
+		},
+	)
+	refreshChan <- struct{}{}
+	content := container.NewBorder(newListBtn, nil, nil, nil, tablePage)
+	return container.NewTabItemWithIcon("Lists", theme.FileTextIcon(), content)
+}
+
+// checkContactListUnusedTx returns an error if broadcasts that have not started yet use the list
+func checkContactListUnusedTx(tx *bolt.Tx, listID ulid.ULID) error {
+	users, err := broadcast.ContactListUsersTx(tx, listID)
+	if err != nil {
+		return err
+	}
+	if len(users) > 0 {
+		return fmt.Errorf("the list is used by broadcasts that have not started yet: %v", users)
+	}
+	return nil
+}
+
+func showContactListImport(w fyne.Window, listID ulid.ULID, refreshChan chan<- struct{}) {
+	cf := newContactsFileForm(w)
+	tagsEntry := widget.NewEntry()
+	tagsEntry.SetPlaceHolder("Optional. e.g. customers, newsletter")
+	f := &widget.Form{}
+	cf.appendTo(f)
+	f.Append("Add tags:", tagsEntry)
+	f.Append("", widget.NewLabel("Existing contacts are updated with the keywords and tags of the file."))
+	form.ShowCustomPopup(w, "Import Contacts", "", "Import", "Cancel", f, func() error {
+		_, contacts, err := cf.readContacts()
+		if err != nil {
+			return logAndReturnError(err)
+		}
+		var result contactlist.ImportResult
+		if err := db.Update(func(tx *bolt.Tx) error {
+			var err error
+			result, err = contactlist.ImportTx(tx, listID, contactsToList(contacts), contactlist.ParseTags(tagsEntry.Text))
+			return err
+		}); err != nil {
+			return logAndReturnError(fmt.Errorf("cannot import contacts: %s", err))
+		}
+		refreshChan <- struct{}{}
+		dialog.ShowInformation("Import Contacts", result.String(), w)
+		return nil
+	})
+}
+
+func showContactListMerge(w fyne.Window, src contactlist.List, refreshChan chan<- struct{}) {
+	lists := make([]contactlist.List, 0)
+	err := dbutil.ForEachReverse(db, &contactlist.List{}, func(k []byte, v interface{}) error {
+		l := v.(contactlist.List)
+		if l.ID != src.ID {
+			lists = append(lists, l)
+		}
+		return nil
+	})
+	if err != nil {
+		logAndShowError(fmt.Errorf("cannot read contact lists from database: %s", err), w)
+		return
+	}
+	listStrings := make([]string, 0, len(lists))
+	for _, l := range lists {
+		listStrings = append(listStrings, l.String())
+	}
+	description := fmt.Sprintf("The contacts of '%s' will be added to the selected list and '%s' will be deleted", src.Name, src.Name)
+	form.ShowSelectionPopup(w, "Merge Contact List", description, "Merge", listStrings, "", func(selected string, selectedIndex int) error {
+		if selectedIndex < 0 {
+			return logAndReturnError(fmt.Errorf("Please select a list"))
+		}
+		var result contactlist.ImportResult
+		if err := db.Update(func(tx *bolt.Tx) error {
+			if err := checkContactListUnusedTx(tx, src.ID); err != nil {
+				return err
+			}
+			var err error
+			result, err = contactlist.MergeTx(tx, src.ID, lists[selectedIndex].ID)
+			return err
+		}); err != nil {
+			return logAndReturnError(fmt.Errorf("cannot merge lists: %s", err))
+		}
+		refreshChan <- struct{}{}
+		dialog.ShowInformation("Merge Contact List", result.String(), w)
+		return nil
+	})
+}
+
+// showContactListWindow shows the contacts of the list in a new window
+func showContactListWindow(l contactlist.List, listsRefreshChan chan<- struct{}) {
+	w := fyne.CurrentApp().NewWindow("Contacts - " + l.Name)
+	refreshChan := make(chan struct{}, 1)
+	tagsFilterEntry := widget.NewEntry()
+	tagsFilterEntry.SetPlaceHolder("Filter by tags e.g. customers, newsletter")
+	tagsFilterEntry.OnChanged = func(string) {
+		select {
+		case refreshChan <- struct{}{}:
+		default:
+		}
+	}
+	refresh := func() {
+		refreshChan <- struct{}{}
+		listsRefreshChan <- struct{}{}
+	}
+	newContactBtn := widget.NewButtonWithIcon("New Contact", theme.ContentAddIcon(), func() {
+		contactNewOrEdit(w, contactlist.Contact{ListID: l.ID}, true, refresh)
+	})
+	tablePage := container2.NewTable(
+		w,
+		refreshChan,
+		[]widget2.TableAttribute{
+			{Name: "Actions", Actions: true},
+			{Name: "Recipient", Field: "Recipient", Width: 250},
+			{Name: "Tags", Field: "TagsString", Width: 200},
+			{Name: "Keywords", Field: "KeywordsString", Width: 400},
+		},
+		[]widget2.Action{
+			{
+				Name: "Edit",
+				Func: func(v dbutil.Saveable, refreshChan chan<- struct{}) func() {
+					return func() {
+						contactNewOrEdit(w, v.(contactlist.Contact), false, refresh)
+					}
+				},
+			}, {
+				Name: "Delete",
+				Func: func(v dbutil.Saveable, refreshChan chan<- struct{}) func() {
+					return func() {
+						content := widget.NewLabel("Are you sure you want to delete this contact?")
+						dialog.ShowCustomConfirm("Delete Contact", "Confirm", "Cancel", content, func(submit bool) {
+							if submit {
+								if err := dbutil.DeleteByTableKey(db, v.DBTable(), v.DBKey()); err != nil {
+									logAndShowError(fmt.Errorf("cannot write to database: %s", err), w)
+								}
+								refresh()
+							}
+						}, w)
+					}
+				},
+			},
+		},
+		func(refreshChan <-chan struct{}, t *widget2.Table, noticeLabel *widget.Label) {
+			for range refreshChan {
+				values := make([]dbutil.Saveable, 0)
+				err := db.View(func(tx *bolt.Tx) error {
+					contacts, err := contactlist.ContactsTx(tx, l.ID, contactlist.ParseTags(tagsFilterEntry.Text))
+					if err != nil {
+						return err
+					}
+					for _, c := range contacts {
+						values = append(values, c)
+					}
+					return nil
+				})
+				if err != nil {
+					err = fmt.Errorf("cannot read contacts: %s", err)
+					loggerInfo.Println(err)
+					noticeLabel.SetText(err.Error())
+				} else {
+					noticeLabel.SetText(fmt.Sprintf("%d contacts", len(values)))
+				}
+				t.UpdateAndRefresh(values)
+			}
+		},
+	)
+	refreshChan <- struct{}{}
+	top := container.NewBorder(nil, nil, newContactBtn, nil, tagsFilterEntry)
+	w.SetContent(container.NewBorder(top, nil, nil, nil, tablePage))
+	w.Resize(fyne.NewSize(1100, 600))
+	w.Show()
+}
+
+func contactNewOrEdit(w fyne.Window, c contactlist.Contact, isNew bool, next func()) {
+	keys := make([]string, 0, len(c.Keywords))
+	for k := range c.Keywords {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var keywordsBuilder strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&keywordsBuilder, "%s=%s\n", k, c.Keywords[k])
+	}
+	recipientEntry := widget.NewEntry()
+	recipientEntry.SetText(c.Recipient)
+	if !isNew {
+		recipientEntry.Disable()
+	}
+	tagsEntry := widget.NewEntry()
+	tagsEntry.SetText(c.TagsString())
+	tagsEntry.SetPlaceHolder("e.g. customers, newsletter")
+	keywordsEntry := widget.NewMultiLineEntry()
+	keywordsEntry.SetText(keywordsBuilder.String())
+	keywordsEntry.SetPlaceHolder("One per line e.g. name=John")
+	f := &widget.Form{}
+	f.Append("Recipient:", recipientEntry)
+	f.Append("Tags:", tagsEntry)
+	f.Append("Keywords:", keywordsEntry)
+	form.ShowCustomPopup(w, "Contact Details", "", "Save", "Cancel", f, func() error {
+		cNew := contactlist.Contact{
+			ListID:    c.ListID,
+			Recipient: strings.TrimSpace(recipientEntry.Text),
+			Tags:      contactlist.ParseTags(tagsEntry.Text),
+		}
+		if !isNew {
+			cNew.Recipient = c.Recipient
+		}
+		if cNew.Recipient == "" {
+			return logAndReturnError(fmt.Errorf("recipient is empty"))
+		}
+		for i, line := range strings.Split(keywordsEntry.Text, "\n") {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			kv := strings.SplitN(line, "=", 2)
+			if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+				return logAndReturnError(fmt.Errorf("invalid keyword on line %d: expected key=value", i+1))
+			}
+			if cNew.Keywords == nil {
+				cNew.Keywords = make(map[string]string)
+			}
+			cNew.Keywords[strings.TrimSpace(kv[0])] = kv[1]
+		}
+		var err error
+		if isNew {
+			err = dbutil.InsertSaveable(db, cNew)
+		} else {
+			err = dbutil.UpsertSaveable(db, cNew)
+		}
+		if err != nil {
+			return logAndReturnError(fmt.Errorf("cannot write to database: %s", err))
+		}
+		next()
+		return nil
+	})
+}
+
+// contactsToList converts broadcast contacts read from a file to contact list contacts
+func contactsToList(contacts []broadcast.Contact) []contactlist.Contact {
+	listContacts := make([]contactlist.Contact, 0, len(contacts))
+	for _, c := range contacts {
+		listContacts = append(listContacts, contactlist.Contact{
+			Recipient: c.Recipient,
+			Keywords:  c.Keywords,
+		})
+	}
+	return listContacts
+}
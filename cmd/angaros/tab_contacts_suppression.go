@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+	bolt "go.etcd.io/bbolt"
+
+	"go.angaros.io/internal/dbutil"
+	container2 "go.angaros.io/internal/fyneutil/container"
+	"go.angaros.io/internal/fyneutil/form"
+	widget2 "go.angaros.io/internal/fyneutil/widget"
+	"go.angaros.io/internal/suppression"
+)
+
+func tabContactsSuppression(w fyne.Window) *container.TabItem {
+	refreshChan := make(chan struct{}, 1)
+	searchEntry := widget.NewEntry()
+	searchEntry.SetPlaceHolder("Search recipient")
+	searchEntry.OnChanged = func(string) {
+		select {
+		case refreshChan <- struct{}{}:
+		default:
+		}
+	}
+	addBtn := widget.NewButtonWithIcon("Add", theme.ContentAddIcon(), func() {
+		suppressionAdd(w, refreshChan)
+	})
+	importBtn := widget.NewButtonWithIcon("Import", theme.FolderOpenIcon(), func() {
+		suppressionImport(w, refreshChan)
+	})
+	tablePage := container2.NewTable(
+		w,
+		refreshChan,
+		[]widget2.TableAttribute{
+			{Name: "Actions", Actions: true},
+			{Name: "Recipient", Field: "Recipient", Width: 250},
+			{Name: "Reason", Field: "Reason", Width: 250},
+			{Name: "Date", Field: "CreatedAtString", Width: 150},
+		},
+		[]widget2.Action{
+			{
+				Name: "Delete",
+				Func: func(v dbutil.Saveable, refreshChan chan<- struct{}) func() {
+					return func() {
+						content := widget.NewLabel("Are you sure you want to remove this recipient from the suppression list?\nBroadcasts will send messages to it again.")
+						dialog.ShowCustomConfirm("Remove Suppressed Recipient", "Confirm", "Cancel", content, func(submit bool) {
+							if submit {
+								if err := dbutil.DeleteByTableKey(db, v.DBTable(), v.DBKey()); err != nil {
+									logAndShowError(fmt.Errorf("cannot write to database: %s", err), w)
+								}
+								refreshChan <- struct{}{}
+							}
+						}, w)
+					}
+				},
+			},
+		},
+		func(refreshChan <-chan struct{}, t *widget2.Table, noticeLabel *widget.Label) {
+			for range refreshChan {
+				search := suppression.Normalize(searchEntry.Text)
+				values := make([]dbutil.Saveable, 0)
+				err := dbutil.ForEach(db, &suppression.Entry{}, func(k []byte, v interface{}) error {
+					vCasted, ok := v.(suppression.Entry)
+					if !ok {
+						return fmt.Errorf("value %v is not a suppression entry", v)
+					}
+					if search == "" || strings.Contains(string(k), search) {
+						values = append(values, vCasted)
+					}
+					return nil
+				})
+				if err != nil {
+					err = fmt.Errorf("cannot read suppression list: %s", err)
+					loggerInfo.Println(err)
+					noticeLabel.SetText(err.Error())
+				} else {
+					noticeLabel.SetText(fmt.Sprintf("%d suppressed recipients", len(values)))
+				}
+				t.UpdateAndRefresh(values)
+			}
+		},
+	)
+	refreshChan <- struct{}{}
+	top := container.NewBorder(nil, nil, container.NewHBox(addBtn, importBtn), nil, searchEntry)
+	content := container.NewBorder(top, nil, nil, nil, tablePage)
+	return container.NewTabItemWithIcon("Suppression", theme.CancelIcon(), content)
+}
+
+func suppressionAdd(w fyne.Window, refreshChan chan<- struct{}) {
+	recipientEntry := widget.NewEntry()
+	recipientEntry.SetPlaceHolder("Email or phone number")
+	reasonEntry := widget.NewEntry()
+	reasonEntry.SetText(suppression.ReasonManual)
+	f := &widget.Form{}
+	f.Append("Recipient:", recipientEntry)
+	f.Append("Reason:", reasonEntry)
+	form.ShowCustomPopup(w, "Suppress Recipient", "", "Save", "Cancel", f, func() error {
+		added, err := suppression.Add(db, recipientEntry.Text, strings.TrimSpace(reasonEntry.Text))
+		if err != nil {
+			return logAndReturnError(fmt.Errorf("cannot add recipient: %s", err))
+		}
+		if !added {
+			return logAndReturnError(fmt.Errorf("recipient is already suppressed"))
+		}
+		refreshChan <- struct{}{}
+		return nil
+	})
+}
+
+func suppressionImport(w fyne.Window, refreshChan chan<- struct{}) {
+	cf := newContactsFileForm(w)
+	reasonEntry := widget.NewEntry()
+	reasonEntry.SetText(suppression.ReasonImported)
+	f := &widget.Form{}
+	cf.appendTo(f)
+	f.Append("Reason:", reasonEntry)
+	form.ShowCustomPopup(w, "Import Suppressed Recipients", "", "Import", "Cancel", f, func() error {
+		_, contacts, err := cf.readContacts()
+		if err != nil {
+			return logAndReturnError(err)
+		}
+		recipients := make([]string, 0, len(contacts))
+		for _, c := range contacts {
+			recipients = append(recipients, c.Recipient)
+		}
+		var added int
+		if err := db.Update(func(tx *bolt.Tx) error {
+			var err error
+			added, err = suppression.ImportTx(tx, recipients, strings.TrimSpace(reasonEntry.Text))
+			return err
+		}); err != nil {
+			return logAndReturnError(fmt.Errorf("cannot import recipients: %s", err))
+		}
+		refreshChan <- struct{}{}
+		dialog.ShowInformation("Import Suppressed Recipients", fmt.Sprintf("%d recipients added, %d already suppressed", added, len(recipients)-added), w)
+		return nil
+	})
+}
@@ -1,18 +1,25 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
 	"fyne.io/fyne/v2/theme"
 	"fyne.io/fyne/v2/widget"
 	bolt "go.etcd.io/bbolt"
 
+	"go.angaros.io/internal/bounce"
 	"go.angaros.io/internal/dbutil"
 	"go.angaros.io/internal/fyneutil/form"
 	"go.angaros.io/internal/gateway/email"
+	"go.angaros.io/internal/unsubscribe"
 )
 
 func tabEmailSettings(w fyne.Window) *container.TabItem {
@@ -79,10 +86,39 @@ func tabEmailSettings(w fyne.Window) *container.TabItem {
 		labelUpdates <- ""
 	})
 
+	listUnsubscribeURLValue := form.NewValue(w, "Public https URL of the unsubscribe endpoint (started with -unsubscribe). Recipients who use it are added to the suppression list.", func(labelUpdates chan<- string) {
+		var existingListUnsubscribeURL email.SettingListUnsubscribeURL
+		err := dbutil.GetByKey(db, existingListUnsubscribeURL.DBKey(), &existingListUnsubscribeURL)
+		if err != nil && !errors.Is(err, dbutil.ErrNotFound) {
+			logAndShowError(fmt.Errorf("database error: %s", err), w)
+			return
+		}
+		form.ShowEntryPopup(w, "List-Unsubscribe URL", "Enter URL", "https://example.com/unsubscribe", string(existingListUnsubscribeURL), func(value string) error {
+			value = strings.TrimSpace(value)
+			if err := unsubscribe.ValidateBaseURL(value); err != nil {
+				return err
+			}
+			if err := dbutil.UpsertSaveable(db, email.SettingListUnsubscribeURL(value)); err != nil {
+				return logAndReturnError(fmt.Errorf("failed to update record on database: %s", err))
+			}
+			labelUpdates <- value
+			return nil
+		})
+	}, func(labelUpdates chan<- string) {
+		var s email.SettingListUnsubscribeURL
+		err := dbutil.DeleteByTableKey(db, s.DBTable(), s.DBKey())
+		if err != nil && !errors.Is(err, dbutil.ErrNotFound) {
+			logAndShowError(fmt.Errorf("failed to delete record from database: %s", err), w)
+			return
+		}
+		labelUpdates <- ""
+	})
+
 	f := &widget.Form{}
-	f.Append("WARNING:", widget.NewLabel("You have to handle unsubscribe emails manually by removing emails from your lists."))
+	f.Append("WARNING:", widget.NewLabel("Without a List-Unsubscribe URL, you have to handle unsubscribe emails manually by adding them to the suppression list."))
 	f.Append("Enable List-Unsubscribe:", listUnsubscribeEnabledCheck)
 	f.Append("List-Unsubscribe email:", listUnsubscribeEmailValue)
+	f.Append("List-Unsubscribe URL:", listUnsubscribeURLValue)
 
 	go func() {
 		for range refreshChan {
@@ -94,10 +130,145 @@ func tabEmailSettings(w fyne.Window) *container.TabItem {
 				return
 			}
 			listUnsubscribeEmailValue.Objects[0].(*widget.Label).SetText(settingListUnsubscribeEmailIdentity.Email)
+			var settingListUnsubscribeURL email.SettingListUnsubscribeURL
+			err := dbutil.GetByKey(db, settingListUnsubscribeURL.DBKey(), &settingListUnsubscribeURL)
+			if err != nil && !errors.Is(err, dbutil.ErrNotFound) {
+				logAndShowError(fmt.Errorf("failed to read settings from database: %s", err), w)
+				return
+			}
+			listUnsubscribeURLValue.Objects[0].(*widget.Label).SetText(string(settingListUnsubscribeURL))
 		}
 	}()
 
 	refreshChan <- struct{}{}
-	content := widget.NewCard("Unsubscribe requests", "", f)
+	content := container.NewVBox(
+		widget.NewCard("Unsubscribe requests", "", f),
+		bounceCard(w),
+	)
 	return container.NewTabItemWithIcon("Settings", theme.SettingsIcon(), container.NewScroll(content))
 }
+
+// bounceCard configures the mailbox that receives the bounces
+func bounceCard(w fyne.Window) *widget.Card {
+	mailboxLabel := widget.NewLabel("")
+	updateLabel := func() {
+		var m bounce.SettingMailbox
+		if err := db.View(func(tx *bolt.Tx) error {
+			var err error
+			m, err = bounce.GetMailboxTx(tx)
+			return err
+		}); err != nil {
+			logAndShowError(fmt.Errorf("database error: %s", err), w)
+			return
+		}
+		if !m.Enabled() {
+			mailboxLabel.SetText("disabled")
+			return
+		}
+		mailboxLabel.SetText(fmt.Sprintf("%s %s@%s", m.Protocol, m.Username, m.Addr()))
+	}
+	updateLabel()
+
+	yesNo := func(b bool) string {
+		if b {
+			return "Yes"
+		}
+		return "No"
+	}
+	configureBtn := widget.NewButtonWithIcon("Configure", theme.DocumentCreateIcon(), func() {
+		var m bounce.SettingMailbox
+		if err := db.View(func(tx *bolt.Tx) error {
+			var err error
+			m, err = bounce.GetMailboxTx(tx)
+			return err
+		}); err != nil {
+			logAndShowError(fmt.Errorf("database error: %s", err), w)
+			return
+		}
+		var port string
+		if m.Port != 0 {
+			port = strconv.Itoa(int(m.Port))
+		}
+		fields := []form.FormField{
+			{Name: "Protocol*", Type: form.FormFieldTypeRadio, Options: bounce.Protocols, ExistingValue: m.Protocol},
+			{Name: "Host*", ExistingValue: m.Host},
+			{Name: "Port", ExistingValue: port, Description: "empty = default port of the protocol and connection encryption"},
+			{Name: "Connection Encryption*", Type: form.FormFieldTypeRadio, Options: []string{"TLS", "STARTTLS", "INSECURE"}, ExistingValue: m.ConnectionEncryption},
+			{Name: "Username*", ExistingValue: m.Username},
+			{Name: "Password", ExistingValue: m.Password},
+			{Name: "Folder", ExistingValue: m.Folder, PlaceHolder: "INBOX", Description: "IMAP only"},
+			{Name: "Delete bounces", Type: form.FormFieldTypeRadio, Options: []string{"Yes", "No"}, ExistingValue: yesNo(m.DeleteBounces), Description: "other messages are left untouched"},
+			{Name: "Suppress hard bounces", Type: form.FormFieldTypeRadio, Options: []string{"Yes", "No"}, ExistingValue: yesNo(m.SuppressHardBounces), Description: "add recipients with a hard bounce to the suppression list"},
+		}
+		form.ShowFormPopup(w, "Bounce mailbox", "The mailbox of your email identities, which receives the bounces", fields, func(inputValues []string) error {
+			var port uint64
+			if inputValues[2] != "" {
+				var err error
+				port, err = strconv.ParseUint(inputValues[2], 10, 16)
+				if err != nil {
+					return logAndReturnError(fmt.Errorf("invalid port: %s", err))
+				}
+			}
+			m := bounce.SettingMailbox{
+				Protocol:             inputValues[0],
+				Host:                 strings.TrimSpace(inputValues[1]),
+				Port:                 uint16(port),
+				ConnectionEncryption: inputValues[3],
+				Username:             inputValues[4],
+				Password:             inputValues[5],
+				Folder:               inputValues[6],
+				DeleteBounces:        inputValues[7] == "Yes",
+				SuppressHardBounces:  inputValues[8] == "Yes",
+			}
+			if err := m.Validate(); err != nil {
+				return logAndReturnError(fmt.Errorf("invalid bounce mailbox: %s", err))
+			}
+			if err := dbutil.UpsertSaveable(db, m); err != nil {
+				return logAndReturnError(fmt.Errorf("failed to update record on database: %s", err))
+			}
+			updateLabel()
+			return nil
+		})
+	})
+	disableBtn := widget.NewButtonWithIcon("Disable", theme.ContentClearIcon(), func() {
+		var m bounce.SettingMailbox
+		if err := dbutil.DeleteByTableKey(db, m.DBTable(), m.DBKey()); err != nil {
+			logAndShowError(fmt.Errorf("failed to delete record from database: %s", err), w)
+			return
+		}
+		updateLabel()
+	})
+	checkBtn := widget.NewButtonWithIcon("Check now", theme.ViewRefreshIcon(), nil)
+	checkBtn.OnTapped = func() {
+		var m bounce.SettingMailbox
+		if err := db.View(func(tx *bolt.Tx) error {
+			var err error
+			m, err = bounce.GetMailboxTx(tx)
+			return err
+		}); err != nil {
+			logAndShowError(fmt.Errorf("database error: %s", err), w)
+			return
+		}
+		if !m.Enabled() {
+			logAndShowError(fmt.Errorf("bounce processing is disabled"), w)
+			return
+		}
+		checkBtn.Disable()
+		go func() {
+			defer checkBtn.Enable()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+			defer cancel()
+			report, err := bounce.Process(ctx, db, m, loggerDebug)
+			if err != nil {
+				logAndShowError(fmt.Errorf("failed to process bounce mailbox: %s", err), w)
+				return
+			}
+			dialog.ShowInformation("Bounces", fmt.Sprintf("%d messages read\n%d bounces found\n%d matched to broadcasts\n%d recipients suppressed", report.Messages, report.Bounces, report.Matched, report.Suppressed), w)
+		}()
+	}
+
+	f := &widget.Form{}
+	f.Append("Bounce mailbox:", mailboxLabel)
+	f.Append("", container.NewHBox(configureBtn, disableBtn, checkBtn))
+	return widget.NewCard("Bounces", "Bounces are read from the mailbox every 10 minutes and shown in the send results of the broadcasts", f)
+}
@@ -12,11 +12,13 @@ import (
 	"fyne.io/fyne/v2/theme"
 	"fyne.io/fyne/v2/widget"
 	"github.com/oklog/ulid/v2"
+	bolt "go.etcd.io/bbolt"
 
 	"go.angaros.io/internal/dbutil"
 	container2 "go.angaros.io/internal/fyneutil/container"
 	"go.angaros.io/internal/fyneutil/form"
 	widget2 "go.angaros.io/internal/fyneutil/widget"
+	"go.angaros.io/internal/gateway"
 	"go.angaros.io/internal/gateway/email"
 )
 
@@ -30,25 +32,29 @@ func tabEmailSMTP(w fyne.Window) *container.TabItem {
 			{Name: "Username*"},
 			{Name: "Password*"},
 			{Name: "Connection Encryption*", Type: form.FormFieldTypeRadio, Options: []string{"TLS", "STARTTLS", "INSECURE"}},
-			{Name: "Authentication*", Type: form.FormFieldTypeRadio, Options: []string{"PLAIN", "NONE"}, Description: "Select PLAIN. NONE is for testing purposes"},
+			{Name: "Authentication*", Type: form.FormFieldTypeRadio, Options: email.AuthTypes, Description: "PLAIN works with most servers. NONE is for testing purposes.\nXOAUTH2 uses the OAuth2 fields instead of the password."},
 			{Name: "Send limit per minute"},
 			{Name: "Send limit per hour"},
 			{Name: "Send limit per day", Description: "0 = no limit"},
 			{Name: "SMTP connection reuse count limit", Description: "0 or 1 disables connection reuse.\n2+ will fail if the SMTP server\ndoes not support it."},
+			{Name: "OAuth2 token URL", Description: "e.g. https://oauth2.googleapis.com/token"},
+			{Name: "OAuth2 client ID"},
+			{Name: "OAuth2 client secret"},
+			{Name: "OAuth2 refresh token"},
+			{Name: "Mode*", Type: form.FormFieldTypeRadio, Options: email.Modes, ExistingValue: email.ModeRelay, Description: "direct delivers to the MX servers of the recipients without a relay.\nOnly the port (default 25), the limits and the connection reuse\ncount limit (0 = 100 per recipient domain) are used."},
+			{Name: "EHLO name", Description: "host name sent to the server. Empty means the host name of\nthis computer. Required in direct mode: the name of the PTR\nrecord of the sending IP address"},
+			{Name: "Proxy", Description: "socks5://host:port or http://host:port (HTTP CONNECT).\nEmpty means no proxy"},
+			{Name: "Proxy username"},
+			{Name: "Proxy password"},
 		}
 		form.ShowFormPopup(w, "New SMTP Account", "Enter your SMTP server details", fields, func(inputValues []string) error {
-			port, err := strconv.Atoi(inputValues[1])
-			if err != nil {
-				return logAndReturnError(fmt.Errorf("invalid port: %s", err))
-			}
-			if port < 0 || port > 65535 {
-				return logAndReturnError(fmt.Errorf("invalid port: value should be between 0 and 65535"))
-			}
-			if inputValues[4] == "" {
-				return logAndReturnError(fmt.Errorf("choose connection encryption"))
-			}
-			if inputValues[5] == "" {
-				return logAndReturnError(fmt.Errorf("choose authentication type"))
+			var port int
+			var err error
+			if inputValues[1] != "" {
+				port, err = strconv.Atoi(inputValues[1])
+				if err != nil {
+					return logAndReturnError(fmt.Errorf("invalid port: %s", err))
+				}
 			}
 			var limitPerMinute uint64
 			if inputValues[6] != "" {
@@ -63,9 +69,6 @@ func tabEmailSMTP(w fyne.Window) *container.TabItem {
 				if err != nil {
 					return logAndReturnError(fmt.Errorf("limit per hour: invalid value: %s", err))
 				}
-				if limitPerHour > 0 && limitPerMinute == 0 {
-					return logAndReturnError(fmt.Errorf("you cannot set limit per hour without setting limit per minute"))
-				}
 			}
 			var limitPerDay uint64
 			if inputValues[8] != "" {
@@ -73,9 +76,6 @@ func tabEmailSMTP(w fyne.Window) *container.TabItem {
 				if err != nil {
 					return logAndReturnError(fmt.Errorf("limit per day: invalid value': %s", err))
 				}
-				if limitPerDay > 0 && limitPerMinute == 0 {
-					return logAndReturnError(fmt.Errorf("you cannot set limit per day without setting limit per minute"))
-				}
 			}
 			var smtpConnectionReuseCountLimit uint64
 			if inputValues[9] != "" {
@@ -90,6 +90,8 @@ func tabEmailSMTP(w fyne.Window) *container.TabItem {
 			}
 			a := email.SMTPAccount{
 				ID:                        id,
+				Mode:                      inputValues[14],
+				HeloName:                  inputValues[15],
 				Host:                      inputValues[0],
 				Port:                      port,
 				Username:                  inputValues[2],
@@ -100,9 +102,22 @@ func tabEmailSMTP(w fyne.Window) *container.TabItem {
 				LimitPerHour:              int(limitPerHour),
 				LimitPerDay:               int(limitPerDay),
 				ConnectionReuseCountLimit: int(smtpConnectionReuseCountLimit),
+				Proxy:                     inputValues[16],
+				ProxyUsername:             inputValues[17],
+				ProxyPassword:             inputValues[18],
+				OAuth2: email.OAuth2{
+					TokenURL:     inputValues[10],
+					ClientID:     inputValues[11],
+					ClientSecret: inputValues[12],
+				},
+			}
+			if err := a.Validate(); err != nil {
+				return logAndReturnError(fmt.Errorf("invalid SMTP account: %s", err))
 			}
 			loggerDebug.Println("[DEBUG] calling store.Save", a)
-			err = dbutil.InsertSaveable(db, a)
+			err = db.Update(func(tx *bolt.Tx) error {
+				return email.SaveSMTPAccountTx(tx, a, inputValues[13])
+			})
 			if err != nil {
 				return logAndReturnError(fmt.Errorf("cannot write to database: %s", err))
 			}
@@ -132,31 +147,39 @@ func tabEmailSMTP(w fyne.Window) *container.TabItem {
 							logAndShowError(fmt.Errorf("database error: %s", err), w)
 							return
 						}
+						mode := a.Mode
+						if mode == "" {
+							mode = email.ModeRelay
+						}
 						fields := []form.FormField{
 							{Name: "Host*", ExistingValue: a.Host},
 							{Name: "Port*", ExistingValue: strconv.Itoa(a.Port)},
 							{Name: "Username*", ExistingValue: a.Username},
 							{Name: "Password*", ExistingValue: a.Password},
 							{Name: "Connection Encryption*", Type: form.FormFieldTypeRadio, ExistingValue: a.ConnectionEncryption, Options: []string{"TLS", "STARTTLS", "INSECURE"}},
-							{Name: "Authentication*", Type: form.FormFieldTypeRadio, ExistingValue: a.AuthType, Options: []string{"PLAIN", "NONE"}, Description: "Select PLAIN. NONE is for testing purposes"},
+							{Name: "Authentication*", Type: form.FormFieldTypeRadio, ExistingValue: a.AuthType, Options: email.AuthTypes, Description: "PLAIN works with most servers. NONE is for testing purposes.\nXOAUTH2 uses the OAuth2 fields instead of the password."},
 							{Name: "Send limit per minute", ExistingValue: strconv.Itoa(a.LimitPerMinute)},
 							{Name: "Send limit per hour", ExistingValue: strconv.Itoa(a.LimitPerHour)},
 							{Name: "Send limit per day", ExistingValue: strconv.Itoa(a.LimitPerDay), Description: "0 = no limit"},
 							{Name: "SMTP connection reuse count limit", ExistingValue: strconv.Itoa(a.ConnectionReuseCountLimit), Description: "0 or 1 disables connection reuse.\n2+ will fail if the SMTP server\ndoes not support it."},
+							{Name: "OAuth2 token URL", ExistingValue: a.OAuth2.TokenURL, Description: "e.g. https://oauth2.googleapis.com/token"},
+							{Name: "OAuth2 client ID", ExistingValue: a.OAuth2.ClientID},
+							{Name: "OAuth2 client secret", ExistingValue: a.OAuth2.ClientSecret},
+							{Name: "OAuth2 refresh token", Description: "Leave empty to keep the existing token"},
+							{Name: "Mode*", Type: form.FormFieldTypeRadio, ExistingValue: mode, Options: email.Modes, Description: "direct delivers to the MX servers of the recipients without a relay.\nOnly the port (default 25), the limits and the connection reuse\ncount limit (0 = 100 per recipient domain) are used."},
+							{Name: "EHLO name", ExistingValue: a.HeloName, Description: "host name sent to the server. Empty means the host name of\nthis computer. Required in direct mode: the name of the PTR\nrecord of the sending IP address"},
+							{Name: "Proxy", ExistingValue: a.Proxy, Description: "socks5://host:port or http://host:port (HTTP CONNECT).\nEmpty means no proxy"},
+							{Name: "Proxy username", ExistingValue: a.ProxyUsername},
+							{Name: "Proxy password", ExistingValue: a.ProxyPassword},
 						}
 						form.ShowFormPopup(w, "Edit SMTP Account", "Enter your SMTP server details", fields, func(inputValues []string) error {
-							port, err := strconv.Atoi(inputValues[1])
-							if err != nil {
-								return logAndReturnError(fmt.Errorf("invalid port: %s", err))
-							}
-							if port < 0 || port > 65535 {
-								return logAndReturnError(fmt.Errorf("invalid port: value should be between 0 and 65535"))
-							}
-							if inputValues[4] == "" {
-								return logAndReturnError(fmt.Errorf("choose connection encryption"))
-							}
-							if inputValues[5] == "" {
-								return logAndReturnError(fmt.Errorf("choose authentication type"))
+							var port int
+							var err error
+							if inputValues[1] != "" {
+								port, err = strconv.Atoi(inputValues[1])
+								if err != nil {
+									return logAndReturnError(fmt.Errorf("invalid port: %s", err))
+								}
 							}
 							var limitPerMinute uint64
 							if inputValues[6] != "" {
@@ -171,9 +194,6 @@ func tabEmailSMTP(w fyne.Window) *container.TabItem {
 								if err != nil {
 									return logAndReturnError(fmt.Errorf("limit per hour: invalid value: %s", err))
 								}
-								if limitPerHour > 0 && limitPerMinute == 0 {
-									return logAndReturnError(fmt.Errorf("you cannot set limit per hour without setting limit per minute"))
-								}
 							}
 							var limitPerDay uint64
 							if inputValues[8] != "" {
@@ -181,9 +201,6 @@ func tabEmailSMTP(w fyne.Window) *container.TabItem {
 								if err != nil {
 									return logAndReturnError(fmt.Errorf("limit per day: invalid value: %s", err))
 								}
-								if limitPerDay > 0 && limitPerMinute == 0 {
-									return logAndReturnError(fmt.Errorf("you cannot set limit per day without setting limit per minute"))
-								}
 							}
 							var smtpConnectionReuseCountLimit uint64
 							if inputValues[9] != "" {
@@ -194,6 +211,8 @@ func tabEmailSMTP(w fyne.Window) *container.TabItem {
 							}
 							a2 := email.SMTPAccount{
 								ID:                        a.ID,
+								Mode:                      inputValues[14],
+								HeloName:                  inputValues[15],
 								Host:                      inputValues[0],
 								Port:                      port,
 								Username:                  inputValues[2],
@@ -204,8 +223,21 @@ func tabEmailSMTP(w fyne.Window) *container.TabItem {
 								LimitPerHour:              int(limitPerHour),
 								LimitPerDay:               int(limitPerDay),
 								ConnectionReuseCountLimit: int(smtpConnectionReuseCountLimit),
+								Proxy:                     inputValues[16],
+								ProxyUsername:             inputValues[17],
+								ProxyPassword:             inputValues[18],
+								OAuth2: email.OAuth2{
+									TokenURL:     inputValues[10],
+									ClientID:     inputValues[11],
+									ClientSecret: inputValues[12],
+								},
+							}
+							if err := a2.Validate(); err != nil {
+								return logAndReturnError(fmt.Errorf("invalid SMTP account: %s", err))
 							}
-							err = dbutil.UpsertSaveable(db, a2)
+							err = db.Update(func(tx *bolt.Tx) error {
+								return email.SaveSMTPAccountTx(tx, a2, inputValues[13])
+							})
 							if err != nil {
 								return logAndReturnError(fmt.Errorf("cannot write to database: %s", err))
 							}
@@ -214,6 +246,15 @@ func tabEmailSMTP(w fyne.Window) *container.TabItem {
 						})
 					}
 				},
+			}, {
+				Name: "Test",
+				Func: func(v dbutil.Saveable, refreshChan chan<- struct{}) func() {
+					return func() {
+						showTestConnection(w, "Test SMTP Account", "Email address", func() (gateway.Tester, error) {
+							return email.NewSenderClientFromAccountKey(db, v.DBKey())
+						})
+					}
+				},
 			}, {
 				Name: "Delete",
 				Func: func(v dbutil.Saveable, refreshChan chan<- struct{}) func() {
@@ -221,7 +262,9 @@ func tabEmailSMTP(w fyne.Window) *container.TabItem {
 						content := widget.NewLabel("Are you sure you want to delete this SMTP server?")
 						dialog.ShowCustomConfirm("Delete SMTP server", "Confirm", "Cancel", content, func(submit bool) {
 							if submit {
-								err := dbutil.DeleteByTableKey(db, v.DBTable(), v.DBKey())
+								err := db.Update(func(tx *bolt.Tx) error {
+									return email.DeleteSMTPAccountTx(tx, v.(email.SMTPAccount).ID)
+								})
 								if err != nil {
 									logAndShowError(fmt.Errorf("cannot write to database: %s", err), w)
 								}
@@ -5,6 +5,7 @@ import (
 
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
 	"fyne.io/fyne/v2/theme"
 	"fyne.io/fyne/v2/widget"
 
@@ -33,10 +34,40 @@ func tabSmsAndroidAdb(w fyne.Window) *container.TabItem {
 				Func: func(v dbutil.Saveable, refreshChan chan<- struct{}) func() {
 					return func() {
 						d := v.(adb.Device)
-						err := dbutil.UpsertSaveable(db, android.FromDeviceable(d))
+						dev := android.FromDeviceable(d)
+						save := func() {
+							err := dbutil.UpsertSaveable(db, dev)
+							if err != nil {
+								logAndShowError(fmt.Errorf("database error: %s", err), w)
+							}
+						}
+						subs, err := d.Subscriptions()
 						if err != nil {
-							logAndShowError(fmt.Errorf("database error: %s", err), w)
+							// the default SIM is used
+							loggerInfo.Printf("cannot read SIM subscriptions of %s: %s\n", d.DeviceAndroidID(), err)
+							save()
+							return
+						}
+						if len(subs) <= 1 {
+							save()
+							return
+						}
+						subStrings := make([]string, 0, len(subs))
+						for _, sub := range subs {
+							subStrings = append(subStrings, sub.String())
 						}
+						subSelect := widget.NewSelect(subStrings, nil)
+						subSelect.SetSelectedIndex(0)
+						content := container.NewVBox(widget.NewLabel("The device has more than one SIM. Select the SIM that sends the messages:"), subSelect)
+						dialog.ShowCustomConfirm("Save Device", "Save", "Cancel", content, func(submit bool) {
+							if !submit {
+								return
+							}
+							sub := subs[subSelect.SelectedIndex()]
+							dev.SubscriptionID = sub.ID
+							dev.SubscriptionName = sub.String()
+							save()
+						}, w)
 					}
 				},
 			},
@@ -50,7 +81,7 @@ func tabSmsAndroidAdb(w fyne.Window) *container.TabItem {
 					loggerInfo.Println(err.Error())
 					noticeLabel.SetText(err.Error())
 				} else {
-					noticeLabel.SetText("")
+					noticeLabel.SetText(adb.CompanionNote)
 				}
 				t.UpdateAndRefresh(devs.ToSliceOfSaveables())
 			}
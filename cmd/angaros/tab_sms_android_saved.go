@@ -12,6 +12,7 @@ import (
 	"go.angaros.io/internal/dbutil"
 	container2 "go.angaros.io/internal/fyneutil/container"
 	widget2 "go.angaros.io/internal/fyneutil/widget"
+	"go.angaros.io/internal/gateway"
 	"go.angaros.io/internal/gateway/sms/android"
 )
 
@@ -24,9 +25,19 @@ func tabSmsAndroidSaved(w fyne.Window) *container.TabItem {
 			{Name: "Actions", Actions: true},
 			{Name: "Android ID", Field: "AndroidID", Width: 175},
 			{Name: "Name", Field: "Name", Width: 175},
+			{Name: "SIM", Field: "SubscriptionName", Width: 250},
 		},
 		[]widget2.Action{
 			{
+				Name: "Test",
+				Func: func(v dbutil.Saveable, refreshChan chan<- struct{}) func() {
+					return func() {
+						showTestConnection(w, "Test Device", "Phone number", func() (gateway.Tester, error) {
+							return android.NewSenderClientFromKey(db, v.DBKey())
+						})
+					}
+				},
+			}, {
 				Name: "Delete",
 				Func: func(v dbutil.Saveable, refreshChan chan<- struct{}) func() {
 					return func() {
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+
+	"go.angaros.io/internal/gateway"
+)
+
+// testMessage is sent by the Test action. It is not part of a broadcast, so send counts are not affected.
+var testMessage = gateway.Message{
+	Subject: "Angaros test message",
+	Text:    "This is a test message sent by Angaros to check the gateway configuration.",
+}
+
+// testMessageBroadcastID is used instead of a broadcast ID e.g. in the Message-ID of test emails
+const testMessageBroadcastID = "test"
+
+// formatTestSteps returns one line per stage, followed by the details of the stage
+func formatTestSteps(steps []gateway.TestStep) string {
+	var b strings.Builder
+	for _, step := range steps {
+		if step.Err != nil {
+			fmt.Fprintf(&b, "[FAILED] %s: %s\n", step.Name, step.Err)
+		} else {
+			fmt.Fprintf(&b, "[OK] %s\n", step.Name)
+		}
+		if step.Details != "" {
+			fmt.Fprintf(&b, "    %s\n", strings.ReplaceAll(step.Details, "\n", "\n    "))
+		}
+	}
+	return b.String()
+}
+
+// showTestConnection runs the connection test of a gateway in a dialog.
+// If the test succeeds, a test message can be sent to a recipient entered in the dialog.
+func showTestConnection(w fyne.Window, title, recipientPlaceHolder string, newClient func() (gateway.Tester, error)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stepsLabel := widget.NewLabel("Testing...")
+	stepsLabel.Wrapping = fyne.TextWrapBreak
+	recipientEntry := widget.NewEntry()
+	recipientEntry.SetPlaceHolder(recipientPlaceHolder)
+	sendLabel := widget.NewLabel("")
+	sendLabel.Wrapping = fyne.TextWrapBreak
+	var client gateway.Tester
+	sendBtn := widget.NewButton("Send test message", nil)
+	sendBtn.Disable()
+	sendBtn.OnTapped = func() {
+		to := strings.TrimSpace(recipientEntry.Text)
+		if to == "" {
+			sendLabel.SetText("Enter a recipient")
+			return
+		}
+		sendBtn.Disable()
+		sendLabel.SetText("Sending...")
+		go func() {
+			defer sendBtn.Enable()
+			ctxSend, cancelSend := context.WithTimeout(ctx, 2*time.Minute)
+			defer cancelSend()
+			if err := client.Send(ctxSend, to, testMessage, testMessageBroadcastID); err != nil {
+				sendLabel.SetText(fmt.Sprintf("Failed to send test message: %s", err))
+				return
+			}
+			sendLabel.SetText("Test message sent to " + to)
+		}()
+	}
+	sendForm := container.NewBorder(nil, nil, nil, sendBtn, recipientEntry)
+	content := container.NewBorder(nil, container.NewVBox(sendForm, sendLabel), nil, nil, container.NewScroll(stepsLabel))
+	d := dialog.NewCustom(title, "Close", content, w)
+	d.SetOnClosed(func() {
+		cancel()
+		if client != nil {
+			_ = client.PostSend(context.Background())
+		}
+	})
+	d.Resize(fyne.NewSize(700, 500))
+	d.Show()
+	go func() {
+		c, err := newClient()
+		if err != nil {
+			stepsLabel.SetText(err.Error())
+			return
+		}
+		ctxTest, cancelTest := context.WithTimeout(ctx, 2*time.Minute)
+		defer cancelTest()
+		steps, err := c.Test(ctxTest)
+		text := formatTestSteps(steps)
+		if err != nil {
+			text += "\nTest failed: " + err.Error()
+		} else {
+			text += "\nTest succeeded"
+			client = c
+			sendBtn.Enable()
+		}
+		stepsLabel.SetText(text)
+	}()
+}
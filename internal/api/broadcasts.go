@@ -0,0 +1,596 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	bolt "go.etcd.io/bbolt"
+
+	"go.angaros.io/internal/broadcast"
+	"go.angaros.io/internal/contactlist"
+	"go.angaros.io/internal/dbutil"
+)
+
+type contactsFileJSON struct {
+	Content         string `json:"content"`
+	Type            string `json:"type"`
+	Delimiter       string `json:"delimiter"`
+	HasHeader       bool   `json:"has_header"`
+	RecipientColumn string `json:"recipient_column"`
+}
+
+// attachmentJSON is an attachment. Content is base64 encoded and only used in requests.
+type attachmentJSON struct {
+	Filename    string `json:"filename"`
+	Content     []byte `json:"content,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Size        int    `json:"size,omitempty"`
+	Inline      bool   `json:"inline,omitempty"`
+}
+
+type contactJSON struct {
+	Recipient string            `json:"recipient"`
+	Keywords  map[string]string `json:"keywords,omitempty"`
+}
+
+// broadcastInputJSON is the request body for creating or updating a broadcast.
+// Contacts are given either as a file (contacts_file), as a list (contacts)
+// or as the ID of a saved contact list (contact_list_id).
+type broadcastInputJSON struct {
+	ContactsFile    *contactsFileJSON `json:"contacts_file"`
+	Contacts        []contactJSON     `json:"contacts"`
+	ContactListID   string            `json:"contact_list_id"`
+	ContactListTags []string          `json:"contact_list_tags"`
+	Filename        string            `json:"filename"`
+	Subject         string            `json:"subject"`
+	Body            string            `json:"body"`
+	BodyHTML        bool              `json:"body_html"`
+	Gateway         string            `json:"gateway"`
+	SendHours       string            `json:"send_hours"`
+	Timezone        string            `json:"timezone"`
+	SendDateFrom    string            `json:"send_date_from"`
+	SendDateTo      string            `json:"send_date_to"`
+	// country of phone numbers without a country code, default from settings
+	DefaultCountry string `json:"default_country"`
+	// images referenced in the HTML body as cid:filename are inline
+	Attachments []attachmentJSON `json:"attachments"`
+	// path template of a file attached to the message of each contact e.g. {{.invoice_file}}, relative to contact_attachment_dir.
+	// contact_attachment_dir is relative to the attachment directory of the server, and both are allowed only if it is set
+	ContactAttachment    string `json:"contact_attachment"`
+	ContactAttachmentDir string `json:"contact_attachment_dir"`
+	// maximum number of consecutive contacts with identical messages sent in one transaction (email only)
+	BatchSize int `json:"batch_size"`
+	// subscription ID of the SIM that sends the messages, 0 means the SIM of the device (android only)
+	SubscriptionID int `json:"subscription_id"`
+}
+
+type broadcastJSON struct {
+	ID              string    `json:"id"`
+	Status          string    `json:"status"`
+	State           string    `json:"state"`
+	Contacts        int       `json:"contacts"`
+	ContactListID   string    `json:"contact_list_id,omitempty"`
+	ContactListTags []string  `json:"contact_list_tags,omitempty"`
+	Filename        string    `json:"filename"`
+	Subject         string    `json:"subject"`
+	Body            string    `json:"body"`
+	BodyHTML        bool      `json:"body_html"`
+	GatewayType     string    `json:"gateway_type"`
+	Gateway         string    `json:"gateway"`
+	SendHours       string    `json:"send_hours"`
+	Timezone        string    `json:"timezone"`
+	SendDateFrom    string    `json:"send_date_from"`
+	SendDateTo      string    `json:"send_date_to"`
+	CreatedAt       time.Time `json:"created_at"`
+
+	Attachments          []attachmentJSON `json:"attachments,omitempty"`
+	ContactAttachment    string           `json:"contact_attachment,omitempty"`
+	ContactAttachmentDir string           `json:"contact_attachment_dir,omitempty"`
+	BatchSize            int              `json:"batch_size,omitempty"`
+	SubscriptionID       int              `json:"subscription_id,omitempty"`
+	// only set in responses to create and update requests
+	RejectedContacts []string `json:"rejected_contacts,omitempty"`
+}
+
+type runJSON struct {
+	BroadcastID string `json:"broadcast_id"`
+	Status      string `json:"status"`
+	NextIndex   int    `json:"next_index"`
+	Length      int    `json:"length"`
+}
+
+type sendJSON struct {
+	Index     int    `json:"index"`
+	Recipient string `json:"recipient"`
+	Sent      string `json:"sent"`
+	Status    string `json:"status,omitempty"`
+	Error     string `json:"error,omitempty"`
+	ErrorCode string `json:"error_code,omitempty"`
+	Bounce    string `json:"bounce,omitempty"`
+	Hard      bool   `json:"hard_bounce,omitempty"`
+}
+
+type replyJSON struct {
+	Index      int       `json:"index"`
+	Recipient  string    `json:"recipient"`
+	From       string    `json:"from"`
+	Body       string    `json:"body"`
+	ReceivedAt time.Time `json:"received_at"`
+	OptOut     bool      `json:"opt_out"`
+}
+
+func formatDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format("2006-01-02")
+}
+
+func newBroadcastJSON(tx *bolt.Tx, b broadcast.Broadcast) (broadcastJSON, error) {
+	if err := b.ReadStatusFromTx(tx); err != nil {
+		return broadcastJSON{}, fmt.Errorf("failed to read status of broadcast %s: %s", b.ID, err)
+	}
+	bJSON := broadcastJSON{
+		ID:              b.ID.String(),
+		Status:          b.GetStatus(),
+		State:           b.State,
+		Contacts:        len(b.Contacts),
+		ContactListTags: b.ContactListTags,
+		Filename:        b.MsgBodyFile,
+		Subject:         b.MsgSubject,
+		Body:            b.MsgBody,
+		BodyHTML:        b.MsgBodyHTML,
+		GatewayType:     b.GatewayType,
+		Gateway:         string(b.GatewayKey),
+		SendHours:       broadcast.TimeRanges(b.SendHours).String(),
+		Timezone:        b.Timezone,
+		SendDateFrom:    formatDate(b.SendDateFrom),
+		SendDateTo:      formatDate(b.SendDateTo),
+		CreatedAt:       b.CreatedAt,
+	}
+	if b.ContactListID != (ulid.ULID{}) {
+		bJSON.ContactListID = b.ContactListID.String()
+	}
+	for _, a := range b.Attachments {
+		bJSON.Attachments = append(bJSON.Attachments, attachmentJSON{
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			Size:        a.Size,
+			Inline:      a.Inline,
+		})
+	}
+	bJSON.ContactAttachment = b.ContactAttachment
+	bJSON.ContactAttachmentDir = b.ContactAttachmentDir
+	bJSON.BatchSize = b.BatchSize
+	bJSON.SubscriptionID = b.SubscriptionID
+	return bJSON, nil
+}
+
+// toBroadcastTx validates the input the same way the new broadcast wizard does
+func (in broadcastInputJSON) toBroadcastTx(tx *bolt.Tx, attachmentDir string) (broadcast.Broadcast, []broadcast.RejectedContact, error) {
+	var contacts []broadcast.Contact
+	var contactListID ulid.ULID
+	if (in.ContactsFile != nil && len(in.Contacts) > 0) || (in.ContactListID != "" && (in.ContactsFile != nil || len(in.Contacts) > 0)) {
+		return broadcast.Broadcast{}, nil, fmt.Errorf("set only one of contacts_file, contacts or contact_list_id")
+	} else if in.ContactListID != "" {
+		var err error
+		contactListID, err = ulid.ParseStrict(in.ContactListID)
+		if err != nil {
+			return broadcast.Broadcast{}, nil, fmt.Errorf("invalid contact list ID: %s", err)
+		}
+		var l contactlist.List
+		err = dbutil.GetByKeyTx(tx, contactListID[:], &l)
+		if err != nil { // don't ignore dbutil.ErrNotFound
+			return broadcast.Broadcast{}, nil, fmt.Errorf("failed to read contact list %s: %s", contactListID, err)
+		}
+		listContacts, err := contactlist.ContactsTx(tx, contactListID, in.ContactListTags)
+		if err != nil {
+			return broadcast.Broadcast{}, nil, err
+		}
+		if len(listContacts) == 0 {
+			return broadcast.Broadcast{}, nil, fmt.Errorf("no contacts in the list have these tags")
+		}
+	} else if in.ContactsFile != nil {
+		contactsFile := broadcast.ContactsFile{
+			Content:         in.ContactsFile.Content,
+			Type:            in.ContactsFile.Type,
+			HasHeader:       in.ContactsFile.HasHeader,
+			RecipientColumn: in.ContactsFile.RecipientColumn,
+		}
+		if contactsFile.Type == "" {
+			contactsFile.Type = broadcast.ContactsFileTypeFromFilename(in.Filename)
+		}
+		if len(in.ContactsFile.Delimiter) > 0 {
+			contactsFile.Delimiter = rune(in.ContactsFile.Delimiter[0])
+		}
+		var err error
+		contacts, err = contactsFile.ReadContacts()
+		if err != nil {
+			return broadcast.Broadcast{}, nil, err
+		}
+	} else {
+		seenRecipients := make(map[string]struct{}, len(in.Contacts))
+		for _, c := range in.Contacts {
+			if c.Recipient == "" {
+				return broadcast.Broadcast{}, nil, fmt.Errorf("contact with empty recipient")
+			}
+			if _, exists := seenRecipients[c.Recipient]; exists {
+				continue
+			}
+			seenRecipients[c.Recipient] = struct{}{}
+			contacts = append(contacts, broadcast.Contact{Recipient: c.Recipient, Keywords: c.Keywords})
+		}
+	}
+	if in.Gateway == "" {
+		return broadcast.Broadcast{}, nil, fmt.Errorf("gateway not set")
+	}
+	gateway, err := broadcast.GetGatewayTx(tx, []byte(in.Gateway))
+	if err != nil {
+		return broadcast.Broadcast{}, nil, err
+	}
+	if in.DefaultCountry == "" {
+		in.DefaultCountry, err = broadcast.GetDefaultCountryTx(tx)
+		if err != nil {
+			return broadcast.Broadcast{}, nil, err
+		}
+	}
+	attachments := make([]broadcast.Attachment, 0, len(in.Attachments))
+	for _, a := range in.Attachments {
+		attachment, err := broadcast.NewAttachment(a.Filename, a.Content)
+		if err != nil {
+			return broadcast.Broadcast{}, nil, err
+		}
+		if a.ContentType != "" {
+			attachment.ContentType = a.ContentType
+		}
+		attachments = append(attachments, attachment)
+	}
+	// per-contact attachments are files of the server, so they are read only from the directory set by the operator
+	var contactAttachmentDir string
+	if in.ContactAttachment != "" || in.ContactAttachmentDir != "" {
+		if attachmentDir == "" {
+			return broadcast.Broadcast{}, nil, fmt.Errorf("contact attachments are disabled: start Angaros with -api-attachment-dir to enable them")
+		}
+		var err error
+		contactAttachmentDir, err = broadcast.PathInDir(attachmentDir, in.ContactAttachmentDir)
+		if err != nil {
+			return broadcast.Broadcast{}, nil, fmt.Errorf("invalid contact_attachment_dir: %s", err)
+		}
+	}
+	return broadcast.NewFromInput(broadcast.Input{
+		Contacts:        contacts,
+		Filename:        in.Filename,
+		ContactListID:   contactListID,
+		ContactListTags: in.ContactListTags,
+		MsgSubject:      in.Subject,
+		MsgBody:         in.Body,
+		MsgBodyHTML:     in.BodyHTML,
+		GatewayType:     gateway.DBTable(),
+		GatewayKey:      gateway.DBKey(),
+		SendHours:       in.SendHours,
+		Timezone:        in.Timezone,
+		SendDateFrom:    in.SendDateFrom,
+		SendDateTo:      in.SendDateTo,
+		DefaultCountry:  in.DefaultCountry,
+
+		Attachments:          attachments,
+		ContactAttachment:    in.ContactAttachment,
+		ContactAttachmentDir: contactAttachmentDir,
+		BatchSize:            in.BatchSize,
+		SubscriptionID:       in.SubscriptionID,
+	})
+}
+
+func rejectedContactsJSON(rejected []broadcast.RejectedContact) []string {
+	strs := make([]string, 0, len(rejected))
+	for _, r := range rejected {
+		strs = append(strs, r.String())
+	}
+	return strs
+}
+
+// errBadRequest wraps errors caused by invalid user input
+type errBadRequest struct {
+	err error
+}
+
+func (e errBadRequest) Error() string {
+	return e.err.Error()
+}
+
+func writeTxError(w http.ResponseWriter, err error) {
+	var errBadReq errBadRequest
+	if errors.As(err, &errBadReq) {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeDBError(w, err)
+}
+
+// GET, POST /api/broadcasts
+func (s *server) handleBroadcasts(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		bs := make([]broadcastJSON, 0)
+		if err := s.db.View(func(tx *bolt.Tx) error {
+			return dbutil.ForEachReverseTx(tx, &broadcast.Broadcast{}, func(k []byte, v interface{}) error {
+				bJSON, err := newBroadcastJSON(tx, v.(broadcast.Broadcast))
+				if err != nil {
+					return err
+				}
+				bs = append(bs, bJSON)
+				return nil
+			})
+		}); err != nil {
+			writeDBError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, bs)
+	case http.MethodPost:
+		var in broadcastInputJSON
+		if err := readJSON(w, r, &in); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		var bJSON broadcastJSON
+		if err := s.db.Update(func(tx *bolt.Tx) error {
+			b, rejected, err := in.toBroadcastTx(tx, s.attachmentDir)
+			if err != nil {
+				return errBadRequest{err: err}
+			}
+			if err := broadcast.SaveTx(tx, b); err != nil {
+				return err
+			}
+			bJSON, err = newBroadcastJSON(tx, b)
+			bJSON.RejectedContacts = rejectedContactsJSON(rejected)
+			return err
+		}); err != nil {
+			writeTxError(w, err)
+			return
+		}
+		s.loggerDebug.Println("broadcast created:", bJSON.ID)
+		broadcast.Wake()
+		writeJSON(w, http.StatusCreated, bJSON)
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+// GET, PUT, DELETE /api/broadcasts/{id}
+// GET /api/broadcasts/{id}/run
+// GET /api/broadcasts/{id}/sends
+// GET /api/broadcasts/{id}/replies
+func (s *server) handleBroadcast(w http.ResponseWriter, r *http.Request) {
+	segments := pathSegments(r.URL.Path, "/api/broadcasts/")
+	if len(segments) == 0 || len(segments) > 2 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("not found"))
+		return
+	}
+	id, err := ulid.ParseStrict(segments[0])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid broadcast ID: %s", err))
+		return
+	}
+	if len(segments) == 2 {
+		switch segments[1] {
+		case "run":
+			s.handleBroadcastRun(w, r, id)
+		case "sends":
+			s.handleBroadcastSends(w, r, id)
+		case "replies":
+			s.handleBroadcastReplies(w, r, id)
+		case "pause":
+			s.handleBroadcastSetState(w, r, id, broadcast.PauseTx)
+		case "resume":
+			s.handleBroadcastSetState(w, r, id, broadcast.ResumeTx)
+		case "cancel":
+			s.handleBroadcastSetState(w, r, id, broadcast.CancelTx)
+		default:
+			writeError(w, http.StatusNotFound, fmt.Errorf("not found"))
+		}
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		var bJSON broadcastJSON
+		if err := s.db.View(func(tx *bolt.Tx) error {
+			var b broadcast.Broadcast
+			if err := dbutil.GetByKeyTx(tx, id[:], &b); err != nil {
+				return err
+			}
+			bJSON, err = newBroadcastJSON(tx, b)
+			return err
+		}); err != nil {
+			writeDBError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, bJSON)
+	case http.MethodPut:
+		var in broadcastInputJSON
+		if err := readJSON(w, r, &in); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		var bJSON broadcastJSON
+		if err := s.db.Update(func(tx *bolt.Tx) error {
+			var existing broadcast.Broadcast
+			if err := dbutil.GetByKeyTx(tx, id[:], &existing); err != nil {
+				return err
+			}
+			var existingRun broadcast.Run
+			err := dbutil.GetByKeyTx(tx, existing.DBKey(), &existingRun)
+			if err == nil {
+				return errBadRequest{err: fmt.Errorf("broadcast has already started and cannot be edited")}
+			} else if !errors.Is(err, dbutil.ErrNotFound) {
+				return err
+			}
+			b, rejected, err := in.toBroadcastTx(tx, s.attachmentDir)
+			if err != nil {
+				return errBadRequest{err: err}
+			}
+			b.ID = existing.ID
+			b.CreatedAt = existing.CreatedAt
+			b.State = existing.State
+			if err := broadcast.SaveTx(tx, b); err != nil {
+				return err
+			}
+			bJSON, err = newBroadcastJSON(tx, b)
+			bJSON.RejectedContacts = rejectedContactsJSON(rejected)
+			return err
+		}); err != nil {
+			writeTxError(w, err)
+			return
+		}
+		broadcast.Wake()
+		writeJSON(w, http.StatusOK, bJSON)
+	case http.MethodDelete:
+		if err := s.db.Update(func(tx *bolt.Tx) error {
+			var b broadcast.Broadcast
+			if err := dbutil.GetByKeyTx(tx, id[:], &b); err != nil {
+				return err
+			}
+			return broadcast.DeleteTx(tx, id[:])
+		}); err != nil {
+			writeDBError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPut, http.MethodDelete)
+	}
+}
+
+// POST /api/broadcasts/{id}/pause
+// POST /api/broadcasts/{id}/resume
+// POST /api/broadcasts/{id}/cancel
+func (s *server) handleBroadcastSetState(w http.ResponseWriter, r *http.Request, id ulid.ULID, setStateTx func(tx *bolt.Tx, key []byte) error) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+	var bJSON broadcastJSON
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		if err := setStateTx(tx, id[:]); err != nil {
+			return err
+		}
+		var b broadcast.Broadcast
+		if err := dbutil.GetByKeyTx(tx, id[:], &b); err != nil {
+			return err
+		}
+		var err error
+		bJSON, err = newBroadcastJSON(tx, b)
+		return err
+	}); err != nil {
+		if errors.Is(err, broadcast.ErrInvalidState) {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		writeDBError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, bJSON)
+}
+
+func (s *server) handleBroadcastRun(w http.ResponseWriter, r *http.Request, id ulid.ULID) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	rJSON := runJSON{BroadcastID: id.String()}
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		var b broadcast.Broadcast
+		if err := dbutil.GetByKeyTx(tx, id[:], &b); err != nil {
+			return err
+		}
+		if err := b.ReadStatusFromTx(tx); err != nil {
+			return err
+		}
+		rJSON.Status = b.GetStatus()
+		rJSON.Length = len(b.Contacts)
+		var run broadcast.Run
+		err := dbutil.GetByKeyTx(tx, id[:], &run)
+		if err != nil && !errors.Is(err, dbutil.ErrNotFound) {
+			return err
+		} else if err == nil {
+			rJSON.NextIndex = run.NextIndex
+			rJSON.Length = run.Length
+		}
+		return nil
+	}); err != nil {
+		writeDBError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, rJSON)
+}
+
+func (s *server) handleBroadcastSends(w http.ResponseWriter, r *http.Request, id ulid.ULID) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	sends := make([]sendJSON, 0)
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		var b broadcast.Broadcast
+		if err := dbutil.GetByKeyTx(tx, id[:], &b); err != nil {
+			return err
+		}
+		return dbutil.ForEachPrefixTx(tx, &broadcast.Send{}, id[:], func(k []byte, v interface{}) error {
+			bSend := v.(broadcast.Send)
+			sJSON := sendJSON{
+				Index:     bSend.Index,
+				Sent:      bSend.SentString(),
+				Status:    bSend.Status,
+				Error:     bSend.ErrorStr,
+				ErrorCode: bSend.ErrorCode,
+				Bounce:    bSend.Bounce,
+				Hard:      bSend.HardBounce,
+			}
+			if bSend.Index < len(b.Contacts) {
+				sJSON.Recipient = b.Contacts[bSend.Index].Recipient
+			}
+			sends = append(sends, sJSON)
+			return nil
+		})
+	}); err != nil {
+		writeDBError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, sends)
+}
+
+// handleBroadcastReplies returns the SMS replies of the contacts, ordered by the time they were received
+func (s *server) handleBroadcastReplies(w http.ResponseWriter, r *http.Request, id ulid.ULID) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	replies := make([]replyJSON, 0)
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		var b broadcast.Broadcast
+		if err := dbutil.GetByKeyTx(tx, id[:], &b); err != nil {
+			return err
+		}
+		return dbutil.ForEachPrefixTx(tx, &broadcast.Reply{}, id[:], func(k []byte, v interface{}) error {
+			bReply := v.(broadcast.Reply)
+			rJSON := replyJSON{
+				Index:      bReply.Index,
+				From:       bReply.From,
+				Body:       bReply.Body,
+				ReceivedAt: bReply.ReceivedAt,
+				OptOut:     bReply.OptOut,
+			}
+			if bReply.Index < len(b.Contacts) {
+				rJSON.Recipient = b.Contacts[bReply.Index].Recipient
+			}
+			replies = append(replies, rJSON)
+			return nil
+		})
+	}); err != nil {
+		writeDBError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, replies)
+}
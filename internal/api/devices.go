@@ -0,0 +1,188 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	bolt "go.etcd.io/bbolt"
+
+	"go.angaros.io/internal/dbutil"
+	"go.angaros.io/internal/gateway/sms/android"
+	"go.angaros.io/internal/gateway/sms/android/adb"
+)
+
+type deviceJSON struct {
+	AndroidID string `json:"android_id"`
+	Name      string `json:"name"`
+	// SIM that sends the messages, 0 means the default SIM of the phone. See GET /api/devices/{androidID}/subscriptions
+	SubscriptionID   int    `json:"subscription_id"`
+	SubscriptionName string `json:"subscription_name"`
+}
+
+func newDeviceJSON(d android.Device) deviceJSON {
+	return deviceJSON{
+		AndroidID:        d.AndroidID,
+		Name:             d.Name,
+		SubscriptionID:   d.SubscriptionID,
+		SubscriptionName: d.SubscriptionName,
+	}
+}
+
+type subscriptionJSON struct {
+	ID          int    `json:"id"`
+	Slot        int    `json:"slot"`
+	DisplayName string `json:"display_name"`
+	CarrierName string `json:"carrier_name"`
+	Number      string `json:"number"`
+}
+
+func (in deviceJSON) toDevice() (android.Device, error) {
+	if in.AndroidID == "" {
+		return android.Device{}, fmt.Errorf("android_id is empty")
+	}
+	if in.SubscriptionID < 0 {
+		return android.Device{}, fmt.Errorf("subscription_id should not be negative")
+	}
+	return android.Device{
+		AndroidID:        in.AndroidID,
+		Name:             in.Name,
+		SubscriptionID:   in.SubscriptionID,
+		SubscriptionName: in.SubscriptionName,
+	}, nil
+}
+
+// GET, POST /api/devices
+func (s *server) handleDevices(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		devs := make([]deviceJSON, 0)
+		err := dbutil.ForEach(s.db, &android.Device{}, func(k []byte, v interface{}) error {
+			devs = append(devs, newDeviceJSON(v.(android.Device)))
+			return nil
+		})
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, devs)
+	case http.MethodPost:
+		var in deviceJSON
+		if err := readJSON(w, r, &in); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		dev, err := in.toDevice()
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		err = dbutil.InsertSaveable(s.db, dev)
+		if errors.Is(err, dbutil.ErrKeyExists) {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("device %s already exists", dev.AndroidID))
+			return
+		} else if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, newDeviceJSON(dev))
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+// GET, PUT, DELETE /api/devices/{androidID}
+// GET /api/devices/{androidID}/subscriptions
+func (s *server) handleDevice(w http.ResponseWriter, r *http.Request) {
+	segments := pathSegments(r.URL.Path, "/api/devices/")
+	if len(segments) == 0 || len(segments) > 2 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("not found"))
+		return
+	}
+	androidID := segments[0]
+	if len(segments) == 2 {
+		if segments[1] != "subscriptions" {
+			writeError(w, http.StatusNotFound, fmt.Errorf("not found"))
+			return
+		}
+		s.handleDeviceSubscriptions(w, r, androidID)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		var dev android.Device
+		if err := dbutil.GetByKey(s.db, []byte(androidID), &dev); err != nil {
+			writeDBError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, newDeviceJSON(dev))
+	case http.MethodPut:
+		var in deviceJSON
+		if err := readJSON(w, r, &in); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		// android ID cannot be changed because it is the key
+		in.AndroidID = androidID
+		var dev android.Device
+		if err := s.db.Update(func(tx *bolt.Tx) error {
+			var existing android.Device
+			if err := dbutil.GetByKeyTx(tx, []byte(androidID), &existing); err != nil {
+				return err
+			}
+			var err error
+			dev, err = in.toDevice()
+			if err != nil {
+				return errBadRequest{err: err}
+			}
+			return dbutil.UpsertSaveableTx(tx, dev)
+		}); err != nil {
+			writeTxError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, newDeviceJSON(dev))
+	case http.MethodDelete:
+		if err := s.db.Update(func(tx *bolt.Tx) error {
+			var existing android.Device
+			if err := dbutil.GetByKeyTx(tx, []byte(androidID), &existing); err != nil {
+				return err
+			}
+			return dbutil.DeleteByTableKeyTx(tx, existing.DBTable(), existing.DBKey())
+		}); err != nil {
+			writeDBError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPut, http.MethodDelete)
+	}
+}
+
+// handleDeviceSubscriptions returns the SIMs of a device connected over ADB
+func (s *server) handleDeviceSubscriptions(w http.ResponseWriter, r *http.Request, androidID string) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	dev, err := adb.GetDeviceWithAndroidID(androidID)
+	if err != nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("ADB device %s: %s", androidID, err))
+		return
+	}
+	subs, err := dev.Subscriptions()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to read SIM subscriptions: %s", err))
+		return
+	}
+	subsJSON := make([]subscriptionJSON, 0, len(subs))
+	for _, sub := range subs {
+		subsJSON = append(subsJSON, subscriptionJSON{
+			ID:          sub.ID,
+			Slot:        sub.Slot,
+			DisplayName: sub.DisplayName,
+			CarrierName: sub.CarrierName,
+			Number:      sub.Number,
+		})
+	}
+	writeJSON(w, http.StatusOK, subsJSON)
+}
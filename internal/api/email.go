@@ -0,0 +1,362 @@
+package api
+
+import (
+	crand "crypto/rand"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	bolt "go.etcd.io/bbolt"
+
+	"go.angaros.io/internal/dbutil"
+	"go.angaros.io/internal/gateway/email"
+)
+
+// smtpAccountJSON is used for both requests and responses. The passwords and the OAuth2 secrets are never returned.
+type smtpAccountJSON struct {
+	ID                        string `json:"id"`
+	Mode                      string `json:"mode"`
+	HeloName                  string `json:"helo_name"`
+	Host                      string `json:"host"`
+	Port                      int    `json:"port"`
+	Username                  string `json:"username"`
+	Password                  string `json:"password,omitempty"`
+	AuthType                  string `json:"auth_type"`
+	ConnectionEncryption      string `json:"connection_encryption"`
+	TLSInsecureSkipVerify     bool   `json:"tls_insecure_skip_verify"`
+	LimitPerMinute            int    `json:"limit_per_minute"`
+	LimitPerHour              int    `json:"limit_per_hour"`
+	LimitPerDay               int    `json:"limit_per_day"`
+	ConnectionReuseCountLimit int    `json:"connection_reuse_count_limit"`
+	Proxy                     string `json:"proxy"`
+	ProxyUsername             string `json:"proxy_username"`
+	ProxyPassword             string `json:"proxy_password,omitempty"`
+
+	OAuth2TokenURL     string `json:"oauth2_token_url,omitempty"`
+	OAuth2ClientID     string `json:"oauth2_client_id,omitempty"`
+	OAuth2ClientSecret string `json:"oauth2_client_secret,omitempty"`
+	OAuth2RefreshToken string `json:"oauth2_refresh_token,omitempty"`
+}
+
+func newSMTPAccountJSON(a email.SMTPAccount) smtpAccountJSON {
+	return smtpAccountJSON{
+		ID:                        a.ID.String(),
+		Mode:                      a.Mode,
+		HeloName:                  a.HeloName,
+		Host:                      a.Host,
+		Port:                      a.Port,
+		Username:                  a.Username,
+		AuthType:                  a.AuthType,
+		ConnectionEncryption:      a.ConnectionEncryption,
+		TLSInsecureSkipVerify:     a.TLSInsecureSkipVerify,
+		LimitPerMinute:            a.LimitPerMinute,
+		LimitPerHour:              a.LimitPerHour,
+		LimitPerDay:               a.LimitPerDay,
+		ConnectionReuseCountLimit: a.ConnectionReuseCountLimit,
+		Proxy:                     a.Proxy,
+		ProxyUsername:             a.ProxyUsername,
+		OAuth2TokenURL:            a.OAuth2.TokenURL,
+		OAuth2ClientID:            a.OAuth2.ClientID,
+	}
+}
+
+func (in smtpAccountJSON) toSMTPAccount(id ulid.ULID) (email.SMTPAccount, error) {
+	a := email.SMTPAccount{
+		ID:                        id,
+		Mode:                      in.Mode,
+		HeloName:                  in.HeloName,
+		Host:                      in.Host,
+		Port:                      in.Port,
+		Username:                  in.Username,
+		Password:                  in.Password,
+		AuthType:                  in.AuthType,
+		ConnectionEncryption:      in.ConnectionEncryption,
+		TLSInsecureSkipVerify:     in.TLSInsecureSkipVerify,
+		LimitPerMinute:            in.LimitPerMinute,
+		LimitPerHour:              in.LimitPerHour,
+		LimitPerDay:               in.LimitPerDay,
+		ConnectionReuseCountLimit: in.ConnectionReuseCountLimit,
+		Proxy:                     in.Proxy,
+		ProxyUsername:             in.ProxyUsername,
+		ProxyPassword:             in.ProxyPassword,
+		OAuth2: email.OAuth2{
+			TokenURL:     in.OAuth2TokenURL,
+			ClientID:     in.OAuth2ClientID,
+			ClientSecret: in.OAuth2ClientSecret,
+		},
+	}
+	if err := a.Validate(); err != nil {
+		return email.SMTPAccount{}, fmt.Errorf("invalid SMTP account: %s", err)
+	}
+	return a, nil
+}
+
+type identityJSON struct {
+	Email  string `json:"email"`
+	Name   string `json:"name"`
+	SMTPID string `json:"smtp_id"`
+	// DKIM is configured with the CLI or the GUI, the DNS record is returned only in responses
+	DKIMRecordName string `json:"dkim_record_name,omitempty"`
+	DKIMRecord     string `json:"dkim_record,omitempty"`
+}
+
+func newIdentityJSON(id email.Identity) identityJSON {
+	idJSON := identityJSON{
+		Email: id.Email,
+		Name:  id.Name,
+	}
+	var smtpID ulid.ULID
+	if err := smtpID.UnmarshalBinary(id.SMTPKey); err == nil {
+		idJSON.SMTPID = smtpID.String()
+	}
+	if id.DKIM.Enabled() {
+		idJSON.DKIMRecordName = id.DKIM.RecordName(id.Email)
+		idJSON.DKIMRecord, _ = id.DKIM.Record()
+	}
+	return idJSON
+}
+
+// toIdentityTx checks that the SMTP account exists
+func (in identityJSON) toIdentityTx(tx *bolt.Tx) (email.Identity, error) {
+	if in.Email == "" {
+		return email.Identity{}, fmt.Errorf("email is empty")
+	}
+	id := email.Identity{
+		Email: in.Email,
+		Name:  in.Name,
+	}
+	if in.SMTPID != "" {
+		smtpID, err := ulid.ParseStrict(in.SMTPID)
+		if err != nil {
+			return email.Identity{}, fmt.Errorf("failed to parse SMTP ULID: %s", err)
+		}
+		var a email.SMTPAccount
+		err = dbutil.GetByKeyTx(tx, smtpID[:], &a)
+		if err != nil { // don't ignore dbutil.ErrNotFound
+			return email.Identity{}, fmt.Errorf("failed to read SMTP account %s: %s", smtpID, err)
+		}
+		id.SMTPKey = smtpID[:]
+	}
+	return id, nil
+}
+
+// GET, POST /api/smtp
+func (s *server) handleSMTPAccounts(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		accounts := make([]smtpAccountJSON, 0)
+		err := dbutil.ForEachReverse(s.db, &email.SMTPAccount{}, func(k []byte, v interface{}) error {
+			accounts = append(accounts, newSMTPAccountJSON(v.(email.SMTPAccount)))
+			return nil
+		})
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, accounts)
+	case http.MethodPost:
+		var in smtpAccountJSON
+		if err := readJSON(w, r, &in); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		id, err := ulid.New(ulid.Timestamp(time.Now()), crand.Reader)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("cannot create ID: %s", err))
+			return
+		}
+		a, err := in.toSMTPAccount(id)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := s.db.Update(func(tx *bolt.Tx) error {
+			if err := email.SaveSMTPAccountTx(tx, a, in.OAuth2RefreshToken); err != nil {
+				return errBadRequest{err: err}
+			}
+			return nil
+		}); err != nil {
+			writeTxError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, newSMTPAccountJSON(a))
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+// GET, PUT, DELETE /api/smtp/{id}
+func (s *server) handleSMTPAccount(w http.ResponseWriter, r *http.Request) {
+	segments := pathSegments(r.URL.Path, "/api/smtp/")
+	if len(segments) != 1 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("not found"))
+		return
+	}
+	id, err := ulid.ParseStrict(segments[0])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid SMTP account ID: %s", err))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		var a email.SMTPAccount
+		if err := dbutil.GetByKey(s.db, id[:], &a); err != nil {
+			writeDBError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, newSMTPAccountJSON(a))
+	case http.MethodPut:
+		var in smtpAccountJSON
+		if err := readJSON(w, r, &in); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		var a email.SMTPAccount
+		if err := s.db.Update(func(tx *bolt.Tx) error {
+			var existing email.SMTPAccount
+			if err := dbutil.GetByKeyTx(tx, id[:], &existing); err != nil {
+				return err
+			}
+			// keep existing passwords and OAuth2 client secret if not given
+			if in.Password == "" {
+				in.Password = existing.Password
+			}
+			if in.ProxyPassword == "" && in.ProxyUsername != "" {
+				in.ProxyPassword = existing.ProxyPassword
+			}
+			if in.OAuth2ClientSecret == "" {
+				in.OAuth2ClientSecret = existing.OAuth2.ClientSecret
+			}
+			var err error
+			a, err = in.toSMTPAccount(id)
+			if err != nil {
+				return errBadRequest{err: err}
+			}
+			if err := email.SaveSMTPAccountTx(tx, a, in.OAuth2RefreshToken); err != nil {
+				return errBadRequest{err: err}
+			}
+			return nil
+		}); err != nil {
+			writeTxError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, newSMTPAccountJSON(a))
+	case http.MethodDelete:
+		if err := s.db.Update(func(tx *bolt.Tx) error {
+			var existing email.SMTPAccount
+			if err := dbutil.GetByKeyTx(tx, id[:], &existing); err != nil {
+				return err
+			}
+			return email.DeleteSMTPAccountTx(tx, existing.ID)
+		}); err != nil {
+			writeDBError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPut, http.MethodDelete)
+	}
+}
+
+// GET, POST /api/identities
+func (s *server) handleIdentities(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		ids := make([]identityJSON, 0)
+		err := dbutil.ForEach(s.db, &email.Identity{}, func(k []byte, v interface{}) error {
+			ids = append(ids, newIdentityJSON(v.(email.Identity)))
+			return nil
+		})
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, ids)
+	case http.MethodPost:
+		var in identityJSON
+		if err := readJSON(w, r, &in); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		var id email.Identity
+		if err := s.db.Update(func(tx *bolt.Tx) error {
+			var err error
+			id, err = in.toIdentityTx(tx)
+			if err != nil {
+				return errBadRequest{err: err}
+			}
+			err = dbutil.InsertSaveableTx(tx, id)
+			if errors.Is(err, dbutil.ErrKeyExists) {
+				return errBadRequest{err: fmt.Errorf("email identity %s already exists", id.Email)}
+			}
+			return err
+		}); err != nil {
+			writeTxError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, newIdentityJSON(id))
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+// GET, PUT, DELETE /api/identities/{email}
+func (s *server) handleIdentity(w http.ResponseWriter, r *http.Request) {
+	segments := pathSegments(r.URL.Path, "/api/identities/")
+	if len(segments) != 1 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("not found"))
+		return
+	}
+	eml := segments[0]
+	switch r.Method {
+	case http.MethodGet:
+		var id email.Identity
+		if err := dbutil.GetByKey(s.db, []byte(eml), &id); err != nil {
+			writeDBError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, newIdentityJSON(id))
+	case http.MethodPut:
+		var in identityJSON
+		if err := readJSON(w, r, &in); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		// email cannot be changed because it is the key
+		in.Email = eml
+		var id email.Identity
+		if err := s.db.Update(func(tx *bolt.Tx) error {
+			var existing email.Identity
+			if err := dbutil.GetByKeyTx(tx, []byte(eml), &existing); err != nil {
+				return err
+			}
+			var err error
+			id, err = in.toIdentityTx(tx)
+			if err != nil {
+				return errBadRequest{err: err}
+			}
+			id.DKIM = existing.DKIM
+			return dbutil.UpsertSaveableTx(tx, id)
+		}); err != nil {
+			writeTxError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, newIdentityJSON(id))
+	case http.MethodDelete:
+		if err := s.db.Update(func(tx *bolt.Tx) error {
+			var existing email.Identity
+			if err := dbutil.GetByKeyTx(tx, []byte(eml), &existing); err != nil {
+				return err
+			}
+			return dbutil.DeleteByTableKeyTx(tx, existing.DBTable(), existing.DBKey())
+		}); err != nil {
+			writeDBError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPut, http.MethodDelete)
+	}
+}
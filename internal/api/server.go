@@ -0,0 +1,148 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"go.angaros.io/internal/dbutil"
+)
+
+type server struct {
+	db    *bolt.DB
+	token string
+	// attachmentDir is the directory of the per-contact attachments of broadcasts. Empty disables them
+	attachmentDir string
+	loggerDebug   *log.Logger
+}
+
+// NewHandler returns the handler of the HTTP API.
+// Every request must have the header 'Authorization: Bearer <token>'.
+// Per-contact attachments are read only from attachmentDir, which is set by the operator, and are disabled if it is empty.
+func NewHandler(db *bolt.DB, token string, attachmentDir string, loggerDebug *log.Logger) http.Handler {
+	s := &server{
+		db:            db,
+		token:         token,
+		attachmentDir: attachmentDir,
+		loggerDebug:   log.New(loggerDebug.Writer(), loggerDebug.Prefix()+"[api] ", loggerDebug.Flags()),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/broadcasts", s.handleBroadcasts)
+	mux.HandleFunc("/api/broadcasts/", s.handleBroadcast)
+	mux.HandleFunc("/api/smtp", s.handleSMTPAccounts)
+	mux.HandleFunc("/api/smtp/", s.handleSMTPAccount)
+	mux.HandleFunc("/api/identities", s.handleIdentities)
+	mux.HandleFunc("/api/identities/", s.handleIdentity)
+	mux.HandleFunc("/api/devices", s.handleDevices)
+	mux.HandleFunc("/api/devices/", s.handleDevice)
+	mux.HandleFunc("/api/suppression", s.handleSuppressionList)
+	mux.HandleFunc("/api/suppression/", s.handleSuppressionEntry)
+	mux.HandleFunc("/api/settings", s.handleSettings)
+	return s.authenticate(mux)
+}
+
+// ListenAndServe serves the HTTP API on addr until ctx is cancelled, see NewHandler
+func ListenAndServe(ctx context.Context, addr string, db *bolt.DB, attachmentDir string, loggerInfo *log.Logger, loggerDebug *log.Logger) error {
+	token, err := GetOrCreateToken(db)
+	if err != nil {
+		return fmt.Errorf("failed to read API token: %s", err)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %s", addr, err)
+	}
+	srv := &http.Server{
+		Handler:           NewHandler(db, token, attachmentDir, loggerDebug),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		ctxShutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctxShutdown); err != nil {
+			loggerInfo.Println("[api] shutdown failed:", err)
+		}
+	}()
+	loggerInfo.Printf("[api] listening on %s\n", ln.Addr())
+	err = srv.Serve(ln)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	// Serve returns when the shutdown starts, so wait for the requests in progress that use the database
+	<-shutdownDone
+	return nil
+}
+
+func (s *server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("missing bearer token"))
+			return
+		}
+		token := strings.TrimPrefix(header, "Bearer ")
+		if s.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("invalid or missing token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
+
+// writeDBError writes 404 if the error is dbutil.ErrNotFound, otherwise 500
+func writeDBError(w http.ResponseWriter, err error) {
+	if errors.Is(err, dbutil.ErrNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeError(w, http.StatusInternalServerError, err)
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("invalid JSON: %s", err)
+	}
+	return nil
+}
+
+// pathSegments returns the segments of the path after prefix
+func pathSegments(path, prefix string) []string {
+	rest := strings.Trim(strings.TrimPrefix(path, prefix), "/")
+	if rest == "" {
+		return nil
+	}
+	return strings.Split(rest, "/")
+}
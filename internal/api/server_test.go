@@ -0,0 +1,41 @@
+package api
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestAuthenticate(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	defer db.Close()
+	const token = "secret-token"
+	h := NewHandler(db, token, "", log.New(ioutil.Discard, "", 0))
+	for header, want := range map[string]int{
+		"Bearer " + token:       http.StatusOK,
+		"":                      http.StatusUnauthorized,
+		token:                   http.StatusUnauthorized,
+		"Basic " + token:        http.StatusUnauthorized,
+		"bearer " + token:       http.StatusUnauthorized,
+		"Bearer wrong-token":    http.StatusUnauthorized,
+		"Bearer " + token + "x": http.StatusUnauthorized,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/api/broadcasts", nil)
+		if header != "" {
+			r.Header.Set("Authorization", header)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("Authorization %q: status %d, want %d", header, w.Code, want)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"go.angaros.io/internal/broadcast"
+	"go.angaros.io/internal/dbutil"
+	"go.angaros.io/internal/gateway/email"
+	"go.angaros.io/internal/gateway/sms/android"
+	"go.angaros.io/internal/phone"
+	"go.angaros.io/internal/reply"
+	"go.angaros.io/internal/unsubscribe"
+)
+
+// settingsJSON is used for both requests and responses.
+// In requests, fields that are not given are left unchanged, and empty strings clear the setting.
+type settingsJSON struct {
+	SendHours              *string `json:"send_hours"`
+	Timezone               *string `json:"timezone"`
+	DefaultCountry         *string `json:"default_country"`
+	AndroidLimitPerMinute  *uint32 `json:"android_limit_per_minute"`
+	AndroidLimitPerHour    *uint32 `json:"android_limit_per_hour"`
+	AndroidLimitPerDay     *uint32 `json:"android_limit_per_day"`
+	ListUnsubscribeEnabled *bool   `json:"list_unsubscribe_enabled"`
+	ListUnsubscribeEmail   *string `json:"list_unsubscribe_email"`
+	ListUnsubscribeURL     *string `json:"list_unsubscribe_url"`
+	// hours after a message was sent that an SMS from the contact is a reply, 0 disables reply collection
+	ReplyWindowHours *int `json:"reply_window_hours"`
+	// replies that add the contact to the suppression list
+	OptOutKeywords *[]string `json:"opt_out_keywords"`
+}
+
+func readSettingsTx(tx *bolt.Tx) (settingsJSON, error) {
+	var (
+		sendHours              broadcast.SettingSendHours
+		timezone               broadcast.SettingTimezone
+		defaultCountry         broadcast.SettingDefaultCountry
+		limitPerMinute         android.SettingLimitPerMinute
+		limitPerHour           android.SettingLimitPerHour
+		limitPerDay            android.SettingLimitPerDay
+		listUnsubscribeEnabled email.SettingListUnsubscribeEnabled
+		listUnsubscribeEmail   email.Identity
+		listUnsubscribeURL     email.SettingListUnsubscribeURL
+	)
+	for _, setting := range []dbutil.Saveable{&sendHours, &timezone, &defaultCountry, &limitPerMinute, &limitPerHour, &limitPerDay, &listUnsubscribeEnabled, &listUnsubscribeURL} {
+		err := dbutil.GetByKeyTx(tx, setting.DBKey(), setting)
+		if err != nil && !errors.Is(err, dbutil.ErrNotFound) {
+			return settingsJSON{}, fmt.Errorf("failed to read setting %s from database: %s", setting.DBKey(), err)
+		}
+	}
+	if err := email.DBGetSettingListUnsubscribeEmailIdentity(tx, &listUnsubscribeEmail); err != nil {
+		return settingsJSON{}, err
+	}
+	replies, err := reply.GetSettingTx(tx)
+	if err != nil {
+		return settingsJSON{}, err
+	}
+	optOutKeywords := append([]string{}, replies.OptOutKeywords...)
+	sendHoursStr := sendHours.String()
+	timezoneStr := string(timezone)
+	defaultCountryStr := string(defaultCountry)
+	limitPerMinuteInt := uint32(limitPerMinute)
+	limitPerHourInt := uint32(limitPerHour)
+	limitPerDayInt := uint32(limitPerDay)
+	listUnsubscribeEnabledBool := bool(listUnsubscribeEnabled)
+	listUnsubscribeURLStr := string(listUnsubscribeURL)
+	return settingsJSON{
+		SendHours:              &sendHoursStr,
+		Timezone:               &timezoneStr,
+		DefaultCountry:         &defaultCountryStr,
+		AndroidLimitPerMinute:  &limitPerMinuteInt,
+		AndroidLimitPerHour:    &limitPerHourInt,
+		AndroidLimitPerDay:     &limitPerDayInt,
+		ListUnsubscribeEnabled: &listUnsubscribeEnabledBool,
+		ListUnsubscribeEmail:   &listUnsubscribeEmail.Email,
+		ListUnsubscribeURL:     &listUnsubscribeURLStr,
+		ReplyWindowHours:       &replies.WindowHours,
+		OptOutKeywords:         &optOutKeywords,
+	}, nil
+}
+
+// saveTx validates and saves the settings that are set
+func (in settingsJSON) saveTx(tx *bolt.Tx) error {
+	settings := make([]dbutil.Saveable, 0)
+	if in.SendHours != nil {
+		sendHours := []broadcast.TimeRange{}
+		if strings.TrimSpace(*in.SendHours) != "" {
+			var err error
+			sendHours, err = broadcast.ParseTimeRanges(*in.SendHours)
+			if err != nil {
+				return errBadRequest{err: fmt.Errorf("invalid send hours: %s", err)}
+			}
+		}
+		settings = append(settings, broadcast.SettingSendHours(sendHours))
+	}
+	if in.Timezone != nil {
+		if _, err := time.LoadLocation(*in.Timezone); err != nil {
+			return errBadRequest{err: fmt.Errorf("invalid timezone: %s", err)}
+		}
+		settings = append(settings, broadcast.SettingTimezone(*in.Timezone))
+	}
+	if in.DefaultCountry != nil {
+		country := strings.ToUpper(*in.DefaultCountry)
+		if _, ok := phone.CallingCode(country); !ok && country != "" {
+			return errBadRequest{err: fmt.Errorf("invalid default country %s: expected an ISO 3166-1 alpha-2 code", *in.DefaultCountry)}
+		}
+		settings = append(settings, broadcast.SettingDefaultCountry(country))
+	}
+	if in.AndroidLimitPerMinute != nil {
+		settings = append(settings, android.SettingLimitPerMinute(*in.AndroidLimitPerMinute))
+	}
+	if in.AndroidLimitPerHour != nil {
+		settings = append(settings, android.SettingLimitPerHour(*in.AndroidLimitPerHour))
+	}
+	if in.AndroidLimitPerDay != nil {
+		settings = append(settings, android.SettingLimitPerDay(*in.AndroidLimitPerDay))
+	}
+	if in.ListUnsubscribeEnabled != nil {
+		settings = append(settings, email.SettingListUnsubscribeEnabled(*in.ListUnsubscribeEnabled))
+	}
+	if in.ListUnsubscribeEmail != nil {
+		if *in.ListUnsubscribeEmail == "" {
+			var s email.SettingListUnsubscribeEmailKey
+			if err := dbutil.DeleteByTableKeyTx(tx, s.DBTable(), s.DBKey()); err != nil && !errors.Is(err, dbutil.ErrNotFound) {
+				return err
+			}
+		} else {
+			var id email.Identity
+			if err := dbutil.GetByKeyTx(tx, []byte(*in.ListUnsubscribeEmail), &id); err != nil {
+				return errBadRequest{err: fmt.Errorf("failed to read email identity %s: %s", *in.ListUnsubscribeEmail, err)}
+			}
+			settings = append(settings, email.SettingListUnsubscribeEmailKey(id.DBKey()))
+		}
+	}
+	if in.ListUnsubscribeURL != nil {
+		u := strings.TrimSpace(*in.ListUnsubscribeURL)
+		if u != "" {
+			if err := unsubscribe.ValidateBaseURL(u); err != nil {
+				return errBadRequest{err: err}
+			}
+		}
+		settings = append(settings, email.SettingListUnsubscribeURL(u))
+	}
+	if in.ReplyWindowHours != nil || in.OptOutKeywords != nil {
+		replies, err := reply.GetSettingTx(tx)
+		if err != nil {
+			return err
+		}
+		if in.ReplyWindowHours != nil {
+			replies.WindowHours = *in.ReplyWindowHours
+		}
+		if in.OptOutKeywords != nil {
+			replies.OptOutKeywords = *in.OptOutKeywords
+		}
+		if err := replies.Validate(); err != nil {
+			return errBadRequest{err: err}
+		}
+		settings = append(settings, replies)
+	}
+	for _, setting := range settings {
+		if err := dbutil.UpsertSaveableTx(tx, setting); err != nil {
+			return fmt.Errorf("failed to save setting %s: %s", setting.DBKey(), err)
+		}
+	}
+	return nil
+}
+
+// GET, PUT /api/settings
+func (s *server) handleSettings(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		var settings settingsJSON
+		if err := s.db.View(func(tx *bolt.Tx) error {
+			var err error
+			settings, err = readSettingsTx(tx)
+			return err
+		}); err != nil {
+			writeDBError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, settings)
+	case http.MethodPut:
+		var in settingsJSON
+		if err := readJSON(w, r, &in); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		var settings settingsJSON
+		if err := s.db.Update(func(tx *bolt.Tx) error {
+			if err := in.saveTx(tx); err != nil {
+				return err
+			}
+			var err error
+			settings, err = readSettingsTx(tx)
+			return err
+		}); err != nil {
+			writeTxError(w, err)
+			return
+		}
+		broadcast.Wake()
+		writeJSON(w, http.StatusOK, settings)
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPut)
+	}
+}
@@ -0,0 +1,110 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"go.angaros.io/internal/dbutil"
+	"go.angaros.io/internal/suppression"
+)
+
+type suppressionJSON struct {
+	Recipient string    `json:"recipient"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newSuppressionJSON(e suppression.Entry) suppressionJSON {
+	return suppressionJSON{
+		Recipient: e.Recipient,
+		Reason:    e.Reason,
+		CreatedAt: e.CreatedAt,
+	}
+}
+
+// GET, POST /api/suppression
+func (s *server) handleSuppressionList(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		entries := make([]suppressionJSON, 0)
+		err := dbutil.ForEach(s.db, &suppression.Entry{}, func(k []byte, v interface{}) error {
+			entries = append(entries, newSuppressionJSON(v.(suppression.Entry)))
+			return nil
+		})
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, entries)
+	case http.MethodPost:
+		var in suppressionJSON
+		if err := readJSON(w, r, &in); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if in.Reason == "" {
+			in.Reason = suppression.ReasonManual
+		}
+		e, err := suppression.New(in.Recipient, in.Reason)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := s.db.Update(func(tx *bolt.Tx) error {
+			added, err := suppression.AddTx(tx, e)
+			if err != nil {
+				return err
+			}
+			if !added {
+				return errBadRequest{err: fmt.Errorf("recipient %s is already suppressed", e.Recipient)}
+			}
+			return nil
+		}); err != nil {
+			writeTxError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, newSuppressionJSON(e))
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+// GET, DELETE /api/suppression/{recipient}
+func (s *server) handleSuppressionEntry(w http.ResponseWriter, r *http.Request) {
+	segments := pathSegments(r.URL.Path, "/api/suppression/")
+	if len(segments) != 1 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("not found"))
+		return
+	}
+	recipient := segments[0]
+	switch r.Method {
+	case http.MethodGet:
+		var e suppression.Entry
+		if err := s.db.View(func(tx *bolt.Tx) error {
+			var err error
+			e, err = suppression.GetTx(tx, recipient)
+			return err
+		}); err != nil {
+			writeDBError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, newSuppressionJSON(e))
+	case http.MethodDelete:
+		if err := s.db.Update(func(tx *bolt.Tx) error {
+			e, err := suppression.GetTx(tx, recipient)
+			if err != nil {
+				return err
+			}
+			return dbutil.DeleteByTableKeyTx(tx, e.DBTable(), e.DBKey())
+		}); err != nil {
+			writeDBError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodDelete)
+	}
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	crand "crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+
+	"go.angaros.io/internal/dbutil"
+)
+
+type SettingToken string
+
+func (t SettingToken) DBTable() string {
+	return "settings"
+}
+
+func (t SettingToken) DBKey() []byte {
+	return []byte("api.token")
+}
+
+// GetOrCreateToken returns the API token, generating a new one if it does not exist
+func GetOrCreateToken(db *bolt.DB) (string, error) {
+	var token SettingToken
+	if err := db.Update(func(tx *bolt.Tx) error {
+		err := dbutil.GetByKeyTx(tx, token.DBKey(), &token)
+		if err != nil && !errors.Is(err, dbutil.ErrNotFound) {
+			return fmt.Errorf("failed to read API token from database: %s", err)
+		}
+		if token != "" {
+			return nil
+		}
+		token, err = newToken()
+		if err != nil {
+			return err
+		}
+		return dbutil.UpsertSaveableTx(tx, token)
+	}); err != nil {
+		return "", err
+	}
+	return string(token), nil
+}
+
+// RegenerateToken replaces the API token with a new one
+func RegenerateToken(db *bolt.DB) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	if err := dbutil.UpsertSaveable(db, token); err != nil {
+		return "", fmt.Errorf("failed to save API token to database: %s", err)
+	}
+	return string(token), nil
+}
+
+func newToken() (SettingToken, error) {
+	var b [32]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("random number generator failed: %s", err)
+	}
+	return SettingToken(base64.RawURLEncoding.EncodeToString(b[:])), nil
+}
@@ -0,0 +1,163 @@
+package bounce
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	bolt "go.etcd.io/bbolt"
+
+	"go.angaros.io/internal/dbutil"
+)
+
+// processIMAP calls handle for each message of the folder with a UID greater than the last one processed.
+// The bounces are deleted if m.DeleteBounces is set.
+func processIMAP(ctx context.Context, db *bolt.DB, m SettingMailbox, handle handleFunc) error {
+	tlsConfig := &tls.Config{ServerName: m.Host}
+	dialer := net.Dialer{Timeout: 30 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", m.Addr())
+	if err != nil {
+		return fmt.Errorf("IMAP dial failed: %s", err)
+	}
+	if m.ConnectionEncryption == "TLS" {
+		tlsConn := tls.Client(conn, tlsConfig)
+		_ = tlsConn.SetDeadline(time.Now().Add(30 * time.Second))
+		if err := tlsConn.Handshake(); err != nil {
+			_ = conn.Close()
+			return fmt.Errorf("IMAP TLS handshake failed: %s", err)
+		}
+		_ = tlsConn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
+	c, err := client.New(conn)
+	if err != nil {
+		_ = conn.Close()
+		return fmt.Errorf("IMAP greeting failed: %s", err)
+	}
+	c.Timeout = 60 * time.Second
+	stop := closeOnDone(ctx, conn)
+	defer stop()
+	defer func() {
+		_ = c.Logout()
+	}()
+
+	if m.ConnectionEncryption == "STARTTLS" {
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("IMAP STARTTLS failed: %s", err)
+		}
+	}
+	if err := c.Login(m.Username, m.Password); err != nil {
+		return fmt.Errorf("IMAP login failed: %s", err)
+	}
+	status, err := c.Select(m.folder(), false)
+	if err != nil {
+		return fmt.Errorf("IMAP select %s failed: %s", m.folder(), err)
+	}
+
+	var state imapState
+	if err := dbutil.GetByKey(db, state.DBKey(), &state); err != nil && !errors.Is(err, dbutil.ErrNotFound) {
+		return fmt.Errorf("failed to read IMAP state from database: %s", err)
+	}
+	if state.UIDValidity != status.UidValidity {
+		// the UIDs were reassigned, so all messages are processed again
+		state = imapState{UIDValidity: status.UidValidity}
+	}
+
+	criteria := imap.NewSearchCriteria()
+	criteria.Uid = new(imap.SeqSet)
+	criteria.Uid.AddRange(state.LastUID+1, 0)
+	uids, err := c.UidSearch(criteria)
+	if err != nil {
+		return fmt.Errorf("IMAP search failed: %s", err)
+	}
+	newUIDs := new(imap.SeqSet)
+	var count int
+	for _, uid := range uids {
+		// the range n:* includes the last message even if its UID is less than n
+		if uid > state.LastUID && count < maxMessagesPerRun {
+			newUIDs.AddNum(uid)
+			count++
+		}
+	}
+	if newUIDs.Empty() {
+		return nil
+	}
+
+	section := &imap.BodySectionName{Peek: true}
+	messages := make(chan *imap.Message, 10)
+	fetchDone := make(chan error, 1)
+	go func() {
+		fetchDone <- c.UidFetch(newUIDs, []imap.FetchItem{imap.FetchUid, section.FetchItem()}, messages)
+	}()
+	bounceUIDs := new(imap.SeqSet)
+	var handleErr error
+	for msg := range messages {
+		if handleErr != nil {
+			continue // drain the channel
+		}
+		body := msg.GetBody(section)
+		if body == nil {
+			continue
+		}
+		raw, err := ioutil.ReadAll(body)
+		if err != nil {
+			handleErr = err
+			continue
+		}
+		isBounce, err := handle(raw)
+		if err != nil {
+			handleErr = err
+			continue
+		}
+		if isBounce {
+			bounceUIDs.AddNum(msg.Uid)
+		}
+		if msg.Uid > state.LastUID {
+			state.LastUID = msg.Uid
+		}
+	}
+	fetchErr := <-fetchDone
+	// save the position even on error, so the processed messages are not fetched again
+	if err := dbutil.UpsertSaveable(db, state); err != nil {
+		return fmt.Errorf("failed to save IMAP state: %s", err)
+	}
+	if handleErr != nil {
+		return handleErr
+	}
+	if fetchErr != nil {
+		return fmt.Errorf("IMAP fetch failed: %s", fetchErr)
+	}
+
+	if m.DeleteBounces && !bounceUIDs.Empty() {
+		item := imap.FormatFlagsOp(imap.AddFlags, true)
+		if err := c.UidStore(bounceUIDs, item, []interface{}{imap.DeletedFlag}, nil); err != nil {
+			return fmt.Errorf("IMAP store failed: %s", err)
+		}
+		if err := c.Expunge(nil); err != nil {
+			return fmt.Errorf("IMAP expunge failed: %s", err)
+		}
+	}
+	return nil
+}
+
+// closeOnDone closes conn when ctx is cancelled, to interrupt clients that don't support contexts.
+// The returned function must be called when conn is no longer used.
+func closeOnDone(ctx context.Context, conn net.Conn) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
@@ -0,0 +1,124 @@
+package bounce
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	bolt "go.etcd.io/bbolt"
+
+	"go.angaros.io/internal/dbutil"
+)
+
+// Protocols are the supported values of SettingMailbox.Protocol
+var Protocols = []string{"IMAP", "POP3"}
+
+// SettingMailbox is the mailbox that receives the bounces, i.e. the mailbox of the email identities
+// because their address is the envelope sender. An empty host disables bounce processing.
+type SettingMailbox struct {
+	Protocol             string // IMAP or POP3
+	Host                 string
+	Port                 uint16 // 0 means the default port of the protocol and encryption
+	ConnectionEncryption string // TLS, STARTTLS or INSECURE
+	Username             string
+	Password             string
+	Folder               string // IMAP only, default INBOX
+
+	DeleteBounces       bool // delete the bounces that were processed, other messages are left untouched
+	SuppressHardBounces bool // add recipients with a hard bounce to the suppression list
+}
+
+func (m SettingMailbox) DBTable() string {
+	return "settings"
+}
+
+func (m SettingMailbox) DBKey() []byte {
+	return []byte("bounce.mailbox")
+}
+
+func (m SettingMailbox) Enabled() bool {
+	return m.Host != ""
+}
+
+func (m SettingMailbox) Validate() error {
+	switch m.Protocol {
+	case "IMAP", "POP3":
+	default:
+		return fmt.Errorf("invalid protocol value: %v", m.Protocol)
+	}
+	if m.Host == "" {
+		return fmt.Errorf("host is empty")
+	}
+	switch m.ConnectionEncryption {
+	case "TLS", "STARTTLS", "INSECURE":
+	default:
+		return fmt.Errorf("invalid connection encryption value: %v", m.ConnectionEncryption)
+	}
+	if m.Username == "" {
+		return fmt.Errorf("username is empty")
+	}
+	return nil
+}
+
+// Addr returns the address of the server, with the default port if none is set
+func (m SettingMailbox) Addr() string {
+	port := m.Port
+	if port == 0 {
+		switch {
+		case m.Protocol == "IMAP" && m.ConnectionEncryption == "TLS":
+			port = 993
+		case m.Protocol == "IMAP":
+			port = 143
+		case m.ConnectionEncryption == "TLS":
+			port = 995
+		default:
+			port = 110
+		}
+	}
+	return net.JoinHostPort(m.Host, strconv.Itoa(int(port)))
+}
+
+func (m SettingMailbox) folder() string {
+	if m.Folder == "" {
+		return "INBOX"
+	}
+	return m.Folder
+}
+
+// GetMailboxTx returns the mailbox setting, which is disabled if it is not set
+func GetMailboxTx(tx *bolt.Tx) (SettingMailbox, error) {
+	var m SettingMailbox
+	err := dbutil.GetByKeyTx(tx, m.DBKey(), &m)
+	if err != nil && !errors.Is(err, dbutil.ErrNotFound) {
+		return m, fmt.Errorf("failed to read setting bounce mailbox from database: %s", err)
+	}
+	return m, nil
+}
+
+// imapState is the position in the IMAP folder, so that messages are only fetched once
+type imapState struct {
+	UIDValidity uint32
+	LastUID     uint32
+}
+
+func (s imapState) DBTable() string {
+	return "settings"
+}
+
+func (s imapState) DBKey() []byte {
+	return []byte("bounce.imap_state")
+}
+
+// pop3Seen is a message of the POP3 mailbox that was already processed, keyed by its unique-id listing (UIDL)
+type pop3Seen struct {
+	UIDL string
+}
+
+func (s pop3Seen) DBTable() string {
+	return "bounce.pop3_seen"
+}
+
+func (s pop3Seen) DBKey() []byte {
+	return []byte(s.UIDL)
+}
@@ -0,0 +1,229 @@
+package bounce
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+
+	"github.com/emersion/go-message"
+)
+
+// Bounce is a delivery failure reported for a recipient
+type Bounce struct {
+	Recipient  string
+	Status     string // enhanced status code (RFC 3463) e.g. 5.1.1, empty if unknown
+	Diagnostic string
+	Hard       bool   // permanent failure
+	MessageID  string // Message-ID of the bounced message without angle brackets, empty if unknown
+}
+
+func (b Bounce) String() string {
+	return strings.TrimSpace(b.Status + " " + b.Diagnostic)
+}
+
+// maxTextSize is the size of the human readable part used to parse non-standard bounces
+const maxTextSize = 64 << 10
+
+var (
+	// bounceSubject matches the subjects of non-standard bounces, e.g. from qmail, Exim or Exchange
+	bounceSubject = regexp.MustCompile(`(?i)undeliver|delivery (status notification|failure|has failed|failed)|returned mail|failure notice|mail delivery failed|could not be delivered`)
+	// bounceSender matches the local part of the sender of bounces
+	bounceSender     = regexp.MustCompile(`(?i)^(mailer-daemon|postmaster|mail-daemon|mailerdaemon)$`)
+	enhancedStatus   = regexp.MustCompile(`\b([245])\.(\d{1,3})\.(\d{1,3})\b`)
+	smtpReplyCode    = regexp.MustCompile(`\b([45]\d\d)[ -]`)
+	emailAddress     = regexp.MustCompile(`[A-Za-z0-9.!#$%&'*+/=?^_{|}~-]+@[A-Za-z0-9](?:[A-Za-z0-9-]*[A-Za-z0-9])?(?:\.[A-Za-z0-9](?:[A-Za-z0-9-]*[A-Za-z0-9])?)+`)
+	quotedMessageID  = regexp.MustCompile(`(?im)^\s*message-id:\s*<?([^>\s]+)>?`)
+	originalMessage  = regexp.MustCompile(`(?im)^(-+ ?(this is a copy|original message|below this line|the header of the original)|received: |return-path: )`)
+	permanentFailure = regexp.MustCompile(`(?i)permanent (error|failure)|does not exist|user unknown|no such user|address rejected`)
+)
+
+// Parse returns the bounces reported by a message, or nil if the message is not a bounce.
+// Delivery status notifications (RFC 3464) are parsed first. Other messages are recognized by their
+// sender or subject, and the recipient and status are searched in the text.
+func Parse(r io.Reader) ([]Bounce, error) {
+	e, err := message.Read(r)
+	if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+		return nil, err
+	}
+	subject := e.Header.Get("Subject")
+	from := e.Header.Get("From")
+	var bounces []Bounce
+	var messageID string
+	var text []byte
+	err = e.Walk(func(path []int, part *message.Entity, err error) error {
+		if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+			return err
+		}
+		mediaType, _, _ := part.Header.ContentType()
+		switch mediaType {
+		case "message/delivery-status", "message/global-delivery-status":
+			bounces, err = parseDeliveryStatus(part.Body)
+			return err
+		case "message/rfc822", "message/global", "text/rfc822-headers", "message/rfc822-headers", "message/global-headers":
+			messageID = readMessageID(part.Body)
+		case "text/plain", "":
+			if text == nil {
+				text, err = ioutil.ReadAll(io.LimitReader(part.Body, maxTextSize))
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if bounces == nil {
+		if !isNonStandardBounce(from, subject) {
+			return nil, nil
+		}
+		b, ok := parseText(string(text), from)
+		if !ok {
+			return nil, nil
+		}
+		bounces = []Bounce{b}
+	}
+	if messageID == "" {
+		if m := quotedMessageID.FindStringSubmatch(string(text)); m != nil {
+			messageID = m[1]
+		}
+	}
+	for i := range bounces {
+		bounces[i].MessageID = messageID
+	}
+	return bounces, nil
+}
+
+// parseDeliveryStatus parses the per-recipient fields of a delivery status notification (RFC 3464 section 2.3).
+// Recipients that were delivered, relayed or are only delayed are skipped.
+func parseDeliveryStatus(r io.Reader) ([]Bounce, error) {
+	tr := textproto.NewReader(bufio.NewReader(r))
+	bounces := make([]Bounce, 0)
+	// the first group has the per-message fields
+	if _, err := tr.ReadMIMEHeader(); err != nil {
+		if errors.Is(err, io.EOF) {
+			return bounces, nil
+		}
+		return nil, err
+	}
+	for {
+		fields, err := tr.ReadMIMEHeader()
+		if len(fields) > 0 {
+			if b, ok := deliveryStatusBounce(fields); ok {
+				bounces = append(bounces, b)
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return bounces, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func deliveryStatusBounce(fields textproto.MIMEHeader) (Bounce, bool) {
+	if !strings.EqualFold(strings.TrimSpace(fields.Get("Action")), "failed") {
+		return Bounce{}, false
+	}
+	recipient := addressField(fields.Get("Original-Recipient"))
+	if recipient == "" {
+		recipient = addressField(fields.Get("Final-Recipient"))
+	}
+	if recipient == "" {
+		return Bounce{}, false
+	}
+	status := strings.Fields(fields.Get("Status"))
+	b := Bounce{
+		Recipient:  recipient,
+		Diagnostic: addressField(fields.Get("Diagnostic-Code")),
+		Hard:       true, // the action is failed
+	}
+	if len(status) > 0 {
+		b.Status = status[0]
+		b.Hard = !strings.HasPrefix(b.Status, "4")
+	}
+	return b, true
+}
+
+// addressField returns the value of a typed field e.g. "rfc822; someone@example.com" without the type
+func addressField(value string) string {
+	value = strings.TrimSpace(value)
+	if i := strings.Index(value, ";"); i >= 0 {
+		value = strings.TrimSpace(value[i+1:])
+	}
+	return strings.Trim(value, "<>")
+}
+
+// readMessageID reads the Message-ID of the original message, included as a message or its header
+func readMessageID(r io.Reader) string {
+	header, err := textproto.NewReader(bufio.NewReader(io.LimitReader(r, maxTextSize))).ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return ""
+	}
+	return strings.Trim(strings.TrimSpace(header.Get("Message-Id")), "<>")
+}
+
+func isNonStandardBounce(from, subject string) bool {
+	if addr, err := mail.ParseAddress(from); err == nil {
+		if bounceSender.MatchString(addr.Address[:strings.LastIndex(addr.Address, "@")]) {
+			return true
+		}
+	}
+	return bounceSubject.MatchString(subject)
+}
+
+// parseText searches the recipient and the status in the text of a non-standard bounce,
+// before the copy of the original message
+func parseText(text, from string) (Bounce, bool) {
+	if loc := originalMessage.FindStringIndex(text); loc != nil {
+		text = text[:loc[0]]
+	}
+	var sender string
+	if addr, err := mail.ParseAddress(from); err == nil {
+		sender = strings.ToLower(addr.Address)
+	}
+	var recipient string
+	for _, addr := range emailAddress.FindAllString(text, -1) {
+		addr = strings.TrimRight(addr, ".")
+		local := addr[:strings.LastIndex(addr, "@")]
+		if strings.ToLower(addr) == sender || bounceSender.MatchString(local) {
+			continue
+		}
+		recipient = addr
+		break
+	}
+	if recipient == "" {
+		return Bounce{}, false
+	}
+	b := Bounce{Recipient: recipient}
+	if m := enhancedStatus.FindString(text); m != "" && !strings.HasPrefix(m, "2") {
+		b.Status = m
+		b.Hard = strings.HasPrefix(m, "5")
+	} else if m := smtpReplyCode.FindStringSubmatch(text); m != nil {
+		b.Hard = strings.HasPrefix(m[1], "5")
+	} else {
+		b.Hard = permanentFailure.MatchString(text)
+	}
+	b.Diagnostic = diagnosticLine(text, b.Status)
+	return b, true
+}
+
+// diagnosticLine returns the line with the status code or the SMTP reply, if any
+func diagnosticLine(text, status string) string {
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if (status != "" && strings.Contains(line, status)) || (status == "" && smtpReplyCode.MatchString(line)) {
+			line = strings.Join(strings.Fields(strings.Replace(line, status, "", 1)), " ")
+			if len(line) > 200 {
+				line = line[:200]
+			}
+			return line
+		}
+	}
+	return ""
+}
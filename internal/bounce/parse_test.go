@@ -0,0 +1,210 @@
+package bounce
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// crlf converts the line endings of a sample message to CRLF, like the messages of a mailbox
+func crlf(s string) string {
+	return strings.ReplaceAll(strings.TrimPrefix(s, "\n"), "\n", "\r\n")
+}
+
+var sampleDSN = crlf(`
+From: Mail Delivery System <MAILER-DAEMON@mx.example.net>
+To: sender@example.com
+Subject: Undelivered Mail Returned to Sender
+MIME-Version: 1.0
+Content-Type: multipart/report; report-type=delivery-status; boundary="BOUNDARY"
+
+--BOUNDARY
+Content-Description: Notification
+Content-Type: text/plain; charset=us-ascii
+
+This is the mail system at host mx.example.net.
+
+I'm sorry to have to inform you that your message could not
+be delivered to one or more recipients.
+
+--BOUNDARY
+Content-Description: Delivery report
+Content-Type: message/delivery-status
+
+Reporting-MTA: dns; mx.example.net
+Arrival-Date: Mon, 10 Jan 2022 10:00:00 +0000
+
+Final-Recipient: rfc822; nobody@example.net
+Original-Recipient: rfc822;Nobody@example.net
+Action: failed
+Status: 5.1.1
+Diagnostic-Code: smtp; 550 5.1.1 <nobody@example.net>: Recipient address rejected: User unknown
+
+Final-Recipient: rfc822; full@example.net
+Action: failed
+Status: 4.2.2
+Diagnostic-Code: smtp; 452 4.2.2 Mailbox full
+
+Final-Recipient: rfc822; slow@example.net
+Action: delayed
+Status: 4.4.1
+
+Final-Recipient: rfc822; ok@example.net
+Action: relayed
+Status: 2.0.0
+
+--BOUNDARY
+Content-Description: Undelivered Message Headers
+Content-Type: text/rfc822-headers
+
+From: sender@example.com
+To: nobody@example.net
+Subject: Hello
+Message-ID: <ABCDEFGHIJKLMNOP@example.com>
+
+--BOUNDARY--
+`)
+
+var sampleDSNWithMessage = crlf(`
+From: postmaster@mail.example.org
+To: sender@example.com
+Subject: Delivery Status Notification (Failure)
+MIME-Version: 1.0
+Content-Type: multipart/report; report-type=delivery-status; boundary="b1"
+
+--b1
+Content-Type: text/plain
+
+Delivery to the following recipient failed permanently.
+
+--b1
+Content-Type: message/delivery-status
+
+Reporting-MTA: dns; mail.example.org
+
+Final-Recipient: rfc822; <gone@example.org>
+Action: failed
+Status: 5.2.1
+
+--b1
+Content-Type: message/rfc822
+
+From: sender@example.com
+To: gone@example.org
+Message-Id: <QRSTUVWXYZ234567@example.com>
+Subject: Hello
+
+Hello there
+--b1--
+`)
+
+var sampleQmail = crlf(`
+From: MAILER-DAEMON@qmail.example.net
+To: sender@example.com
+Subject: failure notice
+
+Hi. This is the qmail-send program at qmail.example.net.
+I'm afraid I wasn't able to deliver your message to the following addresses.
+This is a permanent error; I've given up. Sorry it didn't work out.
+
+<someone@example.net>:
+192.0.2.1 does not like recipient.
+Remote host said: 550 5.1.1 No such user here
+Giving up on 192.0.2.1.
+
+--- Below this line is a copy of the message.
+
+Return-Path: <sender@example.com>
+Message-ID: <ZZZZZZZZZZZZZZZZ@example.com>
+To: someone@example.net
+`)
+
+var sampleNotBounce = crlf(`
+From: Alice <alice@example.com>
+To: sender@example.com
+Subject: Re: Hello
+
+Thanks, I got your message.
+`)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		want    []Bounce
+	}{
+		{
+			name:    "DSN with headers of the original message",
+			message: sampleDSN,
+			want: []Bounce{
+				{
+					Recipient:  "Nobody@example.net",
+					Status:     "5.1.1",
+					Diagnostic: "550 5.1.1 <nobody@example.net>: Recipient address rejected: User unknown",
+					Hard:       true,
+					MessageID:  "ABCDEFGHIJKLMNOP@example.com",
+				},
+				{
+					Recipient:  "full@example.net",
+					Status:     "4.2.2",
+					Diagnostic: "452 4.2.2 Mailbox full",
+					Hard:       false,
+					MessageID:  "ABCDEFGHIJKLMNOP@example.com",
+				},
+			},
+		},
+		{
+			name:    "DSN with the original message",
+			message: sampleDSNWithMessage,
+			want: []Bounce{
+				{
+					Recipient: "gone@example.org",
+					Status:    "5.2.1",
+					Hard:      true,
+					MessageID: "QRSTUVWXYZ234567@example.com",
+				},
+			},
+		},
+		{
+			name:    "qmail bounce",
+			message: sampleQmail,
+			want: []Bounce{
+				{
+					Recipient:  "someone@example.net",
+					Status:     "5.1.1",
+					Diagnostic: "Remote host said: 550 No such user here",
+					Hard:       true,
+					MessageID:  "ZZZZZZZZZZZZZZZZ@example.com",
+				},
+			},
+		},
+		{
+			name:    "not a bounce",
+			message: sampleNotBounce,
+			want:    nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(strings.NewReader(tt.message))
+			if err != nil {
+				t.Fatalf("Parse() failed: %s", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDSNWithoutFailures(t *testing.T) {
+	// a delay notification is a report but not a bounce
+	message := strings.Replace(sampleDSNWithMessage, "Action: failed", "Action: delayed", 1)
+	got, err := Parse(strings.NewReader(message))
+	if err != nil {
+		t.Fatalf("Parse() failed: %s", err)
+	}
+	if len(got) != 0 {
+		t.Errorf("Parse() = %+v, want no bounces", got)
+	}
+}
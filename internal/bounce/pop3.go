@@ -0,0 +1,204 @@
+package bounce
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"go.angaros.io/internal/dbutil"
+)
+
+// pop3Client is a minimal POP3 client (RFC 1939) with the UIDL and STLS extensions
+type pop3Client struct {
+	conn net.Conn
+	text *textproto.Conn
+}
+
+func newPOP3Client(conn net.Conn) (*pop3Client, error) {
+	c := &pop3Client{conn: conn, text: textproto.NewConn(conn)}
+	if _, err := c.readResponse(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// readResponse returns the text after +OK, or the text after -ERR as an error
+func (c *pop3Client) readResponse() (string, error) {
+	_ = c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	line, err := c.text.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case strings.HasPrefix(line, "+OK"):
+		return strings.TrimSpace(line[3:]), nil
+	case strings.HasPrefix(line, "-ERR"):
+		return "", fmt.Errorf("server replied: %s", strings.TrimSpace(line[4:]))
+	default:
+		return "", fmt.Errorf("invalid response: %s", line)
+	}
+}
+
+func (c *pop3Client) cmd(format string, args ...interface{}) (string, error) {
+	if err := c.text.PrintfLine(format, args...); err != nil {
+		return "", err
+	}
+	return c.readResponse()
+}
+
+// cmdMultiline sends a command with a multi-line response and returns the lines without dot-stuffing
+func (c *pop3Client) cmdMultiline(format string, args ...interface{}) ([]byte, error) {
+	if _, err := c.cmd(format, args...); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(c.text.DotReader())
+}
+
+func (c *pop3Client) startTLS(tlsConfig *tls.Config) error {
+	if _, err := c.cmd("STLS"); err != nil {
+		return err
+	}
+	tlsConn := tls.Client(c.conn, tlsConfig)
+	_ = tlsConn.SetDeadline(time.Now().Add(30 * time.Second))
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	_ = tlsConn.SetDeadline(time.Time{})
+	c.conn = tlsConn
+	c.text = textproto.NewConn(tlsConn)
+	return nil
+}
+
+// uidl returns the unique-id listing of each message, keyed by message number
+func (c *pop3Client) uidl() (map[int]string, error) {
+	lines, err := c.cmdMultiline("UIDL")
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[int]string)
+	scanner := bufio.NewScanner(strings.NewReader(string(lines)))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		n, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid UIDL line: %s", scanner.Text())
+		}
+		ids[n] = fields[1]
+	}
+	return ids, nil
+}
+
+// processPOP3 calls handle for each message that was not processed before, identified by its UIDL.
+// The bounces are deleted if m.DeleteBounces is set.
+func processPOP3(ctx context.Context, db *bolt.DB, m SettingMailbox, handle handleFunc) error {
+	tlsConfig := &tls.Config{ServerName: m.Host}
+	dialer := net.Dialer{Timeout: 30 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", m.Addr())
+	if err != nil {
+		return fmt.Errorf("POP3 dial failed: %s", err)
+	}
+	if m.ConnectionEncryption == "TLS" {
+		tlsConn := tls.Client(conn, tlsConfig)
+		_ = tlsConn.SetDeadline(time.Now().Add(30 * time.Second))
+		if err := tlsConn.Handshake(); err != nil {
+			_ = conn.Close()
+			return fmt.Errorf("POP3 TLS handshake failed: %s", err)
+		}
+		_ = tlsConn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
+	stop := closeOnDone(ctx, conn)
+	defer stop()
+	defer conn.Close()
+	c, err := newPOP3Client(conn)
+	if err != nil {
+		return fmt.Errorf("POP3 greeting failed: %s", err)
+	}
+
+	if m.ConnectionEncryption == "STARTTLS" {
+		if err := c.startTLS(tlsConfig); err != nil {
+			return fmt.Errorf("POP3 STLS failed: %s", err)
+		}
+	}
+	if _, err := c.cmd("USER %s", m.Username); err != nil {
+		return fmt.Errorf("POP3 login failed: %s", err)
+	}
+	if _, err := c.cmd("PASS %s", m.Password); err != nil {
+		return fmt.Errorf("POP3 login failed: %s", err)
+	}
+	ids, err := c.uidl()
+	if err != nil {
+		return fmt.Errorf("POP3 UIDL failed: %s", err)
+	}
+
+	seen := make(map[string]struct{})
+	if err := dbutil.ForEach(db, &pop3Seen{}, func(k []byte, v interface{}) error {
+		seen[string(k)] = struct{}{}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to read POP3 state from database: %s", err)
+	}
+	// forget the messages that are no longer in the mailbox
+	current := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		current[id] = struct{}{}
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for id := range seen {
+			if _, ok := current[id]; !ok {
+				if err := dbutil.DeleteByTableKeyTx(tx, pop3Seen{}.DBTable(), []byte(id)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to update POP3 state: %s", err)
+	}
+
+	numbers := make([]int, 0, len(ids))
+	for n, id := range ids {
+		if _, ok := seen[id]; !ok {
+			numbers = append(numbers, n)
+		}
+	}
+	sort.Ints(numbers)
+	if len(numbers) > maxMessagesPerRun {
+		numbers = numbers[:maxMessagesPerRun]
+	}
+	for _, n := range numbers {
+		raw, err := c.cmdMultiline("RETR %d", n)
+		if err != nil {
+			return fmt.Errorf("POP3 RETR failed: %s", err)
+		}
+		isBounce, err := handle(raw)
+		if err != nil {
+			return err
+		}
+		if isBounce && m.DeleteBounces {
+			// deleted when the session ends with QUIT
+			if _, err := c.cmd("DELE %d", n); err != nil {
+				return fmt.Errorf("POP3 DELE failed: %s", err)
+			}
+		} else if err := dbutil.UpsertSaveable(db, pop3Seen{UIDL: ids[n]}); err != nil {
+			return fmt.Errorf("failed to save POP3 state: %s", err)
+		}
+	}
+	if _, err := c.cmd("QUIT"); err != nil {
+		return fmt.Errorf("POP3 QUIT failed: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package bounce
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"go.angaros.io/internal/broadcast"
+	"go.angaros.io/internal/suppression"
+)
+
+const (
+	// pollInterval is the time between two checks of the mailbox
+	pollInterval = 10 * time.Minute
+	// maxMessagesPerRun limits the messages read in one check, the rest are read in the next checks
+	maxMessagesPerRun = 500
+)
+
+// handleFunc processes a message of the mailbox and reports whether it is a bounce
+type handleFunc func(raw []byte) (bool, error)
+
+// Report is the result of a check of the mailbox
+type Report struct {
+	Messages   int // new messages read
+	Bounces    int // bounced recipients found in the messages
+	Matched    int // bounces of messages sent by a broadcast
+	Suppressed int // recipients added to the suppression list
+}
+
+func (r Report) String() string {
+	return fmt.Sprintf("messages=%d bounces=%d matched=%d suppressed=%d", r.Messages, r.Bounces, r.Matched, r.Suppressed)
+}
+
+type processor struct {
+	db          *bolt.DB
+	mailbox     SettingMailbox
+	sends       map[string][]broadcast.SendKey
+	loggerDebug *log.Logger
+	report      Report
+}
+
+// Process reads the new messages of the mailbox once, and records the bounces of messages sent by broadcasts
+// against the send of the contact. The bounce is matched by the Message-ID of the original message.
+func Process(ctx context.Context, db *bolt.DB, m SettingMailbox, loggerDebug *log.Logger) (Report, error) {
+	if err := m.Validate(); err != nil {
+		return Report{}, fmt.Errorf("invalid bounce mailbox: %s", err)
+	}
+	p := processor{
+		db:          db,
+		mailbox:     m,
+		loggerDebug: loggerDebug,
+	}
+	if err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		p.sends, err = broadcast.EmailMessageIDsTx(tx)
+		return err
+	}); err != nil {
+		return Report{}, err
+	}
+	var err error
+	switch m.Protocol {
+	case "IMAP":
+		err = processIMAP(ctx, db, m, p.handle)
+	case "POP3":
+		err = processPOP3(ctx, db, m, p.handle)
+	}
+	return p.report, err
+}
+
+func (p *processor) handle(raw []byte) (bool, error) {
+	p.report.Messages++
+	bounces, err := Parse(bytes.NewReader(raw))
+	if err != nil {
+		// not a valid message, so not a bounce either
+		p.loggerDebug.Println("failed to parse message:", err)
+		return false, nil
+	}
+	if bounces == nil {
+		return false, nil
+	}
+	for _, b := range bounces {
+		p.report.Bounces++
+		key, ok := matchSend(p.sends[messageIDLocalPart(b.MessageID)], b.Recipient)
+		if !ok {
+			p.loggerDebug.Printf("bounce of %s does not match a sent message (Message-ID: %s)\n", b.Recipient, b.MessageID)
+			continue
+		}
+		p.report.Matched++
+		if err := p.db.Update(func(tx *bolt.Tx) error {
+			recipient, err := broadcast.RecordBounceTx(tx, key, b.String(), b.Hard)
+			if err != nil {
+				return err
+			}
+			if !b.Hard || !p.mailbox.SuppressHardBounces {
+				return nil
+			}
+			e, err := suppression.New(recipient, suppression.ReasonHardBounce)
+			if err != nil {
+				return err
+			}
+			added, err := suppression.AddTx(tx, e)
+			if added {
+				p.report.Suppressed++
+			}
+			return err
+		}); err != nil {
+			return false, fmt.Errorf("failed to record bounce of %s: %s", b.Recipient, err)
+		}
+	}
+	return true, nil
+}
+
+// matchSend returns the send of the bounced recipient among the sends of the message.
+// If the recipient is unknown, only a message sent to a single contact is matched.
+func matchSend(keys []broadcast.SendKey, recipient string) (broadcast.SendKey, bool) {
+	for _, key := range keys {
+		if recipient != "" && strings.EqualFold(key.Recipient, recipient) {
+			return key, true
+		}
+	}
+	if len(keys) == 1 {
+		return keys[0], true
+	}
+	return broadcast.SendKey{}, false
+}
+
+func messageIDLocalPart(messageID string) string {
+	if i := strings.LastIndex(messageID, "@"); i >= 0 {
+		return messageID[:i]
+	}
+	return messageID
+}
+
+// Poll checks the mailbox every pollInterval until ctx is cancelled.
+// The setting is read before each check, so changes take effect on the next check.
+func Poll(ctx context.Context, db *bolt.DB, loggerInfo *log.Logger, loggerDebug *log.Logger) {
+	loggerDebug2 := log.New(loggerDebug.Writer(), loggerDebug.Prefix()+"[Bounce] ", loggerDebug.Flags())
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		var m SettingMailbox
+		err := db.View(func(tx *bolt.Tx) error {
+			var err error
+			m, err = GetMailboxTx(tx)
+			return err
+		})
+		if err != nil {
+			loggerInfo.Println("[Bounce]", err)
+		} else if m.Enabled() {
+			report, err := Process(ctx, db, m, loggerDebug2)
+			if err != nil && ctx.Err() == nil {
+				loggerInfo.Println("[Bounce] failed to process mailbox:", err)
+			}
+			if report.Bounces > 0 {
+				loggerInfo.Println("[Bounce]", report)
+			} else {
+				loggerDebug2.Println(report)
+			}
+		}
+		timer.Reset(pollInterval)
+	}
+}
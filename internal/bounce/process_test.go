@@ -0,0 +1,320 @@
+package bounce
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/oklog/ulid/v2"
+	bolt "go.etcd.io/bbolt"
+
+	"go.angaros.io/internal/broadcast"
+	"go.angaros.io/internal/dbutil"
+	"go.angaros.io/internal/gateway/email"
+	"go.angaros.io/internal/suppression"
+)
+
+// fakePOP3 is a POP3 server with the messages of one mailbox.
+// Deleted messages are removed when the client ends the session with QUIT.
+type fakePOP3 struct {
+	ln       net.Listener
+	mu       sync.Mutex
+	messages map[string]string // by UIDL
+	order    []string
+	deleted  []string
+}
+
+func newFakePOP3(t *testing.T, messages ...string) *fakePOP3 {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakePOP3{ln: ln, messages: make(map[string]string)}
+	for i, m := range messages {
+		uidl := fmt.Sprintf("uid%d", i+1)
+		f.messages[uidl] = m
+		f.order = append(f.order, uidl)
+	}
+	go f.serve()
+	t.Cleanup(func() { ln.Close() })
+	return f
+}
+
+func (f *fakePOP3) mailbox() SettingMailbox {
+	_, port, _ := net.SplitHostPort(f.ln.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return SettingMailbox{
+		Protocol:             "POP3",
+		Host:                 "127.0.0.1",
+		Port:                 uint16(p),
+		ConnectionEncryption: "INSECURE",
+		Username:             "user",
+		Password:             "pass",
+	}
+}
+
+func (f *fakePOP3) serve() {
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		f.session(conn)
+	}
+}
+
+func (f *fakePOP3) session(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// the message numbers of the session
+	uidls := append([]string(nil), f.order...)
+	var dele []string
+	_ = text.PrintfLine("+OK ready")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			_ = text.PrintfLine("-ERR empty command")
+			continue
+		}
+		n := 0
+		if len(fields) > 1 {
+			n, _ = strconv.Atoi(fields[1])
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "USER":
+			_ = text.PrintfLine("+OK")
+		case "PASS":
+			if len(fields) != 2 || fields[1] != "pass" {
+				_ = text.PrintfLine("-ERR invalid password")
+				continue
+			}
+			_ = text.PrintfLine("+OK logged in")
+		case "UIDL":
+			_ = text.PrintfLine("+OK")
+			w := text.DotWriter()
+			for i, uidl := range uidls {
+				fmt.Fprintf(w, "%d %s\n", i+1, uidl)
+			}
+			w.Close()
+		case "RETR":
+			if n < 1 || n > len(uidls) {
+				_ = text.PrintfLine("-ERR no such message")
+				continue
+			}
+			_ = text.PrintfLine("+OK")
+			w := text.DotWriter()
+			fmt.Fprint(w, strings.ReplaceAll(f.messages[uidls[n-1]], "\r\n", "\n"))
+			w.Close()
+		case "DELE":
+			if n < 1 || n > len(uidls) {
+				_ = text.PrintfLine("-ERR no such message")
+				continue
+			}
+			dele = append(dele, uidls[n-1])
+			_ = text.PrintfLine("+OK")
+		case "QUIT":
+			for _, uidl := range dele {
+				delete(f.messages, uidl)
+				for i := range f.order {
+					if f.order[i] == uidl {
+						f.order = append(f.order[:i], f.order[i+1:]...)
+						break
+					}
+				}
+			}
+			f.deleted = append(f.deleted, dele...)
+			_ = text.PrintfLine("+OK bye")
+			return
+		default:
+			_ = text.PrintfLine("-ERR unknown command")
+		}
+	}
+}
+
+func openTestDB(t *testing.T) *bolt.DB {
+	t.Helper()
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// bounceOf returns a DSN of the message sent by the broadcast to the recipient
+func bounceOf(broadcastID ulid.ULID, recipient, status string) string {
+	messageID := email.MessageIDLocalPart(broadcastID.String(), recipient) + "@example.com"
+	return crlf(fmt.Sprintf(`
+From: MAILER-DAEMON@mx.example.net
+To: sender@example.com
+Subject: Undelivered Mail Returned to Sender
+MIME-Version: 1.0
+Content-Type: multipart/report; report-type=delivery-status; boundary="b"
+
+--b
+Content-Type: text/plain
+
+Your message could not be delivered.
+
+--b
+Content-Type: message/delivery-status
+
+Reporting-MTA: dns; mx.example.net
+
+Final-Recipient: rfc822; %s
+Action: failed
+Status: %s
+
+--b
+Content-Type: text/rfc822-headers
+
+From: sender@example.com
+To: %s
+Message-ID: <%s>
+
+--b--
+`, recipient, status, recipient, messageID))
+}
+
+func TestProcessPOP3(t *testing.T) {
+	db := openTestDB(t)
+	b := broadcast.Broadcast{
+		ID: ulid.MustNew(ulid.Now(), nil),
+		Contacts: []broadcast.Contact{
+			{Recipient: "hard@example.net"},
+			{Recipient: "soft@example.net"},
+			{Recipient: "ok@example.net"},
+		},
+		GatewayType: email.Identity{}.DBTable(),
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if err := dbutil.UpsertSaveableTx(tx, b); err != nil {
+			return err
+		}
+		for i := range b.Contacts {
+			if err := dbutil.UpsertSaveableTx(tx, broadcast.Send{BroadcastID: b.ID, Index: i, Sent: broadcast.SentYes}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	otherBroadcastID := ulid.MustNew(ulid.Now(), nil)
+	srv := newFakePOP3(t,
+		bounceOf(b.ID, "hard@example.net", "5.1.1"),
+		sampleNotBounce,
+		bounceOf(b.ID, "soft@example.net", "4.2.2"),
+		bounceOf(otherBroadcastID, "unknown@example.net", "5.1.1"),
+	)
+	m := srv.mailbox()
+	m.DeleteBounces = true
+	m.SuppressHardBounces = true
+	loggerDebug := log.New(ioutil.Discard, "", 0)
+
+	report, err := Process(context.Background(), db, m, loggerDebug)
+	if err != nil {
+		t.Fatalf("Process() failed: %s", err)
+	}
+	want := Report{Messages: 4, Bounces: 3, Matched: 2, Suppressed: 1}
+	if report != want {
+		t.Errorf("Process() = %+v, want %+v", report, want)
+	}
+	srv.mu.Lock()
+	deleted := strings.Join(srv.deleted, ",")
+	srv.mu.Unlock()
+	if deleted != "uid1,uid3,uid4" {
+		t.Errorf("deleted messages %s, want the bounces uid1,uid3,uid4", deleted)
+	}
+
+	wantSends := []struct {
+		bounce     string
+		hardBounce bool
+	}{
+		{bounce: "5.1.1", hardBounce: true},
+		{bounce: "4.2.2", hardBounce: false},
+		{},
+	}
+	if err := db.View(func(tx *bolt.Tx) error {
+		for i, want := range wantSends {
+			bSend := broadcast.Send{BroadcastID: b.ID, Index: i}
+			if err := dbutil.GetByKeyTx(tx, bSend.DBKey(), &bSend); err != nil {
+				return err
+			}
+			if bSend.Bounce != want.bounce || bSend.HardBounce != want.hardBounce {
+				t.Errorf("send of contact #%d has bounce %q hard=%t, want %q hard=%t", i+1, bSend.Bounce, bSend.HardBounce, want.bounce, want.hardBounce)
+			}
+		}
+		if _, err := suppression.GetTx(tx, "hard@example.net"); err != nil {
+			t.Errorf("hard bounced recipient is not suppressed: %s", err)
+		}
+		if _, err := suppression.GetTx(tx, "soft@example.net"); err == nil {
+			t.Errorf("soft bounced recipient is suppressed")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the message that is not a bounce is left in the mailbox and is not read again
+	report, err = Process(context.Background(), db, m, loggerDebug)
+	if err != nil {
+		t.Fatalf("second Process() failed: %s", err)
+	}
+	if report != (Report{}) {
+		t.Errorf("second Process() = %+v, want no new messages", report)
+	}
+}
+
+func TestProcessPOP3LoginFailure(t *testing.T) {
+	db := openTestDB(t)
+	srv := newFakePOP3(t, sampleNotBounce)
+	m := srv.mailbox()
+	m.Password = "wrong"
+	if _, err := Process(context.Background(), db, m, log.New(ioutil.Discard, "", 0)); err == nil {
+		t.Fatal("expected error when the password is rejected")
+	}
+}
+
+func TestMatchSend(t *testing.T) {
+	id := ulid.MustNew(ulid.Now(), nil)
+	keys := []broadcast.SendKey{
+		{BroadcastID: id, Index: 0, Recipient: "a@example.com"},
+		{BroadcastID: id, Index: 1, Recipient: "b@example.com"},
+	}
+	if key, ok := matchSend(keys, "B@example.com"); !ok || key.Index != 1 {
+		t.Errorf("matchSend() = %+v, %t, want contact #2", key, ok)
+	}
+	if _, ok := matchSend(keys, "c@example.com"); ok {
+		t.Errorf("matchSend() matched an unknown recipient of a batch")
+	}
+	// the message of a single contact is matched even if the recipient is rewritten, e.g. by a forwarder
+	if key, ok := matchSend(keys[:1], "other@example.com"); !ok || key.Index != 0 {
+		t.Errorf("matchSend() = %+v, %t, want contact #1", key, ok)
+	}
+}
+
+func TestMessageIDLocalPart(t *testing.T) {
+	if got := messageIDLocalPart("ABCDEFGHIJKLMNOP@example.com"); got != "ABCDEFGHIJKLMNOP" {
+		t.Errorf("messageIDLocalPart() = %q", got)
+	}
+	if got := messageIDLocalPart("ABCDEFGHIJKLMNOP"); got != "ABCDEFGHIJKLMNOP" {
+		t.Errorf("messageIDLocalPart() without domain = %q", got)
+	}
+}
@@ -0,0 +1,214 @@
+package broadcast
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	bolt "go.etcd.io/bbolt"
+
+	"go.angaros.io/internal/dbutil"
+	"go.angaros.io/internal/gateway"
+)
+
+// maxAttachmentsSize is the maximum total size of the attachments of a message.
+// Most email providers reject messages larger than 25 MB and base64 encoding adds a third.
+const maxAttachmentsSize = 18 << 20
+
+// Attachment is a file attached to every message of a broadcast.
+// The content is stored separately in the attachment table, see SaveTx.
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Size        int
+	Hash        []byte // SHA-256 of the content
+	// Inline attachments are referenced in the HTML body as cid:Filename e.g. <img src="cid:logo.png">
+	Inline bool
+	data   []byte
+}
+
+// attachmentContent is the content of an attachment, keyed by broadcast ID and hash
+type attachmentContent struct {
+	BroadcastID []byte
+	Hash        []byte
+	Data        []byte
+}
+
+func (a attachmentContent) DBTable() string {
+	return "broadcast.attachment"
+}
+
+func (a attachmentContent) DBKey() []byte {
+	return bytes.Join([][]byte{a.BroadcastID, a.Hash}, nil)
+}
+
+// NewAttachment returns an attachment with the given content.
+// The content type is detected from the file extension or the content.
+func NewAttachment(filename string, data []byte) (Attachment, error) {
+	filename = filepath.Base(filename)
+	if filename == "." || filename == string(filepath.Separator) {
+		return Attachment{}, fmt.Errorf("attachment filename is empty")
+	}
+	if len(data) == 0 {
+		return Attachment{}, fmt.Errorf("attachment %s is empty", filename)
+	}
+	hash := sha256.Sum256(data)
+	return Attachment{
+		Filename:    filename,
+		ContentType: contentTypeOf(filename, data),
+		Size:        len(data),
+		Hash:        hash[:],
+		data:        data,
+	}, nil
+}
+
+func contentTypeOf(filename string, data []byte) string {
+	if t := mime.TypeByExtension(filepath.Ext(filename)); t != "" {
+		return t
+	}
+	return http.DetectContentType(data)
+}
+
+func (a Attachment) String() string {
+	var inline string
+	if a.Inline {
+		inline = ", inline"
+	}
+	return fmt.Sprintf("%s (%s, %d KB%s)", a.Filename, a.ContentType, (a.Size+1023)/1024, inline)
+}
+
+// validateInlineFilename checks that the filename can be used as a Content-ID
+func validateInlineFilename(filename string) error {
+	if strings.ContainsAny(filename, " \t<>\"()[]\\,;:") {
+		return fmt.Errorf("inline attachment filename %s must not contain spaces or special characters", filename)
+	}
+	return nil
+}
+
+// SaveTx saves a broadcast returned by NewFromInput together with the content of its attachments.
+// Attachments of an existing broadcast with the same ID are replaced.
+func SaveTx(tx *bolt.Tx, b Broadcast) error {
+	err := dbutil.DeletePrefixTx(tx, attachmentContent{}.DBTable(), b.ID[:])
+	if err != nil {
+		return fmt.Errorf("failed to delete old attachments: %s", err)
+	}
+	for _, a := range b.Attachments {
+		if a.data == nil {
+			return fmt.Errorf("content of attachment %s is missing", a.Filename)
+		}
+		err := dbutil.UpsertSaveableTx(tx, attachmentContent{BroadcastID: b.ID[:], Hash: a.Hash, Data: a.data})
+		if err != nil {
+			return fmt.Errorf("failed to save attachment %s: %s", a.Filename, err)
+		}
+	}
+	return dbutil.UpsertSaveableTx(tx, b)
+}
+
+// loadAttachments reads the content of the attachments of the broadcast
+func loadAttachments(db *bolt.DB, b Broadcast) ([]gateway.Attachment, error) {
+	attachments := make([]gateway.Attachment, 0, len(b.Attachments))
+	err := db.View(func(tx *bolt.Tx) error {
+		for _, a := range b.Attachments {
+			var content attachmentContent
+			err := dbutil.GetByKeyTx(tx, attachmentContent{BroadcastID: b.ID[:], Hash: a.Hash}.DBKey(), &content)
+			if err != nil { // don't ignore dbutil.ErrNotFound
+				return fmt.Errorf("failed to read attachment %s: %s", a.Filename, err)
+			}
+			ga := gateway.Attachment{
+				Filename:    a.Filename,
+				ContentType: a.ContentType,
+				Data:        content.Data,
+			}
+			if a.Inline {
+				ga.ContentID = a.Filename
+			}
+			attachments = append(attachments, ga)
+		}
+		return nil
+	})
+	return attachments, err
+}
+
+// contactAttachmentPath returns the path of the file attached to the message of the contact, which must be inside dir,
+// or an empty string if the contact has no attachment
+func contactAttachmentPath(tmpl *template.Template, dir string, c Contact) (string, error) {
+	var buf strings.Builder
+	if err := tmpl.Execute(&buf, c.Keywords); err != nil {
+		return "", fmt.Errorf("failed to generate attachment path: %s", err)
+	}
+	path := strings.TrimSpace(buf.String())
+	if path == "" {
+		return "", nil
+	}
+	return PathInDir(dir, path)
+}
+
+// PathInDir joins the relative path to dir. It rejects absolute paths and paths that leave dir with "..",
+// so that a path of a contact or of an API client cannot name any file that the process can read.
+func PathInDir(dir, path string) (string, error) {
+	clean := filepath.Clean(path)
+	if filepath.IsAbs(clean) || filepath.VolumeName(clean) != "" || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %s is not inside the directory %s", path, dir)
+	}
+	return filepath.Join(dir, clean), nil
+}
+
+// readContactAttachment reads the file attached to the message of the contact.
+// It returns nil if the contact has no attachment.
+func readContactAttachment(tmpl *template.Template, dir string, c Contact, maxSize int) (*gateway.Attachment, error) {
+	path, err := contactAttachmentPath(tmpl, dir, c)
+	if err != nil || path == "" {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read attachment: %s", err)
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("attachment %s is a directory", path)
+	}
+	if info.Size() > int64(maxSize) {
+		return nil, fmt.Errorf("attachment %s is too large (%d MB)", path, info.Size()>>20)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read attachment: %s", err)
+	}
+	return &gateway.Attachment{
+		Filename:    filepath.Base(path),
+		ContentType: contentTypeOf(path, data),
+		Data:        data,
+	}, nil
+}
+
+// checkContactAttachments rejects the contacts whose attachment file does not exist
+func checkContactAttachments(contacts []Contact, tmpl *template.Template, dir string) ([]Contact, []RejectedContact) {
+	valid := make([]Contact, 0, len(contacts))
+	var rejected []RejectedContact
+	for _, c := range contacts {
+		path, err := contactAttachmentPath(tmpl, dir, c)
+		if err == nil && path != "" {
+			var info os.FileInfo
+			info, err = os.Stat(path)
+			if err == nil && info.IsDir() {
+				err = fmt.Errorf("%s is a directory", path)
+			}
+			if err != nil {
+				err = fmt.Errorf("attachment: %s", err)
+			}
+		}
+		if err != nil {
+			rejected = append(rejected, RejectedContact{Line: c.line, Recipient: c.Recipient, Reason: err.Error()})
+			continue
+		}
+		valid = append(valid, c)
+	}
+	return valid, rejected
+}
@@ -0,0 +1,65 @@
+package broadcast
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"text/template"
+)
+
+func TestPathInDir(t *testing.T) {
+	dir := filepath.Join(string(filepath.Separator)+"srv", "invoices")
+	for path, want := range map[string]string{
+		"a.pdf":             filepath.Join(dir, "a.pdf"),
+		"2023/a.pdf":        filepath.Join(dir, "2023", "a.pdf"),
+		"./2023/../a.pdf":   filepath.Join(dir, "a.pdf"),
+		"..a.pdf":           filepath.Join(dir, "..a.pdf"),
+		"":                  dir,
+		".":                 dir,
+		"2023/../../a.pdf":  "",
+		"../a.pdf":          "",
+		"..":                "",
+		"/root/.ssh/id_rsa": "",
+	} {
+		got, err := PathInDir(dir, filepath.FromSlash(path))
+		if want == "" {
+			if err == nil {
+				t.Errorf("PathInDir(%q) = %q, want error", path, got)
+			}
+			continue
+		}
+		if err != nil || got != want {
+			t.Errorf("PathInDir(%q) = %q, %v, want %q", path, got, err, want)
+		}
+	}
+}
+
+func TestCheckContactAttachments(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.pdf"), []byte("%PDF-1.4"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	outside := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(outside, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	contacts := []Contact{
+		{Recipient: "a@example.com", Keywords: map[string]string{"file": "a.pdf"}},
+		{Recipient: "b@example.com", Keywords: map[string]string{"file": outside}},
+		{Recipient: "c@example.com", Keywords: map[string]string{"file": "../" + filepath.Base(filepath.Dir(outside)) + "/secret"}},
+		{Recipient: "d@example.com", Keywords: map[string]string{"file": "missing.pdf"}},
+		{Recipient: "e@example.com", Keywords: map[string]string{"file": ""}},
+	}
+	tmpl := template.Must(template.New("attachment").Parse("{{.file}}"))
+	valid, rejected := checkContactAttachments(contacts, tmpl, dir)
+	var validRecipients []string
+	for _, c := range valid {
+		validRecipients = append(validRecipients, c.Recipient)
+	}
+	if len(valid) != 2 || valid[0].Recipient != "a@example.com" || valid[1].Recipient != "e@example.com" {
+		t.Errorf("valid contacts are %v, want a@example.com and e@example.com", validRecipients)
+	}
+	if len(rejected) != 3 {
+		t.Errorf("rejected %v, want the contacts with files outside the directory or missing", rejected)
+	}
+}
@@ -0,0 +1,73 @@
+package broadcast
+
+import (
+	"fmt"
+
+	"github.com/oklog/ulid/v2"
+	bolt "go.etcd.io/bbolt"
+
+	"go.angaros.io/internal/dbutil"
+	"go.angaros.io/internal/gateway/email"
+)
+
+// SendKey identifies the message sent to a contact of a broadcast
+type SendKey struct {
+	BroadcastID ulid.ULID
+	Index       int
+	Recipient   string
+}
+
+// EmailMessageIDsTx returns the messages sent by email broadcasts, keyed by the local part of their Message-ID.
+// A message sent to a batch of contacts has the Message-ID of the first contact of the batch, so it has many sends.
+func EmailMessageIDsTx(tx *bolt.Tx) (map[string][]SendKey, error) {
+	sends := make(map[string][]SendKey)
+	err := dbutil.ForEachTx(tx, &Broadcast{}, func(k []byte, v interface{}) error {
+		b := v.(Broadcast)
+		if b.GatewayType != tableNameEmailIdentity {
+			return nil
+		}
+		return dbutil.ForEachPrefixTx(tx, &Send{}, b.ID[:], func(k []byte, v interface{}) error {
+			bSend := v.(Send)
+			if (bSend.Sent != SentYes && bSend.Sent != SentMaybe) || bSend.Index >= len(b.Contacts) {
+				return nil
+			}
+			first := bSend.Index
+			if bSend.Batched && bSend.BatchFirst < len(b.Contacts) {
+				first = bSend.BatchFirst
+			}
+			messageID := email.MessageIDLocalPart(b.ID.String(), b.Contacts[first].Recipient)
+			sends[messageID] = append(sends[messageID], SendKey{BroadcastID: b.ID, Index: bSend.Index, Recipient: b.Contacts[bSend.Index].Recipient})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sends from database: %s", err)
+	}
+	return sends, nil
+}
+
+// RecordBounceTx records a bounce of the message and returns the recipient of the message.
+// A soft bounce does not replace a hard bounce.
+func RecordBounceTx(tx *bolt.Tx, key SendKey, bounce string, hard bool) (string, error) {
+	var b Broadcast
+	err := dbutil.GetByKeyTx(tx, key.BroadcastID[:], &b)
+	if err != nil { // don't ignore dbutil.ErrNotFound
+		return "", fmt.Errorf("failed to read broadcast %s: %s", key.BroadcastID, err)
+	}
+	if key.Index >= len(b.Contacts) {
+		return "", fmt.Errorf("broadcast %s has no contact #%d", key.BroadcastID, key.Index+1)
+	}
+	bSend := Send{BroadcastID: key.BroadcastID, Index: key.Index}
+	err = dbutil.GetByKeyTx(tx, bSend.DBKey(), &bSend)
+	if err != nil { // don't ignore dbutil.ErrNotFound
+		return "", fmt.Errorf("failed to read send of contact #%d: %s", key.Index+1, err)
+	}
+	if !bSend.HardBounce || hard {
+		bSend.Bounce = bounce
+		bSend.HardBounce = hard
+		if err := dbutil.UpsertSaveableTx(tx, bSend); err != nil {
+			return "", fmt.Errorf("failed to save send of contact #%d: %s", key.Index+1, err)
+		}
+	}
+	return b.Contacts[key.Index].Recipient, nil
+}
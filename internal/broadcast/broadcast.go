@@ -32,21 +32,45 @@ func (rs TimeRanges) String() string {
 }
 
 type Broadcast struct {
-	ID           ulid.ULID
-	Contacts     []Contact
-	MsgSubject   string `cbor:"MsgRawSubject"`
-	MsgBody      string `cbor:"MsgRawBody"`
-	MsgBodyFile  string `cbor:"Filename"`
-	GatewayType  string
-	GatewayKey   []byte
-	SendDateFrom time.Time
-	SendDateTo   time.Time
-	SendHours    []TimeRange
-	Timezone     string
-	CreatedAt    time.Time
-	status       string
+	ID       ulid.ULID
+	Contacts []Contact
+	// if ContactListID is set, Contacts are copied from the contact list when the broadcast starts
+	ContactListID   ulid.ULID
+	ContactListTags []string
+	MsgSubject      string `cbor:"MsgRawSubject"`
+	MsgBody         string `cbor:"MsgRawBody"`
+	MsgBodyFile     string `cbor:"Filename"`
+	MsgBodyHTML     bool   // MsgBody is an html/template, only for email gateways
+	GatewayType     string
+	GatewayKey      []byte
+	SendDateFrom    time.Time
+	SendDateTo      time.Time
+	SendHours       []TimeRange
+	Timezone        string
+	CreatedAt       time.Time
+	State           string // empty, StatePaused or StateCancelled
+	status          string
+
+	// Attachments are attached to every message, only for email gateways
+	Attachments []Attachment
+	// ContactAttachment is a template of the path of a file attached to the message of each contact
+	// e.g. {{.invoice_file}}. The paths are relative to ContactAttachmentDir and must be inside it.
+	ContactAttachment    string
+	ContactAttachmentDir string
+
+	// BatchSize is the maximum number of consecutive contacts that are sent the same message in one transaction,
+	// if the rendered messages are identical. The recipients are not shown in the headers. 0 or 1 disables batches.
+	// Only for email gateways
+	BatchSize int
+
+	// SubscriptionID is the SIM that sends the messages, overriding the SIM of the device.
+	// 0 means the SIM of the device. Only for android gateways
+	SubscriptionID int
 }
 
+// maxBatchSize is the number of recipients that SMTP servers must accept in a transaction (RFC 5321 section 4.5.3.1.8)
+const maxBatchSize = 100
+
 func (b Broadcast) DBTable() string {
 	return "broadcast"
 }
@@ -162,8 +186,13 @@ func (b Broadcast) startableAt(defaultSendHours SettingSendHours, defaultTimezon
 		sendHours = defaultSendHours
 	}
 
-	for day := today; day.Before(day.Add(3 * 24 * time.Hour)); day = day.Add(24 * time.Hour) {
-		if (b.SendDateFrom.IsZero() || day.After(b.SendDateFrom)) && (b.SendDateTo.IsZero() || day.Before(b.SendDateTo)) {
+	// search the first days from today or from SendDateFrom
+	searchUntil := today.Add(3 * 24 * time.Hour)
+	if b.SendDateFrom.After(today) {
+		searchUntil = b.SendDateFrom.Add(3 * 24 * time.Hour)
+	}
+	for day := today; day.Before(searchUntil); day = day.Add(24 * time.Hour) {
+		if (b.SendDateFrom.IsZero() || !day.Before(b.SendDateFrom)) && (b.SendDateTo.IsZero() || !day.After(b.SendDateTo)) {
 			if len(sendHours) == 0 {
 				return day, nil
 			}
@@ -213,6 +242,14 @@ func (b *Broadcast) ReadStatusFromTx(tx *bolt.Tx) error {
 		return fmt.Errorf("database error")
 	}
 	if errors.Is(err, dbutil.ErrNotFound) {
+		switch b.State {
+		case StatePaused:
+			b.status = "not started - paused by user"
+			return nil
+		case StateCancelled:
+			b.status = "not started - cancelled"
+			return nil
+		}
 		b.status = "not started"
 		startableIn, err := b.getStartableInFromTx(tx)
 		if err != nil {
@@ -234,12 +271,18 @@ func (b *Broadcast) ReadStatusFromTx(tx *bolt.Tx) error {
 		// lock mutex because we read from runningBroadcasts
 		runningMutex.Lock()
 		defer runningMutex.Unlock()
-		if _, exists := runningBroadcasts[b.ID.String()]; exists {
+		if _, exists := runningBroadcasts[b.ID.String()]; exists && b.State == "" {
 			b.status = fmt.Sprintf("%d/%d sent - running", run.NextIndex, run.Length)
 			return nil
 		} else if run.NextIndex == run.Length {
 			b.status = fmt.Sprintf("%d/%d sent - finished", run.NextIndex, run.Length)
 			return nil
+		} else if b.State == StatePaused {
+			b.status = fmt.Sprintf("%d/%d sent - paused by user", run.NextIndex, run.Length)
+			return nil
+		} else if b.State == StateCancelled {
+			b.status = fmt.Sprintf("%d/%d sent - cancelled", run.NextIndex, run.Length)
+			return nil
 			//} else if !b.SendDateTo.IsZero() && now.After(b.SendDateTo.Add(24*time.Hour)) {
 			//	b.status = fmt.Sprintf("%d/%d sent - expired", run.NextIndex, run.Length)
 			//	return nil
@@ -258,9 +301,20 @@ func (b Broadcast) DetailsString(tx *bolt.Tx) (string, error) {
 	var buf strings.Builder
 	fmt.Fprintf(&buf, "ID: %s\n", b.ID.String())
 	fmt.Fprintf(&buf, "Contacts: %d\n", len(b.Contacts))
+	if b.ContactListID != (ulid.ULID{}) {
+		fmt.Fprintf(&buf, "Contact list: %s\n", b.ContactListID)
+		fmt.Fprintf(&buf, "Contact list tags: %s\n", strings.Join(b.ContactListTags, ", "))
+	}
 	fmt.Fprintf(&buf, "Message subject: %s\n", b.MsgSubject)
 	fmt.Fprintf(&buf, "Message body: %s\n", b.MsgBody)
+	fmt.Fprintf(&buf, "Message body HTML: %v\n", b.MsgBodyHTML)
 	fmt.Fprintf(&buf, "Message body file: %s\n", b.MsgBodyFile)
+	for _, a := range b.Attachments {
+		fmt.Fprintf(&buf, "Attachment: %s\n", a)
+	}
+	if b.ContactAttachment != "" {
+		fmt.Fprintf(&buf, "Contact attachment: %s (relative to %s)\n", b.ContactAttachment, b.ContactAttachmentDir)
+	}
 	if err := b.ReadStatusFromTx(tx); err != nil {
 		return "", fmt.Errorf("failed to get status: %s", err)
 	}
@@ -271,3 +325,38 @@ func (b Broadcast) DetailsString(tx *bolt.Tx) (string, error) {
 	fmt.Fprintf(&buf, "Send time: %v\n", b.SendHours)
 	return buf.String(), nil
 }
+
+// DeleteTx deletes the broadcast with the given key together with its run, sends, replies and attachments.
+// If the broadcast is running, it is stopped after the transaction is committed.
+func DeleteTx(tx *bolt.Tx, key []byte) error {
+	var id ulid.ULID
+	if err := id.UnmarshalBinary(key); err == nil {
+		tx.OnCommit(func() {
+			stopRunning(id.String())
+		})
+	}
+	err := dbutil.DeleteByTableKeyTx(tx, Broadcast{}.DBTable(), key)
+	if err != nil {
+		return fmt.Errorf("failed to delete Broadcast: %s", err)
+	}
+	err = dbutil.DeleteByTableKeyTx(tx, Run{}.DBTable(), key)
+	if err != nil {
+		return fmt.Errorf("failed to delete Run: %s", err)
+	}
+	err = dbutil.DeletePrefixTx(tx, Send{}.DBTable(), key)
+	if err != nil {
+		return fmt.Errorf("failed to delete Send: %s", err)
+	}
+	err = dbutil.DeletePrefixTx(tx, Reply{}.DBTable(), key)
+	if err != nil {
+		return fmt.Errorf("failed to delete Reply: %s", err)
+	}
+	if err := deleteSMSSendsTx(tx, id); err != nil {
+		return fmt.Errorf("failed to delete SMSSend: %s", err)
+	}
+	err = dbutil.DeletePrefixTx(tx, attachmentContent{}.DBTable(), key)
+	if err != nil {
+		return fmt.Errorf("failed to delete attachments: %s", err)
+	}
+	return nil
+}
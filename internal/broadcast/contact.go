@@ -3,22 +3,37 @@ package broadcast
 import (
 	"bufio"
 	"encoding/csv"
+	"errors"
 	"fmt"
 	"io"
+	"strings"
+
+	"github.com/oklog/ulid/v2"
+	bolt "go.etcd.io/bbolt"
+
+	"go.angaros.io/internal/contactlist"
+	"go.angaros.io/internal/dbutil"
+	"go.angaros.io/internal/gateway/email"
+	"go.angaros.io/internal/phone"
 )
 
 type Contact struct {
 	Recipient string
 	Keywords  map[string]string
+	line      int // line of the contacts file, used in import reports
 }
 
 func ReadContactsFromReader(f io.Reader) ([]Contact, error) {
 	scanner := bufio.NewScanner(f)
 	contacts := make([]Contact, 0)
+	line := 0
 	for scanner.Scan() {
-		var c Contact
-		// TODO: validate & normalize recipient, but we don't know if it's email or phone number
-		c.Recipient = scanner.Text()
+		line++
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		// recipients are validated by NewFromInput, when the gateway is known
+		c := Contact{Recipient: scanner.Text(), line: line}
 		contacts = append(contacts, c)
 	}
 	if err := scanner.Err(); err != nil {
@@ -54,7 +69,7 @@ func ReadContactsFromReaderCSV(f io.Reader, delimiter rune, hasHeader bool, reci
 			continue
 		}
 
-		var c Contact
+		c := Contact{line: i + 1}
 		if len(row) > 0 && hasHeader {
 			c.Keywords = make(map[string]string)
 			for j, field := range row {
@@ -83,3 +98,138 @@ func ReadContactsFromReaderCSV(f io.Reader, delimiter rune, hasHeader bool, reci
 		contacts = append(contacts, c)
 	}
 }
+
+// RejectedContact is a contact that was not added to a broadcast
+type RejectedContact struct {
+	Line      int // 0 if the contact was not read from a file
+	Recipient string
+	Reason    string
+}
+
+func (r RejectedContact) String() string {
+	if r.Line > 0 {
+		return fmt.Sprintf("line %d: '%s' %s", r.Line, r.Recipient, r.Reason)
+	}
+	return fmt.Sprintf("'%s' %s", r.Recipient, r.Reason)
+}
+
+// RejectedContactsString returns the rejected contacts one per line
+func RejectedContactsString(rejected []RejectedContact) string {
+	lines := make([]string, 0, len(rejected))
+	for _, r := range rejected {
+		lines = append(lines, r.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// NormalizePhoneContacts converts the recipients to E.164 format.
+// Contacts with invalid phone numbers and duplicates of the normalized recipient are rejected.
+func NormalizePhoneContacts(contacts []Contact, defaultCountry string) ([]Contact, []RejectedContact) {
+	return normalizeContacts(contacts, func(recipient string) (string, error) {
+		normalized, err := phone.Normalize(recipient, defaultCountry)
+		if err != nil {
+			return "", fmt.Errorf("invalid phone number: %s", err)
+		}
+		return normalized, nil
+	})
+}
+
+// NormalizeEmailContacts validates the email addresses and lowercases their domains.
+// Contacts with invalid addresses and duplicates of the normalized recipient are rejected.
+func NormalizeEmailContacts(contacts []Contact) ([]Contact, []RejectedContact) {
+	return normalizeContacts(contacts, email.NormalizeAddress)
+}
+
+func normalizeContacts(contacts []Contact, normalize func(string) (string, error)) ([]Contact, []RejectedContact) {
+	valid := make([]Contact, 0, len(contacts))
+	rejected := make([]RejectedContact, 0)
+	seen := make(map[string]Contact, len(contacts))
+	for _, c := range contacts {
+		normalized, err := normalize(c.Recipient)
+		if err != nil {
+			rejected = append(rejected, RejectedContact{Line: c.line, Recipient: c.Recipient, Reason: err.Error()})
+			continue
+		}
+		if first, exists := seen[normalized]; exists {
+			reason := fmt.Sprintf("duplicate of '%s'", first.Recipient)
+			if first.line > 0 {
+				reason = fmt.Sprintf("duplicate of line %d (%s)", first.line, normalized)
+			}
+			rejected = append(rejected, RejectedContact{Line: c.line, Recipient: c.Recipient, Reason: reason})
+			continue
+		}
+		seen[normalized] = c
+		c.Recipient = normalized
+		valid = append(valid, c)
+	}
+	return valid, rejected
+}
+
+// ContactsFromList converts the contacts of a contact list to broadcast contacts
+func ContactsFromList(cs []contactlist.Contact) []Contact {
+	contacts := make([]Contact, 0, len(cs))
+	for _, c := range cs {
+		contacts = append(contacts, Contact{
+			Recipient: c.Recipient,
+			Keywords:  c.Keywords,
+		})
+	}
+	return contacts
+}
+
+// snapshotContactListTx copies the contacts of the broadcast's contact list to the broadcast,
+// and creates the broadcast run, so that later changes to the list do not affect the broadcast
+func snapshotContactListTx(tx *bolt.Tx, b *Broadcast) error {
+	listContacts, err := contactlist.ContactsTx(tx, b.ContactListID, b.ContactListTags)
+	if err != nil {
+		return fmt.Errorf("failed to read contact list: %s", err)
+	}
+	b.Contacts = ContactsFromList(listContacts)
+	// contacts with invalid or duplicate recipients are skipped
+	switch b.GatewayType {
+	case tableNameDeviceAndroid:
+		country, err := GetDefaultCountryTx(tx)
+		if err != nil {
+			return err
+		}
+		b.Contacts, _ = NormalizePhoneContacts(b.Contacts, country)
+	case tableNameEmailIdentity:
+		b.Contacts, _ = NormalizeEmailContacts(b.Contacts)
+	}
+	// read the broadcast again to avoid overwriting changes made after it was read, e.g. its state
+	var current Broadcast
+	if err := dbutil.GetByKeyTx(tx, b.DBKey(), &current); err != nil { // don't ignore dbutil.ErrNotFound
+		return fmt.Errorf("failed to read broadcast: %s", err)
+	}
+	current.Contacts = b.Contacts
+	if err := dbutil.UpsertSaveableTx(tx, current); err != nil {
+		return fmt.Errorf("failed to save broadcast: %s", err)
+	}
+	if err := dbutil.UpsertSaveableTx(tx, Run{BroadcastID: b.ID, Length: len(b.Contacts)}); err != nil {
+		return fmt.Errorf("failed to save broadcast run: %s", err)
+	}
+	return nil
+}
+
+// ContactListUsersTx returns the IDs of the broadcasts that will copy the contacts of the list when they start.
+// The list should not be deleted while it is used.
+func ContactListUsersTx(tx *bolt.Tx, listID ulid.ULID) ([]ulid.ULID, error) {
+	ids := make([]ulid.ULID, 0)
+	err := dbutil.ForEachTx(tx, &Broadcast{}, func(k []byte, v interface{}) error {
+		b := v.(Broadcast)
+		if b.ContactListID != listID || b.State == StateCancelled {
+			return nil
+		}
+		var r Run
+		err := dbutil.GetByKeyTx(tx, b.DBKey(), &r)
+		if errors.Is(err, dbutil.ErrNotFound) {
+			ids = append(ids, b.ID)
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read broadcasts: %s", err)
+	}
+	return ids, nil
+}
@@ -13,149 +13,244 @@ import (
 	bolt "go.etcd.io/bbolt"
 
 	"go.angaros.io/internal/dbutil"
+	"go.angaros.io/internal/errorbehavior"
 	"go.angaros.io/internal/gateway/sms/android"
 )
 
+const (
+	// dispatcherRetryDelay is the time to wait before restarting a broadcast that stopped with an error
+	dispatcherRetryDelay = 60 * time.Second
+	// dispatcherMaxSleep is the maximum time the dispatcher sleeps between scans
+	dispatcherMaxSleep = 10 * time.Minute
+)
+
 var (
 	runningBroadcasts map[string]struct{}
+	runningCancels    map[string]context.CancelFunc // cancel the context of each running broadcast
 	runningGateways   map[string]struct{}
+	retryAfter        map[string]time.Time // broadcasts that stopped with an error are not restarted before this time
 	runningMutex      sync.Mutex
+	wakeChan          = make(chan struct{}, 1)
 )
 
 func init() {
 	runningBroadcasts = make(map[string]struct{})
+	runningCancels = make(map[string]context.CancelFunc)
 	runningGateways = make(map[string]struct{})
+	retryAfter = make(map[string]time.Time)
+}
+
+// Wake makes the dispatcher scan the broadcasts immediately.
+// It should be called after a broadcast is created, edited or resumed, and after the settings change.
+func Wake() {
+	select {
+	case wakeChan <- struct{}{}:
+	default:
+		// a scan is already pending
+	}
 }
 
+// Dispatcher starts broadcasts when they can be started, until ctx is cancelled.
+// It sleeps until the next broadcast can be started or until Wake is called.
+// When ctx is cancelled, it waits for the running broadcasts to stop before returning.
 func Dispatcher(ctx context.Context, db *bolt.DB, loggerInfo *log.Logger, loggerDebug *log.Logger) {
 	loggerDebug2 := log.New(loggerDebug.Writer(), loggerDebug.Prefix()+"[Dispatcher] ", loggerDebug.Flags())
-	loggerInfo2 := log.New(loggerInfo.Writer(), loggerInfo.Prefix()+"[Dispatcher] ", loggerInfo.Flags())
+	var wg sync.WaitGroup
+	timer := time.NewTimer(0)
+	defer timer.Stop()
 	for {
-		time.Sleep(60 * time.Second)
-		var bs []Broadcast
-		err := dbutil.ForEach(db, &Broadcast{}, func(k []byte, v interface{}) error {
-			b := v.(Broadcast)
-			// TODO: check if broadcast can be started?
-			bs = append(bs, b)
-			return nil
-		})
-		if err != nil {
-			loggerInfo2.Println("failed to read broadcasts from database:", err)
+		select {
+		case <-ctx.Done():
+			loggerDebug2.Println("context cancelled - waiting for running broadcasts to stop")
+			wg.Wait()
+			return
+		case <-timer.C:
+		case <-wakeChan:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		}
+		if ctx.Err() != nil {
+			// don't start broadcasts if woken up after ctx was cancelled
 			continue
 		}
-		// read settings
-		var defaultSendHours SettingSendHours
-		err = dbutil.GetByKey(db, defaultSendHours.DBKey(), &defaultSendHours)
-		if err != nil && !errors.Is(err, dbutil.ErrNotFound) {
-			loggerInfo2.Println("failed to read send hours settings from database:", err)
+		next := dispatch(ctx, &wg, db, loggerInfo, loggerDebug)
+		sleepDur := time.Until(next)
+		if sleepDur > dispatcherMaxSleep {
+			sleepDur = dispatcherMaxSleep
+		}
+		loggerDebug2.Printf("sleeping for %v\n", sleepDur)
+		timer.Reset(sleepDur)
+	}
+}
+
+// dispatch starts the broadcasts that can be started now,
+// and returns the time when the next broadcast can be started
+func dispatch(ctx context.Context, wg *sync.WaitGroup, db *bolt.DB, loggerInfo *log.Logger, loggerDebug *log.Logger) time.Time {
+	loggerDebug2 := log.New(loggerDebug.Writer(), loggerDebug.Prefix()+"[Dispatcher] ", loggerDebug.Flags())
+	loggerInfo2 := log.New(loggerInfo.Writer(), loggerInfo.Prefix()+"[Dispatcher] ", loggerInfo.Flags())
+	now := time.Now()
+	next := now.Add(dispatcherMaxSleep)
+	var bs []Broadcast
+	err := dbutil.ForEach(db, &Broadcast{}, func(k []byte, v interface{}) error {
+		b := v.(Broadcast)
+		bs = append(bs, b)
+		return nil
+	})
+	if err != nil {
+		loggerInfo2.Println("failed to read broadcasts from database:", err)
+		return now.Add(dispatcherRetryDelay)
+	}
+	// read settings
+	var defaultSendHours SettingSendHours
+	err = dbutil.GetByKey(db, defaultSendHours.DBKey(), &defaultSendHours)
+	if err != nil && !errors.Is(err, dbutil.ErrNotFound) {
+		loggerInfo2.Println("failed to read send hours settings from database:", err)
+		return now.Add(dispatcherRetryDelay)
+	}
+	var defaultTimezone SettingTimezone
+	err = dbutil.GetByKey(db, defaultTimezone.DBKey(), &defaultTimezone)
+	if err != nil && !errors.Is(err, dbutil.ErrNotFound) {
+		loggerInfo2.Println("failed to read time zone settings from database:", err)
+		return now.Add(dispatcherRetryDelay)
+	}
+	// find startable broadcasts
+	sort.Sort(broadcastsByStartableSince{Broadcasts: bs, SendHours: defaultSendHours, Timezone: defaultTimezone})
+	bsToStart := make([]Broadcast, 0, len(bs))
+	gatewaysToStart := make(map[string]struct{})
+	for _, b := range bs {
+		loggerDebugB := log.New(loggerDebug2.Writer(), loggerDebug2.Prefix()+fmt.Sprintf("[broadcast: %s] ", b.ID.String()), loggerDebug2.Flags())
+
+		// check if broadcast has been paused or cancelled by the user
+		if b.State != "" {
+			loggerDebugB.Printf("broadcast is %s - ignoring\n", b.State)
 			continue
 		}
-		var defaultTimezone SettingTimezone
-		err = dbutil.GetByKey(db, defaultTimezone.DBKey(), &defaultTimezone)
+
+		// check if broadcast and gateway is already running
+		var existsB bool
+		var existsG bool
+		var bRetryAfter time.Time
+		func() {
+			runningMutex.Lock()
+			defer runningMutex.Unlock()
+			_, existsB = runningBroadcasts[b.ID.String()]
+			_, existsG = runningGateways[b.GatewayType+string(b.GatewayKey)]
+			bRetryAfter = retryAfter[b.ID.String()]
+		}()
+		if existsB {
+			loggerDebugB.Println("broadcast has already been started - ignoring")
+			continue
+		}
+
+		// check if broadcast has finished
+		var r Run
+		err = dbutil.GetByKey(db, Run{BroadcastID: b.ID}.DBKey(), &r)
 		if err != nil && !errors.Is(err, dbutil.ErrNotFound) {
-			loggerInfo2.Println("failed to read time zone settings from database:", err)
+			loggerDebugB.Println("dbutil.GetByKey failed:", err)
+			continue
+		}
+		if err == nil && r.NextIndex == r.Length {
+			loggerDebugB.Println("broadcast has finished - ignoring")
 			continue
 		}
-		// find startable broadcasts
-		sort.Sort(broadcastsByStartableSince{Broadcasts: bs, SendHours: defaultSendHours, Timezone: defaultTimezone})
-		bsToStart := make([]Broadcast, 0, len(bs))
-		gatewaysToStart := make(map[string]struct{})
-		for _, b := range bs {
-			loggerDebugB := log.New(loggerDebug2.Writer(), loggerDebug2.Prefix()+fmt.Sprintf("[broadcast: %s] ", b.ID.String()), loggerDebug2.Flags())
-			// loggerInfoB := log.New(loggerInfo2.Writer(), loggerInfo2.Prefix()+fmt.Sprintf("[broadcast: %s] ", b.ID.String()), loggerInfo2.Flags())
-
-			// check if broadcast can be started
-			if b.startableNowUntil(defaultSendHours, defaultTimezone).IsZero() {
-				loggerDebugB.Println("broadcast cannot be started now - ignoring")
-				continue
-			}
 
-			// remove broadcasts using the same gateway
-			_, exists := gatewaysToStart[b.GatewayType+string(b.GatewayKey)]
-			if exists {
-				loggerDebugB.Printf("gateway %s already scheduled to start - ignoring\n", b.GatewayKey)
-				continue
-			}
-			_, exists = runningGateways[b.GatewayType+string(b.GatewayKey)]
-			if exists {
-				loggerDebugB.Printf("gateway %s currently in use - ignoring\n", b.GatewayKey)
-				continue
+		// check if broadcast stopped with an error recently
+		if now.Before(bRetryAfter) {
+			loggerDebugB.Printf("broadcast stopped with an error - retrying at %v\n", bRetryAfter)
+			if bRetryAfter.Before(next) {
+				next = bRetryAfter
 			}
+			continue
+		}
 
-			// check if broadcast and gateway is already running
-			var existsB bool
-			var existsG bool
-			func() {
-				runningMutex.Lock()
-				defer runningMutex.Unlock()
-				_, existsB = runningBroadcasts[b.ID.String()]
-				_, existsG = runningGateways[b.GatewayType+string(b.GatewayKey)]
-			}()
-			if existsB {
-				loggerDebugB.Println("broadcast has already been started - ignoring")
-				continue
-			}
-			if existsG {
-				loggerDebugB.Println("broadcast's gateway already in use - ignoring")
-				continue
+		// check if broadcast can be started
+		if b.startableNowUntil(defaultSendHours, defaultTimezone).IsZero() {
+			startableAt, err := b.startableAt(defaultSendHours, defaultTimezone)
+			if err != nil {
+				loggerDebugB.Println("failed to compute when broadcast can be started:", err)
+			} else if startableAt.After(now) && startableAt.Before(next) {
+				next = startableAt
 			}
+			loggerDebugB.Printf("broadcast cannot be started now - startable at %v - ignoring\n", startableAt)
+			continue
+		}
 
-			// check if broadcast has finished
-			var r Run
-			err = dbutil.GetByKey(db, Run{BroadcastID: b.ID}.DBKey(), &r)
-			if err != nil && !errors.Is(err, dbutil.ErrNotFound) {
-				loggerDebugB.Println("dbutil.GetByKeyarray failed")
-				continue
-			}
-			// log.Printf("[DEBUG] [Dispatcher] r.NextIndex: %d r.Length: %d err: %s\n", r.NextIndex, r.Length, err)
-			if err == nil && r.NextIndex == r.Length {
-				loggerDebugB.Println("broadcast has finished - ignoring")
-				continue
-			}
+		// remove broadcasts using the same gateway.
+		// the dispatcher is woken up when the running broadcast stops
+		_, exists := gatewaysToStart[b.GatewayType+string(b.GatewayKey)]
+		if exists {
+			loggerDebugB.Printf("gateway %s already scheduled to start - ignoring\n", b.GatewayKey)
+			continue
+		}
+		if existsG {
+			loggerDebugB.Println("broadcast's gateway already in use - ignoring")
+			continue
+		}
 
-			gatewaysToStart[b.GatewayType+string(b.GatewayKey)] = struct{}{}
+		gatewaysToStart[b.GatewayType+string(b.GatewayKey)] = struct{}{}
 
-			bsToStart = append(bsToStart, b)
-		}
-		for _, b := range bsToStart {
-			// loggerDebugB := log.New(loggerDebug2.Writer(), loggerDebug2.Prefix()+fmt.Sprintf("[broadcast: %s] ", b.ID.String()), loggerDebug2.Flags())
-			loggerInfoB := log.New(loggerInfo2.Writer(), loggerInfo2.Prefix()+fmt.Sprintf("[broadcast: %s] ", b.ID.String()), loggerInfo2.Flags())
-			func() {
-				runningMutex.Lock()
-				defer runningMutex.Unlock()
-				runningBroadcasts[b.ID.String()] = struct{}{}
-				runningGateways[b.GatewayType+string(b.GatewayKey)] = struct{}{}
-			}()
-			loggerInfoB.Println("broadcast starting")
-			go func(b Broadcast) {
-				defer func() {
+		bsToStart = append(bsToStart, b)
+	}
+	for _, b := range bsToStart {
+		loggerInfoB := log.New(loggerInfo2.Writer(), loggerInfo2.Prefix()+fmt.Sprintf("[broadcast: %s] ", b.ID.String()), loggerInfo2.Flags())
+		ctxB, cancelB := context.WithCancel(ctx)
+		func() {
+			runningMutex.Lock()
+			defer runningMutex.Unlock()
+			runningBroadcasts[b.ID.String()] = struct{}{}
+			runningCancels[b.ID.String()] = cancelB
+			runningGateways[b.GatewayType+string(b.GatewayKey)] = struct{}{}
+			delete(retryAfter, b.ID.String())
+		}()
+		loggerInfoB.Println("broadcast starting")
+		wg.Add(1)
+		go func(b Broadcast) {
+			defer wg.Done()
+			var err error
+			defer func() {
+				func() {
 					runningMutex.Lock()
 					defer runningMutex.Unlock()
+					cancelB()
 					delete(runningBroadcasts, b.ID.String())
+					delete(runningCancels, b.ID.String())
 					delete(runningGateways, b.GatewayType+string(b.GatewayKey))
-				}()
-				err := run(ctx, b, db, loggerDebug, defaultSendHours, defaultTimezone)
-				if err != nil {
-					loggerInfoB.Printf("broadcast stopped: %s\n", err)
-					if errors.Is(err, android.ErrDeviceUnreachable) {
-						fyne.CurrentApp().SendNotification(&fyne.Notification{
-							Title:   "[Angaros] Broadcast stopped. Android device is unreachable",
-							Content: "Connect the Android device " + string(b.GatewayKey) + " via ADB or KDE Connect",
-						})
+					if err != nil {
+						retryAfter[b.ID.String()] = time.Now().Add(dispatcherRetryDelay)
 					}
-				} else {
-					loggerInfoB.Println("broadcast finished")
+				}()
+				// the gateway is free, so other broadcasts might be able to start
+				Wake()
+			}()
+			err = run(ctxB, b, db, loggerDebug, defaultSendHours, defaultTimezone)
+			if err != nil {
+				loggerInfoB.Printf("broadcast stopped: %s\n", err)
+				// fyne.CurrentApp() is nil when running without GUI
+				if errors.Is(err, android.ErrDeviceUnreachable) && fyne.CurrentApp() != nil {
+					fyne.CurrentApp().SendNotification(&fyne.Notification{
+						Title:   "[Angaros] Broadcast stopped. Android device is unreachable",
+						Content: "Connect the Android device " + string(b.GatewayKey) + " via ADB or KDE Connect",
+					})
+				} else if errorbehavior.IsPausing(err) && fyne.CurrentApp() != nil {
+					fyne.CurrentApp().SendNotification(&fyne.Notification{
+						Title:   "[Angaros] Broadcast paused. Resume it after fixing the problem",
+						Content: err.Error(),
+					})
 				}
-			}(b)
-		}
-		func() {
-			runningMutex.Lock()
-			defer runningMutex.Unlock()
-			runningBroadcastsKeys := make([]string, 0, len(runningBroadcasts))
-			for runningBroadcastKey := range runningBroadcasts {
-				runningBroadcastsKeys = append(runningBroadcastsKeys, runningBroadcastKey)
+			} else {
+				loggerInfoB.Println("broadcast finished")
 			}
-			loggerDebug2.Printf("%v broadcasts are currently running: %v\n", len(runningBroadcasts), runningBroadcastsKeys)
-		}()
+		}(b)
 	}
+	func() {
+		runningMutex.Lock()
+		defer runningMutex.Unlock()
+		runningBroadcastsKeys := make([]string, 0, len(runningBroadcasts))
+		for runningBroadcastKey := range runningBroadcasts {
+			runningBroadcastsKeys = append(runningBroadcastsKeys, runningBroadcastKey)
+		}
+		loggerDebug2.Printf("%v broadcasts are currently running: %v\n", len(runningBroadcasts), runningBroadcastsKeys)
+	}()
+	return next
 }
@@ -0,0 +1,311 @@
+package broadcast
+
+import (
+	crand "crypto/rand"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	bolt "go.etcd.io/bbolt"
+
+	"go.angaros.io/internal/dbutil"
+	"go.angaros.io/internal/gateway/email"
+	"go.angaros.io/internal/gateway/sms/android"
+)
+
+const (
+	ContactsFileTypeSingleColumn = "txt"
+	ContactsFileTypeCSV          = "csv"
+)
+
+// ContactsFile holds the content of a contacts file and the options needed to parse it.
+type ContactsFile struct {
+	Content         string
+	Type            string
+	Delimiter       rune
+	HasHeader       bool
+	RecipientColumn string
+}
+
+// IsHTMLFilename reports whether a message body file is HTML based on its extension
+func IsHTMLFilename(filename string) bool {
+	ext := strings.ToLower(filepath.Ext(filename))
+	return ext == ".html" || ext == ".htm"
+}
+
+// BodyTemplate is implemented by both text/template and html/template templates
+type BodyTemplate interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+// ParseBodyTemplate parses the message body as an html/template, which escapes the keywords, if isHTML is set
+func ParseBodyTemplate(body string, isHTML bool) (BodyTemplate, error) {
+	if isHTML {
+		return htmltemplate.New("msg").Parse(body)
+	}
+	return template.New("msg").Parse(body)
+}
+
+// ContactsFileTypeFromFilename returns the file type based on the file extension, or an empty string if unknown.
+func ContactsFileTypeFromFilename(filename string) string {
+	if strings.HasSuffix(filename, ".txt") {
+		return ContactsFileTypeSingleColumn
+	} else if strings.HasSuffix(filename, ".csv") {
+		return ContactsFileTypeCSV
+	}
+	return ""
+}
+
+func (f ContactsFile) ReadContacts() ([]Contact, error) {
+	if f.Content == "" {
+		return nil, fmt.Errorf("file is empty")
+	}
+	switch f.Type {
+	case ContactsFileTypeSingleColumn:
+		contacts, err := ReadContactsFromReader(strings.NewReader(f.Content))
+		if err != nil {
+			return nil, fmt.Errorf("error reading file: %s", err)
+		}
+		return contacts, nil
+	case ContactsFileTypeCSV:
+		// recipient column can be a name or a number
+		var recipientColumnInt int
+		var recipientColumnStr string
+		if f.RecipientColumn != "" {
+			var err error
+			recipientColumnInt, err = strconv.Atoi(f.RecipientColumn)
+			if err != nil {
+				recipientColumnStr = f.RecipientColumn
+			}
+		}
+		contacts, err := ReadContactsFromReaderCSV(strings.NewReader(f.Content), f.Delimiter, f.HasHeader, recipientColumnStr, recipientColumnInt)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read contacts from file: %s", err)
+		}
+		if len(contacts) == 0 {
+			return nil, fmt.Errorf("no contacts found on file")
+		}
+		return contacts, nil
+	default:
+		return nil, fmt.Errorf("unknown file type '%s'", f.Type)
+	}
+}
+
+// Input contains the user input needed to create a broadcast.
+// Optional fields are left empty.
+type Input struct {
+	Contacts []Contact
+	// set ContactListID instead of Contacts to send to a contact list.
+	// only contacts with all ContactListTags are included.
+	ContactListID   ulid.ULID
+	ContactListTags []string
+	Filename        string
+	MsgSubject      string
+	MsgBody         string
+	MsgBodyHTML     bool
+	GatewayType     string
+	GatewayKey      []byte
+	SendHours       string
+	Timezone        string
+	SendDateFrom    string
+	SendDateTo      string
+	// country of phone numbers without a country code, see GetDefaultCountryTx
+	DefaultCountry string
+	// attachments whose filename is referenced in the HTML body as cid:filename are inline
+	Attachments []Attachment
+	// template of the path of a file attached to the message of each contact e.g. {{.invoice_file}}.
+	// The paths are relative to ContactAttachmentDir, or the current directory if empty, and must be inside it.
+	ContactAttachment    string
+	ContactAttachmentDir string
+	// maximum number of contacts sent the same message in one transaction, see Broadcast.BatchSize
+	BatchSize int
+	// subscription ID of the SIM of android gateways, see Broadcast.SubscriptionID
+	SubscriptionID int
+}
+
+// NewFromInput validates the input and returns a new broadcast and the contacts that were rejected.
+// The broadcast is not saved to the database.
+func NewFromInput(in Input) (Broadcast, []RejectedContact, error) {
+	if in.ContactListID != (ulid.ULID{}) {
+		if len(in.Contacts) > 0 {
+			return Broadcast{}, nil, fmt.Errorf("set either contacts or contact list, not both")
+		}
+	} else if len(in.Contacts) == 0 {
+		return Broadcast{}, nil, fmt.Errorf("no contacts")
+	}
+	var rejected []RejectedContact
+	if len(in.Contacts) > 0 {
+		switch in.GatewayType {
+		case tableNameDeviceAndroid:
+			in.Contacts, rejected = NormalizePhoneContacts(in.Contacts, in.DefaultCountry)
+			if len(in.Contacts) == 0 {
+				return Broadcast{}, rejected, fmt.Errorf("no valid phone numbers")
+			}
+		case tableNameEmailIdentity:
+			in.Contacts, rejected = NormalizeEmailContacts(in.Contacts)
+			if len(in.Contacts) == 0 {
+				return Broadcast{}, rejected, fmt.Errorf("no valid email addresses")
+			}
+		}
+	}
+	_, err := template.New("msg_subject").Parse(in.MsgSubject)
+	if err != nil {
+		return Broadcast{}, nil, fmt.Errorf("failed to parse message subject: %s", err)
+	}
+	if in.MsgBodyHTML && in.GatewayType != tableNameEmailIdentity {
+		return Broadcast{}, nil, fmt.Errorf("HTML message body is only supported by email gateways")
+	}
+	_, err = ParseBodyTemplate(in.MsgBody, in.MsgBodyHTML)
+	if err != nil {
+		return Broadcast{}, nil, fmt.Errorf("failed to parse message body: %s", err)
+	}
+	if (len(in.Attachments) > 0 || in.ContactAttachment != "") && in.GatewayType != tableNameEmailIdentity {
+		return Broadcast{}, nil, fmt.Errorf("attachments are only supported by email gateways")
+	}
+	var attachmentsSize int
+	attachments := make([]Attachment, 0, len(in.Attachments))
+	filenames := make(map[string]struct{}, len(in.Attachments))
+	for _, a := range in.Attachments {
+		if _, exists := filenames[a.Filename]; exists {
+			return Broadcast{}, nil, fmt.Errorf("more than one attachment with filename %s", a.Filename)
+		}
+		filenames[a.Filename] = struct{}{}
+		a.Inline = in.MsgBodyHTML && strings.Contains(in.MsgBody, "cid:"+a.Filename)
+		if a.Inline {
+			if err := validateInlineFilename(a.Filename); err != nil {
+				return Broadcast{}, nil, err
+			}
+		}
+		attachmentsSize += a.Size
+		attachments = append(attachments, a)
+	}
+	if attachmentsSize > maxAttachmentsSize {
+		return Broadcast{}, nil, fmt.Errorf("attachments are too large (%d MB), the maximum is %d MB", attachmentsSize>>20, maxAttachmentsSize>>20)
+	}
+	var contactAttachmentDir string
+	if in.ContactAttachment != "" {
+		tmpl, err := template.New("attachment").Parse(in.ContactAttachment)
+		if err != nil {
+			return Broadcast{}, nil, fmt.Errorf("failed to parse contact attachment: %s", err)
+		}
+		// store an absolute directory because the dispatcher might run from another directory
+		contactAttachmentDir, err = filepath.Abs(in.ContactAttachmentDir)
+		if err != nil {
+			return Broadcast{}, nil, fmt.Errorf("invalid contact attachment directory: %s", err)
+		}
+		if len(in.Contacts) > 0 {
+			var rejectedAttachment []RejectedContact
+			in.Contacts, rejectedAttachment = checkContactAttachments(in.Contacts, tmpl, contactAttachmentDir)
+			rejected = append(rejected, rejectedAttachment...)
+			if len(in.Contacts) == 0 {
+				return Broadcast{}, rejected, fmt.Errorf("no contacts with attachment files")
+			}
+		}
+	}
+	if in.GatewayType == "" || len(in.GatewayKey) == 0 {
+		return Broadcast{}, nil, fmt.Errorf("gateway not set")
+	}
+	if in.BatchSize < 0 || in.BatchSize > maxBatchSize {
+		return Broadcast{}, nil, fmt.Errorf("invalid batch size: value should be between 0 and %d", maxBatchSize)
+	}
+	if in.BatchSize > 1 && in.GatewayType != tableNameEmailIdentity {
+		return Broadcast{}, nil, fmt.Errorf("batches are only supported by email gateways")
+	}
+	if in.SubscriptionID < 0 {
+		return Broadcast{}, nil, fmt.Errorf("invalid SIM subscription ID: value should not be negative")
+	}
+	if in.SubscriptionID != 0 && in.GatewayType != tableNameDeviceAndroid {
+		return Broadcast{}, nil, fmt.Errorf("SIM subscriptions are only supported by android gateways")
+	}
+	var sendHours TimeRanges
+	if in.SendHours != "" {
+		sendHours, err = ParseTimeRanges(in.SendHours)
+		if err != nil {
+			return Broadcast{}, nil, fmt.Errorf("invalid time ranges: %s", err)
+		}
+	}
+	var timezone string
+	var loc *time.Location
+	if in.Timezone != "" {
+		fields := strings.Fields(in.Timezone)
+		if len(fields) == 0 {
+			return Broadcast{}, nil, fmt.Errorf("invalid time zone")
+		}
+		timezone = fields[0]
+		loc, err = time.LoadLocation(timezone)
+		if err != nil {
+			return Broadcast{}, nil, fmt.Errorf("invalid time zone: %s", err)
+		}
+	}
+	if loc == nil {
+		loc = time.Now().Location()
+	}
+	var sendDateFrom time.Time
+	if in.SendDateFrom != "" {
+		sendDateFrom, err = time.ParseInLocation("2006-01-02", in.SendDateFrom, loc)
+		if err != nil {
+			return Broadcast{}, nil, fmt.Errorf("invalid date: %s", err)
+		}
+	}
+	var sendDateTo time.Time
+	if in.SendDateTo != "" {
+		sendDateTo, err = time.ParseInLocation("2006-01-02", in.SendDateTo, loc)
+		if err != nil {
+			return Broadcast{}, nil, fmt.Errorf("invalid date: %s", err)
+		}
+	}
+	id, err := ulid.New(ulid.Timestamp(time.Now()), crand.Reader)
+	if err != nil {
+		return Broadcast{}, nil, fmt.Errorf("cannot create broadcast ID: %s", err)
+	}
+	return Broadcast{
+		ID:              id,
+		Contacts:        in.Contacts,
+		ContactListID:   in.ContactListID,
+		ContactListTags: in.ContactListTags,
+		MsgSubject:      in.MsgSubject,
+		MsgBody:         in.MsgBody,
+		MsgBodyHTML:     in.MsgBodyHTML,
+		MsgBodyFile:     in.Filename,
+		Attachments:     attachments,
+		GatewayType:     in.GatewayType,
+		GatewayKey:      in.GatewayKey,
+		SendDateFrom:    sendDateFrom,
+		SendDateTo:      sendDateTo,
+		SendHours:       sendHours,
+		Timezone:        timezone,
+		CreatedAt:       time.Now(),
+
+		ContactAttachment:    in.ContactAttachment,
+		ContactAttachmentDir: contactAttachmentDir,
+
+		BatchSize:      in.BatchSize,
+		SubscriptionID: in.SubscriptionID,
+	}, rejected, nil
+}
+
+// GetGatewayTx finds the gateway (email identity or android device) with the given key.
+func GetGatewayTx(tx *bolt.Tx, key []byte) (dbutil.Saveable, error) {
+	var id email.Identity
+	err := dbutil.GetByKeyTx(tx, key, &id)
+	if err == nil {
+		return id, nil
+	} else if !errors.Is(err, dbutil.ErrNotFound) {
+		return nil, fmt.Errorf("failed to read email identity from database: %s", err)
+	}
+	var dev android.Device
+	err = dbutil.GetByKeyTx(tx, key, &dev)
+	if err == nil {
+		return dev, nil
+	} else if !errors.Is(err, dbutil.ErrNotFound) {
+		return nil, fmt.Errorf("failed to read android device from database: %s", err)
+	}
+	return nil, fmt.Errorf("gateway %s not found", key)
+}
@@ -0,0 +1,124 @@
+package broadcast
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	bolt "go.etcd.io/bbolt"
+
+	"go.angaros.io/internal/dbutil"
+)
+
+// Reply is an SMS received from a contact of a broadcast after the message was sent to it
+type Reply struct {
+	BroadcastID ulid.ULID
+	Index       int    // index of the contact
+	From        string // number of the sender as reported by the phone
+	Body        string
+	ReceivedAt  time.Time
+	// OptOut is set if the reply is an opt-out keyword e.g. STOP, so the contact was added to the suppression list
+	OptOut bool
+}
+
+func (r Reply) DBTable() string {
+	return "broadcast.reply"
+}
+
+// DBKey orders the replies of a broadcast by the time they were received.
+// A reply that is read again from the phone has the same key.
+func (r Reply) DBKey() []byte {
+	buf := make([]byte, 12)
+	binary.BigEndian.PutUint64(buf, uint64(r.ReceivedAt.UnixNano()/int64(time.Millisecond)))
+	binary.BigEndian.PutUint32(buf[8:], uint32(r.Index))
+	return bytes.Join([][]byte{r.BroadcastID[:], buf}, nil)
+}
+
+func (r Reply) ReceivedAtString() string {
+	return r.ReceivedAt.Local().Format("2006-01-02 15:04")
+}
+
+// ContactNumber is the number of the contact starting from 1
+func (r Reply) ContactNumber() int {
+	return r.Index + 1
+}
+
+func (r Reply) String() string {
+	var optOutStr string
+	if r.OptOut {
+		optOutStr = " (opt-out)"
+	}
+	return fmt.Sprintf("%s contact #%d %s: %s%s", r.ReceivedAtString(), r.Index+1, r.From, r.Body, optOutStr)
+}
+
+// SMSSend is a message sent to a contact by an android broadcast.
+// It is stored in an index ordered by the time it was sent, so that replies are matched without reading every Send.
+type SMSSend struct {
+	SendKey
+	GatewayKey []byte // android ID of the device
+	SentAt     time.Time
+}
+
+func (s SMSSend) DBTable() string {
+	return "broadcast.sms_send"
+}
+
+// DBKey orders the sends by the time they were sent
+func (s SMSSend) DBKey() []byte {
+	sentAt := make([]byte, 8)
+	binary.BigEndian.PutUint64(sentAt, uint64(s.SentAt.UnixNano()/int64(time.Millisecond)))
+	index := make([]byte, 4)
+	binary.BigEndian.PutUint32(index, uint32(s.Index))
+	return bytes.Join([][]byte{sentAt, s.BroadcastID[:], index}, nil)
+}
+
+// SMSSendsTx returns the messages sent by android broadcasts after since
+func SMSSendsTx(tx *bolt.Tx, since time.Time) ([]SMSSend, error) {
+	var start []byte
+	if since.After(time.Unix(0, 0)) {
+		start = SMSSend{SentAt: since}.DBKey()[:8]
+	}
+	var sends []SMSSend
+	err := dbutil.ForEachStartPrefixTx(tx, SMSSend{}.DBTable(), start, nil, &SMSSend{}, func(k []byte, v interface{}) error {
+		sends = append(sends, v.(SMSSend))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sends from database: %s", err)
+	}
+	return sends, nil
+}
+
+// deleteSMSSendsTx removes the messages of the broadcast from the index of SMSSend
+func deleteSMSSendsTx(tx *bolt.Tx, broadcastID ulid.ULID) error {
+	var keys [][]byte
+	err := dbutil.ForEachStartPrefixTx(tx, SMSSend{}.DBTable(), nil, nil, &SMSSend{}, func(k []byte, v interface{}) error {
+		if v.(SMSSend).BroadcastID == broadcastID {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := dbutil.DeleteByTableKeyTx(tx, SMSSend{}.DBTable(), k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecordReplyTx saves the reply and reports whether it is new
+func RecordReplyTx(tx *bolt.Tx, r Reply) (bool, error) {
+	err := dbutil.InsertSaveableTx(tx, r)
+	if errors.Is(err, dbutil.ErrKeyExists) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to save reply: %s", err)
+	}
+	return true, nil
+}
@@ -0,0 +1,69 @@
+package broadcast
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	bolt "go.etcd.io/bbolt"
+
+	"go.angaros.io/internal/dbutil"
+)
+
+func TestSMSSendsTx(t *testing.T) {
+	db := openTestDB(t)
+	now := time.Now()
+	// the IDs differ in the timestamp, since they have no entropy
+	b1 := Broadcast{ID: ulid.MustNew(ulid.Timestamp(now.Add(-72*time.Hour)), nil), GatewayType: tableNameDeviceAndroid, GatewayKey: []byte("phone")}
+	b2 := Broadcast{ID: ulid.MustNew(ulid.Timestamp(now.Add(-3*time.Hour)), nil), GatewayType: tableNameDeviceAndroid, GatewayKey: []byte("phone")}
+	sends := []SMSSend{
+		{SendKey: SendKey{BroadcastID: b1.ID, Index: 0, Recipient: "+306912345670"}, GatewayKey: b1.GatewayKey, SentAt: now.Add(-48 * time.Hour)},
+		{SendKey: SendKey{BroadcastID: b2.ID, Index: 0, Recipient: "+306912345670"}, GatewayKey: b2.GatewayKey, SentAt: now.Add(-2 * time.Hour)},
+		{SendKey: SendKey{BroadcastID: b1.ID, Index: 1, Recipient: "+306912345671"}, GatewayKey: b1.GatewayKey, SentAt: now.Add(-time.Hour)},
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for _, b := range []Broadcast{b1, b2} {
+			if err := dbutil.UpsertSaveableTx(tx, b); err != nil {
+				return err
+			}
+		}
+		for _, s := range sends {
+			if err := dbutil.UpsertSaveableTx(tx, s); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	smsSends := func(since time.Time) []SendKey {
+		t.Helper()
+		var keys []SendKey
+		if err := db.View(func(tx *bolt.Tx) error {
+			got, err := SMSSendsTx(tx, since)
+			for _, s := range got {
+				keys = append(keys, s.SendKey)
+			}
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return keys
+	}
+
+	// only the sends after since are read, ordered by the time they were sent
+	if got, want := smsSends(now.Add(-24*time.Hour)), []SendKey{sends[1].SendKey, sends[2].SendKey}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SMSSendsTx() = %v, want %v", got, want)
+	}
+
+	// the sends of a deleted broadcast are removed from the index
+	if err := db.Update(func(tx *bolt.Tx) error {
+		return DeleteTx(tx, b1.DBKey())
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := smsSends(time.Time{}), []SendKey{sends[1].SendKey}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SMSSendsTx() after delete = %v, want %v", got, want)
+	}
+}
@@ -21,6 +21,8 @@ import (
 	"go.angaros.io/internal/gateway"
 	"go.angaros.io/internal/gateway/email"
 	"go.angaros.io/internal/gateway/sms/android"
+	"go.angaros.io/internal/suppression"
+	"go.angaros.io/internal/unsubscribe"
 )
 
 type Run struct {
@@ -50,6 +52,14 @@ func newRun(db *bolt.DB, b Broadcast) (Run, error) {
 	if err != nil && !errors.Is(err, dbutil.ErrNotFound) {
 		return Run{}, fmt.Errorf("cannot read broadcast run from database: %s", err)
 	}
+	if errors.Is(err, dbutil.ErrNotFound) && b.ContactListID != (ulid.ULID{}) {
+		// copy the recipients of the contact list when the broadcast starts
+		if err := db.Update(func(tx *bolt.Tx) error {
+			return snapshotContactListTx(tx, &b)
+		}); err != nil {
+			return Run{}, fmt.Errorf("cannot copy contacts from contact list: %s", err)
+		}
+	}
 	if b.GatewayType == tableNameEmailIdentity {
 		senderClient, err := email.NewSenderClientFromKey(db, b.GatewayKey)
 		if err != nil {
@@ -67,6 +77,10 @@ func newRun(db *bolt.DB, b Broadcast) (Run, error) {
 		if err != nil {
 			return Run{}, fmt.Errorf("cannot create sender client from key: %s error: %s", b.GatewayKey, err)
 		}
+		if b.SubscriptionID != 0 && b.SubscriptionID != senderClient.SubscriptionID {
+			senderClient.SubscriptionID = b.SubscriptionID
+			senderClient.SubscriptionName = ""
+		}
 		return Run{
 			BroadcastID:  b.ID,
 			broadcast:    b,
@@ -78,11 +92,39 @@ func newRun(db *bolt.DB, b Broadcast) (Run, error) {
 	return Run{}, fmt.Errorf("unknown b.GatewayType %s", b.GatewayType)
 }
 
+// values of Send.Sent
+const (
+	SentNo         = 0
+	SentMaybe      = 1
+	SentYes        = 2
+	SentSuppressed = 3 // not sent because the recipient is in the suppression list
+	SentRejected   = 4 // not sent because the server rejected it permanently, e.g. unknown recipient
+)
+
 type Send struct {
 	BroadcastID ulid.ULID
 	Index       int
 	Sent        int
 	ErrorStr    string
+	// ErrorCode is the status code of the server if the send failed, e.g. "550 5.1.1" for SMTP
+	ErrorCode string
+
+	// SentAt is the time the message was sent, used to match replies
+	SentAt time.Time
+
+	// Batched is set if the message was sent to many contacts at once,
+	// and BatchFirst is the index of the first contact of the batch
+	Batched    bool
+	BatchFirst int
+
+	// Status is what the gateway did with the message after it was sent, e.g. "queued", "sent" or "failed"
+	// for an SMS in the SMS provider of the phone. Empty if unknown. A message with the status "failed" is not sent
+	Status string
+
+	// Bounce is the delivery failure reported by the recipient's server after the message was sent,
+	// e.g. "5.1.1 user unknown"
+	Bounce     string
+	HardBounce bool
 }
 
 func (b Send) DBTable() string {
@@ -95,23 +137,40 @@ func (b Send) DBKey() []byte {
 	return bytes.Join([][]byte{b.BroadcastID[:], buf}, nil)
 }
 
-func (b Send) String() string {
-	var sentStr string
+func (b Send) SentString() string {
 	switch b.Sent {
-	case 0:
-		sentStr = "NO"
-	case 1:
-		sentStr = "?"
-	case 2:
-		sentStr = "YES"
+	case SentNo:
+		return "NO"
+	case SentMaybe:
+		return "?"
+	case SentYes:
+		return "YES"
+	case SentSuppressed:
+		return "SUPPRESSED"
+	case SentRejected:
+		return "REJECTED"
 	default:
-		sentStr = "invalid value"
+		return "invalid value"
 	}
+}
+
+func (b Send) String() string {
 	var errorStr string
+	if b.ErrorCode != "" {
+		errorStr = ", code=" + b.ErrorCode
+	}
 	if b.ErrorStr != "" {
-		errorStr = ", error=" + b.ErrorStr
+		errorStr += ", error=" + b.ErrorStr
+	}
+	var statusStr string
+	if b.Status != "" {
+		statusStr = ", status=" + b.Status
 	}
-	return fmt.Sprintf("contact #%d: sent=%s%s", b.Index+1, sentStr, errorStr)
+	var bounceStr string
+	if b.Bounce != "" {
+		bounceStr = ", bounce=" + b.Bounce
+	}
+	return fmt.Sprintf("contact #%d: sent=%s%s%s%s", b.Index+1, b.SentString(), statusStr, errorStr, bounceStr)
 }
 
 func run(ctx context.Context, b Broadcast, db *bolt.DB, loggerDebug *log.Logger, defaultSendHours SettingSendHours, defaultTimezone SettingTimezone) error {
@@ -122,9 +181,14 @@ func run(ctx context.Context, b Broadcast, db *bolt.DB, loggerDebug *log.Logger,
 	if err != nil {
 		return fmt.Errorf("broadcast %s could not be started - newRun() failed: %s", b.ID.String(), err)
 	}
-	err = bRun.senderClient.PreSend(ctx)
+	return bRun.send(ctx, b, db, loggerDebug, loggerDebugRun, defaultSendHours, defaultTimezone)
+}
+
+// send sends the message to the contacts of the run with its sender client, starting from NextIndex
+func (bRun *Run) send(ctx context.Context, b Broadcast, db *bolt.DB, loggerDebug *log.Logger, loggerDebugRun *log.Logger, defaultSendHours SettingSendHours, defaultTimezone SettingTimezone) error {
+	err := bRun.senderClient.PreSend(ctx)
 	if err != nil {
-		return fmt.Errorf("preSend() failed: %w", err)
+		return pauseIfPausing(db, b, fmt.Errorf("preSend() failed: %w", err))
 	}
 	defer func() {
 		err = bRun.senderClient.PostSend(ctx)
@@ -136,31 +200,144 @@ func run(ctx context.Context, b Broadcast, db *bolt.DB, loggerDebug *log.Logger,
 	if err != nil {
 		return fmt.Errorf("template.Parse failed: %s", err)
 	}
-	msgTmplBody, err := template.New("msg").Parse(bRun.broadcast.MsgBody)
+	msgTmplBody, err := ParseBodyTemplate(bRun.broadcast.MsgBody, bRun.broadcast.MsgBodyHTML)
 	if err != nil {
 		return fmt.Errorf("template.Parse failed: %s", err)
 	}
+	attachments, err := loadAttachments(db, bRun.broadcast)
+	if err != nil {
+		return err
+	}
+	attachmentsSize := 0
+	for _, a := range attachments {
+		attachmentsSize += len(a.Data)
+	}
+	var unsubscribeURL func(recipient string) string
+	if err := db.Update(func(tx *bolt.Tx) error {
+		var err error
+		unsubscribeURL, err = unsubscribe.NewURLFuncTx(tx)
+		return err
+	}); err != nil {
+		return err
+	}
+	var contactAttachmentTmpl *template.Template
+	if bRun.broadcast.ContactAttachment != "" {
+		contactAttachmentTmpl, err = template.New("attachment").Parse(bRun.broadcast.ContactAttachment)
+		if err != nil {
+			return fmt.Errorf("template.Parse failed: %s", err)
+		}
+	}
 	var μ time.Duration
 	if bRun.senderClient.GetLimitPerMinute() > 0 {
 		μ = time.Minute / time.Duration(bRun.senderClient.GetLimitPerMinute())
 	}
+	// the send counts of the limits are kept per gateway, or per part of it e.g. per SIM
+	sendCountsKeyPrefix := b.GatewayType + string(b.GatewayKey)
+	if limitScoper, ok := bRun.senderClient.(gateway.LimitScoper); ok && limitScoper.LimitScope() != "" {
+		sendCountsKeyPrefix += "/" + limitScoper.LimitScope()
+	}
+	// the statuses of the last messages are checked when the run stops, without waiting for queued messages
+	statuser, _ := bRun.senderClient.(gateway.SendStatuser)
+	var statusChecks []statusCheck
+	defer func() {
+		if _, err := bRun.checkSendStatuses(context.Background(), db, statuser, statusChecks, true, loggerDebugRun); err != nil {
+			loggerDebugRun.Printf("failed to record send statuses: %v\n", err)
+		}
+	}()
+	batchSize := 1
+	batchSender, ok := bRun.senderClient.(gateway.BatchSender)
+	if ok && bRun.broadcast.BatchSize > 1 {
+		batchSize = bRun.broadcast.BatchSize
+	}
+	// render returns the message of the contact, or the reason to skip the contact
+	render := func(c Contact) (gateway.Message, error, error) {
+		var contactUnsubscribeURL string
+		if unsubscribeURL != nil {
+			contactUnsubscribeURL = unsubscribeURL(c.Recipient)
+		}
+		data := templateData(c, contactUnsubscribeURL)
+		var bufSubject strings.Builder
+		err := msgTmplSubject.Execute(&bufSubject, data)
+		if err != nil {
+			return gateway.Message{}, nil, fmt.Errorf("msgTemplate.ExecuteTemplate failed: %s", err)
+		}
+		var bufBody strings.Builder
+		err = msgTmplBody.Execute(&bufBody, data)
+		if err != nil {
+			return gateway.Message{}, nil, fmt.Errorf("msgTemplate.ExecuteTemplate failed: %s", err)
+		}
+		msgAttachments := attachments
+		if contactAttachmentTmpl != nil {
+			a, err := readContactAttachment(contactAttachmentTmpl, bRun.broadcast.ContactAttachmentDir, c, maxAttachmentsSize-attachmentsSize)
+			if err != nil {
+				// the file might have been deleted after the broadcast was created
+				return gateway.Message{}, err, nil
+			}
+			if a != nil {
+				msgAttachments = append(msgAttachments[:len(msgAttachments):len(msgAttachments)], *a)
+			}
+		}
+		msg := gateway.Message{Subject: bufSubject.String(), Text: bufBody.String(), Attachments: msgAttachments, UnsubscribeURL: contactUnsubscribeURL}
+		if bRun.broadcast.MsgBodyHTML {
+			msg.Text, msg.HTML = "", bufBody.String()
+		}
+		return msg, nil, nil
+	}
 	for i := bRun.NextIndex; i < bRun.Length; i++ {
 		loggerDebugRunI := log.New(loggerDebug.Writer(), loggerDebugRun.Prefix()+fmt.Sprintf("[i=%d] ", i), loggerDebug.Flags())
 	restart:
+		// check if broadcast has been paused, cancelled or deleted
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("broadcast has stopped: %w", err)
+		}
+		active, err := isActive(db, b)
+		if err != nil {
+			return err
+		}
+		if !active {
+			return fmt.Errorf("broadcast has stopped because it was paused, cancelled or deleted")
+		}
+
 		// check if current time is within send hours
 		if b.startableNowUntil(defaultSendHours, defaultTimezone).IsZero() {
 			return fmt.Errorf("broadcast has stopped due to send hours")
 		}
 
-		// check limits
-		sendCountsKeyCurrentMinute := []byte(b.GatewayType + string(b.GatewayKey) + time.Now().Truncate(time.Minute).Format("2006-01-02T15:04"))
-		sendCountsKeyPastHour := []byte(b.GatewayType + string(b.GatewayKey) + time.Now().Add(-time.Hour).Truncate(time.Minute).Format("2006-01-02T15:04"))
-		sendCountsKeyPastDay := []byte(b.GatewayType + string(b.GatewayKey) + time.Now().Add(-24*time.Hour).Truncate(time.Minute).Format("2006-01-02T15:04"))
-		sendCountsKeyPrefix := []byte(b.GatewayType + string(b.GatewayKey))
+		// skip the contacts that were sent in a batch, if the run stopped before the other contacts of the batch were sent
+		handled, err := isHandled(db, b.ID, i)
+		if err != nil {
+			return err
+		}
+		if handled {
+			loggerDebugRunI.Println("contact was sent in a previous run - skipping")
+			if err := bRun.advance(db, i, nil); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// skip suppressed recipients without counting them in the limits
+		c := bRun.broadcast.Contacts[i]
+		suppressed, err := bRun.skipIfSuppressed(db, i, c.Recipient)
+		if err != nil {
+			return err
+		}
+		if suppressed {
+			loggerDebugRunI.Printf("recipient %v is suppressed - skipping\n", c.Recipient)
+			continue
+		}
+
+		// check limits. A batch is not larger than the messages that can be sent within the limits
+		capacity := batchSize
+		sendCountsKeyCurrentMinute := []byte(sendCountsKeyPrefix + time.Now().Truncate(time.Minute).Format("2006-01-02T15:04"))
+		sendCountsKeyPastHour := []byte(sendCountsKeyPrefix + time.Now().Add(-time.Hour).Truncate(time.Minute).Format("2006-01-02T15:04"))
+		sendCountsKeyPastDay := []byte(sendCountsKeyPrefix + time.Now().Add(-24*time.Hour).Truncate(time.Minute).Format("2006-01-02T15:04"))
 		if bRun.senderClient.GetLimitPerMinute() > 0 {
 			sleepDur := time.Duration(float64(μ) * (1 + rand.ExpFloat64()) / 2)
 			loggerDebugRunI.Printf("sleeping for %v\n", sleepDur)
-			time.Sleep(sleepDur)
+			if err := sleep(ctx, sleepDur); err != nil {
+				return fmt.Errorf("broadcast has stopped: %w", err)
+			}
 			// count sent in the last minute
 			var count int
 			err := dbutil.GetByTableKey(db, "send_counts", sendCountsKeyCurrentMinute, &count)
@@ -171,15 +348,20 @@ func run(ctx context.Context, b Broadcast, db *bolt.DB, loggerDebug *log.Logger,
 				// duration til minute changes
 				sleepDur := time.Minute - time.Since(time.Now().Truncate(time.Minute))
 				loggerDebugRunI.Printf("sent in the current minute %d - limit reached (%d) - sleeping for %v\n", count, bRun.senderClient.GetLimitPerMinute(), sleepDur)
-				time.Sleep(sleepDur)
+				if err := sleep(ctx, sleepDur); err != nil {
+					return fmt.Errorf("broadcast has stopped: %w", err)
+				}
 				goto restart
 			}
 			loggerDebugRunI.Printf("sent in the current minute: %d\n", count)
+			if remaining := bRun.senderClient.GetLimitPerMinute() - count; remaining < capacity {
+				capacity = remaining
+			}
 		}
 		if bRun.senderClient.GetLimitPerHour() > 0 {
 			// count sent in the last 60 minutes
 			var count int
-			err := dbutil.ForEachStartPrefix(db, "send_counts", sendCountsKeyPastHour, sendCountsKeyPrefix, &count, func(key []byte, val interface{}) error {
+			err := dbutil.ForEachStartPrefix(db, "send_counts", sendCountsKeyPastHour, []byte(sendCountsKeyPrefix), &count, func(key []byte, val interface{}) error {
 				count += val.(int)
 				return nil
 			})
@@ -190,11 +372,14 @@ func run(ctx context.Context, b Broadcast, db *bolt.DB, loggerDebug *log.Logger,
 				return fmt.Errorf("sent in the last hour %d - limit reached (%d)", count, bRun.senderClient.GetLimitPerHour())
 			}
 			loggerDebugRunI.Printf("sent in the last hour: %d\n", count)
+			if remaining := bRun.senderClient.GetLimitPerHour() - count; remaining < capacity {
+				capacity = remaining
+			}
 		}
 		if bRun.senderClient.GetLimitPerDay() > 0 {
 			// count sent in the last 24 hours
 			var count int
-			err := dbutil.ForEachStartPrefix(db, "send_counts", sendCountsKeyPastDay, sendCountsKeyPrefix, &count, func(key []byte, val interface{}) error {
+			err := dbutil.ForEachStartPrefix(db, "send_counts", sendCountsKeyPastDay, []byte(sendCountsKeyPrefix), &count, func(key []byte, val interface{}) error {
 				count += val.(int)
 				return nil
 			})
@@ -205,22 +390,54 @@ func run(ctx context.Context, b Broadcast, db *bolt.DB, loggerDebug *log.Logger,
 				return fmt.Errorf("sent in the last 24 hours %d - limit reached (%d)", count, bRun.senderClient.GetLimitPerDay())
 			}
 			loggerDebugRunI.Printf("sent in the last 24 hours: %d\n", count)
+			if remaining := bRun.senderClient.GetLimitPerDay() - count; remaining < capacity {
+				capacity = remaining
+			}
 		}
 
 		// generate message subject & body
-		c := bRun.broadcast.Contacts[i]
-		var bufSubject strings.Builder
-		err = msgTmplSubject.Execute(&bufSubject, c.Keywords)
+		msg, skipReason, err := render(c)
 		if err != nil {
-			return fmt.Errorf("msgTemplate.ExecuteTemplate failed: %s", err)
+			return err
 		}
-		var bufBody strings.Builder
-		err = msgTmplBody.Execute(&bufBody, c.Keywords)
-		if err != nil {
-			return fmt.Errorf("msgTemplate.ExecuteTemplate failed: %s", err)
+		if skipReason != nil {
+			loggerDebugRunI.Printf("skipping %v: %s\n", c.Recipient, skipReason)
+			if err := bRun.skip(db, i, SentNo, skipReason.Error()); err != nil {
+				return err
+			}
+			continue
 		}
 
-		for attempt := 0; attempt < 4; attempt++ {
+		// the next contacts with the same message are sent in the same batch
+		batch := []int{i}
+		for j := i + 1; len(batch) < capacity && j < bRun.Length; j++ {
+			cj := bRun.broadcast.Contacts[j]
+			handled, err := isHandled(db, b.ID, j)
+			if err != nil {
+				return err
+			}
+			if handled {
+				break
+			}
+			_, suppressed, err := suppressionEntry(db, cj.Recipient)
+			if err != nil {
+				return err
+			}
+			if suppressed {
+				break
+			}
+			msgJ, skipReason, err := render(cj)
+			if err != nil {
+				return err
+			}
+			if skipReason != nil || !msgJ.Equal(msg) {
+				break
+			}
+			batch = append(batch, j)
+		}
+
+		pending := batch
+		for attempt := 0; attempt < 4 && len(pending) > 0; attempt++ {
 			loggerDebugRunIA := log.New(loggerDebug.Writer(), loggerDebugRunI.Prefix()+fmt.Sprintf("[attempt=%d] ", attempt), loggerDebug.Flags())
 
 			if attempt > 0 {
@@ -231,55 +448,127 @@ func run(ctx context.Context, b Broadcast, db *bolt.DB, loggerDebug *log.Logger,
 				// sleep for 1*μ2, 4*μ2, 16*μ2 seconds
 				sleepDur := time.Duration(math.Pow(4, float64(attempt-1))) * μ2
 				loggerDebugRunIA.Printf("sleeping for %v\n", sleepDur)
-				time.Sleep(sleepDur)
+				if err := sleep(ctx, sleepDur); err != nil {
+					return fmt.Errorf("broadcast has stopped: %w", err)
+				}
 			}
 
-			var sent int
-
 			// send message
-			loggerDebugRunIA.Printf("sending message to %v\n", c.Recipient)
-			errSend := bRun.senderClient.Send(ctx, c.Recipient, bufSubject.String(), bufBody.String(), b.ID.String())
-			// log if message was sent
-			if errSend == nil {
-				loggerDebugRunIA.Printf("message sent to %v\n", c.Recipient)
-				sent = 2 // message sent
-			} else if errorbehavior.IsRetryable(errSend) {
-				loggerDebugRunIA.Printf("send failed with retryable error: %s\n", errSend)
-				sent = 0 // message not sent
+			recipients := make([]string, len(pending))
+			for k, j := range pending {
+				recipients[k] = bRun.broadcast.Contacts[j].Recipient
+			}
+			loggerDebugRunIA.Printf("sending message to %v\n", strings.Join(recipients, ", "))
+			var errsSend []error
+			sentAt := time.Now()
+			if len(pending) == 1 {
+				errsSend = []error{bRun.senderClient.Send(ctx, recipients[0], msg, b.ID.String())}
 			} else {
-				loggerDebugRunIA.Printf("send failed with non-retryable error: %s\n", errSend)
-				sent = 1 // message maybe sent
+				errsSend = batchSender.SendBatch(ctx, recipients, msg, b.ID.String())
 			}
-
-			// update DB
-			bRun.NextIndex = i + 1
-			errDB := db.Update(func(tx *bolt.Tx) error {
-				var errStr string
-				if errSend != nil {
-					errStr = fmt.Sprintf("%s", errSend)
+			// log if message was sent
+			sents := make([]int, len(pending))
+			var errPausing error
+			var reconnect bool
+			for k, errSend := range errsSend {
+				if errSend == nil {
+					loggerDebugRunIA.Printf("message sent to %v\n", recipients[k])
+					sents[k] = SentYes
+				} else if errorbehavior.IsPausing(errSend) {
+					loggerDebugRunIA.Printf("send to %v failed with an error of the gateway: %s\n", recipients[k], errSend)
+					sents[k] = SentNo
+					errPausing = errSend
+				} else if errorbehavior.IsRejected(errSend) {
+					loggerDebugRunIA.Printf("send to %v rejected: %s\n", recipients[k], errSend)
+					sents[k] = SentRejected
+				} else if errorbehavior.IsRetryable(errSend) {
+					loggerDebugRunIA.Printf("send to %v failed with retryable error: %s\n", recipients[k], errSend)
+					sents[k] = SentNo
+					reconnect = true
+				} else {
+					loggerDebugRunIA.Printf("send to %v failed with non-retryable error: %s\n", recipients[k], errSend)
+					sents[k] = SentMaybe
+					reconnect = true
 				}
-				err = dbutil.UpsertSaveableTx(tx, Send{BroadcastID: b.ID, Index: i, Sent: sent, ErrorStr: errStr})
-				if err != nil {
-					return fmt.Errorf("failed to update Send: %s", err)
+			}
+
+			// update DB. The run continues from the first contact of the batch that was not sent,
+			// so that it is sent again if the run stops before the retries
+			bRun.NextIndex = batch[len(batch)-1] + 1
+			for k, j := range pending {
+				if sents[k] == SentNo {
+					bRun.NextIndex = j
+					break
 				}
-				if sent == 0 {
-					// message wasn't sent so don't count it
-					return nil
+			}
+			var deleted bool
+			errDB := db.Update(func(tx *bolt.Tx) error {
+				// don't store sends of a deleted broadcast, but count them below
+				var current Broadcast
+				err := dbutil.GetByKeyTx(tx, b.DBKey(), &current)
+				if err != nil && !errors.Is(err, dbutil.ErrNotFound) {
+					return fmt.Errorf("failed to read broadcast: %s", err)
 				}
+				deleted = errors.Is(err, dbutil.ErrNotFound)
 
-				// increase send_counts
-				var count int
-				err := dbutil.GetByTableKeyTx(tx, "send_counts", sendCountsKeyCurrentMinute, &count)
-				if err != nil && !errors.Is(err, dbutil.ErrNotFound) {
-					return fmt.Errorf("failed to read count: %s", err)
+				// the run continues with the next contacts if the message was sent or rejected,
+				// otherwise the contacts are sent again when the broadcast is restarted
+				var sentCount int
+				var storeRun bool
+				for k, j := range pending {
+					var errStr, errCode string
+					if errsSend[k] != nil {
+						errStr = fmt.Sprintf("%s", errsSend[k])
+						var errStatusCoder gateway.StatusCoder
+						if errors.As(errsSend[k], &errStatusCoder) {
+							errCode = errStatusCoder.StatusCode()
+						}
+					}
+					if !deleted {
+						bSend := Send{BroadcastID: b.ID, Index: j, Sent: sents[k], ErrorStr: errStr, ErrorCode: errCode}
+						if sents[k] == SentYes || sents[k] == SentMaybe {
+							bSend.SentAt = sentAt
+						}
+						if len(batch) > 1 {
+							bSend.Batched, bSend.BatchFirst = true, batch[0]
+						}
+						err = dbutil.UpsertSaveableTx(tx, bSend)
+						if err != nil {
+							return fmt.Errorf("failed to update Send: %s", err)
+						}
+						if b.GatewayType == tableNameDeviceAndroid && !bSend.SentAt.IsZero() {
+							// index the SMS to match the replies of the contact
+							smsSend := SMSSend{SendKey: SendKey{BroadcastID: b.ID, Index: j, Recipient: recipients[k]}, GatewayKey: b.GatewayKey, SentAt: sentAt}
+							err = dbutil.UpsertSaveableTx(tx, smsSend)
+							if err != nil {
+								return fmt.Errorf("failed to update SMSSend: %s", err)
+							}
+						}
+					}
+					if sents[k] == SentYes || sents[k] == SentMaybe {
+						sentCount++
+					}
+					storeRun = storeRun || sents[k] != SentNo
 				}
-				err = dbutil.UpsertTableKeyValueTx(tx, "send_counts", sendCountsKeyCurrentMinute, count+1)
-				if err != nil {
-					return fmt.Errorf("failed to store count: %s", err)
+
+				if sentCount > 0 {
+					// increase send_counts by the number of recipients
+					var count int
+					err = dbutil.GetByTableKeyTx(tx, "send_counts", sendCountsKeyCurrentMinute, &count)
+					if err != nil && !errors.Is(err, dbutil.ErrNotFound) {
+						return fmt.Errorf("failed to read count: %s", err)
+					}
+					err = dbutil.UpsertTableKeyValueTx(tx, "send_counts", sendCountsKeyCurrentMinute, count+sentCount)
+					if err != nil {
+						return fmt.Errorf("failed to store count: %s", err)
+					}
 				}
 
 				// update broadcast run
-				err = dbutil.UpsertSaveableTx(tx, bRun)
+				if deleted || !storeRun {
+					return nil
+				}
+				err = dbutil.UpsertSaveableTx(tx, *bRun)
 				if err != nil {
 					return fmt.Errorf("failed to store run: %s", err)
 				}
@@ -289,9 +578,31 @@ func run(ctx context.Context, b Broadcast, db *bolt.DB, loggerDebug *log.Logger,
 			if errDB != nil {
 				return fmt.Errorf("failed to update database: %s", errDB)
 			}
+			if deleted {
+				return fmt.Errorf("broadcast has stopped because it was deleted")
+			}
 
-			// if send error, call PostSend() and PreSend() to find out if there is a connection issue
-			if errSend != nil {
+			// ask the gateway later what happened to the messages, e.g. whether the phone sent the SMS
+			if statuser != nil {
+				for k, j := range pending {
+					if sents[k] == SentYes {
+						statusChecks = append(statusChecks, statusCheck{index: j, to: recipients[k], sentAt: sentAt, sendCountsKey: sendCountsKeyCurrentMinute})
+					}
+				}
+				statusChecks, err = bRun.checkSendStatuses(ctx, db, statuser, statusChecks, false, loggerDebugRunIA)
+				if err != nil {
+					return err
+				}
+			}
+
+			// if no recipient of the batch was sent, the run was not stored and the batch is sent again when the broadcast is resumed
+			if errPausing != nil {
+				return pauseIfPausing(db, b, errPausing)
+			}
+
+			// if send error, call PostSend() and PreSend() to find out if there is a connection issue.
+			// A rejection is a reply of the server, so the connection works
+			if reconnect {
 				err = bRun.senderClient.PostSend(ctx)
 				if err != nil {
 					loggerDebugRunIA.Printf("PostSend() failed: %v\n", err)
@@ -299,16 +610,224 @@ func run(ctx context.Context, b Broadcast, db *bolt.DB, loggerDebug *log.Logger,
 				errPreSend := bRun.senderClient.PreSend(ctx)
 				// abort run on PreSend() failure
 				if errPreSend != nil {
-					return fmt.Errorf("preSend() failed: %w", errPreSend)
+					return pauseIfPausing(db, b, fmt.Errorf("preSend() failed: %w", errPreSend))
 				}
 			}
 
-			// exit loop if message was sent or maybe sent
-			if sent > 0 {
-				break
+			// retry the recipients that were not sent
+			var retry []int
+			for k, j := range pending {
+				if sents[k] == SentNo {
+					retry = append(retry, j)
+				}
 			}
+			pending = retry
 		}
+		i = batch[len(batch)-1]
 	}
 	loggerDebugRun.Println("run finished")
 	return nil
 }
+
+// statusCheck is a message whose status is asked from the gateway after it was sent
+type statusCheck struct {
+	index  int
+	to     string
+	sentAt time.Time
+	// sendCountsKey is the key of send_counts where the message was counted
+	sendCountsKey []byte
+}
+
+const (
+	// sendStatusDelay is how long after a send its status is first checked
+	sendStatusDelay = 5 * time.Second
+	// sendStatusTimeout is how long the status of a queued message is checked again
+	sendStatusTimeout = 2 * time.Minute
+)
+
+// checkSendStatuses records the status of the messages that were sent at least sendStatusDelay ago.
+// Messages that are queued or not found yet are returned to be checked again after the next send, until sendStatusTimeout.
+// If final is set, every message is checked once and nothing is returned.
+func (bRun *Run) checkSendStatuses(ctx context.Context, db *bolt.DB, statuser gateway.SendStatuser, checks []statusCheck, final bool, logger *log.Logger) ([]statusCheck, error) {
+	var later []statusCheck
+	for _, c := range checks {
+		if !final && time.Since(c.sentAt) < sendStatusDelay {
+			later = append(later, c)
+			continue
+		}
+		status, err := statuser.SendStatus(ctx, c.to, c.sentAt)
+		if err != nil {
+			logger.Printf("cannot read send status of %v: %s\n", c.to, err)
+			continue
+		}
+		if (status == "" || status == gateway.SendStatusQueued) && !final && time.Since(c.sentAt) < sendStatusTimeout {
+			later = append(later, c)
+			continue
+		}
+		logger.Printf("send status of %v: %q\n", c.to, status)
+		if status == "" {
+			continue
+		}
+		if err := bRun.recordSendStatus(db, c, status); err != nil {
+			return later, err
+		}
+	}
+	return later, nil
+}
+
+// recordSendStatus stores the status of a sent message. A message that the gateway failed to send is stored as not sent
+// and is removed from the send counts of the limits.
+func (bRun *Run) recordSendStatus(db *bolt.DB, c statusCheck, status string) error {
+	err := db.Update(func(tx *bolt.Tx) error {
+		bSend := Send{BroadcastID: bRun.BroadcastID, Index: c.index}
+		err := dbutil.GetByKeyTx(tx, bSend.DBKey(), &bSend)
+		if errors.Is(err, dbutil.ErrNotFound) {
+			// the broadcast was deleted
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read Send: %s", err)
+		}
+		bSend.Status = status
+		if status == gateway.SendStatusFailed && bSend.Sent == SentYes {
+			err = dbutil.DeleteByTableKeyTx(tx, SMSSend{}.DBTable(), SMSSend{SendKey: SendKey{BroadcastID: bRun.BroadcastID, Index: c.index}, SentAt: bSend.SentAt}.DBKey())
+			if err != nil {
+				return fmt.Errorf("failed to delete SMSSend: %s", err)
+			}
+			bSend.Sent = SentNo
+			bSend.SentAt = time.Time{}
+			bSend.ErrorStr = "the gateway failed to send the message"
+			var count int
+			err = dbutil.GetByTableKeyTx(tx, "send_counts", c.sendCountsKey, &count)
+			if err != nil && !errors.Is(err, dbutil.ErrNotFound) {
+				return fmt.Errorf("failed to read count: %s", err)
+			}
+			if count > 0 {
+				err = dbutil.UpsertTableKeyValueTx(tx, "send_counts", c.sendCountsKey, count-1)
+				if err != nil {
+					return fmt.Errorf("failed to store count: %s", err)
+				}
+			}
+		}
+		err = dbutil.UpsertSaveableTx(tx, bSend)
+		if err != nil {
+			return fmt.Errorf("failed to update Send: %s", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update database: %s", err)
+	}
+	return nil
+}
+
+// pauseIfPausing pauses the broadcast if err affects every message of the gateway, e.g. revoked credentials,
+// instead of failing the sends to the remaining contacts. It returns the error that stops the run.
+func pauseIfPausing(db *bolt.DB, b Broadcast, err error) error {
+	if !errorbehavior.IsPausing(err) {
+		return err
+	}
+	if errPause := db.Update(func(tx *bolt.Tx) error {
+		return PauseTx(tx, b.DBKey())
+	}); errPause != nil && !errors.Is(errPause, ErrInvalidState) {
+		return fmt.Errorf("failed to pause broadcast: %s. Error: %w", errPause, err)
+	}
+	return fmt.Errorf("broadcast has been paused: %w", err)
+}
+
+// suppressionEntry returns the entry of the recipient in the suppression list, if any
+func suppressionEntry(db *bolt.DB, recipient string) (suppression.Entry, bool, error) {
+	var entry suppression.Entry
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		entry, err = suppression.GetTx(tx, recipient)
+		return err
+	})
+	if errors.Is(err, dbutil.ErrNotFound) {
+		return suppression.Entry{}, false, nil
+	}
+	if err != nil {
+		return suppression.Entry{}, false, fmt.Errorf("failed to read suppression list: %s", err)
+	}
+	return entry, true, nil
+}
+
+// isHandled reports whether the contact i already has a Send that is not SentNo.
+// Contacts after the NextIndex of a stored run have one if the run stopped while retrying other contacts of their batch.
+func isHandled(db *bolt.DB, broadcastID ulid.ULID, i int) (bool, error) {
+	bSend := Send{BroadcastID: broadcastID, Index: i}
+	err := dbutil.GetByKey(db, bSend.DBKey(), &bSend)
+	if errors.Is(err, dbutil.ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to read send of contact #%d: %s", i+1, err)
+	}
+	return bSend.Sent != SentNo, nil
+}
+
+// skipIfSuppressed records a suppressed Send and advances the run if the recipient is in the suppression list
+func (bRun *Run) skipIfSuppressed(db *bolt.DB, i int, recipient string) (bool, error) {
+	entry, suppressed, err := suppressionEntry(db, recipient)
+	if err != nil || !suppressed {
+		return false, err
+	}
+	return true, bRun.skip(db, i, SentSuppressed, "recipient is suppressed: "+entry.Reason)
+}
+
+// skip records a Send of the contact i without sending a message and advances the run
+func (bRun *Run) skip(db *bolt.DB, i int, sent int, errStr string) error {
+	return bRun.advance(db, i, &Send{BroadcastID: bRun.BroadcastID, Index: i, Sent: sent, ErrorStr: errStr})
+}
+
+// advance stores the run with the contact i done, and the Send of the contact if it is not nil
+func (bRun *Run) advance(db *bolt.DB, i int, bSend *Send) error {
+	err := db.Update(func(tx *bolt.Tx) error {
+		var current Broadcast
+		err := dbutil.GetByKeyTx(tx, bRun.BroadcastID[:], &current)
+		if errors.Is(err, dbutil.ErrNotFound) {
+			// deleted broadcast, the next isActive check stops the run
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read broadcast: %s", err)
+		}
+		if bSend != nil {
+			err = dbutil.UpsertSaveableTx(tx, *bSend)
+			if err != nil {
+				return fmt.Errorf("failed to update Send: %s", err)
+			}
+		}
+		bRun.NextIndex = i + 1
+		if err := dbutil.UpsertSaveableTx(tx, *bRun); err != nil {
+			return fmt.Errorf("failed to store run: %s", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update database: %s", err)
+	}
+	return nil
+}
+
+// templateData returns the data of the message templates: the keywords of the contact
+// and UnsubscribeURL, which is empty if the unsubscribe URL is not set in the settings
+func templateData(c Contact, unsubscribeURL string) map[string]string {
+	data := make(map[string]string, len(c.Keywords)+1)
+	for k, v := range c.Keywords {
+		data[k] = v
+	}
+	data["UnsubscribeURL"] = unsubscribeURL
+	return data
+}
+
+// sleep is like time.Sleep but returns early with an error if ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
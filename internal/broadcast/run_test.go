@@ -0,0 +1,248 @@
+package broadcast
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	bolt "go.etcd.io/bbolt"
+
+	"go.angaros.io/internal/dbutil"
+	"go.angaros.io/internal/errorbehavior"
+	"go.angaros.io/internal/gateway"
+)
+
+// fakeBatchSender returns the next error queued for each recipient, or nil if none is queued
+type fakeBatchSender struct {
+	mu    sync.Mutex
+	errs  map[string][]error
+	calls []string // the recipients of each call, joined with commas
+}
+
+func (f *fakeBatchSender) next(to string) error {
+	queue := f.errs[to]
+	if len(queue) == 0 {
+		return nil
+	}
+	f.errs[to] = queue[1:]
+	return queue[0]
+}
+
+func (f *fakeBatchSender) PreSend(ctx context.Context) error  { return nil }
+func (f *fakeBatchSender) PostSend(ctx context.Context) error { return nil }
+func (f *fakeBatchSender) GetLimitPerMinute() int             { return 0 }
+func (f *fakeBatchSender) GetLimitPerHour() int               { return 0 }
+func (f *fakeBatchSender) GetLimitPerDay() int                { return 0 }
+
+func (f *fakeBatchSender) Send(ctx context.Context, to string, msg gateway.Message, broadcastID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, to)
+	return f.next(to)
+}
+
+func (f *fakeBatchSender) SendBatch(ctx context.Context, to []string, msg gateway.Message, broadcastID string) []error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, strings.Join(to, ","))
+	errs := make([]error, len(to))
+	for i := range to {
+		errs[i] = f.next(to[i])
+	}
+	return errs
+}
+
+func openTestDB(t *testing.T) *bolt.DB {
+	t.Helper()
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// newTestBatchRun saves a broadcast to contacts a, b, c and d sent in one batch, and returns its run
+func newTestBatchRun(t *testing.T, db *bolt.DB, sender *fakeBatchSender) (Broadcast, *Run) {
+	t.Helper()
+	b := Broadcast{
+		ID:          ulid.MustNew(ulid.Now(), nil),
+		MsgSubject:  "subject",
+		MsgBody:     "body",
+		GatewayType: tableNameEmailIdentity,
+		BatchSize:   10,
+	}
+	for _, r := range []string{"a", "b", "c", "d"} {
+		b.Contacts = append(b.Contacts, Contact{Recipient: r + "@example.com"})
+	}
+	if err := dbutil.UpsertSaveable(db, b); err != nil {
+		t.Fatal(err)
+	}
+	return b, &Run{BroadcastID: b.ID, Length: len(b.Contacts), broadcast: b, senderClient: sender}
+}
+
+// checkSends compares the Sent values of the contacts of the broadcast
+func checkSends(t *testing.T, db *bolt.DB, b Broadcast, want []int) {
+	t.Helper()
+	got := make([]int, len(b.Contacts))
+	for i := range b.Contacts {
+		bSend := Send{BroadcastID: b.ID, Index: i}
+		if err := dbutil.GetByKey(db, bSend.DBKey(), &bSend); err != nil && !errors.Is(err, dbutil.ErrNotFound) {
+			t.Fatal(err)
+		}
+		got[i] = bSend.Sent
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sends are %v, want %v", got, want)
+	}
+}
+
+func storedNextIndex(t *testing.T, db *bolt.DB, b Broadcast) int {
+	t.Helper()
+	var r Run
+	if err := dbutil.GetByKey(db, Run{BroadcastID: b.ID}.DBKey(), &r); err != nil {
+		t.Fatal(err)
+	}
+	return r.NextIndex
+}
+
+func TestRunBatchPartialFailureIsResumed(t *testing.T) {
+	db := openTestDB(t)
+	sender := &fakeBatchSender{errs: map[string][]error{
+		"b@example.com": {errorbehavior.WrapPausing(fmt.Errorf("rate limited"))},
+		"c@example.com": {errorbehavior.WrapRejected(fmt.Errorf("user unknown"))},
+	}}
+	b, bRun := newTestBatchRun(t, db, sender)
+	loggerDebug := log.New(ioutil.Discard, "", 0)
+
+	err := bRun.send(context.Background(), b, db, loggerDebug, loggerDebug, nil, "")
+	if !errorbehavior.IsPausing(err) {
+		t.Fatalf("send() = %v, want pausing error", err)
+	}
+	checkSends(t, db, b, []int{SentYes, SentNo, SentRejected, SentYes})
+	if got := storedNextIndex(t, db, b); got != 1 {
+		t.Errorf("stored NextIndex is %d, want the contact that was not sent (1)", got)
+	}
+
+	// the resumed run sends only to the contact that was not sent
+	if err := db.Update(func(tx *bolt.Tx) error {
+		return ResumeTx(tx, b.DBKey())
+	}); err != nil {
+		t.Fatal(err)
+	}
+	bRun.NextIndex = storedNextIndex(t, db, b)
+	if err := bRun.send(context.Background(), b, db, loggerDebug, loggerDebug, nil, ""); err != nil {
+		t.Fatalf("resumed send() failed: %s", err)
+	}
+	checkSends(t, db, b, []int{SentYes, SentYes, SentRejected, SentYes})
+	if got := storedNextIndex(t, db, b); got != len(b.Contacts) {
+		t.Errorf("stored NextIndex is %d, want %d", got, len(b.Contacts))
+	}
+	wantCalls := []string{"a@example.com,b@example.com,c@example.com,d@example.com", "b@example.com"}
+	if !reflect.DeepEqual(sender.calls, wantCalls) {
+		t.Errorf("sends %q, want %q", sender.calls, wantCalls)
+	}
+}
+
+func TestRunBatchRetriesNotSentContacts(t *testing.T) {
+	db := openTestDB(t)
+	sender := &fakeBatchSender{errs: map[string][]error{
+		"b@example.com": {errorbehavior.WrapRetryable(fmt.Errorf("connection closed"))},
+		"d@example.com": {errorbehavior.WrapRetryable(fmt.Errorf("connection closed"))},
+	}}
+	b, bRun := newTestBatchRun(t, db, sender)
+	loggerDebug := log.New(ioutil.Discard, "", 0)
+
+	if err := bRun.send(context.Background(), b, db, loggerDebug, loggerDebug, nil, ""); err != nil {
+		t.Fatalf("send() failed: %s", err)
+	}
+	checkSends(t, db, b, []int{SentYes, SentYes, SentYes, SentYes})
+	if got := storedNextIndex(t, db, b); got != len(b.Contacts) {
+		t.Errorf("stored NextIndex is %d, want %d", got, len(b.Contacts))
+	}
+	wantCalls := []string{"a@example.com,b@example.com,c@example.com,d@example.com", "b@example.com,d@example.com"}
+	if !reflect.DeepEqual(sender.calls, wantCalls) {
+		t.Errorf("sends %q, want %q", sender.calls, wantCalls)
+	}
+}
+
+// fakeStatuser returns the status of each recipient
+type fakeStatuser map[string]string
+
+func (f fakeStatuser) SendStatus(ctx context.Context, to string, sentAt time.Time) (string, error) {
+	return f[to], nil
+}
+
+func TestCheckSendStatuses(t *testing.T) {
+	db := openTestDB(t)
+	b, bRun := newTestBatchRun(t, db, &fakeBatchSender{})
+	loggerDebug := log.New(ioutil.Discard, "", 0)
+	sendCountsKey := []byte("test/2023-01-02T15:04")
+	sentAt := time.Now().Add(-time.Minute)
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for i := range b.Contacts {
+			if err := dbutil.UpsertSaveableTx(tx, Send{BroadcastID: b.ID, Index: i, Sent: SentYes, SentAt: sentAt}); err != nil {
+				return err
+			}
+		}
+		return dbutil.UpsertTableKeyValueTx(tx, "send_counts", sendCountsKey, len(b.Contacts))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	statuser := fakeStatuser{
+		"a@example.com": gateway.SendStatusSent,
+		"b@example.com": gateway.SendStatusFailed,
+		"c@example.com": gateway.SendStatusQueued,
+	}
+	var checks []statusCheck
+	for i, c := range b.Contacts {
+		checks = append(checks, statusCheck{index: i, to: c.Recipient, sentAt: sentAt, sendCountsKey: sendCountsKey})
+	}
+	// d was sent just now, so it is checked later
+	checks[3].sentAt = time.Now()
+
+	later, err := bRun.checkSendStatuses(context.Background(), db, statuser, checks, false, loggerDebug)
+	if err != nil {
+		t.Fatalf("checkSendStatuses() failed: %s", err)
+	}
+	var laterIndexes []int
+	for _, c := range later {
+		laterIndexes = append(laterIndexes, c.index)
+	}
+	if want := []int{2, 3}; !reflect.DeepEqual(laterIndexes, want) {
+		t.Errorf("messages to check later are %v, want %v", laterIndexes, want)
+	}
+	// the failed message is not sent and is not counted in the limits
+	checkSends(t, db, b, []int{SentYes, SentNo, SentYes, SentYes})
+	var count int
+	if err := dbutil.GetByTableKey(db, "send_counts", sendCountsKey, &count); err != nil {
+		t.Fatal(err)
+	}
+	if count != len(b.Contacts)-1 {
+		t.Errorf("send count is %d, want %d", count, len(b.Contacts)-1)
+	}
+
+	// when the run stops, the queued messages are recorded without waiting
+	later, err = bRun.checkSendStatuses(context.Background(), db, statuser, later, true, loggerDebug)
+	if err != nil || len(later) != 0 {
+		t.Fatalf("final checkSendStatuses() = %v, %v, want no messages to check later", later, err)
+	}
+	for i, want := range []string{gateway.SendStatusSent, gateway.SendStatusFailed, gateway.SendStatusQueued, ""} {
+		bSend := Send{BroadcastID: b.ID, Index: i}
+		if err := dbutil.GetByKey(db, bSend.DBKey(), &bSend); err != nil {
+			t.Fatal(err)
+		}
+		if bSend.Status != want {
+			t.Errorf("status of contact %d is %q, want %q", i, bSend.Status, want)
+		}
+	}
+}
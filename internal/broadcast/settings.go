@@ -1,11 +1,17 @@
 package broadcast
 
 import (
+	"errors"
 	"fmt"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"go.angaros.io/internal/dbutil"
+	"go.angaros.io/internal/tzdb"
 )
 
 type SettingSendHours []TimeRange
@@ -36,6 +42,36 @@ func (t SettingTimezone) DBKey() []byte {
 	return []byte("broadcast.timezone")
 }
 
+// SettingDefaultCountry is the ISO 3166-1 alpha-2 code of the country of phone numbers without a country code
+type SettingDefaultCountry string
+
+func (c SettingDefaultCountry) DBTable() string {
+	return "settings"
+}
+
+func (c SettingDefaultCountry) DBKey() []byte {
+	return []byte("broadcast.default_country")
+}
+
+// GetDefaultCountryTx returns the default country setting.
+// If it is not set, the country of the time zone setting is returned, which may be empty.
+func GetDefaultCountryTx(tx *bolt.Tx) (string, error) {
+	var country SettingDefaultCountry
+	err := dbutil.GetByKeyTx(tx, country.DBKey(), &country)
+	if err != nil && !errors.Is(err, dbutil.ErrNotFound) {
+		return "", fmt.Errorf("failed to read default country: %s", err)
+	}
+	if country != "" {
+		return string(country), nil
+	}
+	var timezone SettingTimezone
+	err = dbutil.GetByKeyTx(tx, timezone.DBKey(), &timezone)
+	if err != nil && !errors.Is(err, dbutil.ErrNotFound) {
+		return "", fmt.Errorf("failed to read time zone: %s", err)
+	}
+	return tzdb.CountryCodeByTimeZone[string(timezone)], nil
+}
+
 var parseTimeRangesRe = regexp.MustCompile(`(([0-9]+)-([0-9]+))+`)
 
 func ParseTimeRanges(str string) ([]TimeRange, error) {
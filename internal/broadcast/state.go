@@ -0,0 +1,110 @@
+package broadcast
+
+import (
+	"errors"
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+
+	"go.angaros.io/internal/dbutil"
+)
+
+// states set by the user. A broadcast without a state is active
+const (
+	StatePaused    = "paused"
+	StateCancelled = "cancelled"
+)
+
+// ErrInvalidState is returned when the requested state change is not possible in the current state of the broadcast
+var ErrInvalidState = errors.New("invalid broadcast state")
+
+// PauseTx pauses the broadcast with the given key and stops it if it is running.
+// The broadcast will not be started again until it is resumed.
+func PauseTx(tx *bolt.Tx, key []byte) error {
+	return setStateTx(tx, key, StatePaused)
+}
+
+// ResumeTx resumes a paused broadcast. The dispatcher will start it again as soon as it can be started.
+func ResumeTx(tx *bolt.Tx, key []byte) error {
+	return setStateTx(tx, key, "")
+}
+
+// CancelTx cancels the broadcast with the given key and stops it if it is running.
+// A cancelled broadcast cannot be resumed.
+func CancelTx(tx *bolt.Tx, key []byte) error {
+	return setStateTx(tx, key, StateCancelled)
+}
+
+func setStateTx(tx *bolt.Tx, key []byte, state string) error {
+	var b Broadcast
+	err := dbutil.GetByKeyTx(tx, key, &b)
+	if err != nil { // don't ignore dbutil.ErrNotFound
+		return err
+	}
+	finished, err := b.finishedTx(tx)
+	if err != nil {
+		return err
+	}
+	switch {
+	case b.State == StateCancelled:
+		return fmt.Errorf("%w: broadcast has been cancelled", ErrInvalidState)
+	case finished:
+		return fmt.Errorf("%w: broadcast has finished", ErrInvalidState)
+	case state == StatePaused && b.State == StatePaused:
+		return fmt.Errorf("%w: broadcast is already paused", ErrInvalidState)
+	case state == "" && b.State != StatePaused:
+		return fmt.Errorf("%w: broadcast is not paused", ErrInvalidState)
+	}
+	b.State = state
+	if err := dbutil.UpsertSaveableTx(tx, b); err != nil {
+		return fmt.Errorf("failed to save broadcast: %s", err)
+	}
+	if state != "" {
+		tx.OnCommit(func() {
+			stopRunning(b.ID.String())
+		})
+	} else {
+		tx.OnCommit(func() {
+			// start the resumed broadcast without waiting for the retry delay
+			func() {
+				runningMutex.Lock()
+				defer runningMutex.Unlock()
+				delete(retryAfter, b.ID.String())
+			}()
+			Wake()
+		})
+	}
+	return nil
+}
+
+func (b Broadcast) finishedTx(tx *bolt.Tx) (bool, error) {
+	var r Run
+	err := dbutil.GetByKeyTx(tx, Run{BroadcastID: b.ID}.DBKey(), &r)
+	if errors.Is(err, dbutil.ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to read broadcast run: %s", err)
+	}
+	return r.NextIndex == r.Length, nil
+}
+
+// isActive reports whether the broadcast still exists and has not been paused or cancelled
+func isActive(db *bolt.DB, b Broadcast) (bool, error) {
+	var current Broadcast
+	err := dbutil.GetByKey(db, b.DBKey(), &current)
+	if errors.Is(err, dbutil.ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to read broadcast: %s", err)
+	}
+	return current.State == "", nil
+}
+
+// stopRunning cancels the context of the run of the broadcast, if it is running
+func stopRunning(broadcastID string) {
+	runningMutex.Lock()
+	defer runningMutex.Unlock()
+	if cancel, exists := runningCancels[broadcastID]; exists {
+		cancel()
+	}
+}
@@ -0,0 +1,168 @@
+package contactlist
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/oklog/ulid/v2"
+	bolt "go.etcd.io/bbolt"
+
+	"go.angaros.io/internal/dbutil"
+)
+
+// Contact belongs to a list and is unique by recipient within the list
+type Contact struct {
+	ListID    ulid.ULID
+	Recipient string
+	Keywords  map[string]string
+	Tags      []string
+}
+
+func (c Contact) DBTable() string {
+	return "contactlist.contact"
+}
+
+func (c Contact) DBKey() []byte {
+	return bytes.Join([][]byte{c.ListID[:], []byte(c.Recipient)}, nil)
+}
+
+func (c Contact) TagsString() string {
+	return strings.Join(c.Tags, ", ")
+}
+
+func (c Contact) KeywordsString() string {
+	keys := make([]string, 0, len(c.Keywords))
+	for k := range c.Keywords {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+c.Keywords[k])
+	}
+	return strings.Join(pairs, " ")
+}
+
+// HasTags reports whether the contact has all the given tags
+func (c Contact) HasTags(tags []string) bool {
+	for _, tag := range tags {
+		found := false
+		for _, t := range c.Tags {
+			if t == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseTags splits a comma separated list of tags, ignoring empty and duplicate tags
+func ParseTags(s string) []string {
+	return uniqueTags(strings.Split(s, ","))
+}
+
+// uniqueTags trims the tags and removes empty and duplicate tags
+func uniqueTags(tags []string) []string {
+	unique := make([]string, 0, len(tags))
+	seen := make(map[string]struct{})
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		if _, exists := seen[tag]; exists {
+			continue
+		}
+		seen[tag] = struct{}{}
+		unique = append(unique, tag)
+	}
+	return unique
+}
+
+// ContactsTx returns the contacts of the list that have all the given tags
+func ContactsTx(tx *bolt.Tx, listID ulid.ULID, tags []string) ([]Contact, error) {
+	var l List
+	if err := dbutil.GetByKeyTx(tx, listID[:], &l); errors.Is(err, dbutil.ErrNotFound) {
+		return nil, fmt.Errorf("list %s not found", listID)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read list %s: %s", listID, err)
+	}
+	contacts := make([]Contact, 0)
+	err := dbutil.ForEachPrefixTx(tx, &Contact{}, listID[:], func(k []byte, v interface{}) error {
+		c := v.(Contact)
+		if c.HasTags(tags) {
+			contacts = append(contacts, c)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read contacts: %s", err)
+	}
+	return contacts, nil
+}
+
+// ImportResult counts the contacts affected by an import
+type ImportResult struct {
+	Added   int
+	Updated int
+}
+
+func (r ImportResult) String() string {
+	return fmt.Sprintf("%d contacts added, %d contacts updated", r.Added, r.Updated)
+}
+
+// ImportTx adds the contacts to the list and gives them the tags.
+// Contacts that already exist in the list are merged:
+// keywords are overwritten by the imported ones and tags are added.
+func ImportTx(tx *bolt.Tx, listID ulid.ULID, contacts []Contact, tags []string) (ImportResult, error) {
+	var l List
+	if err := dbutil.GetByKeyTx(tx, listID[:], &l); errors.Is(err, dbutil.ErrNotFound) {
+		return ImportResult{}, fmt.Errorf("list %s not found", listID)
+	} else if err != nil {
+		return ImportResult{}, fmt.Errorf("failed to read list %s: %s", listID, err)
+	}
+	var result ImportResult
+	for _, c := range contacts {
+		if c.Recipient == "" {
+			continue
+		}
+		c.ListID = listID
+		var existing Contact
+		err := dbutil.GetByKeyTx(tx, c.DBKey(), &existing)
+		if err != nil && !errors.Is(err, dbutil.ErrNotFound) {
+			return ImportResult{}, fmt.Errorf("failed to read contact %s: %s", c.Recipient, err)
+		}
+		if err == nil {
+			c = merge(existing, c)
+			result.Updated++
+		} else {
+			result.Added++
+		}
+		c.Tags = uniqueTags(append(c.Tags, tags...))
+		if err := dbutil.UpsertSaveableTx(tx, c); err != nil {
+			return ImportResult{}, fmt.Errorf("failed to save contact %s: %s", c.Recipient, err)
+		}
+	}
+	return result, nil
+}
+
+// merge returns the existing contact updated with the keywords and tags of c
+func merge(existing, c Contact) Contact {
+	keywords := make(map[string]string, len(existing.Keywords)+len(c.Keywords))
+	for k, v := range existing.Keywords {
+		keywords[k] = v
+	}
+	for k, v := range c.Keywords {
+		keywords[k] = v
+	}
+	existing.Keywords = keywords
+	existing.Tags = append(existing.Tags, c.Tags...)
+	return existing
+}
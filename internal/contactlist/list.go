@@ -0,0 +1,101 @@
+package contactlist
+
+import (
+	crand "crypto/rand"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	bolt "go.etcd.io/bbolt"
+
+	"go.angaros.io/internal/dbutil"
+)
+
+// List is a named list of contacts that can be used by many broadcasts
+type List struct {
+	ID        ulid.ULID
+	Name      string
+	CreatedAt time.Time
+	size      int
+}
+
+func (l List) DBTable() string {
+	return "contactlist"
+}
+
+func (l List) DBKey() []byte {
+	return l.ID[:]
+}
+
+func (l List) String() string {
+	return fmt.Sprintf("%s %s", l.ID, l.Name)
+}
+
+// NewList returns a new empty list. The list is not saved to the database.
+func NewList(name string) (List, error) {
+	if name == "" {
+		return List{}, fmt.Errorf("name is empty")
+	}
+	id, err := ulid.New(ulid.Timestamp(time.Now()), crand.Reader)
+	if err != nil {
+		return List{}, fmt.Errorf("cannot create list ID: %s", err)
+	}
+	return List{
+		ID:        id,
+		Name:      name,
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+func (l *List) ReadSizeFromTx(tx *bolt.Tx) error {
+	l.size = 0
+	return dbutil.ForEachPrefixTx(tx, &Contact{}, l.ID[:], func(k []byte, v interface{}) error {
+		l.size++
+		return nil
+	})
+}
+
+func (l List) GetSize() int {
+	return l.size
+}
+
+// DeleteTx deletes the list with the given ID together with its contacts
+func DeleteTx(tx *bolt.Tx, listID ulid.ULID) error {
+	err := dbutil.DeleteByTableKeyTx(tx, List{}.DBTable(), listID[:])
+	if err != nil {
+		return fmt.Errorf("failed to delete list: %s", err)
+	}
+	err = dbutil.DeletePrefixTx(tx, Contact{}.DBTable(), listID[:])
+	if err != nil {
+		return fmt.Errorf("failed to delete contacts: %s", err)
+	}
+	return nil
+}
+
+// MergeTx imports the contacts of the list src into the list dst and deletes src
+func MergeTx(tx *bolt.Tx, srcID, dstID ulid.ULID) (ImportResult, error) {
+	if srcID == dstID {
+		return ImportResult{}, fmt.Errorf("cannot merge a list with itself")
+	}
+	for _, id := range []ulid.ULID{srcID, dstID} {
+		var l List
+		if err := dbutil.GetByKeyTx(tx, id[:], &l); errors.Is(err, dbutil.ErrNotFound) {
+			return ImportResult{}, fmt.Errorf("list %s not found", id)
+		} else if err != nil {
+			return ImportResult{}, fmt.Errorf("failed to read list %s: %s", id, err)
+		}
+	}
+	contacts, err := ContactsTx(tx, srcID, nil)
+	if err != nil {
+		return ImportResult{}, err
+	}
+	result, err := ImportTx(tx, dstID, contacts, nil)
+	if err != nil {
+		return ImportResult{}, err
+	}
+	if err := DeleteTx(tx, srcID); err != nil {
+		return ImportResult{}, err
+	}
+	return result, nil
+}
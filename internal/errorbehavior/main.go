@@ -64,3 +64,87 @@ func WrapNonRetryable(err error) error {
 	}
 	return &nonRetryable{Err: err}
 }
+
+type rejectedBehavior interface {
+	Rejected() bool
+}
+
+// IsRejected reports whether the message was rejected permanently, so it has not been sent and should not be retried.
+func IsRejected(err error) bool {
+	var errBehavior rejectedBehavior
+	if errors.As(err, &errBehavior) {
+		return errBehavior.Rejected()
+	}
+	return false
+}
+
+type rejected struct {
+	Err error
+}
+
+func (err rejected) Error() string {
+	return err.Err.Error()
+}
+
+func (err rejected) Unwrap() error {
+	return err.Err
+}
+
+func (err rejected) Retryable() bool {
+	return false
+}
+
+func (err rejected) Rejected() bool {
+	return true
+}
+
+// WrapRejected marks an error as a permanent rejection of the message, e.g. an unknown recipient.
+func WrapRejected(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &rejected{Err: err}
+}
+
+type pausingBehavior interface {
+	Pausing() bool
+}
+
+// IsPausing reports whether the error affects every message of the gateway and not only the current recipient,
+// e.g. revoked credentials or rate limiting, so sending should be paused.
+func IsPausing(err error) bool {
+	var errBehavior pausingBehavior
+	if errors.As(err, &errBehavior) {
+		return errBehavior.Pausing()
+	}
+	return false
+}
+
+type pausing struct {
+	Err error
+}
+
+func (err pausing) Error() string {
+	return err.Err.Error()
+}
+
+func (err pausing) Unwrap() error {
+	return err.Err
+}
+
+// Retryable is true because the message has not been sent and can be sent after sending is resumed
+func (err pausing) Retryable() bool {
+	return true
+}
+
+func (err pausing) Pausing() bool {
+	return true
+}
+
+// WrapPausing marks an error as affecting every message of the gateway.
+func WrapPausing(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &pausing{Err: err}
+}
@@ -0,0 +1,49 @@
+package email
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// NormalizeAddress validates the syntax of an email address (RFC 5322 addr-spec)
+// and returns it with the domain converted to lowercase ASCII (IDNA).
+// Display names e.g. "John <john@example.com>" are rejected.
+func NormalizeAddress(address string) (string, error) {
+	address = strings.TrimSpace(address)
+	if address == "" {
+		return "", fmt.Errorf("email address is empty")
+	}
+	if strings.ContainsAny(address, "<>") {
+		return "", fmt.Errorf("email address must not contain a display name or angle brackets")
+	}
+	parsed, err := mail.ParseAddress(address)
+	if err != nil {
+		return "", fmt.Errorf("invalid email address: %s", strings.TrimPrefix(err.Error(), "mail: "))
+	}
+	if parsed.Name != "" {
+		return "", fmt.Errorf("email address must not contain a display name")
+	}
+	// keep the local part as written, because parsed.Address has the quotes of quoted local parts removed
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return "", fmt.Errorf("email address has no domain")
+	}
+	local, domain := address[:at], address[at+1:]
+	if strings.HasPrefix(domain, "[") {
+		return "", fmt.Errorf("email addresses with IP address literals are not supported")
+	}
+	domainASCII, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return "", fmt.Errorf("invalid domain %s: %s", domain, err)
+	}
+	if !strings.Contains(domainASCII, ".") {
+		return "", fmt.Errorf("invalid domain %s: no top level domain", domain)
+	}
+	if len(domainASCII) > 253 {
+		return "", fmt.Errorf("invalid domain %s: too long", domain)
+	}
+	return local + "@" + strings.ToLower(domainASCII), nil
+}
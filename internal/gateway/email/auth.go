@@ -0,0 +1,47 @@
+package email
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/emersion/go-sasl"
+)
+
+// AuthTypes are the supported values of SMTPAccount.AuthType. NONE is for testing purposes.
+var AuthTypes = []string{"PLAIN", "LOGIN", "CRAM-MD5", "XOAUTH2", "NONE"}
+
+// cramMD5Client implements the CRAM-MD5 mechanism (RFC 2195)
+type cramMD5Client struct {
+	username, password string
+}
+
+func (c *cramMD5Client) Start() (string, []byte, error) {
+	return "CRAM-MD5", nil, nil
+}
+
+func (c *cramMD5Client) Next(challenge []byte) ([]byte, error) {
+	mac := hmac.New(md5.New, []byte(c.password))
+	mac.Write(challenge)
+	return []byte(c.username + " " + hex.EncodeToString(mac.Sum(nil))), nil
+}
+
+// xoauth2Client implements the XOAUTH2 mechanism used by Gmail and Microsoft
+type xoauth2Client struct {
+	username, accessToken string
+}
+
+func (c *xoauth2Client) Start() (string, []byte, error) {
+	return "XOAUTH2", []byte("user=" + c.username + "\x01auth=Bearer " + c.accessToken + "\x01\x01"), nil
+}
+
+// Next is called only when authentication fails, with the error returned by the server as JSON
+func (c *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	return nil, fmt.Errorf("XOAUTH2 failed: %s", challenge)
+}
+
+var (
+	_ sasl.Client = (*cramMD5Client)(nil)
+	_ sasl.Client = (*xoauth2Client)(nil)
+)
@@ -0,0 +1,229 @@
+package email
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+
+	"go.angaros.io/internal/errorbehavior"
+)
+
+// values of SMTPAccount.Mode
+const (
+	ModeRelay  = "relay"  // send through the SMTP server of the account
+	ModeDirect = "direct" // deliver to the MX servers of each recipient's domain
+)
+
+// Modes are the supported values of SMTPAccount.Mode
+var Modes = []string{ModeRelay, ModeDirect}
+
+const (
+	// directMaxConns is the maximum number of connections kept open in direct mode, one per recipient domain
+	directMaxConns = 10
+	// directDefaultPort is the port of MX servers
+	directDefaultPort = 25
+	// directDefaultReuseCountLimit is used in direct mode if the account has no connection reuse count limit
+	directDefaultReuseCountLimit = 100
+)
+
+// Resolver looks up the DNS records used in direct mode. *net.Resolver implements it.
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// directConn is a connection to an MX server of a recipient domain
+type directConn struct {
+	conn       *smtp.Client
+	netConn    net.Conn // the connection of conn
+	reuseCount int
+	started    time.Time
+	lastUsed   time.Time
+}
+
+func (c *SenderClientSMTP) resolver() Resolver {
+	if c.Resolver != nil {
+		return c.Resolver
+	}
+	return net.DefaultResolver
+}
+
+// mxHosts returns the hosts that receive email for the domain, in order of preference.
+// Domains without MX records receive email at the domain itself (RFC 5321 section 5.1).
+func (c *SenderClientSMTP) mxHosts(ctx context.Context, domain string) ([]string, error) {
+	mxs, err := c.resolver().LookupMX(ctx, domain)
+	if err != nil && !isNotFound(err) {
+		return nil, errorbehavior.WrapRetryable(fmt.Errorf("MX lookup of %s failed: %s", domain, err))
+	}
+	if len(mxs) == 0 {
+		_, err := c.resolver().LookupHost(ctx, domain)
+		if isNotFound(err) {
+			return nil, errorbehavior.WrapRejected(fmt.Errorf("domain %s has no MX or address records", domain))
+		} else if err != nil {
+			return nil, errorbehavior.WrapRetryable(fmt.Errorf("address lookup of %s failed: %s", domain, err))
+		}
+		return []string{domain}, nil
+	}
+	sort.SliceStable(mxs, func(i, j int) bool {
+		return mxs[i].Pref < mxs[j].Pref
+	})
+	hosts := make([]string, 0, len(mxs))
+	for _, mx := range mxs {
+		host := strings.TrimSuffix(mx.Host, ".")
+		if host == "" {
+			// null MX (RFC 7505)
+			return nil, errorbehavior.WrapRejected(fmt.Errorf("domain %s does not accept email", domain))
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+func isNotFound(err error) bool {
+	var errDNS *net.DNSError
+	return errors.As(err, &errDNS) && errDNS.IsNotFound
+}
+
+// directConnect returns an open connection to an MX server of the domain.
+// The connection is reused for the next recipients of the domain, within the reuse limits of the account.
+func (c *SenderClientSMTP) directConnect(ctx context.Context, domain string) (*directConn, error) {
+	reuseCountLimit := c.SMTPAccount.ConnectionReuseCountLimit
+	if reuseCountLimit == 0 {
+		reuseCountLimit = directDefaultReuseCountLimit
+	}
+	if dc, ok := c.directConns[domain]; ok {
+		if reuseCountLimit >= 2 &&
+			dc.reuseCount < reuseCountLimit &&
+			time.Since(dc.started) < 300*time.Second &&
+			dc.conn.Noop() == nil {
+			dc.reuseCount++
+			dc.lastUsed = time.Now()
+			return dc, nil
+		}
+		c.directClose(domain)
+	}
+	hosts, err := c.mxHosts(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+	var errs []string
+	for _, host := range hosts {
+		dc, err := c.directDial(ctx, host, true)
+		if isTLSError(err) {
+			// opportunistic TLS: deliver without encryption if the TLS handshake fails
+			dc, err = c.directDial(ctx, host, false)
+		}
+		if err != nil {
+			var errSMTP *smtp.SMTPError
+			if errors.As(err, &errSMTP) && errSMTP.Code >= 500 {
+				// the server rejected the connection, the other MX servers are expected to do the same
+				errReply := newReplyError("connect", errSMTP)
+				return nil, errorbehavior.WrapRejected(fmt.Errorf("%s rejected the connection with code %s: %s", host, errReply.StatusCode(), errReply.Message))
+			}
+			errs = append(errs, fmt.Sprintf("%s: %s", host, err))
+			continue
+		}
+		if c.directConns == nil {
+			c.directConns = make(map[string]*directConn)
+		}
+		if len(c.directConns) >= directMaxConns {
+			c.directCloseLeastRecentlyUsed()
+		}
+		c.directConns[domain] = dc
+		return dc, nil
+	}
+	return nil, errorbehavior.WrapRetryable(fmt.Errorf("failed to connect to the MX servers of %s: %s", domain, strings.Join(errs, "; ")))
+}
+
+// tlsError is returned by directDial if the STARTTLS handshake failed
+type tlsError struct {
+	err error
+}
+
+func (e tlsError) Error() string {
+	return "STARTTLS failed: " + e.err.Error()
+}
+
+func isTLSError(err error) bool {
+	var e tlsError
+	return errors.As(err, &e)
+}
+
+// directDial connects to the MX server and says EHLO. If useTLS is set and the server supports it, the connection is upgraded with STARTTLS.
+// The certificate is not verified, like in most MTAs, because MX servers often don't have a certificate for their name.
+func (c *SenderClientSMTP) directDial(ctx context.Context, host string, useTLS bool) (*directConn, error) {
+	port := directDefaultPort
+	if c.SMTPAccount.Port != 0 {
+		port = c.SMTPAccount.Port
+	}
+	conn, err := c.dial(ctx, net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if err := client.Hello(c.heloName()); err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+	dc := &directConn{conn: client, netConn: conn, reuseCount: 1, started: time.Now(), lastUsed: time.Now()}
+	if ok, _ := client.Extension("STARTTLS"); ok && useTLS {
+		tlsConfig := &tls.Config{
+			ServerName:         host,
+			InsecureSkipVerify: true,
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			_ = client.Close()
+			return nil, tlsError{err: err}
+		}
+	}
+	return dc, nil
+}
+
+func (c *SenderClientSMTP) directClose(domain string) {
+	dc, ok := c.directConns[domain]
+	if !ok {
+		return
+	}
+	if err := dc.conn.Quit(); err != nil {
+		_ = dc.conn.Close()
+	}
+	delete(c.directConns, domain)
+}
+
+func (c *SenderClientSMTP) directCloseLeastRecentlyUsed() {
+	var oldestDomain string
+	var oldest time.Time
+	for domain, dc := range c.directConns {
+		if oldestDomain == "" || dc.lastUsed.Before(oldest) {
+			oldestDomain, oldest = domain, dc.lastUsed
+		}
+	}
+	c.directClose(oldestDomain)
+}
+
+func (c *SenderClientSMTP) directCloseAll() {
+	for domain := range c.directConns {
+		c.directClose(domain)
+	}
+}
+
+// recipientDomain returns the lowercase domain of the address
+func recipientDomain(address string) (string, error) {
+	i := strings.LastIndex(address, "@")
+	if i < 0 || i == len(address)-1 {
+		return "", fmt.Errorf("address %s has no domain", address)
+	}
+	return strings.ToLower(address[i+1:]), nil
+}
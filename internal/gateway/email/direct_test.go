@@ -0,0 +1,147 @@
+package email
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+
+	"go.angaros.io/internal/errorbehavior"
+)
+
+// fakeResolver answers from fixed records. Names without records are not found.
+type fakeResolver struct {
+	mx    map[string][]*net.MX
+	hosts map[string][]string
+	err   error // if set, returned by every lookup
+}
+
+func (r fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if mxs, ok := r.mx[name]; ok {
+		return mxs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if addrs, ok := r.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestMXHosts(t *testing.T) {
+	resolver := fakeResolver{
+		mx: map[string][]*net.MX{
+			"example.com": {
+				{Host: "mx3.example.com.", Pref: 30},
+				{Host: "mx1.example.com.", Pref: 10},
+				{Host: "backup.example.net.", Pref: 20},
+				{Host: "mx1b.example.com.", Pref: 10},
+			},
+			"nomail.example.com": {
+				{Host: ".", Pref: 0},
+			},
+		},
+		hosts: map[string][]string{
+			"implicit.example.com": {"192.0.2.1", "2001:db8::1"},
+		},
+	}
+	tests := []struct {
+		name     string
+		domain   string
+		want     []string
+		rejected bool
+	}{
+		{
+			name:   "MX records in order of preference",
+			domain: "example.com",
+			want:   []string{"mx1.example.com", "mx1b.example.com", "backup.example.net", "mx3.example.com"},
+		},
+		{
+			name:   "implicit MX",
+			domain: "implicit.example.com",
+			want:   []string{"implicit.example.com"},
+		},
+		{
+			name:     "null MX",
+			domain:   "nomail.example.com",
+			rejected: true,
+		},
+		{
+			name:     "no MX or address records",
+			domain:   "missing.example.com",
+			rejected: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := SenderClientSMTP{Resolver: resolver}
+			got, err := c.mxHosts(context.Background(), tt.domain)
+			if tt.rejected {
+				if !errorbehavior.IsRejected(err) {
+					t.Fatalf("mxHosts() = %v, %v, want rejected error", got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("mxHosts() failed: %s", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mxHosts() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMXHostsTemporaryFailure(t *testing.T) {
+	c := SenderClientSMTP{Resolver: fakeResolver{err: &net.DNSError{Err: "server misbehaving", Name: "example.com", IsTemporary: true}}}
+	_, err := c.mxHosts(context.Background(), "example.com")
+	if err == nil || errorbehavior.IsRejected(err) || !errorbehavior.IsRetryable(err) {
+		t.Errorf("mxHosts() error = %v, want retryable error", err)
+	}
+}
+
+func TestRecipientDomain(t *testing.T) {
+	for address, want := range map[string]string{
+		"someone@Example.COM":     "example.com",
+		`"a@b"@example.org`:       "example.org",
+		"someone@sub.example.net": "sub.example.net",
+		"no-domain":               "",
+		"trailing-at@":            "",
+	} {
+		got, err := recipientDomain(address)
+		if want == "" {
+			if err == nil {
+				t.Errorf("recipientDomain(%q) = %q, want error", address, got)
+			}
+			continue
+		}
+		if err != nil || got != want {
+			t.Errorf("recipientDomain(%q) = %q, %v, want %q", address, got, err, want)
+		}
+	}
+}
+
+func TestValidateDirectRequiresHeloName(t *testing.T) {
+	a := SMTPAccount{Mode: ModeDirect}
+	if err := a.Validate(); err == nil {
+		t.Errorf("Validate() of a direct account without EHLO name succeeded")
+	}
+	a.HeloName = "mail.example.com"
+	if err := a.Validate(); err != nil {
+		t.Errorf("Validate() of a direct account with EHLO name failed: %s", err)
+	}
+	// the EHLO name does not default to the domain of the sender
+	c := SenderClientSMTP{SMTPAccount: SMTPAccount{Mode: ModeDirect}}
+	c.From.Email = "news@example.com"
+	if got := c.heloName(); got == "example.com" {
+		t.Errorf("heloName() = %q, want the host name of the computer", got)
+	}
+}
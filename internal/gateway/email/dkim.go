@@ -0,0 +1,172 @@
+package email
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	crand "crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+const (
+	DKIMAlgorithmRSA     = "rsa"
+	DKIMAlgorithmEd25519 = "ed25519"
+)
+
+// dkimHeaderKeys are the signed header fields, as recommended in RFC 6376 section 5.4.1
+var dkimHeaderKeys = []string{
+	"From", "To", "Subject", "Date", "Message-ID", "MIME-Version", "Content-Type", "Content-Transfer-Encoding",
+	"List-Unsubscribe", "List-Unsubscribe-Post",
+}
+
+// DKIM is the DKIM signing configuration of an email identity
+type DKIM struct {
+	Domain   string // empty means the domain of the identity's email
+	Selector string
+	// PrivateKey is a PKCS #8 DER encoded RSA or Ed25519 key
+	PrivateKey []byte
+}
+
+// Enabled reports whether messages are signed
+func (d DKIM) Enabled() bool {
+	return d.Selector != "" && len(d.PrivateKey) > 0
+}
+
+// GenerateDKIMKey generates a private key of the given algorithm for DKIM.
+// RSA keys have 2048 bits, which is the size most DNS providers support in a TXT record.
+func GenerateDKIMKey(algorithm string) ([]byte, error) {
+	var key interface{}
+	var err error
+	switch algorithm {
+	case DKIMAlgorithmRSA:
+		key, err = rsa.GenerateKey(crand.Reader, 2048)
+	case DKIMAlgorithmEd25519:
+		_, key, err = ed25519.GenerateKey(crand.Reader)
+	default:
+		return nil, fmt.Errorf("unknown DKIM algorithm %s", algorithm)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %s", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode key: %s", err)
+	}
+	return der, nil
+}
+
+// ParseDKIMKeyPEM parses a PEM encoded RSA (PKCS #1 or PKCS #8) or Ed25519 (PKCS #8) private key
+// and returns it PKCS #8 DER encoded
+func ParseDKIMKeyPEM(data []byte) ([]byte, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM encoded key found")
+	}
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %s", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse key: %s", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode key: %s", err)
+	}
+	if _, err := parseDKIMKey(der); err != nil {
+		return nil, err
+	}
+	return der, nil
+}
+
+func parseDKIMKey(der []byte) (crypto.Signer, error) {
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse DKIM key: %s", err)
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < 1024 {
+			return nil, fmt.Errorf("RSA DKIM key must have at least 1024 bits")
+		}
+		return k, nil
+	case ed25519.PrivateKey:
+		return k, nil
+	default:
+		return nil, fmt.Errorf("unsupported DKIM key type %T", key)
+	}
+}
+
+// domain returns the signing domain
+func (d DKIM) domain(email string) string {
+	if d.Domain != "" {
+		return d.Domain
+	}
+	return email[strings.LastIndex(email, "@")+1:]
+}
+
+// RecordName returns the DNS name of the TXT record with the public key
+func (d DKIM) RecordName(email string) string {
+	return fmt.Sprintf("%s._domainkey.%s", d.Selector, d.domain(email))
+}
+
+// Record returns the value of the DNS TXT record with the public key
+func (d DKIM) Record() (string, error) {
+	signer, err := parseDKIMKey(d.PrivateKey)
+	if err != nil {
+		return "", err
+	}
+	switch pub := signer.Public().(type) {
+	case *rsa.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			return "", fmt.Errorf("failed to encode public key: %s", err)
+		}
+		return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der), nil
+	case ed25519.PublicKey:
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub), nil
+	default:
+		return "", fmt.Errorf("unsupported DKIM key type %T", pub)
+	}
+}
+
+// Validate checks that the configuration can be used for signing
+func (d DKIM) Validate() error {
+	if d.Selector == "" {
+		return fmt.Errorf("DKIM selector is empty")
+	}
+	if strings.ContainsAny(d.Selector, " ;=") || strings.ContainsAny(d.Domain, " ;=") {
+		return fmt.Errorf("DKIM selector and domain must not contain spaces, ';' or '='")
+	}
+	_, err := parseDKIMKey(d.PrivateKey)
+	return err
+}
+
+// sign writes the message read from r to w with a DKIM-Signature header field added
+func (d DKIM) sign(w io.Writer, r io.Reader, email string) error {
+	signer, err := parseDKIMKey(d.PrivateKey)
+	if err != nil {
+		return err
+	}
+	return dkim.Sign(w, r, &dkim.SignOptions{
+		Domain:                 d.domain(email),
+		Selector:               d.Selector,
+		Signer:                 signer,
+		HeaderCanonicalization: dkim.CanonicalizationRelaxed,
+		BodyCanonicalization:   dkim.CanonicalizationRelaxed,
+		HeaderKeys:             dkimHeaderKeys,
+	})
+}
@@ -0,0 +1,147 @@
+package email
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/html"
+)
+
+// htmlBlockElements start on a new line in the text version
+var htmlBlockElements = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true, "div": true, "dl": true, "dt": true, "dd": true,
+	"fieldset": true, "figure": true, "footer": true, "form": true, "h1": true, "h2": true, "h3": true, "h4": true,
+	"h5": true, "h6": true, "header": true, "hr": true, "main": true, "nav": true, "ol": true, "p": true, "pre": true,
+	"section": true, "table": true, "tr": true, "ul": true,
+}
+
+// htmlSkippedElements have content that is not shown
+var htmlSkippedElements = map[string]bool{
+	"head": true, "script": true, "style": true, "title": true, "template": true,
+}
+
+// HTMLToText returns a plain text version of an HTML document, used as the text alternative of HTML emails.
+// Links are written as "text (URL)" and list items start with "- ".
+func HTMLToText(s string) string {
+	var b strings.Builder
+	z := html.NewTokenizer(strings.NewReader(s))
+	var skipDepth int
+	var pre int
+	var hrefs []string
+	newline := func() {
+		str := b.String()
+		// at most one empty line between blocks
+		if str == "" || strings.HasSuffix(str, "\n\n") {
+			return
+		}
+		b.WriteString("\n")
+	}
+	writeText := func(text string) {
+		if pre == 0 {
+			// collapse whitespace like browsers do
+			fields := strings.Fields(text)
+			collapsed := strings.Join(fields, " ")
+			if len(fields) > 0 && strings.TrimLeftFunc(text, unicode.IsSpace) != text {
+				collapsed = " " + collapsed
+			}
+			if len(fields) > 0 && strings.TrimRightFunc(text, unicode.IsSpace) != text {
+				collapsed += " "
+			}
+			if len(fields) == 0 && text != "" {
+				collapsed = " "
+			}
+			str := b.String()
+			if str == "" || strings.HasSuffix(str, "\n") || strings.HasSuffix(str, " ") {
+				collapsed = strings.TrimLeft(collapsed, " ")
+			}
+			text = collapsed
+		}
+		b.WriteString(text)
+	}
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			lines := strings.Split(b.String(), "\n")
+			for i := range lines {
+				lines[i] = strings.TrimRight(lines[i], " ")
+			}
+			return strings.TrimSpace(strings.Join(lines, "\n")) + "\n"
+		case html.TextToken:
+			if skipDepth == 0 {
+				writeText(string(z.Text()))
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			nameBytes, hasAttr := z.TagName()
+			name := string(nameBytes)
+			if htmlSkippedElements[name] {
+				if tt == html.StartTagToken {
+					skipDepth++
+				}
+				continue
+			}
+			if skipDepth > 0 {
+				continue
+			}
+			switch {
+			case name == "br":
+				b.WriteString("\n")
+			case name == "li":
+				newline()
+				b.WriteString("- ")
+			case name == "img":
+				for hasAttr {
+					var key, val []byte
+					key, val, hasAttr = z.TagAttr()
+					if string(key) == "alt" && len(val) > 0 {
+						writeText(string(val))
+					}
+				}
+			case name == "a" && tt == html.StartTagToken:
+				var href string
+				for hasAttr {
+					var key, val []byte
+					key, val, hasAttr = z.TagAttr()
+					if string(key) == "href" {
+						href = string(val)
+					}
+				}
+				hrefs = append(hrefs, href)
+			case htmlBlockElements[name]:
+				newline()
+				newline()
+				if name == "pre" {
+					pre++
+				}
+			}
+		case html.EndTagToken:
+			nameBytes, _ := z.TagName()
+			name := string(nameBytes)
+			if htmlSkippedElements[name] {
+				if skipDepth > 0 {
+					skipDepth--
+				}
+				continue
+			}
+			if skipDepth > 0 {
+				continue
+			}
+			switch {
+			case name == "a" && len(hrefs) > 0:
+				href := hrefs[len(hrefs)-1]
+				hrefs = hrefs[:len(hrefs)-1]
+				if href != "" && !strings.HasPrefix(href, "#") && !strings.HasSuffix(b.String(), href) {
+					writeText(" (" + href + ")")
+				}
+			case name == "td" || name == "th":
+				b.WriteString(" ")
+			case htmlBlockElements[name]:
+				if name == "pre" && pre > 0 {
+					pre--
+				}
+				newline()
+				newline()
+			}
+		}
+	}
+}
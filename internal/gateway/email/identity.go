@@ -8,6 +8,7 @@ type Identity struct {
 	Email   string
 	Name    string
 	SMTPKey []byte
+	DKIM    DKIM
 }
 
 func (i Identity) DBTable() string {
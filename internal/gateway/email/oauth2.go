@@ -0,0 +1,207 @@
+package email
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	bolt "go.etcd.io/bbolt"
+
+	"go.angaros.io/internal/dbutil"
+)
+
+// OAuth2 is the configuration of XOAUTH2 authentication. The tokens are stored separately, see OAuth2Token.
+type OAuth2 struct {
+	TokenURL     string // e.g. https://oauth2.googleapis.com/token
+	ClientID     string
+	ClientSecret string // empty for public clients
+}
+
+// Validate checks that the configuration can be used to refresh access tokens
+func (o OAuth2) Validate() error {
+	u, err := url.Parse(o.TokenURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("invalid OAuth2 token URL %s", o.TokenURL)
+	}
+	if o.ClientID == "" {
+		return fmt.Errorf("OAuth2 client ID is empty")
+	}
+	return nil
+}
+
+// OAuth2Token holds the tokens of an SMTP account that uses XOAUTH2.
+// The access token is refreshed when it expires and the refresh token is replaced if the server rotates it.
+type OAuth2Token struct {
+	AccountID    ulid.ULID
+	RefreshToken string
+	AccessToken  string
+	Expiry       time.Time // zero means the access token must be refreshed before use
+}
+
+func (t OAuth2Token) DBTable() string {
+	return "gateway.email.oauth2_token"
+}
+
+func (t OAuth2Token) DBKey() []byte {
+	return t.AccountID[:]
+}
+
+// valid reports whether the access token can be used for at least one more minute
+func (t OAuth2Token) valid() bool {
+	return t.AccessToken != "" && !t.Expiry.IsZero() && time.Until(t.Expiry) > time.Minute
+}
+
+// SetOAuth2RefreshTokenTx replaces the tokens of the account with a new refresh token
+func SetOAuth2RefreshTokenTx(tx *bolt.Tx, accountID ulid.ULID, refreshToken string) error {
+	if refreshToken == "" {
+		return fmt.Errorf("OAuth2 refresh token is empty")
+	}
+	err := dbutil.UpsertSaveableTx(tx, OAuth2Token{AccountID: accountID, RefreshToken: refreshToken})
+	if err != nil {
+		return fmt.Errorf("failed to save OAuth2 token: %s", err)
+	}
+	return nil
+}
+
+// HasOAuth2RefreshTokenTx reports whether a refresh token is stored for the account
+func HasOAuth2RefreshTokenTx(tx *bolt.Tx, accountID ulid.ULID) (bool, error) {
+	var t OAuth2Token
+	err := dbutil.GetByKeyTx(tx, OAuth2Token{AccountID: accountID}.DBKey(), &t)
+	if errors.Is(err, dbutil.ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to read OAuth2 token: %s", err)
+	}
+	return t.RefreshToken != "", nil
+}
+
+// oauth2RefreshLocks serializes the refreshes of the tokens of each account, so that identities that share an account
+// do not refresh at the same time and lose a refresh token that the server rotated. The values are *sync.Mutex keyed by account ID.
+var oauth2RefreshLocks sync.Map
+
+// oauth2AccessToken returns a valid access token of the account, refreshing it if needed.
+// The token is read again after the lock of the account is held, so a token refreshed by another identity is reused.
+func oauth2AccessToken(ctx context.Context, db *bolt.DB, acc SMTPAccount) (string, error) {
+	lock, _ := oauth2RefreshLocks.LoadOrStore(acc.ID, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	var t OAuth2Token
+	err := dbutil.GetByKey(db, OAuth2Token{AccountID: acc.ID}.DBKey(), &t)
+	if errors.Is(err, dbutil.ErrNotFound) {
+		return "", fmt.Errorf("OAuth2 refresh token is not set")
+	} else if err != nil {
+		return "", fmt.Errorf("failed to read OAuth2 token: %s", err)
+	}
+	if t.valid() {
+		return t.AccessToken, nil
+	}
+	refreshed, err := refreshOAuth2Token(ctx, acc.OAuth2, t)
+	if err != nil {
+		return "", err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		// the refresh token might have been replaced by the user during the request, and the new one is kept
+		var stored OAuth2Token
+		err := dbutil.GetByKeyTx(tx, t.DBKey(), &stored)
+		if errors.Is(err, dbutil.ErrNotFound) || (err == nil && stored.RefreshToken != t.RefreshToken) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return dbutil.UpsertSaveableTx(tx, refreshed)
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to save OAuth2 token: %s", err)
+	}
+	return refreshed.AccessToken, nil
+}
+
+// invalidateOAuth2AccessToken forces a refresh on the next connection, e.g. after the server rejected the token
+func invalidateOAuth2AccessToken(db *bolt.DB, accountID ulid.ULID) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		var t OAuth2Token
+		err := dbutil.GetByKeyTx(tx, OAuth2Token{AccountID: accountID}.DBKey(), &t)
+		if errors.Is(err, dbutil.ErrNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		t.AccessToken = ""
+		t.Expiry = time.Time{}
+		return dbutil.UpsertSaveableTx(tx, t)
+	})
+}
+
+// oauth2TokenResponse is the response of the token endpoint (RFC 6749 sections 5.1 and 5.2)
+type oauth2TokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int64  `json:"expires_in"`
+	RefreshToken     string `json:"refresh_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+var oauth2HTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// refreshOAuth2Token uses the refresh token grant (RFC 6749 section 6) to get a new access token
+func refreshOAuth2Token(ctx context.Context, o OAuth2, t OAuth2Token) (OAuth2Token, error) {
+	if t.RefreshToken == "" {
+		return t, fmt.Errorf("OAuth2 refresh token is not set")
+	}
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {t.RefreshToken},
+		"client_id":     {o.ClientID},
+	}
+	if o.ClientSecret != "" {
+		form.Set("client_secret", o.ClientSecret)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return t, fmt.Errorf("invalid OAuth2 token request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := oauth2HTTPClient.Do(req)
+	if err != nil {
+		return t, fmt.Errorf("OAuth2 token request failed: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return t, fmt.Errorf("failed to read OAuth2 token response: %s", err)
+	}
+	var tr oauth2TokenResponse
+	if err := json.Unmarshal(body, &tr); err != nil {
+		return t, fmt.Errorf("OAuth2 token request failed with status %d: invalid response: %s", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK || tr.Error != "" {
+		return t, fmt.Errorf("OAuth2 token request failed with status %d: %s %s", resp.StatusCode, tr.Error, tr.ErrorDescription)
+	}
+	if tr.AccessToken == "" {
+		return t, fmt.Errorf("OAuth2 token response has no access token")
+	}
+	if tr.TokenType != "" && !strings.EqualFold(tr.TokenType, "bearer") {
+		return t, fmt.Errorf("unsupported OAuth2 token type %s", tr.TokenType)
+	}
+	t.AccessToken = tr.AccessToken
+	t.Expiry = time.Time{}
+	if tr.ExpiresIn > 0 {
+		t.Expiry = time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second)
+	}
+	if tr.RefreshToken != "" {
+		t.RefreshToken = tr.RefreshToken
+	}
+	return t, nil
+}
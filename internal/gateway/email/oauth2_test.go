@@ -0,0 +1,246 @@
+package email
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	bolt "go.etcd.io/bbolt"
+
+	"go.angaros.io/internal/dbutil"
+)
+
+// fakeTokenServer is a token endpoint that returns a new access token for every refresh request
+type fakeTokenServer struct {
+	mu           sync.Mutex
+	requests     int
+	refreshToken string // the refresh token of the last request
+	expiresIn    int64
+	rotate       bool // return a new refresh token
+	status       int  // if not zero, fail with this status
+}
+
+func (f *fakeTokenServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests++
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "refresh_token" || r.PostForm.Get("client_id") != "client" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error":"invalid_request"}`)
+		return
+	}
+	f.refreshToken = r.PostForm.Get("refresh_token")
+	w.Header().Set("Content-Type", "application/json")
+	if f.status != 0 {
+		w.WriteHeader(f.status)
+		fmt.Fprint(w, `{"error":"invalid_grant","error_description":"token revoked"}`)
+		return
+	}
+	newRefreshToken := ""
+	if f.rotate {
+		newRefreshToken = fmt.Sprintf("refresh-%d", f.requests)
+	}
+	fmt.Fprintf(w, `{"access_token":"access-%d","token_type":"Bearer","expires_in":%d,"refresh_token":%q}`, f.requests, f.expiresIn, newRefreshToken)
+}
+
+func openTestDB(t *testing.T) *bolt.DB {
+	t.Helper()
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func newTestOAuth2Account(t *testing.T, db *bolt.DB, tokenURL string) SMTPAccount {
+	t.Helper()
+	acc := SMTPAccount{
+		ID:     ulid.MustNew(ulid.Now(), nil),
+		OAuth2: OAuth2{TokenURL: tokenURL, ClientID: "client"},
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		return SetOAuth2RefreshTokenTx(tx, acc.ID, "refresh-0")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return acc
+}
+
+func TestOAuth2AccessTokenRefresh(t *testing.T) {
+	fake := &fakeTokenServer{expiresIn: 3600}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	db := openTestDB(t)
+	acc := newTestOAuth2Account(t, db, srv.URL)
+
+	// the stored token has no access token, so it is refreshed
+	token, err := oauth2AccessToken(context.Background(), db, acc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "access-1" {
+		t.Errorf("got access token %q, want %q", token, "access-1")
+	}
+	if fake.refreshToken != "refresh-0" {
+		t.Errorf("server received refresh token %q, want %q", fake.refreshToken, "refresh-0")
+	}
+
+	// the stored access token is still valid, so the server is not contacted
+	token, err = oauth2AccessToken(context.Background(), db, acc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "access-1" || fake.requests != 1 {
+		t.Errorf("got access token %q after %d requests, want %q after 1 request", token, fake.requests, "access-1")
+	}
+
+	// invalidation forces a refresh
+	if err := invalidateOAuth2AccessToken(db, acc.ID); err != nil {
+		t.Fatal(err)
+	}
+	token, err = oauth2AccessToken(context.Background(), db, acc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "access-2" || fake.requests != 2 {
+		t.Errorf("got access token %q after %d requests, want %q after 2 requests", token, fake.requests, "access-2")
+	}
+}
+
+func TestOAuth2AccessTokenExpiry(t *testing.T) {
+	// tokens that expire within a minute are not used
+	fake := &fakeTokenServer{expiresIn: 30, rotate: true}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	db := openTestDB(t)
+	acc := newTestOAuth2Account(t, db, srv.URL)
+
+	for i := 1; i <= 3; i++ {
+		token, err := oauth2AccessToken(context.Background(), db, acc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("access-%d", i); token != want {
+			t.Errorf("got access token %q, want %q", token, want)
+		}
+		// the rotated refresh token of the previous response is used
+		if want := fmt.Sprintf("refresh-%d", i-1); fake.refreshToken != want {
+			t.Errorf("server received refresh token %q, want %q", fake.refreshToken, want)
+		}
+	}
+
+	var stored OAuth2Token
+	if err := dbutil.GetByKey(db, OAuth2Token{AccountID: acc.ID}.DBKey(), &stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored.RefreshToken != "refresh-3" {
+		t.Errorf("stored refresh token is %q, want %q", stored.RefreshToken, "refresh-3")
+	}
+	if until := time.Until(stored.Expiry); until <= 0 || until > 30*time.Second {
+		t.Errorf("stored token expires in %s, want at most 30s", until)
+	}
+}
+
+func TestOAuth2AccessTokenRefreshFailure(t *testing.T) {
+	fake := &fakeTokenServer{status: http.StatusBadRequest}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	db := openTestDB(t)
+	acc := newTestOAuth2Account(t, db, srv.URL)
+
+	if _, err := oauth2AccessToken(context.Background(), db, acc); err == nil {
+		t.Fatal("expected error when the token endpoint rejects the refresh token")
+	}
+	// the stored tokens are not modified
+	var stored OAuth2Token
+	if err := dbutil.GetByKey(db, OAuth2Token{AccountID: acc.ID}.DBKey(), &stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored.RefreshToken != "refresh-0" || stored.AccessToken != "" {
+		t.Errorf("stored token changed after a failed refresh: %+v", stored)
+	}
+}
+
+func TestOAuth2AccessTokenNotSet(t *testing.T) {
+	db := openTestDB(t)
+	acc := SMTPAccount{ID: ulid.MustNew(ulid.Now(), nil), OAuth2: OAuth2{TokenURL: "http://127.0.0.1:1", ClientID: "client"}}
+	if _, err := oauth2AccessToken(context.Background(), db, acc); err == nil {
+		t.Fatal("expected error when no refresh token is stored")
+	}
+}
+
+func TestOAuth2AccessTokenConcurrentRefresh(t *testing.T) {
+	fake := &fakeTokenServer{expiresIn: 3600, rotate: true}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	db := openTestDB(t)
+	acc := newTestOAuth2Account(t, db, srv.URL)
+
+	// identities that share the account connect at the same time
+	const identities = 5
+	tokens := make([]string, identities)
+	errs := make([]error, identities)
+	var wg sync.WaitGroup
+	for i := 0; i < identities; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tokens[i], errs[i] = oauth2AccessToken(context.Background(), db, acc)
+		}(i)
+	}
+	wg.Wait()
+	for i := range tokens {
+		if errs[i] != nil || tokens[i] != "access-1" {
+			t.Errorf("identity %d got access token %q, %v, want %q", i, tokens[i], errs[i], "access-1")
+		}
+	}
+	fake.mu.Lock()
+	requests := fake.requests
+	fake.mu.Unlock()
+	if requests != 1 {
+		t.Errorf("%d refresh requests, want 1", requests)
+	}
+	var stored OAuth2Token
+	if err := dbutil.GetByKey(db, OAuth2Token{AccountID: acc.ID}.DBKey(), &stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored.RefreshToken != "refresh-1" {
+		t.Errorf("stored refresh token is %q, want the rotated %q", stored.RefreshToken, "refresh-1")
+	}
+}
+
+func TestOAuth2AccessTokenKeepsReplacedRefreshToken(t *testing.T) {
+	db := openTestDB(t)
+	var acc SMTPAccount
+	// the user replaces the refresh token while the refresh request is in progress
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			return SetOAuth2RefreshTokenTx(tx, acc.ID, "refresh-user")
+		}); err != nil {
+			t.Error(err)
+		}
+		fmt.Fprint(w, `{"access_token":"access-1","token_type":"Bearer","expires_in":3600,"refresh_token":"refresh-1"}`)
+	}))
+	defer srv.Close()
+	acc = newTestOAuth2Account(t, db, srv.URL)
+
+	token, err := oauth2AccessToken(context.Background(), db, acc)
+	if err != nil || token != "access-1" {
+		t.Fatalf("oauth2AccessToken() = %q, %v, want %q", token, err, "access-1")
+	}
+	var stored OAuth2Token
+	if err := dbutil.GetByKey(db, OAuth2Token{AccountID: acc.ID}.DBKey(), &stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored.RefreshToken != "refresh-user" {
+		t.Errorf("stored refresh token is %q, want the one set by the user", stored.RefreshToken)
+	}
+}
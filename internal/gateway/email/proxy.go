@@ -0,0 +1,117 @@
+package email
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// validateProxy checks the proxy URL of the account, e.g. socks5://proxy.example.com:1080 or http://proxy.example.com:3128
+func validateProxy(proxyURL string) error {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return fmt.Errorf("invalid proxy URL: %s", err)
+	}
+	if u.Scheme != "socks5" && u.Scheme != "http" {
+		return fmt.Errorf("invalid proxy URL: scheme should be socks5 or http")
+	}
+	if u.Hostname() == "" || u.Port() == "" {
+		return fmt.Errorf("invalid proxy URL: host and port are required e.g. %s://proxy.example.com:1080", u.Scheme)
+	}
+	if u.User != nil {
+		return fmt.Errorf("invalid proxy URL: set the proxy username and password separately")
+	}
+	if u.Path != "" && u.Path != "/" {
+		return fmt.Errorf("invalid proxy URL: path is not allowed")
+	}
+	return nil
+}
+
+// dial connects to addr, through the proxy of the account if it is set.
+// The TLS handshake, if any, is done by the caller over the returned connection, so certificates are verified the same way with or without a proxy.
+func (c *SenderClientSMTP) dial(ctx context.Context, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	if c.SMTPAccount.Proxy == "" {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+	u, err := url.Parse(c.SMTPAccount.Proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %s", err)
+	}
+	switch u.Scheme {
+	case "socks5":
+		var auth *proxy.Auth
+		if c.SMTPAccount.ProxyUsername != "" {
+			auth = &proxy.Auth{User: c.SMTPAccount.ProxyUsername, Password: c.SMTPAccount.ProxyPassword}
+		}
+		socksDialer, err := proxy.SOCKS5("tcp", u.Host, auth, dialer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create SOCKS5 dialer: %s", err)
+		}
+		// the host name is resolved by the proxy
+		conn, err := socksDialer.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("SOCKS5 proxy %s: %s", u.Host, err)
+		}
+		return conn, nil
+	case "http":
+		return c.dialHTTPConnect(ctx, dialer, u.Host, addr)
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %s", u.Scheme)
+	}
+}
+
+// dialHTTPConnect opens a tunnel to addr with the CONNECT method of an HTTP proxy
+func (c *SenderClientSMTP) dialHTTPConnect(ctx context.Context, dialer *net.Dialer, proxyAddr string, addr string) (net.Conn, error) {
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("HTTP proxy %s: %s", proxyAddr, err)
+	}
+	// the proxy has the same time as a TCP connection to answer
+	_ = conn.SetDeadline(time.Now().Add(30 * time.Second))
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if c.SMTPAccount.ProxyUsername != "" {
+		credentials := c.SMTPAccount.ProxyUsername + ":" + c.SMTPAccount.ProxyPassword
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	}
+	if err := req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("HTTP proxy %s: failed to send CONNECT: %s", proxyAddr, err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("HTTP proxy %s: failed to read reply to CONNECT: %s", proxyAddr, err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("HTTP proxy %s: CONNECT to %s failed: %s", proxyAddr, addr, resp.Status)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	// the greeting of the SMTP server might have been read together with the reply of the proxy
+	return &bufferedConn{Conn: conn, r: br}, nil
+}
+
+// bufferedConn is a connection whose first bytes have been read into r
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,101 @@
+package email
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+
+	"go.angaros.io/internal/errorbehavior"
+)
+
+// ReplyError is a negative reply of the SMTP server to a command
+type ReplyError struct {
+	Command string
+	Code    int
+	// EnhancedCode is the enhanced status code (RFC 3463) e.g. 5.1.1, empty if the server does not send them
+	EnhancedCode string
+	Message      string
+}
+
+func newReplyError(command string, errSMTP *smtp.SMTPError) *ReplyError {
+	e := &ReplyError{
+		Command: command,
+		Code:    errSMTP.Code,
+		Message: errSMTP.Message,
+	}
+	if c := errSMTP.EnhancedCode; c != smtp.EnhancedCodeNotSet && c != smtp.NoEnhancedCode {
+		e.EnhancedCode = fmt.Sprintf("%d.%d.%d", c[0], c[1], c[2])
+	}
+	return e
+}
+
+func (e *ReplyError) Error() string {
+	return fmt.Sprintf("SMTP %s failed with code %s: %s", e.Command, e.StatusCode(), e.Message)
+}
+
+// StatusCode returns the reply code followed by the enhanced status code, e.g. "550 5.1.1"
+func (e *ReplyError) StatusCode() string {
+	if e.EnhancedCode == "" {
+		return strconv.Itoa(e.Code)
+	}
+	return strconv.Itoa(e.Code) + " " + e.EnhancedCode
+}
+
+// Permanent reports whether the reply is a permanent failure (5xx), so the command will fail again if retried
+func (e *ReplyError) Permanent() bool {
+	return e.Code >= 500
+}
+
+// accountLevel reports whether a reply of the relay affects every message of the account and not only the current recipient:
+//   - authentication is required, too weak or has been revoked (530, 534, 535, 5.7.0, 5.7.8 and 5.7.9)
+//   - the relay refuses the sender or the connection, e.g. because the account is rate limited (421 or 4.7.X)
+//     or blocked by a policy (any 5xx, e.g. 554 5.7.1), in reply to MAIL or the greeting
+//
+// The same codes in reply to RCPT are about the recipient, e.g. a policy rejection of the recipient's domain, except for the authentication reply codes.
+func (e *ReplyError) accountLevel() bool {
+	switch e.Code {
+	case 530, // authentication required
+		534, // authentication mechanism is too weak
+		535: // authentication credentials invalid
+		return true
+	}
+	if e.Command == "Rcpt" {
+		return false
+	}
+	switch e.EnhancedCode {
+	case "5.7.0", // other security or policy status, e.g. authentication required
+		"5.7.8", // authentication credentials invalid
+		"5.7.9": // authentication mechanism is too weak
+		return true
+	}
+	if e.Command == "Mail" || e.Command == "connect" {
+		return e.Code == 421 || strings.HasPrefix(e.EnhancedCode, "4.7.") || e.Permanent()
+	}
+	return false
+}
+
+// wrapSMTPError wraps the error of an SMTP command according to the reply of the server:
+//   - 4xx replies are temporary failures and the message is retried
+//   - 5xx replies are permanent failures and the message is rejected
+//   - replies of the relay that affect every message of the account pause sending, see accountLevel.
+//     In direct mode they affect only the recipient's domain, e.g. greylisting uses 451 4.7.1
+//
+// Errors without a reply, e.g. a closed connection, are retried.
+func (c *SenderClientSMTP) wrapSMTPError(command string, err error) error {
+	var errSMTP *smtp.SMTPError
+	if !errors.As(err, &errSMTP) {
+		return errorbehavior.WrapRetryable(fmt.Errorf("SMTP %s failed: %s", command, err))
+	}
+	errReply := newReplyError(command, errSMTP)
+	switch {
+	case !c.SMTPAccount.IsDirect() && errReply.accountLevel():
+		return errorbehavior.WrapPausing(errReply)
+	case errReply.Permanent():
+		return errorbehavior.WrapRejected(errReply)
+	default:
+		return errorbehavior.WrapRetryable(errReply)
+	}
+}
@@ -0,0 +1,102 @@
+package email
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+
+	"go.angaros.io/internal/errorbehavior"
+)
+
+func TestWrapSMTPError(t *testing.T) {
+	const (
+		retryable = "retryable"
+		rejected  = "rejected"
+		pausing   = "pausing"
+	)
+	tests := []struct {
+		command string
+		code    int
+		enh     smtp.EnhancedCode
+		direct  bool
+		want    string
+	}{
+		// authentication failures pause the broadcast at any stage
+		{command: "Mail", code: 530, enh: smtp.EnhancedCode{5, 7, 0}, want: pausing},
+		{command: "Rcpt", code: 530, enh: smtp.EnhancedCode{5, 7, 0}, want: pausing},
+		{command: "Mail", code: 535, enh: smtp.NoEnhancedCode, want: pausing},
+		{command: "Data", code: 534, enh: smtp.EnhancedCode{5, 7, 9}, want: pausing},
+		{command: "Mail", code: 550, enh: smtp.EnhancedCode{5, 7, 8}, want: pausing},
+		{command: "Data", code: 554, enh: smtp.EnhancedCode{5, 7, 0}, want: pausing},
+		// the relay refuses the sender or the connection
+		{command: "Mail", code: 421, enh: smtp.NoEnhancedCode, want: pausing},
+		{command: "Mail", code: 451, enh: smtp.EnhancedCode{4, 7, 1}, want: pausing},
+		{command: "connect", code: 421, enh: smtp.EnhancedCode{4, 7, 0}, want: pausing},
+		{command: "connect", code: 554, enh: smtp.NoEnhancedCode, want: pausing},
+		{command: "Mail", code: 554, enh: smtp.EnhancedCode{5, 7, 1}, want: pausing},
+		{command: "Mail", code: 550, enh: smtp.EnhancedCode{5, 1, 0}, want: pausing},
+		// policy rejections of a recipient
+		{command: "Rcpt", code: 550, enh: smtp.EnhancedCode{5, 7, 1}, want: rejected},
+		{command: "Rcpt", code: 554, enh: smtp.EnhancedCode{5, 7, 0}, want: rejected},
+		{command: "Rcpt", code: 554, enh: smtp.NoEnhancedCode, want: rejected},
+		{command: "Rcpt", code: 450, enh: smtp.EnhancedCode{4, 7, 1}, want: retryable},
+		{command: "Rcpt", code: 421, enh: smtp.NoEnhancedCode, want: retryable},
+		// other security statuses are about the message
+		{command: "Data", code: 550, enh: smtp.EnhancedCode{5, 7, 1}, want: rejected},
+		{command: "Data", code: 554, enh: smtp.NoEnhancedCode, want: rejected},
+		{command: "Data", code: 451, enh: smtp.EnhancedCode{4, 7, 1}, want: retryable},
+		// temporary and permanent failures without an enhanced code
+		{command: "Data", code: 421, enh: smtp.NoEnhancedCode, want: retryable},
+		{command: "Data", code: 451, enh: smtp.NoEnhancedCode, want: retryable},
+		{command: "Rcpt", code: 550, enh: smtp.EnhancedCode{5, 1, 1}, want: rejected},
+		{command: "Rcpt", code: 452, enh: smtp.EnhancedCode{4, 2, 2}, want: retryable},
+		// in direct mode the replies affect only the recipient's domain
+		{command: "Mail", code: 451, enh: smtp.EnhancedCode{4, 7, 1}, direct: true, want: retryable},
+		{command: "Mail", code: 530, enh: smtp.EnhancedCode{5, 7, 0}, direct: true, want: rejected},
+		{command: "connect", code: 421, enh: smtp.NoEnhancedCode, direct: true, want: retryable},
+		{command: "connect", code: 554, enh: smtp.NoEnhancedCode, direct: true, want: rejected},
+	}
+	for _, tt := range tests {
+		c := SenderClientSMTP{}
+		if tt.direct {
+			c.SMTPAccount.Mode = ModeDirect
+		}
+		err := c.wrapSMTPError(tt.command, &smtp.SMTPError{Code: tt.code, EnhancedCode: tt.enh, Message: "reply"})
+		var got string
+		switch {
+		case errorbehavior.IsPausing(err):
+			got = pausing
+		case errorbehavior.IsRejected(err):
+			got = rejected
+		case errorbehavior.IsRetryable(err):
+			got = retryable
+		}
+		if got != tt.want {
+			t.Errorf("wrapSMTPError(%s, %d %v, direct=%t) is %s, want %s: %v", tt.command, tt.code, tt.enh, tt.direct, got, tt.want, err)
+		}
+		var errReply *ReplyError
+		if !errors.As(err, &errReply) || errReply.Code != tt.code {
+			t.Errorf("wrapSMTPError(%s, %d %v) does not wrap the reply: %v", tt.command, tt.code, tt.enh, err)
+		}
+	}
+}
+
+func TestWrapSMTPErrorWithoutReply(t *testing.T) {
+	err := (&SenderClientSMTP{}).wrapSMTPError("Data", io.ErrUnexpectedEOF)
+	if !errorbehavior.IsRetryable(err) || errorbehavior.IsRejected(err) || errorbehavior.IsPausing(err) {
+		t.Errorf("wrapSMTPError() of a broken connection = %v, want retryable", err)
+	}
+}
+
+func TestReplyErrorStatusCode(t *testing.T) {
+	e := newReplyError("Rcpt", &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "user unknown"})
+	if got := e.StatusCode(); got != "550 5.1.1" {
+		t.Errorf("StatusCode() = %q, want %q", got, "550 5.1.1")
+	}
+	e = newReplyError("Rcpt", &smtp.SMTPError{Code: 550, EnhancedCode: smtp.NoEnhancedCode, Message: "user unknown"})
+	if got := e.StatusCode(); got != "550" {
+		t.Errorf("StatusCode() without enhanced code = %q, want %q", got, "550")
+	}
+}
@@ -47,12 +47,14 @@ func DBGetSettingListUnsubscribeEmailIdentity(tx *bolt.Tx, listUnsubscribeEmailI
 	return nil
 }
 
-type SettingListUnsubscribeHeader string
+// SettingListUnsubscribeURL is the public https URL of the unsubscribe endpoint e.g. https://example.com/unsubscribe.
+// If set, the List-Unsubscribe header has the URL with a signed token of the recipient and supports one-click unsubscribe (RFC 8058).
+type SettingListUnsubscribeURL string
 
-func (s SettingListUnsubscribeHeader) DBTable() string {
+func (s SettingListUnsubscribeURL) DBTable() string {
 	return "settings"
 }
 
-func (s SettingListUnsubscribeHeader) DBKey() []byte {
-	return []byte("gateway.email.list_unsubscribe_header")
+func (s SettingListUnsubscribeURL) DBKey() []byte {
+	return []byte("gateway.email.list_unsubscribe_url")
 }
@@ -1,6 +1,7 @@
 package email
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
 	"crypto/tls"
@@ -8,9 +9,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"mime"
+	"net"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/emersion/go-message"
 	"github.com/emersion/go-message/mail"
 	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
@@ -35,6 +41,24 @@ type SMTPAccount struct {
 	LimitPerHour              int
 	LimitPerDay               int
 	ConnectionReuseCountLimit int
+
+	// OAuth2 is used only by the XOAUTH2 auth type
+	OAuth2 OAuth2
+
+	// Mode is ModeRelay or ModeDirect. Empty means ModeRelay.
+	// In direct mode, Host, Username, Password, AuthType and ConnectionEncryption are not used
+	// and Port is the port of the MX servers (0 means 25).
+	Mode string
+
+	// HeloName is the host name sent in EHLO. Empty means the host name of the computer.
+	// It is required in direct mode, where it must be the name that the PTR record of the sending IP address points to.
+	HeloName string
+
+	// Proxy is the URL of the proxy that connections go through, e.g. socks5://proxy.example.com:1080
+	// or http://proxy.example.com:3128 for HTTP CONNECT. Empty means no proxy.
+	Proxy         string
+	ProxyUsername string
+	ProxyPassword string
 }
 
 func (s SMTPAccount) DBTable() string {
@@ -46,19 +70,130 @@ func (s SMTPAccount) DBKey() []byte {
 }
 
 func (s SMTPAccount) String() string {
+	if s.IsDirect() {
+		return fmt.Sprintf("ID: %s, Mode: %s", s.ID, ModeDirect)
+	}
 	return fmt.Sprintf("ID: %s, Host: %v, Port: %v, Username: %v", s.ID, s.Host, s.Port, s.Username)
 }
 
+// IsDirect reports whether the account delivers to the MX servers of the recipients instead of a relay
+func (s SMTPAccount) IsDirect() bool {
+	return s.Mode == ModeDirect
+}
+
+// Validate checks that the account settings are valid
+func (s SMTPAccount) Validate() error {
+	if strings.ContainsAny(s.HeloName, " \t\r\n") {
+		return fmt.Errorf("invalid EHLO name: it must be a host name or an address literal e.g. [192.0.2.1]")
+	}
+	if s.Proxy != "" {
+		if err := validateProxy(s.Proxy); err != nil {
+			return err
+		}
+	} else if s.ProxyUsername != "" {
+		return fmt.Errorf("proxy username is set without a proxy")
+	}
+	switch s.Mode {
+	case "", ModeRelay:
+	case ModeDirect:
+		// the receiving servers check that the EHLO name resolves to the sending IP address and back (FCrDNS)
+		if s.HeloName == "" {
+			return fmt.Errorf("EHLO name is required in direct mode: set it to the name of the PTR record of the sending IP address")
+		}
+		if s.Port < 0 || s.Port > 65535 {
+			return fmt.Errorf("invalid port: value should be between 0 and 65535")
+		}
+		return s.validateLimits()
+	default:
+		return fmt.Errorf("invalid mode: %v", s.Mode)
+	}
+	if s.Host == "" {
+		return fmt.Errorf("host is empty")
+	}
+	if s.Port < 0 || s.Port > 65535 {
+		return fmt.Errorf("invalid port: value should be between 0 and 65535")
+	}
+	switch s.ConnectionEncryption {
+	case "TLS", "STARTTLS", "INSECURE":
+	case "":
+		return fmt.Errorf("choose connection encryption")
+	default:
+		return fmt.Errorf("invalid connection encryption value: %v", s.ConnectionEncryption)
+	}
+	switch s.AuthType {
+	case "PLAIN", "LOGIN", "CRAM-MD5", "NONE":
+	case "XOAUTH2":
+		if s.Username == "" {
+			return fmt.Errorf("username is required for XOAUTH2")
+		}
+		if err := s.OAuth2.Validate(); err != nil {
+			return err
+		}
+	case "":
+		return fmt.Errorf("choose authentication type")
+	default:
+		return fmt.Errorf("unknown auth type %s", s.AuthType)
+	}
+	return s.validateLimits()
+}
+
+func (s SMTPAccount) validateLimits() error {
+	if s.LimitPerMinute < 0 || s.LimitPerHour < 0 || s.LimitPerDay < 0 || s.ConnectionReuseCountLimit < 0 {
+		return fmt.Errorf("limits cannot be negative")
+	}
+	if s.LimitPerHour > 0 && s.LimitPerMinute == 0 {
+		return fmt.Errorf("you cannot set limit per hour without setting limit per minute")
+	}
+	if s.LimitPerDay > 0 && s.LimitPerMinute == 0 {
+		return fmt.Errorf("you cannot set limit per day without setting limit per minute")
+	}
+	return nil
+}
+
+// SaveSMTPAccountTx saves the account and, if given, its OAuth2 refresh token.
+// A refresh token is required for XOAUTH2 unless one is already stored.
+func SaveSMTPAccountTx(tx *bolt.Tx, a SMTPAccount, oauth2RefreshToken string) error {
+	if a.AuthType == "XOAUTH2" {
+		if oauth2RefreshToken != "" {
+			if err := SetOAuth2RefreshTokenTx(tx, a.ID, oauth2RefreshToken); err != nil {
+				return err
+			}
+		} else if ok, err := HasOAuth2RefreshTokenTx(tx, a.ID); err != nil {
+			return err
+		} else if !ok {
+			return fmt.Errorf("OAuth2 refresh token is required for XOAUTH2")
+		}
+	}
+	return dbutil.UpsertSaveableTx(tx, a)
+}
+
+// DeleteSMTPAccountTx deletes the account and its OAuth2 tokens
+func DeleteSMTPAccountTx(tx *bolt.Tx, id ulid.ULID) error {
+	var t OAuth2Token
+	err := dbutil.DeleteByTableKeyTx(tx, t.DBTable(), id[:])
+	if err != nil && !errors.Is(err, dbutil.ErrNotFound) {
+		return fmt.Errorf("failed to delete OAuth2 token: %s", err)
+	}
+	var a SMTPAccount
+	return dbutil.DeleteByTableKeyTx(tx, a.DBTable(), id[:])
+}
+
 type SenderClientSMTP struct {
+	db                     *bolt.DB // used to store refreshed OAuth2 tokens
 	SMTPAccount            SMTPAccount
 	From                   Identity
 	saslClient             sasl.Client
 	TLSConfig              *tls.Config
 	conn                   *smtp.Client
+	netConn                net.Conn // the connection of conn
 	connectionReuseCounter int
 	connectionReuseStarted time.Time
 	ListUnsubscribeEnabled bool
 	ListUnsubscribeEmail   string
+
+	// Resolver is used in direct mode to look up the MX servers. If nil, net.DefaultResolver is used.
+	Resolver    Resolver
+	directConns map[string]*directConn // keyed by recipient domain
 }
 
 func (c SenderClientSMTP) GetLimitPerMinute() int {
@@ -73,7 +208,7 @@ func (c SenderClientSMTP) GetLimitPerDay() int {
 	return c.SMTPAccount.LimitPerDay
 }
 
-var _ gateway.SenderClient = (*SenderClientSMTP)(nil)
+var _ gateway.BatchSender = (*SenderClientSMTP)(nil)
 
 func NewSenderClientFromKey(db *bolt.DB, key []byte) (*SenderClientSMTP, error) {
 	var acc SMTPAccount
@@ -107,6 +242,7 @@ func NewSenderClientFromKey(db *bolt.DB, key []byte) (*SenderClientSMTP, error)
 		return nil, err
 	}
 	return &SenderClientSMTP{
+		db:                     db,
 		SMTPAccount:            acc,
 		From:                   id,
 		ListUnsubscribeEnabled: bool(settingListUnsubscribeEnabled),
@@ -114,7 +250,64 @@ func NewSenderClientFromKey(db *bolt.DB, key []byte) (*SenderClientSMTP, error)
 	}, nil
 }
 
+// NewSenderClientFromAccountKey returns a client of the SMTP account, used to test it.
+// The sender of test messages is the first email identity that uses the account, if any.
+func NewSenderClientFromAccountKey(db *bolt.DB, key []byte) (*SenderClientSMTP, error) {
+	var acc SMTPAccount
+	var from Identity
+	if err := db.View(func(tx *bolt.Tx) error {
+		err := dbutil.GetByKeyTx(tx, key, &acc)
+		if err != nil { // don't ignore dbutil.ErrNotFound
+			return fmt.Errorf("failed to read SMTP account from database: %s", err)
+		}
+		err = dbutil.ForEachTx(tx, &Identity{}, func(k []byte, v interface{}) error {
+			if id := v.(Identity); from.Email == "" && bytes.Equal(id.SMTPKey, key) {
+				from = id
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read email identities from database: %s", err)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return &SenderClientSMTP{
+		db:          db,
+		SMTPAccount: acc,
+		From:        from,
+	}, nil
+}
+
 func (c *SenderClientSMTP) PreSend(ctx context.Context) error {
+	if c.SMTPAccount.IsDirect() {
+		// connections are opened per recipient domain by Send
+		return nil
+	}
+	return c.connect(ctx, nil)
+}
+
+// Test connects and authenticates like PreSend and reports each stage.
+// On success the connection is left open, so a test message can be sent.
+func (c *SenderClientSMTP) Test(ctx context.Context) ([]gateway.TestStep, error) {
+	if c.SMTPAccount.IsDirect() {
+		return []gateway.TestStep{{Name: "Mode", Details: "direct delivery, the MX servers of the recipient are tested by sending a test message"}}, nil
+	}
+	var steps []gateway.TestStep
+	err := c.connect(ctx, func(step gateway.TestStep) {
+		steps = append(steps, step)
+	})
+	return steps, err
+}
+
+// connect opens a new connection. If report is not nil, it is called after each stage.
+func (c *SenderClientSMTP) connect(ctx context.Context, report func(gateway.TestStep)) error {
+	step := func(name, details string, err error) {
+		if report != nil {
+			report(gateway.TestStep{Name: name, Details: details, Err: err})
+		}
+	}
 	var err error
 	_ = c.PostSend(ctx)
 	c.connectionReuseCounter = 0
@@ -122,6 +315,18 @@ func (c *SenderClientSMTP) PreSend(ctx context.Context) error {
 	switch c.SMTPAccount.AuthType {
 	case "PLAIN", "":
 		c.saslClient = sasl.NewPlainClient("", c.SMTPAccount.Username, c.SMTPAccount.Password)
+	case "LOGIN":
+		c.saslClient = sasl.NewLoginClient(c.SMTPAccount.Username, c.SMTPAccount.Password)
+	case "CRAM-MD5":
+		c.saslClient = &cramMD5Client{username: c.SMTPAccount.Username, password: c.SMTPAccount.Password}
+	case "XOAUTH2":
+		accessToken, err := oauth2AccessToken(ctx, c.db, c.SMTPAccount)
+		if err != nil {
+			step("OAuth2", "", err)
+			return err
+		}
+		step("OAuth2", "access token is valid", nil)
+		c.saslClient = &xoauth2Client{username: c.SMTPAccount.Username, accessToken: accessToken}
 	case "NONE":
 	default:
 		return fmt.Errorf("unknown auth type %s", c.SMTPAccount.AuthType)
@@ -130,69 +335,179 @@ func (c *SenderClientSMTP) PreSend(ctx context.Context) error {
 		InsecureSkipVerify: c.SMTPAccount.TLSInsecureSkipVerify,
 		ServerName:         c.SMTPAccount.Host,
 	}
+	port := 587
 	switch c.SMTPAccount.ConnectionEncryption {
-	case "STARTTLS":
-		port := 587
-		if c.SMTPAccount.Port != 0 {
-			port = c.SMTPAccount.Port
+	case "TLS":
+		port = 465
+	case "STARTTLS", "INSECURE":
+	default:
+		return fmt.Errorf("invalid connection encryption value: %v", c.SMTPAccount.ConnectionEncryption)
+	}
+	if c.SMTPAccount.Port != 0 {
+		port = c.SMTPAccount.Port
+	}
+
+	if c.SMTPAccount.Proxy == "" {
+		addrs, err := net.DefaultResolver.LookupHost(ctx, c.SMTPAccount.Host)
+		step("DNS", strings.Join(addrs, ", "), err)
+		if err != nil {
+			return fmt.Errorf("DNS lookup failed: %s", err)
 		}
-		c.conn, err = smtp.Dial(fmt.Sprintf("%s:%d", c.SMTPAccount.Host, port))
+	}
+	addr := net.JoinHostPort(c.SMTPAccount.Host, strconv.Itoa(port))
+	conn, err := c.dial(ctx, addr)
+	if err != nil {
+		step("TCP", "", err)
+		return fmt.Errorf("smtp.Dial failed: %s", err)
+	}
+	if c.SMTPAccount.Proxy != "" {
+		// the host name is resolved by the proxy
+		step("TCP", "connected to "+addr+" through "+c.SMTPAccount.Proxy, nil)
+	} else {
+		step("TCP", "connected to "+conn.RemoteAddr().String(), nil)
+	}
+	if c.SMTPAccount.ConnectionEncryption == "TLS" {
+		tlsConn := tls.Client(conn, c.TLSConfig)
+		_ = tlsConn.SetDeadline(time.Now().Add(30 * time.Second))
+		err = tlsConn.Handshake()
 		if err != nil {
-			return fmt.Errorf("smtp.Dial failed: %s", err)
+			step("TLS", "", err)
+			_ = conn.Close()
+			return fmt.Errorf("smtp.DialTLS failed: %s", err)
+		}
+		_ = tlsConn.SetDeadline(time.Time{})
+		step("TLS", tlsDetails(tlsConn.ConnectionState()), nil)
+		conn = tlsConn
+	}
+	c.conn, err = smtp.NewClient(conn, c.SMTPAccount.Host)
+	if err != nil {
+		step("EHLO", "", err)
+		_ = conn.Close()
+		var errSMTP *smtp.SMTPError
+		if errors.As(err, &errSMTP) {
+			// the server refused the connection in its greeting
+			return c.wrapSMTPError("connect", err)
 		}
+		return fmt.Errorf("smtp.Dial failed: %s", err)
+	}
+	c.netConn = conn
+	err = c.conn.Hello(c.heloName())
+	step("EHLO", "as "+c.heloName()+": "+c.extensions(), err)
+	if err != nil {
+		_ = c.PostSend(ctx)
+		return fmt.Errorf("SMTP EHLO failed: %s", err)
+	}
+	if c.SMTPAccount.ConnectionEncryption == "STARTTLS" {
 		starttlsSupported, _ := c.conn.Extension("STARTTLS")
 		if !starttlsSupported {
 			_ = c.PostSend(ctx)
-			return fmt.Errorf("SMTP server does not support STARTTLS")
+			err = fmt.Errorf("SMTP server does not support STARTTLS")
+			step("STARTTLS", "", err)
+			return err
 		}
 		err = c.conn.StartTLS(c.TLSConfig)
 		if err != nil {
+			step("STARTTLS", "", err)
 			_ = c.PostSend(ctx)
 			return fmt.Errorf("conn.StartTLS failed: %s", err)
 		}
-	case "TLS":
-		port := 465
-		if c.SMTPAccount.Port != 0 {
-			port = c.SMTPAccount.Port
-		}
-		c.conn, err = smtp.DialTLS(fmt.Sprintf("%s:%d", c.SMTPAccount.Host, port), c.TLSConfig)
+		state, _ := c.conn.TLSConnectionState()
+		step("STARTTLS", tlsDetails(state), nil)
+		// the extensions may change after STARTTLS
+		err = c.conn.Hello(c.heloName())
+		step("EHLO", c.extensions(), err)
 		if err != nil {
-			return fmt.Errorf("smtp.DialTLS failed: %s", err)
-		}
-	case "INSECURE":
-		port := 587
-		if c.SMTPAccount.Port != 0 {
-			port = c.SMTPAccount.Port
-		}
-		c.conn, err = smtp.Dial(fmt.Sprintf("%s:%d", c.SMTPAccount.Host, port))
-		if err != nil {
-			return fmt.Errorf("smtp.Dial failed: %s", err)
+			_ = c.PostSend(ctx)
+			return fmt.Errorf("SMTP EHLO failed: %s", err)
 		}
-	default:
-		return fmt.Errorf("invalid connection encryption value: %v", c.SMTPAccount.ConnectionEncryption)
 	}
 	err = c.conn.Noop()
 	if err != nil {
 		_ = c.PostSend(ctx)
 		return fmt.Errorf("SMTP Noop failed: %s", err)
 	}
-	// TODO: EHLO
 	if c.SMTPAccount.AuthType == "NONE" {
+		step("AUTH", "skipped, authentication is NONE", nil)
 		return nil
 	}
 	err = c.conn.Auth(c.saslClient)
 	if err != nil {
+		step("AUTH", "", err)
 		_ = c.PostSend(ctx)
+		if c.SMTPAccount.AuthType == "XOAUTH2" {
+			// the access token may have been revoked before its expiry
+			if err := invalidateOAuth2AccessToken(c.db, c.SMTPAccount.ID); err != nil {
+				return fmt.Errorf("failed to reset OAuth2 access token: %s", err)
+			}
+		}
 		var errSMTP *smtp.SMTPError
 		if errors.As(err, &errSMTP) {
-			return fmt.Errorf("SMTP Auth failed with code %d: %v", errSMTP.Code, errSMTP)
+			errReply := newReplyError("Auth", errSMTP)
+			if errReply.Permanent() {
+				// the credentials are invalid or have been revoked, so every reconnection would fail
+				return errorbehavior.WrapPausing(errReply)
+			}
+			return errReply
 		}
 		return fmt.Errorf("SMTP Auth failed: %s", err)
 	}
+	step("AUTH", fmt.Sprintf("authenticated as %s with %s", c.SMTPAccount.Username, c.SMTPAccount.AuthType), nil)
 	return nil
 }
 
+// heloName is the host name sent in EHLO: the name set in the account, or else the host name of the computer if it is fully qualified.
+// The domain of the sender is not used, because it does not match the PTR record of the sending IP address
+func (c *SenderClientSMTP) heloName() string {
+	if c.SMTPAccount.HeloName != "" {
+		return c.SMTPAccount.HeloName
+	}
+	if hostname, err := os.Hostname(); err == nil && strings.Contains(hostname, ".") {
+		return hostname
+	}
+	return "localhost"
+}
+
+// smtpExtensions are the extensions reported by Test. The SMTP client does not expose the full EHLO response.
+var smtpExtensions = []string{"STARTTLS", "AUTH", "SIZE", "8BITMIME", "SMTPUTF8", "PIPELINING", "CHUNKING", "BINARYMIME", "DSN", "ENHANCEDSTATUSCODES", "REQUIRETLS"}
+
+// extensions returns the known extensions advertised by the server
+func (c *SenderClientSMTP) extensions() string {
+	var exts []string
+	for _, name := range smtpExtensions {
+		if ok, param := c.conn.Extension(name); ok {
+			exts = append(exts, strings.TrimSpace(name+" "+param))
+		}
+	}
+	if len(exts) == 0 {
+		return "no extensions"
+	}
+	return strings.Join(exts, ", ")
+}
+
+// tlsDetails describes the TLS connection and the certificate of the server
+func tlsDetails(state tls.ConnectionState) string {
+	versions := map[uint16]string{
+		tls.VersionTLS10: "TLS 1.0",
+		tls.VersionTLS11: "TLS 1.1",
+		tls.VersionTLS12: "TLS 1.2",
+		tls.VersionTLS13: "TLS 1.3",
+	}
+	details := fmt.Sprintf("%s, %s", versions[state.Version], tls.CipherSuiteName(state.CipherSuite))
+	if len(state.PeerCertificates) > 0 {
+		cert := state.PeerCertificates[0]
+		details += fmt.Sprintf("\ncertificate: %s, issued by %s, valid until %s", cert.Subject.CommonName, cert.Issuer.CommonName, cert.NotAfter.Format("2006-01-02"))
+		if len(cert.DNSNames) > 0 {
+			details += "\nnames: " + strings.Join(cert.DNSNames, ", ")
+		}
+	}
+	if len(state.VerifiedChains) == 0 {
+		details += "\ncertificate was not verified"
+	}
+	return details
+}
+
 func (c *SenderClientSMTP) PostSend(ctx context.Context) error {
+	c.directCloseAll()
 	if c.conn == nil {
 		return nil
 	}
@@ -204,58 +519,68 @@ func (c *SenderClientSMTP) PostSend(ctx context.Context) error {
 		}
 	}
 	c.conn = nil
+	c.netConn = nil
 	return nil
 }
 
-func (c *SenderClientSMTP) Send(ctx context.Context, to string, subject, msg, broadcastID string) error {
-	if c.SMTPAccount.ConnectionReuseCountLimit < 2 ||
-		c.connectionReuseCounter >= c.SMTPAccount.ConnectionReuseCountLimit ||
-		time.Since(c.connectionReuseStarted) >= 300*time.Second { // 300s is postfix's default value for smtp_connection_reuse_time_limit
-		// reconnect
-		err := c.PreSend(ctx)
-		if err != nil {
-			return errorbehavior.WrapRetryable(fmt.Errorf("failed to connect to server: %s", err))
+func (c *SenderClientSMTP) Send(ctx context.Context, to string, msg gateway.Message, broadcastID string) error {
+	return c.send(ctx, []string{to}, msg, broadcastID)[0]
+}
+
+// SendBatch sends the message in one transaction with many envelope recipients.
+// The recipients are not shown in the headers. In direct mode there is one transaction per recipient domain.
+func (c *SenderClientSMTP) SendBatch(ctx context.Context, to []string, msg gateway.Message, broadcastID string) []error {
+	return c.send(ctx, to, msg, broadcastID)
+}
+
+// send sends the message to the recipients and returns the error of each recipient
+func (c *SenderClientSMTP) send(ctx context.Context, to []string, msg gateway.Message, broadcastID string) []error {
+	errs := make([]error, len(to))
+	setErrs := func(indexes []int, err error) {
+		for _, i := range indexes {
+			errs[i] = err
 		}
 	}
-	c.connectionReuseCounter++
-	fromParsed, err := mail.ParseAddress(c.From.String())
-	if err != nil {
-		return fmt.Errorf("failed to parse sender address %s: %s", c.From.String(), err)
+	all := make([]int, len(to))
+	for i := range to {
+		all[i] = i
 	}
-	toParsed, err := mail.ParseAddress(to)
-	if err != nil {
-		return fmt.Errorf("failed to parse recipient address %s: %s", to, err)
-	}
-
-	err = c.conn.Noop()
+	fromParsed, err := mail.ParseAddress(c.From.String())
 	if err != nil {
-		return errorbehavior.WrapRetryable(fmt.Errorf("SMTP Noop failed: %s", err))
+		setErrs(all, fmt.Errorf("failed to parse sender address %s: %s", c.From.String(), err))
+		return errs
 	}
-	err = c.conn.Mail(fromParsed.Address, nil)
-	if err != nil {
-		var errSMTP *smtp.SMTPError
-		if errors.As(err, &errSMTP) {
-			return errorbehavior.WrapRetryable(fmt.Errorf("SMTP Mail failed with code %d: %v", errSMTP.Code, errSMTP))
+	toParsed := make([]*mail.Address, len(to))
+	var valid []int
+	for i := range to {
+		toParsed[i], err = mail.ParseAddress(to[i])
+		if err != nil {
+			errs[i] = errorbehavior.WrapRejected(fmt.Errorf("failed to parse recipient address %s: %s", to[i], err))
+			continue
 		}
-		return errorbehavior.WrapRetryable(fmt.Errorf("SMTP Mail failed: %s", err))
+		valid = append(valid, i)
 	}
-	err = c.conn.Rcpt(to)
-	if err != nil {
-		var errSMTP *smtp.SMTPError
-		if errors.As(err, &errSMTP) {
-			return errorbehavior.WrapRetryable(fmt.Errorf("SMTP Rcpt failed with code %d: %v", errSMTP.Code, errSMTP))
-		}
-		return errorbehavior.WrapRetryable(fmt.Errorf("SMTP Rcpt failed: %s", err))
+	if len(valid) == 0 {
+		return errs
 	}
 
+	messageIDDomain := c.SMTPAccount.Host
+	if c.SMTPAccount.IsDirect() {
+		messageIDDomain = c.heloName()
+	}
 	var header mail.Header
-	header.SetContentType("text/plain", map[string]string{"charset": "UTF-8"})
 	header.SetDate(time.Now().UTC())
 	header.SetAddressList("From", []*mail.Address{fromParsed})
-	header.SetAddressList("To", []*mail.Address{toParsed})
+	if len(to) == 1 {
+		header.SetAddressList("To", []*mail.Address{toParsed[0]})
+	} else {
+		// the recipients of a batch are only in the envelope
+		header.Set("To", "undisclosed-recipients:;")
+	}
 	// header.GenerateMessageID()
-	header.SetMessageID(generateMessageID(broadcastID, to, c.SMTPAccount.Host))
-	header.SetSubject(subject)
+	// the messages of a batch are matched to bounces by the first recipient
+	header.SetMessageID(generateMessageID(broadcastID, to[0], messageIDDomain))
+	header.SetSubject(msg.Subject)
 	if c.ListUnsubscribeEnabled {
 		var listUnsubscribeEmail string
 		if c.ListUnsubscribeEmail != "" {
@@ -263,37 +588,285 @@ func (c *SenderClientSMTP) Send(ctx context.Context, to string, subject, msg, br
 		} else {
 			listUnsubscribeEmail = c.From.Email
 		}
-		header.Set("List-Unsubscribe", fmt.Sprintf("<mailto:%s?subject=unsubscribe>", listUnsubscribeEmail))
+		listUnsubscribe := fmt.Sprintf("<mailto:%s?subject=unsubscribe>", listUnsubscribeEmail)
+		if msg.UnsubscribeURL != "" {
+			// one-click unsubscribe (RFC 8058)
+			listUnsubscribe = fmt.Sprintf("<%s>, %s", msg.UnsubscribeURL, listUnsubscribe)
+			header.Set("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+		}
+		header.Set("List-Unsubscribe", listUnsubscribe)
+	}
+	// the message is built before the transaction, so its size can be checked against the limit of the server
+	var buf bytes.Buffer
+	if err := c.writeMessage(&buf, header, msg); err != nil {
+		setErrs(valid, errorbehavior.WrapRetryable(err))
+		return errs
+	}
+
+	if !c.SMTPAccount.IsDirect() {
+		c.sendTransaction(ctx, "", fromParsed.Address, to, valid, buf.Bytes(), errs)
+		return errs
+	}
+	// one transaction per recipient domain, in the order of the recipients
+	var domains []string
+	byDomain := make(map[string][]int)
+	for _, i := range valid {
+		domain, err := recipientDomain(toParsed[i].Address)
+		if err != nil {
+			errs[i] = errorbehavior.WrapRejected(err)
+			continue
+		}
+		if _, ok := byDomain[domain]; !ok {
+			domains = append(domains, domain)
+		}
+		byDomain[domain] = append(byDomain[domain], i)
+	}
+	for _, domain := range domains {
+		c.sendTransaction(ctx, domain, fromParsed.Address, to, byDomain[domain], buf.Bytes(), errs)
 	}
+	return errs
+}
 
-	dataWriter, err := c.conn.Data()
+// sendTransaction sends the message to the recipients to[i] for i in indexes and sets their errors in errs.
+// domain is the recipient domain in direct mode, and empty in relay mode.
+func (c *SenderClientSMTP) sendTransaction(ctx context.Context, domain string, from string, to []string, indexes []int, message []byte, errs []error) {
+	setErrs := func(err error) {
+		for _, i := range indexes {
+			errs[i] = err
+		}
+	}
+	var conn *smtp.Client
+	var netConn net.Conn
+	if c.SMTPAccount.IsDirect() {
+		dc, err := c.directConnect(ctx, domain)
+		if err != nil {
+			setErrs(err)
+			return
+		}
+		conn, netConn = dc.conn, dc.netConn
+	} else {
+		if c.SMTPAccount.ConnectionReuseCountLimit < 2 ||
+			c.connectionReuseCounter >= c.SMTPAccount.ConnectionReuseCountLimit ||
+			time.Since(c.connectionReuseStarted) >= 300*time.Second { // 300s is postfix's default value for smtp_connection_reuse_time_limit
+			// reconnect
+			err := c.PreSend(ctx)
+			if errorbehavior.IsPausing(err) {
+				setErrs(err)
+				return
+			} else if err != nil {
+				setErrs(errorbehavior.WrapRetryable(fmt.Errorf("failed to connect to server: %s", err)))
+				return
+			}
+		}
+		c.connectionReuseCounter++
+		conn, netConn = c.conn, c.netConn
+
+		// with PIPELINING a broken connection is detected by the pipelined commands, without an extra round-trip
+		if ok, _ := conn.Extension("PIPELINING"); !ok {
+			if err := conn.Noop(); err != nil {
+				setErrs(errorbehavior.WrapRetryable(fmt.Errorf("SMTP Noop failed: %s", err)))
+				return
+			}
+		}
+	}
+	recipients := make([]string, len(indexes))
+	for k, i := range indexes {
+		recipients[k] = to[i]
+	}
+	e, rcptErrs, err := newEnvelope(conn, from, recipients, len(message))
 	if err != nil {
-		var errSMTP *smtp.SMTPError
-		if errors.As(err, &errSMTP) {
-			return errorbehavior.WrapRetryable(fmt.Errorf("SMTP Data failed with code %d: %v", errSMTP.Code, errSMTP))
+		setErrs(err)
+		return
+	}
+	dataWriter, rcptErrs, err := c.startTransaction(conn, netConn, e, rcptErrs)
+	for k, i := range indexes {
+		errs[i] = rcptErrs[k]
+	}
+	// the message is sent to the recipients that were not rejected
+	setAccepted := func(err error) {
+		for k, i := range indexes {
+			if rcptErrs[k] == nil {
+				errs[i] = err
+			}
 		}
-		return errorbehavior.WrapRetryable(fmt.Errorf("SMTP Data failed: %s", err))
 	}
-	defer dataWriter.Close()
+	if err != nil {
+		setAccepted(err)
+		return
+	}
+	if dataWriter == nil {
+		// every recipient was rejected
+		return
+	}
+	if _, err := dataWriter.Write(message); err != nil {
+		_ = dataWriter.Close()
+		setAccepted(errorbehavior.WrapRetryable(fmt.Errorf("SMTP Data failed: %s", err)))
+		return
+	}
+	// the server replies to the message after it is written
+	if err := dataWriter.Close(); err != nil {
+		setAccepted(c.wrapSMTPError("Data", err))
+	}
+}
+
+// writeMessage writes the message, signed with DKIM if it is enabled for the sender
+func (c *SenderClientSMTP) writeMessage(w io.Writer, header mail.Header, msg gateway.Message) error {
+	if !c.From.DKIM.Enabled() {
+		return writeBody(w, header, msg)
+	}
+	// the signature is computed over the whole message, so build it before signing it
+	var buf bytes.Buffer
+	if err := writeBody(&buf, header, msg); err != nil {
+		return err
+	}
+	if err := c.From.DKIM.sign(w, &buf, c.From.Email); err != nil {
+		return fmt.Errorf("DKIM signing failed: %s", err)
+	}
+	return nil
+}
 
-	dataBodyWriter, err := mail.CreateSingleInlineWriter(dataWriter, header)
+// writeBody writes the message with the following structure.
+// Multipart entities with a single part are replaced by the part.
+//
+//	multipart/mixed
+//	  multipart/related
+//	    multipart/alternative (text/plain and text/html) or text/plain
+//	    inline attachments
+//	  attachments
+func writeBody(w io.Writer, header mail.Header, msg gateway.Message) error {
+	var inline, attached []gateway.Attachment
+	for _, a := range msg.Attachments {
+		if a.ContentID != "" && msg.HTML != "" {
+			inline = append(inline, a)
+		} else {
+			attached = append(attached, a)
+		}
+	}
+	// the top level entity has the header of the message
+	createTop := func(h message.Header) (*message.Writer, error) {
+		h2 := header.Copy()
+		fields := h.Fields()
+		for fields.Next() {
+			h2.Set(fields.Key(), fields.Value())
+		}
+		return message.CreateWriter(w, h2.Header)
+	}
+	if len(attached) == 0 {
+		return writeRelated(createTop, msg, inline)
+	}
+	mixed, err := createTop(multipartHeader("multipart/mixed"))
 	if err != nil {
-		return errorbehavior.WrapRetryable(fmt.Errorf("mail.CreateSingleInlineWriter() failed: %s", err))
+		return fmt.Errorf("failed to create multipart/mixed: %s", err)
+	}
+	if err := writeRelated(mixed.CreatePart, msg, inline); err != nil {
+		return err
 	}
-	defer dataBodyWriter.Close()
+	for _, a := range attached {
+		if err := writeAttachment(mixed.CreatePart, a, "attachment"); err != nil {
+			return err
+		}
+	}
+	return mixed.Close()
+}
+
+type createPartFunc func(h message.Header) (*message.Writer, error)
 
-	_, err = io.Copy(dataBodyWriter, strings.NewReader(msg))
+func multipartHeader(contentType string) message.Header {
+	var h message.Header
+	h.SetContentType(contentType, nil)
+	return h
+}
+
+// writeRelated writes the text of the message and the inline attachments
+func writeRelated(create createPartFunc, msg gateway.Message, inline []gateway.Attachment) error {
+	if len(inline) == 0 {
+		return writeText(create, msg)
+	}
+	related, err := create(multipartHeader("multipart/related"))
 	if err != nil {
-		return errorbehavior.WrapRetryable(fmt.Errorf("io.Copy() failed: %s", err))
+		return fmt.Errorf("failed to create multipart/related: %s", err)
 	}
+	if err := writeText(related.CreatePart, msg); err != nil {
+		return err
+	}
+	for _, a := range inline {
+		if err := writeAttachment(related.CreatePart, a, "inline"); err != nil {
+			return err
+		}
+	}
+	return related.Close()
+}
 
-	return nil
+// writeText writes a text/plain part, or a multipart/alternative part if msg has HTML
+func writeText(create createPartFunc, msg gateway.Message) error {
+	if msg.HTML == "" {
+		return writeTextPart(create, "text/plain", msg.Text)
+	}
+	text := msg.Text
+	if text == "" {
+		text = HTMLToText(msg.HTML)
+	}
+	alternative, err := create(multipartHeader("multipart/alternative"))
+	if err != nil {
+		return fmt.Errorf("failed to create multipart/alternative: %s", err)
+	}
+	// the preferred alternative is the last part
+	if err := writeTextPart(alternative.CreatePart, "text/plain", text); err != nil {
+		return err
+	}
+	if err := writeTextPart(alternative.CreatePart, "text/html", msg.HTML); err != nil {
+		return err
+	}
+	return alternative.Close()
+}
+
+func writeTextPart(create createPartFunc, contentType, content string) error {
+	var h message.Header
+	h.SetContentType(contentType, map[string]string{"charset": "UTF-8"})
+	h.Set("Content-Transfer-Encoding", "quoted-printable")
+	partWriter, err := create(h)
+	if err != nil {
+		return fmt.Errorf("failed to create %s part: %s", contentType, err)
+	}
+	if _, err := io.Copy(partWriter, strings.NewReader(content)); err != nil {
+		return fmt.Errorf("io.Copy() failed: %s", err)
+	}
+	return partWriter.Close()
+}
+
+// writeAttachment writes an attachment with disposition "attachment" or "inline"
+func writeAttachment(create createPartFunc, a gateway.Attachment, disposition string) error {
+	contentType, params, err := mime.ParseMediaType(a.ContentType)
+	if err != nil {
+		contentType, params = "application/octet-stream", make(map[string]string)
+	}
+	params["name"] = a.Filename
+	var h message.Header
+	h.SetContentType(contentType, params)
+	h.SetContentDisposition(disposition, map[string]string{"filename": a.Filename})
+	h.Set("Content-Transfer-Encoding", "base64")
+	if disposition == "inline" {
+		h.Set("Content-ID", "<"+a.ContentID+">")
+	}
+	partWriter, err := create(h)
+	if err != nil {
+		return fmt.Errorf("failed to create attachment %s: %s", a.Filename, err)
+	}
+	if _, err := partWriter.Write(a.Data); err != nil {
+		return fmt.Errorf("failed to write attachment %s: %s", a.Filename, err)
+	}
+	return partWriter.Close()
 }
 
 func generateMessageID(broadcastID, to, domain string) string {
+	return fmt.Sprintf("%s@%s", MessageIDLocalPart(broadcastID, to), domain)
+}
+
+// MessageIDLocalPart returns the part before @ of the Message-ID of the message sent to the recipient,
+// used to match bounces to broadcasts
+func MessageIDLocalPart(broadcastID, to string) string {
 	h := sha256.New()
 	h.Write([]byte(broadcastID))
 	h.Write([]byte(to))
-	id := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(h.Sum(nil))[:16]
-	return fmt.Sprintf("%s@%s", id, domain)
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(h.Sum(nil))[:16]
 }
@@ -0,0 +1,281 @@
+package email
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/emersion/go-smtp"
+	"golang.org/x/net/idna"
+
+	"go.angaros.io/internal/errorbehavior"
+)
+
+const (
+	// commandTimeout is the time to wait for the replies of pipelined commands, the same as the SMTP client
+	commandTimeout = 5 * time.Minute
+	// submissionTimeout is the time to wait for the reply to a message, the same as the SMTP client
+	submissionTimeout = 12 * time.Minute
+)
+
+// envelope is the sender and the recipients of a message and the parameters of the MAIL command
+type envelope struct {
+	from string
+	to   []string // empty strings are recipients that cannot be sent to
+	size int
+	utf8 bool
+}
+
+// newEnvelope checks the message against the extensions of the server:
+// the message must not be larger than the limit of SIZE,
+// and addresses with non-ASCII characters require SMTPUTF8. Without it, non-ASCII domains are converted to ASCII (IDNA).
+// It returns the errors of the recipients that cannot be sent to, and an error if the message cannot be sent at all.
+func newEnvelope(client *smtp.Client, from string, to []string, size int) (envelope, []error, error) {
+	e := envelope{from: from, to: append([]string(nil), to...), size: size}
+	errs := make([]error, len(to))
+	if ok, param := client.Extension("SIZE"); ok {
+		if limit, err := strconv.Atoi(param); err == nil && limit > 0 && size > limit {
+			return envelope{}, nil, errorbehavior.WrapRejected(fmt.Errorf("message size %d bytes exceeds the limit of the server (%d bytes)", size, limit))
+		}
+	}
+	ascii := isASCII(from)
+	for _, address := range to {
+		ascii = ascii && isASCII(address)
+	}
+	if ascii {
+		return e, errs, nil
+	}
+	if ok, _ := client.Extension("SMTPUTF8"); ok {
+		e.utf8 = true
+		return e, errs, nil
+	}
+	var err error
+	e.from, err = asciiAddress(from)
+	if err != nil {
+		// every message of the sender would fail
+		return envelope{}, nil, errorbehavior.WrapPausing(err)
+	}
+	for i := range e.to {
+		e.to[i], err = asciiAddress(to[i])
+		if err != nil {
+			errs[i] = errorbehavior.WrapRejected(err)
+		}
+	}
+	return e, errs, nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// asciiAddress converts the domain of the address to ASCII. Local parts cannot be converted.
+func asciiAddress(address string) (string, error) {
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return "", fmt.Errorf("address %s has no domain", address)
+	}
+	local, domain := address[:at], address[at+1:]
+	if !isASCII(local) {
+		return "", fmt.Errorf("address %s has non-ASCII characters but the server does not support SMTPUTF8", address)
+	}
+	domainASCII, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return "", fmt.Errorf("invalid domain %s: %s", domain, err)
+	}
+	return local + "@" + domainASCII, nil
+}
+
+// startTransaction sends the MAIL, RCPT and DATA commands and returns the writer of the message.
+// If the server supports PIPELINING, the commands are sent together and their replies are read afterwards.
+// netConn is the connection of the client, used to set the deadlines of pipelined commands.
+//
+// rcptErrs are the errors of the recipients that are not sent to, and are updated with the rejections of RCPT.
+// If every recipient is rejected, the writer is nil. The error is returned if the transaction failed for every recipient.
+func (c *SenderClientSMTP) startTransaction(client *smtp.Client, netConn net.Conn, e envelope, rcptErrs []error) (io.WriteCloser, []error, error) {
+	rcptErrs = append([]error(nil), rcptErrs...)
+	if ok, _ := client.Extension("PIPELINING"); ok && netConn != nil {
+		w, err := c.startTransactionPipelined(client, netConn, e, rcptErrs)
+		return w, rcptErrs, err
+	}
+	if err := client.Mail(e.from, &smtp.MailOptions{Size: e.size, UTF8: e.utf8}); err != nil {
+		_ = client.Reset()
+		return nil, rcptErrs, c.wrapSMTPError("Mail", err)
+	}
+	accepted := 0
+	for i, to := range e.to {
+		if rcptErrs[i] != nil {
+			continue
+		}
+		if err := client.Rcpt(to); err != nil {
+			var errSMTP *smtp.SMTPError
+			if !errors.As(err, &errSMTP) {
+				// the connection is broken
+				_ = client.Reset()
+				return nil, rcptErrs, c.wrapSMTPError("Rcpt", err)
+			}
+			rcptErrs[i] = c.wrapSMTPError("Rcpt", err)
+			continue
+		}
+		accepted++
+	}
+	if accepted == 0 {
+		// abort the transaction, so the connection can be reused for the next recipients
+		_ = client.Reset()
+		return nil, rcptErrs, nil
+	}
+	w, err := client.Data()
+	if err != nil {
+		_ = client.Reset()
+		return nil, rcptErrs, c.wrapSMTPError("Data", err)
+	}
+	return w, rcptErrs, nil
+}
+
+func (c *SenderClientSMTP) startTransactionPipelined(client *smtp.Client, netConn net.Conn, e envelope, rcptErrs []error) (io.WriteCloser, error) {
+	_ = netConn.SetDeadline(time.Now().Add(commandTimeout))
+	defer netConn.SetDeadline(time.Time{})
+	// the same parameters as smtp.Client.Mail
+	mailCmd := "MAIL FROM:<%s>"
+	if ok, _ := client.Extension("8BITMIME"); ok {
+		mailCmd += " BODY=8BITMIME"
+	}
+	if ok, _ := client.Extension("SIZE"); ok && e.size > 0 {
+		mailCmd += " SIZE=" + strconv.Itoa(e.size)
+	}
+	if e.utf8 {
+		mailCmd += " SMTPUTF8"
+	}
+	type command struct {
+		name   string
+		format string
+		args   []interface{}
+		code   int
+		rcpt   int // index of the recipient of RCPT
+	}
+	commands := []command{{name: "Mail", format: mailCmd, args: []interface{}{e.from}, code: 250}}
+	for i, to := range e.to {
+		if rcptErrs[i] == nil {
+			commands = append(commands, command{name: "Rcpt", format: "RCPT TO:<%s>", args: []interface{}{to}, code: 25, rcpt: i})
+		}
+	}
+	commands = append(commands, command{name: "Data", format: "DATA", code: 354})
+	ids := make([]uint, len(commands))
+	for i, cmd := range commands {
+		id, err := client.Text.Cmd(cmd.format, cmd.args...)
+		if err != nil {
+			return nil, errorbehavior.WrapRetryable(fmt.Errorf("SMTP %s failed: %s", cmd.name, err))
+		}
+		ids[i] = id
+	}
+	var errMail, errData error
+	var dataAccepted bool
+	accepted := 0
+	for i, cmd := range commands {
+		client.Text.StartResponse(ids[i])
+		_, _, err := client.Text.ReadResponse(cmd.code)
+		client.Text.EndResponse(ids[i])
+		var errProto *textproto.Error
+		if err != nil && !errors.As(err, &errProto) {
+			// the connection is broken, so the next replies cannot be read
+			return nil, errorbehavior.WrapRetryable(fmt.Errorf("SMTP %s failed: %s", cmd.name, err))
+		}
+		switch cmd.name {
+		case "Mail":
+			if err != nil {
+				errMail = c.wrapSMTPError(cmd.name, smtpError(errProto))
+			}
+		case "Rcpt":
+			if errMail != nil {
+				// the replies are caused by the failure of MAIL
+				continue
+			}
+			if err != nil {
+				rcptErrs[cmd.rcpt] = c.wrapSMTPError(cmd.name, smtpError(errProto))
+			} else {
+				accepted++
+			}
+		case "Data":
+			if err != nil {
+				errData = c.wrapSMTPError(cmd.name, smtpError(errProto))
+			}
+			dataAccepted = err == nil
+		}
+	}
+	if errMail == nil && accepted > 0 && dataAccepted {
+		return &pipelinedDataWriter{WriteCloser: client.Text.DotWriter(), text: client.Text, netConn: netConn}, nil
+	}
+	if dataAccepted {
+		// DATA was accepted although MAIL or every RCPT failed, so end it with an empty message (RFC 2920 section 3.1)
+		_ = client.Text.DotWriter().Close()
+		_, _, _ = client.Text.ReadResponse(0)
+	}
+	// abort the transaction, so the connection can be reused for the next recipients
+	_ = client.Reset()
+	if errMail != nil {
+		return nil, errMail
+	}
+	if accepted == 0 {
+		// the reply to DATA is caused by the rejected recipients
+		return nil, nil
+	}
+	return nil, errData
+}
+
+// pipelinedDataWriter writes the message after a pipelined DATA command and reads the reply when it is closed
+type pipelinedDataWriter struct {
+	io.WriteCloser
+	text    *textproto.Conn
+	netConn net.Conn
+}
+
+func (w *pipelinedDataWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+	_ = w.netConn.SetDeadline(time.Now().Add(submissionTimeout))
+	defer w.netConn.SetDeadline(time.Time{})
+	_, _, err := w.text.ReadResponse(250)
+	var errProto *textproto.Error
+	if errors.As(err, &errProto) {
+		return smtpError(errProto)
+	}
+	return err
+}
+
+// smtpError converts the error reply to an SMTP error with the enhanced status code, like the SMTP client does
+func smtpError(errProto *textproto.Error) *smtp.SMTPError {
+	errSMTP := &smtp.SMTPError{
+		Code:    errProto.Code,
+		Message: errProto.Msg,
+	}
+	parts := strings.SplitN(errProto.Msg, " ", 2)
+	if len(parts) != 2 {
+		return errSMTP
+	}
+	codeParts := strings.Split(parts[0], ".")
+	if len(codeParts) != 3 {
+		return errSMTP
+	}
+	var code smtp.EnhancedCode
+	for i, s := range codeParts {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return errSMTP
+		}
+		code[i] = n
+	}
+	errSMTP.EnhancedCode = code
+	errSMTP.Message = strings.ReplaceAll(parts[1], "\n"+parts[0]+" ", "\n")
+	return errSMTP
+}
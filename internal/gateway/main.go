@@ -1,14 +1,97 @@
 package gateway
 
 import (
+	"bytes"
 	"context"
+	"time"
 )
 
 type SenderClient interface {
 	PreSend(ctx context.Context) error
-	Send(ctx context.Context, to string, subject, message, broadcastID string) error
+	Send(ctx context.Context, to string, msg Message, broadcastID string) error
 	PostSend(ctx context.Context) error
 	GetLimitPerMinute() int
 	GetLimitPerHour() int
 	GetLimitPerDay() int
 }
+
+// TestStep is the result of a stage of a connection test e.g. DNS lookup or authentication
+type TestStep struct {
+	Name    string
+	Details string
+	Err     error
+}
+
+// Tester is implemented by sender clients that can report the stages of PreSend.
+// A successful Test leaves the client ready to Send.
+type Tester interface {
+	SenderClient
+	Test(ctx context.Context) ([]TestStep, error)
+}
+
+// BatchSender is implemented by sender clients that can send the same message to many recipients at once
+type BatchSender interface {
+	SenderClient
+	// SendBatch returns the error of each recipient, nil if the message was sent to it
+	SendBatch(ctx context.Context, to []string, msg Message, broadcastID string) []error
+}
+
+// LimitScoper is implemented by sender clients whose send limits apply to a part of the gateway, e.g. a SIM of a phone
+type LimitScoper interface {
+	// LimitScope identifies the part of the gateway that sends, empty means the whole gateway
+	LimitScope() string
+}
+
+// SendStatuser is implemented by sender clients that can find out what happened to a message after Send returned,
+// e.g. whether a phone sent an SMS
+type SendStatuser interface {
+	// SendStatus returns the status of the message sent to the recipient at sentAt, empty if it is unknown
+	SendStatus(ctx context.Context, to string, sentAt time.Time) (string, error)
+}
+
+// statuses returned by SendStatus
+const (
+	SendStatusQueued = "queued" // the gateway has not sent the message yet
+	SendStatusSent   = "sent"
+	SendStatusFailed = "failed" // the gateway accepted the message but failed to send it
+)
+
+// StatusCoder is implemented by errors of Send that carry the status code of the server, e.g. the SMTP reply code
+type StatusCoder interface {
+	StatusCode() string
+}
+
+// Message is the content sent to a recipient
+type Message struct {
+	Subject string
+	Text    string
+	// HTML is optional and used only by email gateways. If Text is empty, it is generated from HTML.
+	HTML string
+	// Attachments are used only by email gateways
+	Attachments []Attachment
+	// UnsubscribeURL is the one-click unsubscribe URL of the recipient, used in the List-Unsubscribe header
+	UnsubscribeURL string
+}
+
+// Attachment is a file attached to a message
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+	// ContentID is set for inline attachments that are referenced in the HTML as cid:ContentID
+	ContentID string
+}
+
+// Equal reports whether the messages have the same content
+func (m Message) Equal(m2 Message) bool {
+	if m.Subject != m2.Subject || m.Text != m2.Text || m.HTML != m2.HTML || m.UnsubscribeURL != m2.UnsubscribeURL || len(m.Attachments) != len(m2.Attachments) {
+		return false
+	}
+	for i, a := range m.Attachments {
+		a2 := m2.Attachments[i]
+		if a.Filename != a2.Filename || a.ContentType != a2.ContentType || a.ContentID != a2.ContentID || !bytes.Equal(a.Data, a2.Data) {
+			return false
+		}
+	}
+	return true
+}
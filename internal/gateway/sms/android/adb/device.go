@@ -1,17 +1,24 @@
 package adb
 
 import (
+	"time"
+
 	"github.com/electricbubble/gadb"
 )
 
 type Device struct {
-	AndroidID           string
-	Name                string
-	adbDevice           gadb.Device
-	reachable           bool
-	serial              string
-	androidVersionMajor int
-	serviceDomain       string
+	AndroidID  string
+	Name       string
+	adbDevice  gadb.Device
+	reachable  bool
+	serial     string
+	sdk        int
+	release    string
+	strategies []smsStrategy
+	// subscriptionID is the SIM that sends the messages, 0 means the default SIM
+	subscriptionID int
+	// clockOffset is the time of the phone minus the local time
+	clockOffset time.Duration
 }
 
 func (d Device) DBTable() string {
@@ -37,3 +44,24 @@ func (d Device) Reachable() bool {
 func (d Device) Serial() string {
 	return d.adbDevice.Serial()
 }
+
+// SDK is the API level of the device, detected by PreSend
+func (d Device) SDK() int {
+	return d.sdk
+}
+
+// Release is the Android version of the device e.g. "13", detected by PreSend
+func (d Device) Release() string {
+	return d.release
+}
+
+// Strategy is the name of the way SMS are sent, detected by PreSend
+func (d Device) Strategy() string {
+	if len(d.strategies) == 0 {
+		return ""
+	}
+	if d.strategies[0].companion {
+		return d.strategies[0].name
+	}
+	return d.strategies[0].name + " (" + d.strategies[0].callingPackage + ")"
+}
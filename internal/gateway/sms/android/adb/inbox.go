@@ -0,0 +1,61 @@
+package adb
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// InboxSMS is a message received by the phone
+type InboxSMS struct {
+	From string
+	Date time.Time // by the clock of the phone
+	Body string
+}
+
+// inboxColumns are the columns of content://sms/inbox that are queried. The body is last because it can span many lines.
+var inboxColumns = []string{"_id", "address", "date", "body"}
+
+// Inbox returns the messages of the inbox of the phone that were received after since
+func (d Device) Inbox(since time.Time) ([]InboxSMS, error) {
+	where := fmt.Sprintf("date>=%d", since.UnixNano()/int64(time.Millisecond))
+	output, err := d.adbDevice.RunShellCommand("content", "query", "--uri", "content://sms/inbox", "--projection", strings.Join(inboxColumns, ":"), "--where", shellQuote(where))
+	if err != nil {
+		return nil, fmt.Errorf("runAdbCommand failed: %w", err)
+	}
+	return parseInbox(output)
+}
+
+// parseInbox parses the output of "content query --uri content://sms/inbox",
+// e.g. "Row: 0 _id=7, address=+306900000000, date=1700000000000, body=STOP".
+// A line that does not start a row continues the body of the previous row.
+func parseInbox(output string) ([]InboxSMS, error) {
+	var lines []string
+	for _, line := range strings.Split(strings.TrimRight(output, "\r\n"), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		switch {
+		case strings.HasPrefix(line, "Row: "):
+			lines = append(lines, line)
+		case len(lines) > 0:
+			lines[len(lines)-1] += "\n" + line
+		case strings.TrimSpace(line) == "" || strings.TrimSpace(line) == "No result found.":
+		default:
+			return nil, fmt.Errorf("unexpected output of content query: %s", line)
+		}
+	}
+	messages := make([]InboxSMS, 0, len(lines))
+	for _, line := range lines {
+		values := parseRow(line, inboxColumns)
+		date, err := strconv.ParseInt(values["date"], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid date in %s", line)
+		}
+		messages = append(messages, InboxSMS{
+			From: nullToEmpty(values["address"]),
+			Date: time.Unix(0, date*int64(time.Millisecond)),
+			Body: values["body"],
+		})
+	}
+	return messages, nil
+}
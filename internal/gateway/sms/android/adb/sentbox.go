@@ -0,0 +1,133 @@
+package adb
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.angaros.io/internal/phone"
+)
+
+// Statuses of a sent SMS in the SMS provider of the phone
+const (
+	SentStatusQueued = "queued" // waiting for the network
+	SentStatusSent   = "sent"
+	SentStatusFailed = "failed"
+)
+
+// values of the type and status columns of the SMS provider (android.provider.Telephony.TextBasedSmsColumns)
+const (
+	smsTypeSent   = 2
+	smsTypeOutbox = 4
+	smsTypeFailed = 5
+	smsTypeQueued = 6
+
+	smsStatusFailed = 64 // delivery report of a failure
+)
+
+// smsColumns are the columns of content://sms that are queried
+var smsColumns = []string{"_id", "address", "date", "type", "status"}
+
+// smsRow is a message of the SMS provider
+type smsRow struct {
+	address string
+	date    int64 // milliseconds since the epoch, by the clock of the phone
+	smsType int
+	status  int
+}
+
+// readClockOffset stores the difference between the clock of the phone and the local clock,
+// so that the time of a send can be compared with the dates of the SMS provider
+func (d *Device) readClockOffset() error {
+	before := time.Now()
+	output, err := d.adbDevice.RunShellCommand("date", "+%s")
+	if err != nil {
+		return fmt.Errorf("runAdbCommand failed: %w", err)
+	}
+	phoneSeconds, err := strconv.ParseInt(strings.TrimSpace(output), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid output of date: %s", strings.TrimSpace(output))
+	}
+	d.clockOffset = time.Unix(phoneSeconds, 0).Sub(before)
+	return nil
+}
+
+// SentStatus returns the status of the latest SMS to the recipient that was stored after the time sentAt by the local clock,
+// or an empty string if it is not found, e.g. because the app that sent it did not store it.
+// Messages that wait or failed are not in the sent box (content://sms/sent), so every box of content://sms is queried.
+func (d *Device) SentStatus(to string, sentAt time.Time) (string, error) {
+	// the clock offset is measured in seconds and the date of the message might be set before the command returns
+	since := sentAt.Add(d.clockOffset).Add(-5*time.Second).UnixNano() / int64(time.Millisecond)
+	where := fmt.Sprintf("date>=%d AND type IN (%d,%d,%d,%d)", since, smsTypeSent, smsTypeOutbox, smsTypeFailed, smsTypeQueued)
+	output, err := d.adbDevice.RunShellCommand("content", "query", "--uri", "content://sms", "--projection", strings.Join(smsColumns, ":"), "--where", shellQuote(where))
+	if err != nil {
+		return "", fmt.Errorf("runAdbCommand failed: %w", err)
+	}
+	rows, err := parseSMSRows(output)
+	if err != nil {
+		return "", err
+	}
+	var latest *smsRow
+	for i, row := range rows {
+		if !phone.SameNumber(row.address, to) {
+			continue
+		}
+		if latest == nil || row.date >= latest.date {
+			latest = &rows[i]
+		}
+	}
+	if latest == nil {
+		return "", nil
+	}
+	return latest.sentStatus(), nil
+}
+
+func (row smsRow) sentStatus() string {
+	switch {
+	case row.smsType == smsTypeFailed || row.status == smsStatusFailed:
+		return SentStatusFailed
+	case row.smsType == smsTypeSent:
+		return SentStatusSent
+	default:
+		return SentStatusQueued
+	}
+}
+
+// parseSMSRows parses the output of "content query --uri content://sms",
+// e.g. "Row: 0 _id=12, address=+306900000000, date=1700000000000, type=2, status=-1"
+func parseSMSRows(output string) ([]smsRow, error) {
+	var rows []smsRow
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line == "No result found." {
+			continue
+		}
+		if !strings.HasPrefix(line, "Row: ") {
+			return nil, fmt.Errorf("unexpected output of content query: %s", line)
+		}
+		values := parseRow(line, smsColumns)
+		date, err := strconv.ParseInt(values["date"], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid date in %s", line)
+		}
+		smsType, err := strconv.Atoi(values["type"])
+		if err != nil {
+			return nil, fmt.Errorf("invalid type in %s", line)
+		}
+		// the status is NULL on some phones
+		status, err := strconv.Atoi(values["status"])
+		if err != nil {
+			status = -1
+		}
+		rows = append(rows, smsRow{
+			address: nullToEmpty(values["address"]),
+			date:    date,
+			smsType: smsType,
+			status:  status,
+		})
+	}
+	return rows, nil
+}
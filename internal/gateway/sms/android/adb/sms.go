@@ -1,89 +1,85 @@
 package adb
 
 import (
-	"bufio"
 	"fmt"
-	"strconv"
 	"strings"
 )
 
+// PreSend detects the API level of the device, the strategies that can send SMS on it and the offset of its clock
 func (d *Device) PreSend() error {
-	// detect version
-	versionFull, err := d.adbDevice.RunShellCommand("getprop", "ro.build.version.release")
+	// the API level identifies the version better than the release string, which is e.g. "8.1.0" or "Tiramisu" on previews
+	sdkOutput, err := d.adbDevice.RunShellCommand("getprop", "ro.build.version.sdk")
 	if err != nil {
 		return fmt.Errorf("runAdbCommand failed: %w", err)
 	}
-	versionMajor := strings.SplitN(versionFull, ".", 2)[0]
-	versionMajorInt, err := strconv.Atoi(versionMajor)
+	d.sdk, err = parseSDK(sdkOutput)
 	if err != nil {
-		return fmt.Errorf("strconv.Atoi failed: %w", err)
+		return err
 	}
-	d.androidVersionMajor = versionMajorInt
+	release, err := d.adbDevice.RunShellCommand("getprop", "ro.build.version.release")
+	if err != nil {
+		return fmt.Errorf("runAdbCommand failed: %w", err)
+	}
+	d.release = strings.TrimSpace(release)
 
-	// detect service domain name
 	servicesOutput, err := d.adbDevice.RunShellCommand("service", "list")
 	if err != nil {
 		return fmt.Errorf("runAdbCommand failed: %w", err)
 	}
-	var serviceDomainExpected string
-	switch d.androidVersionMajor {
-	case 5:
-		serviceDomainExpected = "com.android.mms"
-	case 6, 7:
-		serviceDomainExpected = "com.android.mms"
-	case 8, 9, 10:
-		serviceDomainExpected = "com.android.mms.service"
-	default:
-		return fmt.Errorf("android version %d not supported", d.androidVersionMajor)
-	}
-	scanner := bufio.NewScanner(strings.NewReader(servicesOutput))
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.Contains(line, ".IMms") || strings.Contains(line, "com.android.mms") {
-			lineSplit := strings.Split(line, "[")
-			if len(lineSplit) != 2 {
-				continue
-			}
-			lastCharIndex := len(lineSplit[1]) - 1
-			if lineSplit[1][lastCharIndex] != ']' {
-				continue
-			}
-			if lastCharIndex < 2 {
-				continue
-			}
-			serviceDomain := lineSplit[1][:lastCharIndex]
-			if serviceDomainExpected != "" && serviceDomain == serviceDomainExpected {
-				d.serviceDomain = serviceDomain
-				break
-			} else if strings.HasSuffix(serviceDomain, ".IMms") {
-				d.serviceDomain = serviceDomain
-			}
-		}
-	}
-	if d.serviceDomain == "" {
-		return fmt.Errorf("service domain not found")
+	packagesOutput, err := d.adbDevice.RunShellCommand("pm", "list", "packages", CompanionPackage)
+	if err != nil {
+		return fmt.Errorf("runAdbCommand failed: %w", err)
 	}
-	if strings.Contains(d.serviceDomain, " ") {
-		return fmt.Errorf("service domain contains white space")
+	companionInstalled := strings.Contains(packagesOutput, "package:"+CompanionPackage+"\n") || strings.HasSuffix(strings.TrimSpace(packagesOutput), "package:"+CompanionPackage)
+	d.strategies, err = selectStrategies(d.sdk, servicesOutput, companionInstalled)
+	if err != nil {
+		return err
 	}
-	return nil
+	return d.readClockOffset()
+}
+
+// SetSubscriptionID sets the SIM that sends the messages. 0 means the default SIM
+func (d *Device) SetSubscriptionID(id int) {
+	d.subscriptionID = id
 }
 
-func (d Device) SendSMS(to string, msg string) error {
-	const subID = 1
-	var err error
-	switch d.androidVersionMajor {
-	case 5:
-		_, err = d.adbDevice.RunShellCommand("service", "call", "isms", "9", "s16", `"`+d.serviceDomain+`"`, "s16", `"`+to+`"`, "s16", "null", "s16", `"`+msg+`"`, "s16", "null", "s16", "null")
-	case 6, 7:
-		_, err = d.adbDevice.RunShellCommand("service", "call", "isms", "7", "i32", strconv.Itoa(subID), "s16", `"`+d.serviceDomain+`"`, "s16", `"`+to+`"`, "s16", "null", "s16", `"`+msg+`"`, "s16", "null", "s16", "null")
-	case 8, 9, 10:
-		_, err = d.adbDevice.RunShellCommand("service", "call", "isms", "7", "i32", strconv.Itoa(subID-1), "s16", `"`+d.serviceDomain+`"`, "s16", `"`+to+`"`, "s16", "null", "s16", `"`+msg+`"`, "s16", "null", "s16", "null")
-	default:
-		return fmt.Errorf("android version %d not supported", d.androidVersionMajor)
+// SendSMS sends the segments of the message with the first strategy of the device that works,
+// as a concatenated SMS if there are many segments.
+// A strategy that fails, e.g. because the ROM has different transaction codes, is not used again.
+// A strategy that cannot send concatenated SMS is skipped for a message of many segments, instead of sending each segment as a separate SMS.
+func (d *Device) SendSMS(to string, segments []string) error {
+	if len(d.strategies) == 0 {
+		return fmt.Errorf("android API level %d not supported", d.sdk)
 	}
-	if err != nil {
-		return fmt.Errorf("ADB shell command failed: %w", err)
+	var errs []string
+	for i := 0; i < len(d.strategies); {
+		s := d.strategies[i]
+		p := smsParams{serviceDomain: s.callingPackage, subID: d.subscriptionID, to: to}
+		if p.subID == 0 {
+			p.subID = s.defaultSubID
+		}
+		var args []string
+		switch {
+		case len(segments) == 1:
+			p.text = segments[0]
+			args = s.args(p)
+		case s.multipartArgs != nil:
+			args = s.multipartArgs(p, segments)
+		default:
+			errs = append(errs, fmt.Sprintf("%s: a message of %d segments cannot be sent as a concatenated SMS on android API level %d", s.name, len(segments), d.sdk))
+			i++
+			continue
+		}
+		output, err := d.adbDevice.RunShellCommand(args[0], args[1:]...)
+		if err != nil {
+			return fmt.Errorf("ADB shell command failed: %w", err)
+		}
+		err = s.parseResult(output)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", s.name, err))
+		d.strategies = append(d.strategies[:i:i], d.strategies[i+1:]...)
 	}
-	return nil
+	return fmt.Errorf("failed to send SMS: %s", strings.Join(errs, "; "))
 }
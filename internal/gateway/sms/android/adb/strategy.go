@@ -0,0 +1,334 @@
+package adb
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// The companion app is an external Android app that is not part of Angaros and must be installed on the phone separately.
+// It is used only if it is installed. It receives the CompanionActionSendSMS broadcast with the extras "to", "text" and "sub_id"
+// and sends the message with the SmsManager of the phone, as a multipart message if it is long. It sets the result code of the broadcast to -1 (RESULT_OK)
+// if the message was handed to the phone.
+const (
+	CompanionPackage       = "io.angaros.companion"
+	CompanionReceiver      = CompanionPackage + "/.SmsReceiver"
+	CompanionActionSendSMS = CompanionPackage + ".SEND_SMS"
+	// CompanionNote tells the user that the companion app is not included
+	CompanionNote = "If the SMS service of a phone is restricted, SMS can be sent through an external companion app (" + CompanionPackage + ") that is not part of Angaros and must be installed on the phone separately."
+)
+
+// smsParams are the parameters of a message sent by a strategy
+type smsParams struct {
+	serviceDomain string // the calling package of isms
+	subID         int
+	to            string
+	text          string
+}
+
+// smsStrategy is a way to send SMS over the ADB shell on a range of API levels
+type smsStrategy struct {
+	name   string
+	minSDK int
+	maxSDK int // 0 means no maximum
+	// callingPackage is the package passed to isms. If empty, the MMS service found in the service list is used
+	callingPackage string
+	// defaultSubID is the subscription ID passed if the device has no subscription set
+	defaultSubID int
+	// companion is set if the strategy sends through the companion app instead of the isms service
+	companion bool
+	// args returns the shell command that sends the message
+	args func(p smsParams) []string
+	// multipartArgs returns the shell command that sends the segments as a concatenated SMS.
+	// If nil, the strategy cannot send a message of many segments
+	multipartArgs func(p smsParams, segments []string) []string
+	// parseResult returns an error if the output of the command is a failure
+	parseResult func(output string) error
+}
+
+func (s smsStrategy) supports(sdk int) bool {
+	return sdk >= s.minSDK && (s.maxSDK == 0 || sdk <= s.maxSDK)
+}
+
+// smsStrategies are the transaction codes of ISms.sendTextForSubscriber (sendText before API 23)
+// and ISms.sendMultipartTextForSubscriber (sendMultipartText before API 23) per API level, and the companion app that works on every level.
+// They are tried in order.
+var smsStrategies = []smsStrategy{
+	{
+		name:         "isms 9",
+		minSDK:       21,
+		maxSDK:       22, // Android 5
+		defaultSubID: 1,
+		args: func(p smsParams) []string {
+			return []string{"service", "call", "isms", "9", "s16", shellQuote(p.serviceDomain), "s16", shellQuote(p.to), "s16", "null", "s16", shellQuote(p.text), "s16", "null", "s16", "null"}
+		},
+		multipartArgs: func(p smsParams, segments []string) []string {
+			args := []string{"service", "call", "isms", "11", "s16", shellQuote(p.serviceDomain), "s16", shellQuote(p.to), "s16", "null"}
+			args = append(args, stringListArgs(segments)...)
+			return append(args, "i32", "-1", "i32", "-1")
+		},
+		parseResult: parseServiceCallResult,
+	},
+	{
+		name:         "isms 7",
+		minSDK:       23,
+		maxSDK:       25, // Android 6 and 7
+		defaultSubID: 1,
+		args: func(p smsParams) []string {
+			return []string{"service", "call", "isms", "7", "i32", strconv.Itoa(p.subID), "s16", shellQuote(p.serviceDomain), "s16", shellQuote(p.to), "s16", "null", "s16", shellQuote(p.text), "s16", "null", "s16", "null"}
+		},
+		multipartArgs: func(p smsParams, segments []string) []string {
+			args := []string{"service", "call", "isms", "9", "i32", strconv.Itoa(p.subID), "s16", shellQuote(p.serviceDomain), "s16", shellQuote(p.to), "s16", "null"}
+			args = append(args, stringListArgs(segments)...)
+			return append(args, "i32", "-1", "i32", "-1")
+		},
+		parseResult: parseServiceCallResult,
+	},
+	{
+		name:         "isms 7",
+		minSDK:       26,
+		maxSDK:       29, // Android 8 to 10
+		defaultSubID: 0,
+		args: func(p smsParams) []string {
+			return []string{"service", "call", "isms", "7", "i32", strconv.Itoa(p.subID), "s16", shellQuote(p.serviceDomain), "s16", shellQuote(p.to), "s16", "null", "s16", shellQuote(p.text), "s16", "null", "s16", "null"}
+		},
+		multipartArgs: func(p smsParams, segments []string) []string {
+			// persistMessageForNonDefaultSmsApp was added in Android 8
+			args := []string{"service", "call", "isms", "10", "i32", strconv.Itoa(p.subID), "s16", shellQuote(p.serviceDomain), "s16", shellQuote(p.to), "s16", "null"}
+			args = append(args, stringListArgs(segments)...)
+			return append(args, "i32", "-1", "i32", "-1", "i32", "1")
+		},
+		parseResult: parseServiceCallResult,
+	},
+	{
+		// the calling attribution tag and persistMessageForNonDefaultSmsApp were added in Android 11.
+		// The calling package must belong to the shell user
+		name:           "isms 5",
+		minSDK:         30,
+		maxSDK:         30, // Android 11
+		defaultSubID:   1,
+		callingPackage: "com.android.shell",
+		args: func(p smsParams) []string {
+			return []string{"service", "call", "isms", "5", "i32", strconv.Itoa(p.subID), "s16", shellQuote(p.serviceDomain), "s16", "null", "s16", shellQuote(p.to), "s16", "null", "s16", shellQuote(p.text), "s16", "null", "s16", "null", "i32", "1"}
+		},
+		multipartArgs: func(p smsParams, segments []string) []string {
+			args := []string{"service", "call", "isms", "8", "i32", strconv.Itoa(p.subID), "s16", shellQuote(p.serviceDomain), "s16", "null", "s16", shellQuote(p.to), "s16", "null"}
+			args = append(args, stringListArgs(segments)...)
+			return append(args, "i32", "-1", "i32", "-1", "i32", "1")
+		},
+		parseResult: parseServiceCallResult,
+	},
+	{
+		// the message ID was added in Android 12
+		name:           "isms 5",
+		minSDK:         31, // Android 12 and later
+		defaultSubID:   1,
+		callingPackage: "com.android.shell",
+		args: func(p smsParams) []string {
+			return []string{"service", "call", "isms", "5", "i32", strconv.Itoa(p.subID), "s16", shellQuote(p.serviceDomain), "s16", "null", "s16", shellQuote(p.to), "s16", "null", "s16", shellQuote(p.text), "s16", "null", "s16", "null", "i32", "1", "i64", "0"}
+		},
+		multipartArgs: func(p smsParams, segments []string) []string {
+			args := []string{"service", "call", "isms", "8", "i32", strconv.Itoa(p.subID), "s16", shellQuote(p.serviceDomain), "s16", "null", "s16", shellQuote(p.to), "s16", "null"}
+			args = append(args, stringListArgs(segments)...)
+			return append(args, "i32", "-1", "i32", "-1", "i32", "1", "i64", "0")
+		},
+		parseResult: parseServiceCallResult,
+	},
+	{
+		name:   "external companion app " + CompanionPackage,
+		minSDK: 21,
+		// the companion app uses the default SIM
+		defaultSubID: -1,
+		companion:    true,
+		args: func(p smsParams) []string {
+			return []string{"am", "broadcast", "-a", CompanionActionSendSMS, "-n", CompanionReceiver, "--es", "to", shellQuote(p.to), "--es", "text", shellQuote(p.text), "--ei", "sub_id", strconv.Itoa(p.subID)}
+		},
+		multipartArgs: func(p smsParams, segments []string) []string {
+			// the companion app splits the text itself
+			return []string{"am", "broadcast", "-a", CompanionActionSendSMS, "-n", CompanionReceiver, "--es", "to", shellQuote(p.to), "--es", "text", shellQuote(strings.Join(segments, "")), "--ei", "sub_id", strconv.Itoa(p.subID)}
+		},
+		parseResult: parseBroadcastResult,
+	},
+}
+
+// selectStrategies returns the strategies that can be used on the device, in order of preference,
+// from the API level, the output of "service list" and whether the companion app is installed.
+// The calling package of the isms strategies is set.
+func selectStrategies(sdk int, serviceList string, companionInstalled bool) ([]smsStrategy, error) {
+	hasISms := hasService(serviceList, "isms")
+	mmsDomain := mmsServiceDomain(serviceList, sdk)
+	var strategies []smsStrategy
+	for _, s := range smsStrategies {
+		if !s.supports(sdk) {
+			continue
+		}
+		if s.companion {
+			if companionInstalled {
+				strategies = append(strategies, s)
+			}
+			continue
+		}
+		if !hasISms {
+			continue
+		}
+		if s.callingPackage == "" {
+			if mmsDomain == "" {
+				continue
+			}
+			s.callingPackage = mmsDomain
+		}
+		strategies = append(strategies, s)
+	}
+	if len(strategies) == 0 {
+		if sdk < smsStrategies[0].minSDK {
+			return nil, fmt.Errorf("android API level %d not supported", sdk)
+		}
+		return nil, fmt.Errorf("no way to send SMS on android API level %d: the isms service was not found and the external companion app (%s) is not installed", sdk, CompanionPackage)
+	}
+	return strategies, nil
+}
+
+// parseSDK parses the output of "getprop ro.build.version.sdk"
+func parseSDK(output string) (int, error) {
+	sdk, err := strconv.Atoi(strings.TrimSpace(output))
+	if err != nil {
+		return 0, fmt.Errorf("invalid API level %q: %s", strings.TrimSpace(output), err)
+	}
+	return sdk, nil
+}
+
+// hasService reports whether the output of "service list" contains the service,
+// e.g. "110	isms: [com.android.internal.telephony.ISms]"
+func hasService(serviceList string, name string) bool {
+	scanner := bufio.NewScanner(strings.NewReader(serviceList))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[1] == name+":" {
+			return true
+		}
+	}
+	return false
+}
+
+// mmsServiceDomain returns the MMS service of the output of "service list", used as the calling package before Android 11
+func mmsServiceDomain(serviceList string, sdk int) string {
+	var serviceDomainExpected string
+	switch {
+	case sdk <= 25:
+		serviceDomainExpected = "com.android.mms"
+	case sdk <= 29:
+		serviceDomainExpected = "com.android.mms.service"
+	}
+	var serviceDomainFound string
+	scanner := bufio.NewScanner(strings.NewReader(serviceList))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.Contains(line, ".IMms") || strings.Contains(line, "com.android.mms") {
+			lineSplit := strings.Split(line, "[")
+			if len(lineSplit) != 2 {
+				continue
+			}
+			lastCharIndex := len(lineSplit[1]) - 1
+			if lastCharIndex < 2 || lineSplit[1][lastCharIndex] != ']' {
+				continue
+			}
+			serviceDomain := lineSplit[1][:lastCharIndex]
+			if strings.Contains(serviceDomain, " ") {
+				continue
+			}
+			if serviceDomainExpected != "" && serviceDomain == serviceDomainExpected {
+				return serviceDomain
+			} else if strings.HasSuffix(serviceDomain, ".IMms") {
+				serviceDomainFound = serviceDomain
+			}
+		}
+	}
+	return serviceDomainFound
+}
+
+// parseServiceCallResult parses the output of "service call", e.g. "Result: Parcel(00000000    '....')".
+// The first value of the reply is 0 on success, otherwise it is the code of the exception thrown by the service,
+// followed by its message.
+func parseServiceCallResult(output string) error {
+	output = strings.TrimSpace(output)
+	i := strings.Index(output, "Parcel(")
+	if i < 0 {
+		return fmt.Errorf("unexpected output of service call: %s", output)
+	}
+	fields := strings.Fields(output[i+len("Parcel("):])
+	if len(fields) == 0 {
+		return fmt.Errorf("unexpected output of service call: %s", output)
+	}
+	if strings.HasPrefix(fields[0], "00000000") {
+		return nil
+	}
+	return fmt.Errorf("service call failed: %s", parcelText(output))
+}
+
+// parcelText returns the message of the exception in the hex dump of a parcel:
+// the words after the exception code are the length of the message and its UTF-16 code units
+func parcelText(output string) string {
+	var words []uint32
+	for _, line := range strings.Split(output, "\n") {
+		if i := strings.Index(line, "Parcel("); i >= 0 {
+			line = line[i+len("Parcel("):]
+		}
+		if i := strings.Index(line, "'"); i >= 0 {
+			line = line[:i]
+		}
+		for _, field := range strings.Fields(line) {
+			if strings.HasPrefix(field, "0x") && strings.HasSuffix(field, ":") {
+				// offset of the line
+				continue
+			}
+			word, err := strconv.ParseUint(field, 16, 32)
+			if err != nil {
+				return strings.TrimSpace(output)
+			}
+			words = append(words, uint32(word))
+		}
+	}
+	if len(words) < 2 || int32(words[1]) <= 0 {
+		return strings.TrimSpace(output)
+	}
+	length := int(words[1])
+	units := make([]uint16, 0, length+1)
+	for _, word := range words[2:] {
+		units = append(units, uint16(word), uint16(word>>16))
+	}
+	if len(units) < length {
+		return strings.TrimSpace(output)
+	}
+	return string(utf16.Decode(units[:length]))
+}
+
+// parseBroadcastResult parses the output of "am broadcast", e.g. "Broadcast completed: result=-1".
+// The result is 0 if no receiver handled the broadcast.
+func parseBroadcastResult(output string) error {
+	const prefix = "Broadcast completed: result="
+	i := strings.Index(output, prefix)
+	if i < 0 {
+		return fmt.Errorf("unexpected output of am broadcast: %s", strings.TrimSpace(output))
+	}
+	result := strings.Fields(output[i+len(prefix):])
+	if len(result) == 0 || strings.TrimSuffix(result[0], ",") != "-1" {
+		return fmt.Errorf("the external companion app did not accept the message: %s", strings.TrimSpace(output[i:]))
+	}
+	return nil
+}
+
+// stringListArgs returns the arguments of service call that write a list of strings to the parcel: its length and each string
+func stringListArgs(list []string) []string {
+	args := []string{"i32", strconv.Itoa(len(list))}
+	for _, s := range list {
+		args = append(args, "s16", shellQuote(s))
+	}
+	return args
+}
+
+// shellQuote quotes the argument for the shell of the device
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
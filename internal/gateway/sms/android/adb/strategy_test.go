@@ -0,0 +1,267 @@
+package adb
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// serviceListAndroid13 is a shortened output of "service list" on Android 13
+const serviceListAndroid13 = `Found 5 services:
+0	sip: [android.net.sip.ISipService]
+1	isms: [com.android.internal.telephony.ISms]
+2	imms: [com.android.internal.telephony.IMms]
+3	iphonesubinfo: [com.android.internal.telephony.IPhoneSubInfo]
+4	phone: [com.android.internal.telephony.ITelephony]
+`
+
+// serviceListAndroid9 is a shortened output of "service list" on Android 9
+const serviceListAndroid9 = `Found 4 services:
+0	isms: [com.android.internal.telephony.ISms]
+1	imms: [com.android.internal.telephony.IMms]
+2	isub: [com.android.internal.telephony.ISub]
+3	phone: [com.android.internal.telephony.ITelephony]
+`
+
+// serviceListRestricted has no isms service, like on some ROMs that remove it
+const serviceListRestricted = `Found 2 services:
+0	iphonesubinfo: [com.android.internal.telephony.IPhoneSubInfo]
+1	phone: [com.android.internal.telephony.ITelephony]
+`
+
+func TestSelectStrategies(t *testing.T) {
+	const companion = "external companion app " + CompanionPackage
+	tests := []struct {
+		name               string
+		sdk                int
+		serviceList        string
+		companionInstalled bool
+		want               []string // name and calling package of each strategy
+		wantErr            bool
+	}{
+		{
+			name:        "Android 13",
+			sdk:         33,
+			serviceList: serviceListAndroid13,
+			want:        []string{"isms 5 com.android.shell"},
+		},
+		{
+			name:               "Android 13 with the companion app",
+			sdk:                33,
+			serviceList:        serviceListAndroid13,
+			companionInstalled: true,
+			want:               []string{"isms 5 com.android.shell", companion},
+		},
+		{
+			name:        "Android 11",
+			sdk:         30,
+			serviceList: serviceListAndroid13,
+			want:        []string{"isms 5 com.android.shell"},
+		},
+		{
+			name:        "Android 9",
+			sdk:         28,
+			serviceList: serviceListAndroid9,
+			want:        []string{"isms 7 com.android.internal.telephony.IMms"},
+		},
+		{
+			name:        "Android 5.0",
+			sdk:         21,
+			serviceList: serviceListAndroid9,
+			want:        []string{"isms 9 com.android.internal.telephony.IMms"},
+		},
+		{
+			name:               "restricted ROM with the companion app",
+			sdk:                31,
+			serviceList:        serviceListRestricted,
+			companionInstalled: true,
+			want:               []string{companion},
+		},
+		{
+			name:        "restricted ROM",
+			sdk:         31,
+			serviceList: serviceListRestricted,
+			wantErr:     true,
+		},
+		{
+			name:               "Android 4.4",
+			sdk:                19,
+			serviceList:        serviceListAndroid9,
+			companionInstalled: true,
+			wantErr:            true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strategies, err := selectStrategies(tt.sdk, tt.serviceList, tt.companionInstalled)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("selectStrategies() = %v, want error", strategies)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("selectStrategies() failed: %s", err)
+			}
+			got := make([]string, 0, len(strategies))
+			for _, s := range strategies {
+				got = append(got, strings.TrimSpace(s.name+" "+s.callingPackage))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("selectStrategies() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStrategyArgs(t *testing.T) {
+	strategies, err := selectStrategies(33, serviceListAndroid13, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := strategies[0]
+	p := smsParams{serviceDomain: s.callingPackage, subID: 2, to: "+306912345678", text: "it's"}
+	got := strings.Join(s.args(p), " ")
+	want := `service call isms 5 i32 2 s16 'com.android.shell' s16 null s16 '+306912345678' s16 null s16 'it'\''s' s16 null s16 null i32 1 i64 0`
+	if got != want {
+		t.Errorf("args() = %s, want %s", got, want)
+	}
+	got = strings.Join(s.multipartArgs(p, []string{"a", "b"}), " ")
+	want = `service call isms 8 i32 2 s16 'com.android.shell' s16 null s16 '+306912345678' s16 null i32 2 s16 'a' s16 'b' i32 -1 i32 -1 i32 1 i64 0`
+	if got != want {
+		t.Errorf("multipartArgs() = %s, want %s", got, want)
+	}
+}
+
+func TestMultipartArgs(t *testing.T) {
+	p := smsParams{subID: 2, to: "+306912345678"}
+	segments := []string{"a", "b"}
+	for _, tt := range []struct {
+		sdk         int
+		serviceList string
+		want        string
+	}{
+		{
+			sdk:         21,
+			serviceList: serviceListAndroid9,
+			want:        `service call isms 11 s16 'com.android.internal.telephony.IMms' s16 '+306912345678' s16 null i32 2 s16 'a' s16 'b' i32 -1 i32 -1`,
+		},
+		{
+			sdk:         22,
+			serviceList: serviceListAndroid9,
+			want:        `service call isms 11 s16 'com.android.internal.telephony.IMms' s16 '+306912345678' s16 null i32 2 s16 'a' s16 'b' i32 -1 i32 -1`,
+		},
+		{
+			sdk:         23,
+			serviceList: serviceListAndroid9,
+			want:        `service call isms 9 i32 2 s16 'com.android.internal.telephony.IMms' s16 '+306912345678' s16 null i32 2 s16 'a' s16 'b' i32 -1 i32 -1`,
+		},
+		{
+			sdk:         25,
+			serviceList: serviceListAndroid9,
+			want:        `service call isms 9 i32 2 s16 'com.android.internal.telephony.IMms' s16 '+306912345678' s16 null i32 2 s16 'a' s16 'b' i32 -1 i32 -1`,
+		},
+		{
+			sdk:         26,
+			serviceList: serviceListAndroid9,
+			want:        `service call isms 10 i32 2 s16 'com.android.internal.telephony.IMms' s16 '+306912345678' s16 null i32 2 s16 'a' s16 'b' i32 -1 i32 -1 i32 1`,
+		},
+		{
+			sdk:         29,
+			serviceList: serviceListAndroid9,
+			want:        `service call isms 10 i32 2 s16 'com.android.internal.telephony.IMms' s16 '+306912345678' s16 null i32 2 s16 'a' s16 'b' i32 -1 i32 -1 i32 1`,
+		},
+	} {
+		strategies, err := selectStrategies(tt.sdk, tt.serviceList, false)
+		if err != nil {
+			t.Fatalf("selectStrategies(%d) failed: %s", tt.sdk, err)
+		}
+		s := strategies[0]
+		if s.multipartArgs == nil {
+			t.Errorf("API level %d cannot send concatenated SMS", tt.sdk)
+			continue
+		}
+		p.serviceDomain = s.callingPackage
+		if got := strings.Join(s.multipartArgs(p, segments), " "); got != tt.want {
+			t.Errorf("multipartArgs() on API level %d = %s, want %s", tt.sdk, got, tt.want)
+		}
+	}
+}
+
+// every isms strategy sends long messages as concatenated SMS, so that they are never split into separate SMS
+func TestStrategiesSendConcatenatedSMS(t *testing.T) {
+	for _, s := range smsStrategies {
+		if s.multipartArgs == nil {
+			t.Errorf("strategy %s for API levels %d to %d cannot send concatenated SMS", s.name, s.minSDK, s.maxSDK)
+		}
+	}
+}
+
+func TestParseSDK(t *testing.T) {
+	for output, want := range map[string]int{
+		"33\n":     33,
+		"30\r\n":   30,
+		"  21  \n": 21,
+	} {
+		got, err := parseSDK(output)
+		if err != nil || got != want {
+			t.Errorf("parseSDK(%q) = %d, %v, want %d", output, got, err, want)
+		}
+	}
+	for _, output := range []string{"", "\n", "Tiramisu\n", "/system/bin/sh: getprop: not found\n"} {
+		if got, err := parseSDK(output); err == nil {
+			t.Errorf("parseSDK(%q) = %d, want error", output, got)
+		}
+	}
+}
+
+// serviceCallSecurityException is the output of "service call isms" when the calling package does not belong to the shell user
+const serviceCallSecurityException = `Result: Parcel(
+  0x00000000: ffffffff 00000039 00610043 006c006c '....9...C.a.l.l.'
+  0x00000010: 006e0069 00200067 00610070 006b0063 'i.n.g. .p.a.c.k.'
+  0x00000020: 00670061 00200065 006f0063 002e006d 'a.g.e. .c.o.m...'
+  0x00000030: 006e0061 00720064 0069006f 002e0064 'a.n.d.r.o.i.d...'
+  0x00000040: 00680073 006c0065 0020006c 006f0064 's.h.e.l.l. .d.o.'
+  0x00000050: 00730065 006e0020 0074006f 00620020 'e.s. .n.o.t. .b.'
+  0x00000060: 006c0065 006e006f 00200067 006f0074 'e.l.o.n.g. .t.o.'
+  0x00000070: 00320020 00300030 00000030          ' .2.0.0.0...')
+`
+
+func TestParseServiceCallResult(t *testing.T) {
+	for _, output := range []string{
+		"Result: Parcel(00000000    '....')\n",
+		"Result: Parcel(00000000 00000000   '........')\r\n",
+	} {
+		if err := parseServiceCallResult(output); err != nil {
+			t.Errorf("parseServiceCallResult(%q) failed: %s", output, err)
+		}
+	}
+
+	err := parseServiceCallResult(serviceCallSecurityException)
+	if err == nil {
+		t.Fatal("parseServiceCallResult() of an exception succeeded")
+	}
+	if want := "service call failed: Calling package com.android.shell does not belong to 2000"; err.Error() != want {
+		t.Errorf("parseServiceCallResult() = %q, want %q", err, want)
+	}
+
+	for _, output := range []string{
+		"",
+		"service: Service isms does not exist\n",
+		"Result: Parcel(\n",
+	} {
+		if err := parseServiceCallResult(output); err == nil {
+			t.Errorf("parseServiceCallResult(%q) succeeded, want error", output)
+		}
+	}
+}
+
+func TestParseBroadcastResult(t *testing.T) {
+	if err := parseBroadcastResult("Broadcasting: Intent { act=io.angaros.companion.SEND_SMS }\nBroadcast completed: result=-1\n"); err != nil {
+		t.Errorf("parseBroadcastResult() failed: %s", err)
+	}
+	// no receiver, i.e. the companion app is not installed
+	if err := parseBroadcastResult("Broadcasting: Intent { act=io.angaros.companion.SEND_SMS }\nBroadcast completed: result=0\n"); err == nil {
+		t.Errorf("parseBroadcastResult() succeeded without a receiver")
+	}
+}
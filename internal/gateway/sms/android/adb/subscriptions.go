@@ -0,0 +1,144 @@
+package adb
+
+import (
+	"bufio"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Subscription is a SIM of the device
+type Subscription struct {
+	ID          int // subscription ID, passed to the SMS service
+	Slot        int // SIM slot index starting from 0
+	DisplayName string
+	CarrierName string
+	Number      string
+}
+
+func (s Subscription) String() string {
+	str := fmt.Sprintf("SIM %d: %s", s.Slot+1, s.CarrierName)
+	if s.DisplayName != "" && s.DisplayName != s.CarrierName {
+		str += " (" + s.DisplayName + ")"
+	}
+	if s.Number != "" {
+		str += " " + s.Number
+	}
+	return str
+}
+
+// Subscriptions returns the active subscriptions of the device, ordered by slot
+func (d Device) Subscriptions() ([]Subscription, error) {
+	output, err := d.adbDevice.RunShellCommand("content", "query", "--uri", "content://telephony/siminfo", "--projection", strings.Join(subscriptionColumns, ":"))
+	if err != nil {
+		return nil, fmt.Errorf("runAdbCommand failed: %w", err)
+	}
+	return parseSubscriptions(output)
+}
+
+// DefaultSMSSubscriptionID returns the subscription ID of the SIM that sends SMS by default: the setting multi_sim_sms,
+// or the only active subscription if the setting is not set
+func (d Device) DefaultSMSSubscriptionID() (int, error) {
+	output, err := d.adbDevice.RunShellCommand("settings", "get", "global", "multi_sim_sms")
+	if err != nil {
+		return 0, fmt.Errorf("runAdbCommand failed: %w", err)
+	}
+	if id, ok := parseSubscriptionSetting(output); ok {
+		return id, nil
+	}
+	subs, err := d.Subscriptions()
+	if err != nil {
+		return 0, err
+	}
+	if len(subs) != 1 {
+		return 0, fmt.Errorf("the default SIM for SMS is not set and the device has %d SIMs", len(subs))
+	}
+	return subs[0].ID, nil
+}
+
+// parseSubscriptionSetting parses the output of "settings get", which is "null" if the setting is not set
+// and -1 if no subscription is selected
+func parseSubscriptionSetting(output string) (int, bool) {
+	id, err := strconv.Atoi(strings.TrimSpace(output))
+	if err != nil || id <= 0 {
+		return 0, false
+	}
+	return id, true
+}
+
+// subscriptionColumns are the columns of content://telephony/siminfo that are queried
+var subscriptionColumns = []string{"_id", "sim_id", "display_name", "carrier_name", "number"}
+
+// parseSubscriptions parses the output of "content query --uri content://telephony/siminfo",
+// e.g. "Row: 0 _id=1, sim_id=0, display_name=Vodafone, carrier_name=Vodafone GR, number=+306900000000".
+// SIMs that are not inserted have sim_id=-1 and are skipped.
+func parseSubscriptions(output string) ([]Subscription, error) {
+	var subs []Subscription
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line == "No result found." {
+			continue
+		}
+		if !strings.HasPrefix(line, "Row: ") {
+			return nil, fmt.Errorf("unexpected output of content query: %s", line)
+		}
+		values := parseRow(line, subscriptionColumns)
+		id, err := strconv.Atoi(values["_id"])
+		if err != nil {
+			return nil, fmt.Errorf("invalid subscription ID in %s", line)
+		}
+		slot, err := strconv.Atoi(values["sim_id"])
+		if err != nil {
+			return nil, fmt.Errorf("invalid SIM slot in %s", line)
+		}
+		if slot < 0 {
+			continue
+		}
+		subs = append(subs, Subscription{
+			ID:          id,
+			Slot:        slot,
+			DisplayName: nullToEmpty(values["display_name"]),
+			CarrierName: nullToEmpty(values["carrier_name"]),
+			Number:      nullToEmpty(values["number"]),
+		})
+	}
+	sort.SliceStable(subs, func(i, j int) bool {
+		return subs[i].Slot < subs[j].Slot
+	})
+	return subs, nil
+}
+
+// parseRow parses the columns of a row of content query, which are printed in the order of the projection.
+// Values may contain ", " so a value ends only before the name of the next column.
+func parseRow(line string, columns []string) map[string]string {
+	line = strings.TrimPrefix(line, "Row: ")
+	if i := strings.Index(line, " "); i >= 0 {
+		// skip the row number
+		line = line[i+1:]
+	}
+	values := make(map[string]string, len(columns))
+	for i, c := range columns {
+		if !strings.HasPrefix(line, c+"=") {
+			break
+		}
+		rest := line[len(c)+1:]
+		end := len(rest)
+		if i+1 < len(columns) {
+			if j := strings.Index(rest, ", "+columns[i+1]+"="); j >= 0 {
+				end = j
+			}
+		}
+		values[c] = rest[:end]
+		line = strings.TrimPrefix(rest[end:], ", ")
+	}
+	return values
+}
+
+func nullToEmpty(s string) string {
+	if s == "NULL" {
+		return ""
+	}
+	return s
+}
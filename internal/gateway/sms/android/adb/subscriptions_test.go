@@ -0,0 +1,36 @@
+package adb
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSubscriptions(t *testing.T) {
+	output := `Row: 0 _id=1, sim_id=0, display_name=Vodafone, carrier_name=Vodafone GR, number=+306900000000
+Row: 1 _id=2, sim_id=-1, display_name=Old SIM, carrier_name=NULL, number=NULL
+Row: 2 _id=3, sim_id=1, display_name=Work, phone, carrier_name=Cosmote, number=NULL
+`
+	got, err := parseSubscriptions(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Subscription{
+		{ID: 1, Slot: 0, DisplayName: "Vodafone", CarrierName: "Vodafone GR", Number: "+306900000000"},
+		{ID: 3, Slot: 1, DisplayName: "Work, phone", CarrierName: "Cosmote"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseSubscriptions() = %+v, want %+v", got, want)
+	}
+	if got, err := parseSubscriptions("No result found.\n"); err != nil || len(got) != 0 {
+		t.Errorf("parseSubscriptions() without rows = %+v, %v", got, err)
+	}
+}
+
+func TestParseSubscriptionSetting(t *testing.T) {
+	for output, want := range map[string]int{"3\n": 3, "1": 1, "null\n": 0, "-1\n": 0, "": 0} {
+		got, ok := parseSubscriptionSetting(output)
+		if got != want || ok != (want != 0) {
+			t.Errorf("parseSubscriptionSetting(%q) = %d, %t, want %d", output, got, ok, want)
+		}
+	}
+}
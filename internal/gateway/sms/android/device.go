@@ -4,19 +4,29 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
 	bolt "go.etcd.io/bbolt"
 
 	"go.angaros.io/internal/dbutil"
 	"go.angaros.io/internal/gateway"
+	"go.angaros.io/internal/gateway/sms"
 	"go.angaros.io/internal/gateway/sms/android/adb"
 	"go.angaros.io/internal/gateway/sms/android/kde"
 )
 
 type Device struct {
-	AndroidID      string
-	Name           string
+	AndroidID string
+	Name      string
+	// SubscriptionID is the SIM that sends the messages, 0 means the default SIM of the phone.
+	// SubscriptionName describes the SIM e.g. "SIM 2: Vodafone +306900000000"
+	SubscriptionID   int
+	SubscriptionName string
+	// simID is the subscription ID of the SIM that sends: SubscriptionID, or the default SIM found by PreSend.
+	// 0 if the default SIM is unknown, e.g. if the device is connected only via KDE Connect
+	simID          int
 	adb            *adb.Device
 	kde            *kde.Device
 	limitPerMinute SettingLimitPerMinute
@@ -38,6 +48,15 @@ func (d Device) GetLimitPerDay() int {
 
 var _ gateway.SenderClient = (*Device)(nil)
 
+// LimitScope makes the send limits apply to each SIM of the phone.
+// The default SIM shares the limits of its subscription ID, so PreSend must be called first.
+func (d Device) LimitScope() string {
+	if d.simID == 0 {
+		return ""
+	}
+	return "sim" + strconv.Itoa(d.simID)
+}
+
 func (d Device) DBTable() string {
 	return "gateway.sms.android.device"
 }
@@ -91,27 +110,85 @@ func FromDeviceable(d deviceAble) Device {
 var ErrDeviceUnreachable = errors.New("device unreachable")
 
 func (d *Device) PreSend(ctx context.Context) error {
+	return d.connect(ctx, nil)
+}
+
+// Test finds the device like PreSend and reports the result of ADB and KDE Connect.
+// On success the device is ready to send a test message.
+func (d *Device) Test(ctx context.Context) ([]gateway.TestStep, error) {
+	var steps []gateway.TestStep
+	err := d.connect(ctx, func(step gateway.TestStep) {
+		steps = append(steps, step)
+	})
+	return steps, err
+}
+
+// connect finds the device via ADB and KDE Connect. If report is not nil, it is called with the result of each.
+func (d *Device) connect(ctx context.Context, report func(gateway.TestStep)) error {
+	step := func(name, details string, err error) {
+		if report != nil {
+			report(gateway.TestStep{Name: name, Details: details, Err: err})
+		}
+	}
+	d.adb, d.kde = nil, nil
+	d.simID = d.SubscriptionID
 	devAdb, errAdb := adb.GetDeviceWithAndroidID(d.AndroidID)
 	devKde, errKde := kde.GetDeviceWithAndroidID(ctx, d.AndroidID)
 	if errAdb != nil && errKde != nil {
+		step("ADB", "", errAdb)
+		step("KDE Connect", "", errKde)
 		return fmt.Errorf("failed to find connected device via ADB (error: %s) and KDE Connect (error: %s): %w", errAdb, errKde, ErrDeviceUnreachable)
 	}
 	var reachable bool
 	if errAdb == nil {
 		d.adb = &devAdb
+		d.adb.SetSubscriptionID(d.SubscriptionID)
 		err := d.adb.PreSend()
 		if err != nil {
 			d.adb = nil
+			step("ADB", "found with serial "+devAdb.Serial(), err)
+		} else if !devAdb.Reachable() {
+			step("ADB", "found with serial "+devAdb.Serial(), ErrDeviceUnreachable)
+		} else {
+			step("ADB", fmt.Sprintf("serial %s, Android %s (API level %d), sending with %s", devAdb.Serial(), d.adb.Release(), d.adb.SDK(), d.adb.Strategy()), nil)
 		}
 		if err == nil && devAdb.Reachable() {
 			reachable = true
+			if d.SubscriptionID == 0 {
+				// the limits of the default SIM are shared with broadcasts that select it by its subscription ID
+				simID, err := d.adb.DefaultSMSSubscriptionID()
+				if err != nil {
+					step("SIM", "default SIM", fmt.Errorf("cannot find the subscription ID of the default SIM: %s", err))
+				} else {
+					d.simID = simID
+					step("SIM", "default SIM, subscription ID "+strconv.Itoa(simID), nil)
+				}
+			}
 		}
+	} else {
+		step("ADB", "", errAdb)
 	}
 	if errKde == nil {
 		d.kde = devKde
 		if devKde.Reachable {
 			reachable = true
 		}
+		var errStep error
+		if !devKde.Reachable {
+			errStep = ErrDeviceUnreachable
+		} else if !devKde.PermissionSMS() {
+			errStep = fmt.Errorf("SMS plugin is not enabled")
+		}
+		step("KDE Connect", fmt.Sprintf("trusted: %v, reachable: %v", devKde.Trusted, devKde.Reachable), errStep)
+	} else {
+		step("KDE Connect", "", errKde)
+	}
+	if d.SubscriptionID != 0 {
+		sim := d.SubscriptionName
+		if sim == "" {
+			sim = "subscription ID " + strconv.Itoa(d.SubscriptionID)
+		}
+		step("SIM", sim, nil)
 	}
 	if !reachable {
 		return ErrDeviceUnreachable
@@ -120,6 +197,9 @@ func (d *Device) PreSend(ctx context.Context) error {
 }
 
 func (d Device) PostSend(ctx context.Context) error {
+	if d.kde == nil || d.kde.Conn == nil {
+		return nil
+	}
 	err := d.kde.Conn.Close()
 	if err != nil {
 		return fmt.Errorf("failed to close kde connection to device: %w", err)
@@ -127,15 +207,20 @@ func (d Device) PostSend(ctx context.Context) error {
 	return nil
 }
 
-func (d Device) Send(ctx context.Context, to string, subject, msg, broadcastID string) error {
-	msg = strings.TrimSpace(msg)
+func (d Device) Send(ctx context.Context, to string, message gateway.Message, broadcastID string) error {
+	msg := strings.TrimSpace(message.Text)
 	if d.adb != nil {
-		err := d.adb.SendSMS(to, msg)
+		// long messages are sent as concatenated SMS
+		_, segments := sms.Split(msg)
+		if len(segments) == 0 {
+			return fmt.Errorf("message is empty")
+		}
+		err := d.adb.SendSMS(to, segments)
 		if err != nil {
 			return fmt.Errorf("failed to send SMS via ADB: %s", err)
 		}
 	} else if d.kde != nil && d.kde.Reachable {
-		err := d.kde.SendSMS(to, msg)
+		err := d.kde.SendSMS(to, msg, d.SubscriptionID)
 		if err != nil {
 			return fmt.Errorf("failed to send SMS via KDE Connect: %s", err)
 		}
@@ -144,3 +229,26 @@ func (d Device) Send(ctx context.Context, to string, subject, msg, broadcastID s
 	}
 	return nil
 }
+
+var _ gateway.SendStatuser = (*Device)(nil)
+
+// SendStatus returns the current status of the SMS in the SMS provider of the phone, e.g. gateway.SendStatusSent.
+// It does not wait for a queued SMS to be sent. It is empty if the SMS was sent via KDE Connect or was not stored by the phone.
+func (d Device) SendStatus(ctx context.Context, to string, sentAt time.Time) (string, error) {
+	if d.adb == nil {
+		return "", nil
+	}
+	status, err := d.adb.SentStatus(to, sentAt)
+	if err != nil {
+		return "", fmt.Errorf("failed to read SMS status via ADB: %s", err)
+	}
+	switch status {
+	case adb.SentStatusQueued:
+		return gateway.SendStatusQueued, nil
+	case adb.SentStatusSent:
+		return gateway.SendStatusSent, nil
+	case adb.SentStatusFailed:
+		return gateway.SendStatusFailed, nil
+	}
+	return status, nil
+}
@@ -0,0 +1,66 @@
+package kde
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// messageTypeInbox is the type of a received message in the conversations of KDE Connect
+const messageTypeInbox = 1
+
+// Message is a message of the conversations of KDE Connect
+type Message struct {
+	From string
+	Date time.Time // by the clock of the phone
+	Body string
+}
+
+// ReceivedMessages returns the latest message of each conversation of the phone, if it is a received message.
+// KDE Connect keeps only the latest message of each conversation, so older messages of a conversation are not returned.
+// The phone is asked to send its conversations again, so that the next call returns newer messages.
+func (d *Device) ReceivedMessages() ([]Message, error) {
+	if _, exists := d.Plugins["kdeconnect_sms"]; !exists {
+		return nil, fmt.Errorf("SMS plugin not enabled")
+	}
+	obj := d.Conn.Object(serviceName, dbus.ObjectPath(servicePath+"/devices/"+d.AndroidID))
+	var conversations []dbus.Variant
+	if err := obj.Call(serviceName+".device.conversations.activeConversations", 0).Store(&conversations); err != nil {
+		return nil, fmt.Errorf("dbus call 'activeConversations' failed: %s", err)
+	}
+	obj.Go(serviceName+".device.conversations.requestAllConversationThreads", dbus.FlagNoReplyExpected, nil)
+	var messages []Message
+	for _, c := range conversations {
+		m, inbox, ok := parseConversationMessage(c.Value())
+		if ok && inbox {
+			messages = append(messages, m)
+		}
+	}
+	return messages, nil
+}
+
+// parseConversationMessage parses a ConversationMessage of KDE Connect, a struct of
+// event, body, addresses, date in milliseconds, type, read, thread ID and, in later versions, more fields
+func parseConversationMessage(v interface{}) (Message, bool, bool) {
+	fields, ok := v.([]interface{})
+	if !ok || len(fields) < 5 {
+		return Message{}, false, false
+	}
+	body, ok1 := fields[1].(string)
+	addresses, ok2 := fields[2].([][]interface{})
+	date, ok3 := fields[3].(int64)
+	messageType, ok4 := fields[4].(int32)
+	if !ok1 || !ok2 || !ok3 || !ok4 || len(addresses) == 0 || len(addresses[0]) == 0 {
+		return Message{}, false, false
+	}
+	from, ok := addresses[0][0].(string)
+	if !ok {
+		return Message{}, false, false
+	}
+	return Message{
+		From: from,
+		Date: time.Unix(0, date*int64(time.Millisecond)),
+		Body: body,
+	}, messageType == messageTypeInbox, true
+}
@@ -91,9 +91,15 @@ func (d *Device) dbusGetPropAndSet(signalIndex int) error {
 	return nil
 }
 
-func (d *Device) SendSMS(to string, msg string) error {
+// SendSMS sends the message from the SIM with the subscription ID, or the default SIM if subID is 0
+func (d *Device) SendSMS(to string, msg string, subID int) error {
 	if _, exists := d.Plugins["kdeconnect_sms"]; !exists {
 		return fmt.Errorf("SMS plugin not enabled")
 	}
-	return d.Conn.Object(serviceName, dbus.ObjectPath(servicePath+"/devices/"+d.AndroidID+"/sms")).Call(serviceName+".device.sms.sendSms", 0, []interface{}{to}, msg, []interface{}{}).Err
+	obj := d.Conn.Object(serviceName, dbus.ObjectPath(servicePath+"/devices/"+d.AndroidID+"/sms"))
+	if subID == 0 {
+		// older versions of KDE Connect don't have the subID argument
+		return obj.Call(serviceName+".device.sms.sendSms", 0, []interface{}{to}, msg, []interface{}{}).Err
+	}
+	return obj.Call(serviceName+".device.sms.sendSms", 0, []interface{}{to}, msg, []interface{}{}, int64(subID)).Err
 }
@@ -0,0 +1,56 @@
+package android
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.angaros.io/internal/gateway/sms/android/adb"
+	"go.angaros.io/internal/gateway/sms/android/kde"
+)
+
+// ReceivedSMS is a message received by the phone
+type ReceivedSMS struct {
+	From string
+	Date time.Time // by the clock of the phone
+	Body string
+}
+
+// ReceivedSMS returns the messages received by the phone after since. The inbox is read via ADB,
+// or via KDE Connect if the phone is not connected via ADB, which returns only the latest message of each conversation.
+func (d Device) ReceivedSMS(ctx context.Context, since time.Time) ([]ReceivedSMS, error) {
+	devAdb, errAdb := adb.GetDeviceWithAndroidID(d.AndroidID)
+	if errAdb == nil && !devAdb.Reachable() {
+		errAdb = ErrDeviceUnreachable
+	}
+	if errAdb == nil {
+		inbox, err := devAdb.Inbox(since)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read inbox via ADB: %s", err)
+		}
+		messages := make([]ReceivedSMS, 0, len(inbox))
+		for _, m := range inbox {
+			messages = append(messages, ReceivedSMS{From: m.From, Date: m.Date, Body: m.Body})
+		}
+		return messages, nil
+	}
+	devKde, errKde := kde.GetDeviceWithAndroidID(ctx, d.AndroidID)
+	if errKde != nil {
+		return nil, fmt.Errorf("failed to find connected device via ADB (error: %s) and KDE Connect (error: %s): %w", errAdb, errKde, ErrDeviceUnreachable)
+	}
+	defer devKde.Conn.Close()
+	if !devKde.Reachable {
+		return nil, ErrDeviceUnreachable
+	}
+	received, err := devKde.ReceivedMessages()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read conversations via KDE Connect: %s", err)
+	}
+	var messages []ReceivedSMS
+	for _, m := range received {
+		if !m.Date.Before(since) {
+			messages = append(messages, ReceivedSMS{From: m.From, Date: m.Date, Body: m.Body})
+		}
+	}
+	return messages, nil
+}
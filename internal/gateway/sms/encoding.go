@@ -0,0 +1,106 @@
+package sms
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Encodings of SMS
+const (
+	EncodingGSM7 = "GSM-7"
+	EncodingUCS2 = "UCS-2"
+)
+
+// lengths of a single SMS and of each segment of a concatenated SMS, whose header takes 6 bytes of the 140 bytes of the SMS.
+// GSM-7 lengths are in septets and UCS-2 lengths in UTF-16 code units.
+const (
+	gsm7SingleLen  = 160
+	gsm7SegmentLen = 153
+	ucs2SingleLen  = 70
+	ucs2SegmentLen = 67
+)
+
+// gsm7Basic is the basic character set of GSM 03.38, without the escape character
+const gsm7Basic = "@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?" +
+	"¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà"
+
+// gsm7Extension are the characters of the extension table of GSM 03.38, which take two septets
+const gsm7Extension = "\f^{}\\[~]|€"
+
+// Encoding returns EncodingGSM7 if every character of the text is in the GSM 03.38 alphabet, otherwise EncodingUCS2
+func Encoding(text string) string {
+	for _, r := range text {
+		if !strings.ContainsRune(gsm7Basic, r) && !strings.ContainsRune(gsm7Extension, r) {
+			return EncodingUCS2
+		}
+	}
+	return EncodingGSM7
+}
+
+// runeLen returns the length of the character in the encoding
+func runeLen(r rune, encoding string) int {
+	if encoding == EncodingGSM7 {
+		if strings.ContainsRune(gsm7Extension, r) {
+			return 2
+		}
+		return 1
+	}
+	// characters outside the Basic Multilingual Plane are encoded as a surrogate pair
+	if r > 0xFFFF {
+		return 2
+	}
+	return 1
+}
+
+// Split returns the encoding of the text and its segments: the text itself if it fits in one SMS,
+// otherwise the segments of a concatenated SMS (153 GSM-7 or 67 UCS-2 characters each).
+// Characters that take two septets or two code units are not split. An empty text has no segments.
+func Split(text string) (string, []string) {
+	encoding := Encoding(text)
+	if text == "" {
+		return encoding, nil
+	}
+	singleLen, segmentLen := gsm7SingleLen, gsm7SegmentLen
+	if encoding == EncodingUCS2 {
+		singleLen, segmentLen = ucs2SingleLen, ucs2SegmentLen
+	}
+	if length(text, encoding) <= singleLen {
+		return encoding, []string{text}
+	}
+	var segments []string
+	var start, segmentLength int
+	for i, r := range text {
+		l := runeLen(r, encoding)
+		if segmentLength+l > segmentLen {
+			segments = append(segments, text[start:i])
+			start, segmentLength = i, 0
+		}
+		segmentLength += l
+	}
+	segments = append(segments, text[start:])
+	return encoding, segments
+}
+
+// length returns the length of the text in septets for GSM-7 or in code units for UCS-2
+func length(text string, encoding string) int {
+	if encoding == EncodingGSM7 {
+		n := utf8.RuneCountInString(text)
+		for _, r := range text {
+			if strings.ContainsRune(gsm7Extension, r) {
+				n++
+			}
+		}
+		return n
+	}
+	var n int
+	for _, r := range text {
+		n += runeLen(r, encoding)
+	}
+	return n
+}
+
+// CountSegments returns the encoding of the text and the number of SMS it is sent as
+func CountSegments(text string) (string, int) {
+	encoding, segments := Split(text)
+	return encoding, len(segments)
+}
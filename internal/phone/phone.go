@@ -0,0 +1,131 @@
+package phone
+
+import (
+	"fmt"
+	"strings"
+)
+
+// trunkPrefixes holds the national trunk prefix of the countries where it is not "0".
+// An empty prefix means the leading zero is part of the number.
+var trunkPrefixes = map[string]string{
+	"IT": "", "SM": "", "VA": "",
+	"RU": "8", "KZ": "8", "BY": "8", "LT": "8",
+	"HU": "06",
+}
+
+// internationalPrefixes holds the international call prefix of the countries where it is not "00"
+var internationalPrefixes = map[string]string{
+	"1": "011", // North American Numbering Plan
+}
+
+var knownCallingCodes = make(map[string]struct{})
+
+func init() {
+	for _, code := range callingCodes {
+		knownCallingCodes[code] = struct{}{}
+	}
+}
+
+// CallingCode returns the calling code of the ISO 3166-1 alpha-2 country code
+func CallingCode(country string) (string, bool) {
+	code, ok := callingCodes[strings.ToUpper(country)]
+	return code, ok
+}
+
+// Normalize converts a phone number to E.164 format e.g. +306912345678.
+// Numbers without an international prefix are considered national numbers of country
+// (ISO 3166-1 alpha-2 code) and are rejected if country is empty.
+func Normalize(number, country string) (string, error) {
+	digits := strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '-', '.', '(', ')', '/', '\t':
+			return -1
+		}
+		return r
+	}, number)
+	if digits == "" {
+		return "", fmt.Errorf("phone number is empty")
+	}
+	country = strings.ToUpper(country)
+	callingCode, countryKnown := callingCodes[country]
+
+	var international bool
+	if strings.HasPrefix(digits, "+") {
+		digits = digits[1:]
+		international = true
+	} else if prefix, ok := internationalPrefixes[callingCode]; ok && strings.HasPrefix(digits, prefix) {
+		digits = digits[len(prefix):]
+		international = true
+	} else if strings.HasPrefix(digits, "00") {
+		digits = digits[2:]
+		international = true
+	}
+	for _, r := range digits {
+		if r < '0' || r > '9' {
+			return "", fmt.Errorf("phone number contains invalid character '%c'", r)
+		}
+	}
+
+	if !international {
+		if !countryKnown {
+			return "", fmt.Errorf("phone number has no country code and the default country is not set")
+		}
+		trunkPrefix, ok := trunkPrefixes[country]
+		if !ok {
+			trunkPrefix = "0"
+		}
+		if callingCode == "1" {
+			// numbers of the North American Numbering Plan have 10 digits without the trunk prefix
+			if len(digits) == 11 && strings.HasPrefix(digits, "1") {
+				digits = digits[1:]
+			}
+		} else if trunkPrefix != "" {
+			digits = strings.TrimPrefix(digits, trunkPrefix)
+		}
+		digits = callingCode + digits
+	}
+
+	// E.164 numbers have at most 15 digits including the calling code
+	if len(digits) < 7 || len(digits) > 15 {
+		return "", fmt.Errorf("phone number has %d digits, expected 7 to 15 including the country code", len(digits))
+	}
+	var codeFound bool
+	for i := 1; i <= 3; i++ {
+		if _, ok := knownCallingCodes[digits[:i]]; ok {
+			codeFound = true
+			break
+		}
+	}
+	if !codeFound {
+		return "", fmt.Errorf("unknown country code")
+	}
+	return "+" + digits, nil
+}
+
+// SameNumber reports whether the phone numbers are the same, ignoring formatting.
+// Phones might report a number in national format, so a number without the country code
+// and the trunk prefix matches the end of the international number.
+func SameNumber(a, b string) bool {
+	a, b = onlyDigits(a), onlyDigits(b)
+	if a == "" || b == "" {
+		return false
+	}
+	if a == b {
+		return true
+	}
+	if len(a) < len(b) {
+		a, b = b, a
+	}
+	b = strings.TrimLeft(b, "0")
+	// subscriber numbers have at least 7 digits
+	return len(b) >= 7 && strings.HasSuffix(a, b)
+}
+
+func onlyDigits(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < '0' || r > '9' {
+			return -1
+		}
+		return r
+	}, s)
+}
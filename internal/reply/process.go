@@ -0,0 +1,189 @@
+package reply
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"go.angaros.io/internal/broadcast"
+	"go.angaros.io/internal/dbutil"
+	"go.angaros.io/internal/gateway/sms/android"
+	"go.angaros.io/internal/phone"
+	"go.angaros.io/internal/suppression"
+)
+
+const (
+	// pollInterval is the time between two checks of the devices
+	pollInterval = 5 * time.Minute
+	// maxClockSkew is the difference allowed between the clock of the phone and the local clock
+	maxClockSkew = 5 * time.Minute
+)
+
+// Report is the result of a check of the devices
+type Report struct {
+	Devices  int // devices read
+	Messages int // messages received in the reply window
+	Replies  int // new replies to broadcasts
+	OptOuts  int // contacts added to the suppression list
+}
+
+func (r Report) String() string {
+	return fmt.Sprintf("devices=%d messages=%d replies=%d opt-outs=%d", r.Devices, r.Messages, r.Replies, r.OptOuts)
+}
+
+// Process reads the messages received by the android devices of broadcasts once, and records a message as a reply
+// to the latest message sent to the same number by the device within the reply window.
+// Only devices that sent messages in the reply window are read.
+func Process(ctx context.Context, db *bolt.DB, s SettingReplies, loggerDebug *log.Logger) (Report, error) {
+	if err := s.Validate(); err != nil {
+		return Report{}, fmt.Errorf("invalid reply setting: %s", err)
+	}
+	var report Report
+	since := time.Now().Add(-s.Window())
+	var sends []broadcast.SMSSend
+	if err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		// a message received at the start of the window replies to a message sent up to a window earlier
+		sends, err = broadcast.SMSSendsTx(tx, since.Add(-s.Window()))
+		return err
+	}); err != nil {
+		return report, err
+	}
+	var gatewayKeys [][]byte
+	for _, send := range sends {
+		if !containsKey(gatewayKeys, send.GatewayKey) {
+			gatewayKeys = append(gatewayKeys, send.GatewayKey)
+		}
+	}
+	var errs []string
+	for _, key := range gatewayKeys {
+		if ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+		var dev android.Device
+		err := dbutil.GetByKey(db, key, &dev)
+		if errors.Is(err, dbutil.ErrNotFound) {
+			// the device was deleted
+			continue
+		} else if err != nil {
+			return report, fmt.Errorf("failed to read device from database: %s", err)
+		}
+		messages, err := dev.ReceivedSMS(ctx, since.Add(-maxClockSkew))
+		if errors.Is(err, android.ErrDeviceUnreachable) {
+			loggerDebug.Printf("device %s: %s\n", dev.AndroidID, err)
+			continue
+		} else if err != nil {
+			errs = append(errs, fmt.Sprintf("device %s: %s", dev.AndroidID, err))
+			continue
+		}
+		report.Devices++
+		report.Messages += len(messages)
+		for _, m := range messages {
+			send, ok := matchSend(sends, key, m, s.Window())
+			if !ok {
+				continue
+			}
+			r := broadcast.Reply{
+				BroadcastID: send.BroadcastID,
+				Index:       send.Index,
+				From:        m.From,
+				Body:        strings.TrimSpace(m.Body),
+				ReceivedAt:  m.Date,
+				OptOut:      s.IsOptOut(m.Body),
+			}
+			if err := db.Update(func(tx *bolt.Tx) error {
+				added, err := broadcast.RecordReplyTx(tx, r)
+				if err != nil || !added {
+					return err
+				}
+				report.Replies++
+				if !r.OptOut {
+					return nil
+				}
+				e, err := suppression.New(send.Recipient, suppression.ReasonOptOut)
+				if err != nil {
+					return err
+				}
+				added, err = suppression.AddTx(tx, e)
+				if added {
+					report.OptOuts++
+				}
+				return err
+			}); err != nil {
+				return report, fmt.Errorf("failed to record reply of %s: %s", m.From, err)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return report, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return report, nil
+}
+
+// matchSend returns the latest message sent by the device to the sender of the received message within the window before it
+func matchSend(sends []broadcast.SMSSend, gatewayKey []byte, m android.ReceivedSMS, window time.Duration) (broadcast.SMSSend, bool) {
+	var match broadcast.SMSSend
+	var found bool
+	for _, send := range sends {
+		if !bytes.Equal(send.GatewayKey, gatewayKey) || !phone.SameNumber(send.Recipient, m.From) {
+			continue
+		}
+		if send.SentAt.After(m.Date.Add(maxClockSkew)) || m.Date.Sub(send.SentAt) > window {
+			continue
+		}
+		if !found || send.SentAt.After(match.SentAt) {
+			match, found = send, true
+		}
+	}
+	return match, found
+}
+
+func containsKey(keys [][]byte, key []byte) bool {
+	for _, k := range keys {
+		if bytes.Equal(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Poll checks the devices every pollInterval until ctx is cancelled.
+// The setting is read before each check, so changes take effect on the next check.
+func Poll(ctx context.Context, db *bolt.DB, loggerInfo *log.Logger, loggerDebug *log.Logger) {
+	loggerDebug2 := log.New(loggerDebug.Writer(), loggerDebug.Prefix()+"[Reply] ", loggerDebug.Flags())
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		var s SettingReplies
+		err := db.View(func(tx *bolt.Tx) error {
+			var err error
+			s, err = GetSettingTx(tx)
+			return err
+		})
+		if err != nil {
+			loggerInfo.Println("[Reply]", err)
+		} else if s.Enabled() {
+			report, err := Process(ctx, db, s, loggerDebug2)
+			if err != nil && ctx.Err() == nil {
+				loggerInfo.Println("[Reply] failed to read replies:", err)
+			}
+			if report.Replies > 0 {
+				loggerInfo.Println("[Reply]", report)
+			} else {
+				loggerDebug2.Println(report)
+			}
+		}
+		timer.Reset(pollInterval)
+	}
+}
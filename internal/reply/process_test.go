@@ -0,0 +1,112 @@
+package reply
+
+import (
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+
+	"go.angaros.io/internal/broadcast"
+	"go.angaros.io/internal/gateway/sms/android"
+)
+
+func TestMatchSend(t *testing.T) {
+	const window = 72 * time.Hour
+	phoneKey, otherPhoneKey := []byte("phone"), []byte("other phone")
+	received := time.Date(2023, 3, 10, 12, 0, 0, 0, time.UTC)
+	send := func(index int, recipient string, gatewayKey []byte, sentAt time.Time) broadcast.SMSSend {
+		return broadcast.SMSSend{
+			SendKey:    broadcast.SendKey{BroadcastID: ulid.MustNew(ulid.Timestamp(sentAt), nil), Index: index, Recipient: recipient},
+			GatewayKey: gatewayKey,
+			SentAt:     sentAt,
+		}
+	}
+	tests := []struct {
+		name      string
+		sends     []broadcast.SMSSend
+		from      string
+		wantIndex int // -1 if no send matches
+	}{
+		{
+			name:      "sent before the reply",
+			sends:     []broadcast.SMSSend{send(0, "+306912345678", phoneKey, received.Add(-time.Hour))},
+			from:      "+306912345678",
+			wantIndex: 0,
+		},
+		{
+			name:      "national format",
+			sends:     []broadcast.SMSSend{send(0, "+306912345678", phoneKey, received.Add(-time.Hour))},
+			from:      "6912345678",
+			wantIndex: 0,
+		},
+		{
+			// the clock of the phone is behind the local clock, so the reply seems to be received before the send
+			name:      "phone clock behind within the skew",
+			sends:     []broadcast.SMSSend{send(0, "+306912345678", phoneKey, received.Add(maxClockSkew-time.Second))},
+			from:      "+306912345678",
+			wantIndex: 0,
+		},
+		{
+			name:      "phone clock behind beyond the skew",
+			sends:     []broadcast.SMSSend{send(0, "+306912345678", phoneKey, received.Add(maxClockSkew+time.Second))},
+			from:      "+306912345678",
+			wantIndex: -1,
+		},
+		{
+			name:      "sent before the window",
+			sends:     []broadcast.SMSSend{send(0, "+306912345678", phoneKey, received.Add(-window-time.Second))},
+			from:      "+306912345678",
+			wantIndex: -1,
+		},
+		{
+			name:      "sent by another phone",
+			sends:     []broadcast.SMSSend{send(0, "+306912345678", otherPhoneKey, received.Add(-time.Hour))},
+			from:      "+306912345678",
+			wantIndex: -1,
+		},
+		{
+			name:      "sent to another number",
+			sends:     []broadcast.SMSSend{send(0, "+306912345679", phoneKey, received.Add(-time.Hour))},
+			from:      "+306912345678",
+			wantIndex: -1,
+		},
+		{
+			name: "latest send",
+			sends: []broadcast.SMSSend{
+				send(0, "+306912345678", phoneKey, received.Add(-48*time.Hour)),
+				send(1, "+306912345678", phoneKey, received.Add(-time.Hour)),
+				send(2, "+306912345678", phoneKey, received.Add(-24*time.Hour)),
+				send(3, "+306912345678", otherPhoneKey, received.Add(-time.Minute)),
+			},
+			from:      "+306912345678",
+			wantIndex: 1,
+		},
+		{
+			name: "latest send within the skew",
+			sends: []broadcast.SMSSend{
+				send(0, "+306912345678", phoneKey, received.Add(-time.Hour)),
+				send(1, "+306912345678", phoneKey, received.Add(2*time.Minute)),
+				send(2, "+306912345678", phoneKey, received.Add(10*time.Minute)),
+			},
+			from:      "+306912345678",
+			wantIndex: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := matchSend(tt.sends, phoneKey, android.ReceivedSMS{From: tt.from, Date: received, Body: "hi"}, window)
+			if tt.wantIndex < 0 {
+				if ok {
+					t.Errorf("matchSend() = contact %d, want no match", got.Index)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("matchSend() found no match, want contact %d", tt.wantIndex)
+			}
+			if got.Index != tt.wantIndex {
+				t.Errorf("matchSend() = contact %d, want %d", got.Index, tt.wantIndex)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package reply
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	bolt "go.etcd.io/bbolt"
+
+	"go.angaros.io/internal/dbutil"
+)
+
+// DefaultOptOutKeywords are the opt-out keywords if the setting is not set, in English and some other languages
+var DefaultOptOutKeywords = []string{"STOP", "STOPALL", "UNSUBSCRIBE", "CANCEL", "END", "QUIT", "ΣΤΟΠ", "ΔΙΑΓΡΑΦΗ", "ΑΠΕΓΓΡΑΦΗ", "BAJA", "ARRET", "STOPP", "ABMELDEN"}
+
+// DefaultWindowHours is the reply window if the setting is not set
+const DefaultWindowHours = 72
+
+// SettingReplies configures the collection of SMS replies to broadcasts
+type SettingReplies struct {
+	// OptOutKeywords are the replies that add the contact to the suppression list.
+	// They are compared with the whole reply, ignoring case, accents and punctuation. Empty disables opt-outs.
+	OptOutKeywords []string
+	// WindowHours is how long after a message was sent a message from the contact is a reply to it. 0 disables reply collection
+	WindowHours int
+}
+
+func (s SettingReplies) DBTable() string {
+	return "settings"
+}
+
+func (s SettingReplies) DBKey() []byte {
+	return []byte("reply.settings")
+}
+
+func (s SettingReplies) Enabled() bool {
+	return s.WindowHours > 0
+}
+
+func (s SettingReplies) Window() time.Duration {
+	return time.Duration(s.WindowHours) * time.Hour
+}
+
+func (s SettingReplies) Validate() error {
+	if s.WindowHours < 0 {
+		return fmt.Errorf("invalid reply window: value should not be negative")
+	}
+	for _, k := range s.OptOutKeywords {
+		if normalizeKeyword(k) == "" {
+			return fmt.Errorf("invalid opt-out keyword %q", k)
+		}
+	}
+	return nil
+}
+
+// IsOptOut reports whether the reply is one of the opt-out keywords
+func (s SettingReplies) IsOptOut(body string) bool {
+	body = normalizeKeyword(body)
+	if body == "" {
+		return false
+	}
+	for _, k := range s.OptOutKeywords {
+		if normalizeKeyword(k) == body {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseKeywords parses a comma separated list of keywords
+func ParseKeywords(s string) []string {
+	var keywords []string
+	for _, k := range strings.Split(s, ",") {
+		k = strings.TrimSpace(k)
+		if k != "" {
+			keywords = append(keywords, k)
+		}
+	}
+	return keywords
+}
+
+// accents replaces the uppercase letters with accents of the languages of DefaultOptOutKeywords
+var accents = strings.NewReplacer(
+	"Ά", "Α", "Έ", "Ε", "Ή", "Η", "Ί", "Ι", "Ϊ", "Ι", "Ό", "Ο", "Ύ", "Υ", "Ϋ", "Υ", "Ώ", "Ω",
+	"À", "A", "Á", "A", "Â", "A", "Ä", "A", "Ç", "C", "È", "E", "É", "E", "Ê", "E", "Ë", "E",
+	"Ì", "I", "Í", "I", "Î", "I", "Ï", "I", "Ñ", "N", "Ò", "O", "Ó", "O", "Ô", "O", "Ö", "O",
+	"Ù", "U", "Ú", "U", "Û", "U", "Ü", "U",
+)
+
+// normalizeKeyword uppercases the text and removes accents, punctuation and spaces at the ends
+func normalizeKeyword(s string) string {
+	s = accents.Replace(strings.ToUpper(s))
+	return strings.TrimFunc(s, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsPunct(r)
+	})
+}
+
+// GetSettingTx returns the setting, which has the default values if it is not set
+func GetSettingTx(tx *bolt.Tx) (SettingReplies, error) {
+	var s SettingReplies
+	err := dbutil.GetByKeyTx(tx, s.DBKey(), &s)
+	if errors.Is(err, dbutil.ErrNotFound) {
+		return SettingReplies{OptOutKeywords: DefaultOptOutKeywords, WindowHours: DefaultWindowHours}, nil
+	}
+	if err != nil {
+		return s, fmt.Errorf("failed to read setting replies from database: %s", err)
+	}
+	return s, nil
+}
@@ -0,0 +1,42 @@
+package reply
+
+import "testing"
+
+func TestNormalizeKeyword(t *testing.T) {
+	for s, want := range map[string]string{
+		"STOP":       "STOP",
+		"stop":       "STOP",
+		" Stop. ":    "STOP",
+		"STOP!":      "STOP",
+		"«stop»":     "STOP",
+		"στοπ":       "ΣΤΟΠ",
+		"στόπ":       "ΣΤΟΠ",
+		"Διαγραφή":   "ΔΙΑΓΡΑΦΗ",
+		"arrêt":      "ARRET",
+		"stop all":   "STOP ALL",
+		"?!":         "",
+		"":           "",
+		"\tbaja\r\n": "BAJA",
+	} {
+		if got := normalizeKeyword(s); got != want {
+			t.Errorf("normalizeKeyword(%q) = %q, want %q", s, got, want)
+		}
+	}
+}
+
+func TestIsOptOut(t *testing.T) {
+	s := SettingReplies{OptOutKeywords: DefaultOptOutKeywords, WindowHours: DefaultWindowHours}
+	for _, body := range []string{"STOP", "stop", "Stop.", " STOP! ", "στοπ", "ΣΤΌΠ", "διαγραφή", "Arrêt", "unsubscribe\n"} {
+		if !s.IsOptOut(body) {
+			t.Errorf("IsOptOut(%q) = false, want true", body)
+		}
+	}
+	for _, body := range []string{"", "...", "stop please", "don't stop", "STOPS", "thanks", "ΣΤΟ"} {
+		if s.IsOptOut(body) {
+			t.Errorf("IsOptOut(%q) = true, want false", body)
+		}
+	}
+	if (SettingReplies{WindowHours: DefaultWindowHours}).IsOptOut("STOP") {
+		t.Errorf("IsOptOut() without keywords = true, want false")
+	}
+}
@@ -0,0 +1,127 @@
+package suppression
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"go.angaros.io/internal/dbutil"
+)
+
+const (
+	ReasonManual       = "added manually"
+	ReasonImported     = "imported"
+	ReasonUnsubscribed = "unsubscribed"
+	ReasonHardBounce   = "hard bounce"
+	ReasonOptOut       = "opt-out reply"
+)
+
+// Entry is a recipient (email or phone number) that must not receive messages from any broadcast
+type Entry struct {
+	Recipient string
+	Reason    string
+	CreatedAt time.Time
+}
+
+func (e Entry) DBTable() string {
+	return "suppression"
+}
+
+func (e Entry) DBKey() []byte {
+	return []byte(Normalize(e.Recipient))
+}
+
+func (e Entry) CreatedAtString() string {
+	return e.CreatedAt.Local().Format("2006-01-02 15:04")
+}
+
+// Normalize returns the form of the recipient used for lookups.
+// Emails are lowercased. Spaces, dashes, dots and parentheses are removed from phone numbers
+// and the international prefix 00 is replaced with +.
+func Normalize(recipient string) string {
+	recipient = strings.TrimSpace(recipient)
+	if strings.Contains(recipient, "@") {
+		return strings.ToLower(recipient)
+	}
+	number := strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '-', '.', '(', ')':
+			return -1
+		}
+		return r
+	}, recipient)
+	if strings.HasPrefix(number, "00") {
+		number = "+" + number[2:]
+	}
+	return number
+}
+
+// New returns a new entry. The entry is not saved to the database.
+func New(recipient, reason string) (Entry, error) {
+	recipient = strings.TrimSpace(recipient)
+	if recipient == "" {
+		return Entry{}, fmt.Errorf("recipient is empty")
+	}
+	return Entry{
+		Recipient: recipient,
+		Reason:    reason,
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+// GetTx returns the entry of the recipient or dbutil.ErrNotFound if the recipient is not suppressed
+func GetTx(tx *bolt.Tx, recipient string) (Entry, error) {
+	var e Entry
+	err := dbutil.GetByKeyTx(tx, []byte(Normalize(recipient)), &e)
+	return e, err
+}
+
+// AddTx saves the entry unless the recipient is already suppressed.
+// It reports whether the entry was added.
+func AddTx(tx *bolt.Tx, e Entry) (bool, error) {
+	err := dbutil.InsertSaveableTx(tx, e)
+	if errors.Is(err, dbutil.ErrKeyExists) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to save suppression entry: %s", err)
+	}
+	return true, nil
+}
+
+// Add is like AddTx but opens its own transaction
+func Add(db *bolt.DB, recipient, reason string) (bool, error) {
+	e, err := New(recipient, reason)
+	if err != nil {
+		return false, err
+	}
+	var added bool
+	err = db.Update(func(tx *bolt.Tx) error {
+		added, err = AddTx(tx, e)
+		return err
+	})
+	return added, err
+}
+
+// ImportTx adds the recipients that are not already suppressed.
+// It returns the number of recipients added.
+func ImportTx(tx *bolt.Tx, recipients []string, reason string) (int, error) {
+	var added int
+	for _, r := range recipients {
+		e, err := New(r, reason)
+		if err != nil {
+			continue
+		}
+		ok, err := AddTx(tx, e)
+		if err != nil {
+			return added, err
+		}
+		if ok {
+			added++
+		}
+	}
+	return added, nil
+}
@@ -12,6 +12,8 @@ var (
 	TimeZones              []string
 	TimeZonesByCountryName map[string][]string
 	TimeZonesByCountryCode map[string][]string
+	CountryNameByCode      map[string]string
+	CountryCodeByTimeZone  map[string]string
 	Countries              []string
 )
 
@@ -39,6 +41,8 @@ func init() {
 	countriesMap := make(map[string]struct{})
 	TimeZonesByCountryName = make(map[string][]string)
 	TimeZonesByCountryCode = make(map[string][]string)
+	CountryNameByCode = make(map[string]string)
+	CountryCodeByTimeZone = make(map[string]string)
 	for _, tz := range tzs {
 		_, err := time.LoadLocation(tz.Name)
 		if err != nil {
@@ -49,6 +53,11 @@ func init() {
 		TimeZones = append(TimeZones, tz.String())
 		TimeZonesByCountryName[tz.CountryName] = append(TimeZonesByCountryName[tz.CountryName], tz.String())
 		TimeZonesByCountryCode[tz.CountryCode] = append(TimeZonesByCountryCode[tz.CountryCode], tz.String())
+		CountryNameByCode[tz.CountryCode] = tz.CountryName
+		CountryCodeByTimeZone[tz.Name] = tz.CountryCode
+		for _, name := range tz.Group {
+			CountryCodeByTimeZone[name] = tz.CountryCode
+		}
 	}
 	for country := range countriesMap {
 		Countries = append(Countries, country)
@@ -0,0 +1,125 @@
+package unsubscribe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"go.angaros.io/internal/suppression"
+)
+
+var pageTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1"><title>Unsubscribe</title></head>
+<body style="font-family: sans-serif; max-width: 40em; margin: 4em auto; padding: 0 1em">
+{{if .Error}}<p>{{.Error}}</p>
+{{else if .Done}}<p>{{.Recipient}} has been unsubscribed and will not receive any more messages.</p>
+{{else}}<form method="post">
+<p>Do you want to stop receiving messages at {{.Recipient}}?</p>
+<button type="submit" name="List-Unsubscribe" value="One-Click">Unsubscribe</button>
+</form>
+{{end}}</body>
+</html>
+`))
+
+type page struct {
+	Recipient string
+	Done      bool
+	Error     string
+}
+
+type handler struct {
+	db         *bolt.DB
+	loggerInfo *log.Logger
+}
+
+// NewHandler returns the handler of the unsubscribe endpoint, which is meant to be public.
+// GET shows a confirmation page, because link scanners follow the links in messages.
+// POST, which is also used by one-click unsubscribe (RFC 8058), adds the recipient of the token to the suppression list.
+func NewHandler(db *bolt.DB, loggerInfo *log.Logger) http.Handler {
+	return &handler{
+		db:         db,
+		loggerInfo: log.New(loggerInfo.Writer(), loggerInfo.Prefix()+"[unsubscribe] ", loggerInfo.Flags()),
+	}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		h.writePage(w, http.StatusMethodNotAllowed, page{Error: "Method not allowed."})
+		return
+	}
+	var secret []byte
+	if err := h.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		secret, err = GetOrCreateSecretTx(tx)
+		return err
+	}); err != nil {
+		h.loggerInfo.Println(err)
+		h.writePage(w, http.StatusInternalServerError, page{Error: "Something went wrong. Please try again later."})
+		return
+	}
+	recipient, err := Verify(secret, r.URL.Query().Get("token"))
+	if err != nil {
+		h.writePage(w, http.StatusBadRequest, page{Error: "This unsubscribe link is invalid."})
+		return
+	}
+	if r.Method == http.MethodGet {
+		h.writePage(w, http.StatusOK, page{Recipient: recipient})
+		return
+	}
+	added, err := suppression.Add(h.db, recipient, suppression.ReasonUnsubscribed)
+	if err != nil {
+		h.loggerInfo.Printf("failed to unsubscribe %s: %s\n", recipient, err)
+		h.writePage(w, http.StatusInternalServerError, page{Error: "Something went wrong. Please try again later."})
+		return
+	}
+	if added {
+		h.loggerInfo.Printf("%s unsubscribed\n", recipient)
+	}
+	h.writePage(w, http.StatusOK, page{Recipient: recipient, Done: true})
+}
+
+func (h *handler) writePage(w http.ResponseWriter, status int, p page) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	_ = pageTemplate.Execute(w, p)
+}
+
+// ListenAndServe serves the unsubscribe endpoint on addr until ctx is cancelled.
+// It should be behind a reverse proxy that terminates TLS, because the List-Unsubscribe URL must be https.
+func ListenAndServe(ctx context.Context, addr string, db *bolt.DB, loggerInfo *log.Logger) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %s", addr, err)
+	}
+	srv := &http.Server{
+		Handler:           NewHandler(db, loggerInfo),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		ctxShutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctxShutdown); err != nil {
+			loggerInfo.Println("[unsubscribe] shutdown failed:", err)
+		}
+	}()
+	loggerInfo.Printf("[unsubscribe] listening on %s\n", ln.Addr())
+	err = srv.Serve(ln)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	// Serve returns when the shutdown starts, so wait for the requests in progress that use the database
+	<-shutdownDone
+	return nil
+}
@@ -0,0 +1,121 @@
+package unsubscribe
+
+import (
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+
+	"go.angaros.io/internal/dbutil"
+	"go.angaros.io/internal/gateway/email"
+)
+
+// SettingSecret is the key used to sign the unsubscribe tokens
+type SettingSecret []byte
+
+func (s SettingSecret) DBTable() string {
+	return "settings"
+}
+
+func (s SettingSecret) DBKey() []byte {
+	return []byte("unsubscribe.secret")
+}
+
+// GetOrCreateSecretTx returns the secret, generating a new one if it does not exist
+func GetOrCreateSecretTx(tx *bolt.Tx) ([]byte, error) {
+	var secret SettingSecret
+	err := dbutil.GetByKeyTx(tx, secret.DBKey(), &secret)
+	if err != nil && !errors.Is(err, dbutil.ErrNotFound) {
+		return nil, fmt.Errorf("failed to read unsubscribe secret from database: %s", err)
+	}
+	if len(secret) > 0 {
+		return secret, nil
+	}
+	secret = make(SettingSecret, 32)
+	if _, err := crand.Read(secret); err != nil {
+		return nil, fmt.Errorf("random number generator failed: %s", err)
+	}
+	if err := dbutil.UpsertSaveableTx(tx, secret); err != nil {
+		return nil, fmt.Errorf("failed to save unsubscribe secret to database: %s", err)
+	}
+	return secret, nil
+}
+
+// Token returns the token of the recipient: the base64 encoded recipient followed by a signature.
+// Tokens do not expire, so links in old messages keep working.
+func Token(secret []byte, recipient string) string {
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString([]byte(recipient)) + "." + enc.EncodeToString(sign(secret, recipient))
+}
+
+// Verify checks the signature of the token and returns the recipient
+func Verify(secret []byte, token string) (string, error) {
+	enc := base64.RawURLEncoding
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return "", fmt.Errorf("invalid token")
+	}
+	recipient, err := enc.DecodeString(parts[0])
+	if err != nil {
+		return "", fmt.Errorf("invalid token")
+	}
+	signature, err := enc.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(signature, sign(secret, string(recipient))) {
+		return "", fmt.Errorf("invalid token")
+	}
+	return string(recipient), nil
+}
+
+func sign(secret []byte, recipient string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("unsubscribe\x00" + recipient))
+	// 128 bits are enough and keep the URLs short
+	return mac.Sum(nil)[:16]
+}
+
+// URL returns the unsubscribe URL of the recipient
+func URL(baseURL string, secret []byte, recipient string) string {
+	sep := "?"
+	if strings.Contains(baseURL, "?") {
+		sep = "&"
+	}
+	return baseURL + sep + "token=" + url.QueryEscape(Token(secret, recipient))
+}
+
+// ValidateBaseURL checks that the URL can be used in the List-Unsubscribe header, which requires https for one-click unsubscribe
+func ValidateBaseURL(baseURL string) error {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return fmt.Errorf("invalid URL: %s", err)
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("invalid URL %s: expected https://host/path", baseURL)
+	}
+	return nil
+}
+
+// NewURLFuncTx returns a function that returns the unsubscribe URL of a recipient,
+// or nil if the unsubscribe URL is not set in the settings
+func NewURLFuncTx(tx *bolt.Tx) (func(recipient string) string, error) {
+	var baseURL email.SettingListUnsubscribeURL
+	err := dbutil.GetByKeyTx(tx, baseURL.DBKey(), &baseURL)
+	if err != nil && !errors.Is(err, dbutil.ErrNotFound) {
+		return nil, fmt.Errorf("failed to read setting ListUnsubscribeURL from database: %s", err)
+	}
+	if baseURL == "" {
+		return nil, nil
+	}
+	secret, err := GetOrCreateSecretTx(tx)
+	if err != nil {
+		return nil, err
+	}
+	return func(recipient string) string {
+		return URL(string(baseURL), secret, recipient)
+	}, nil
+}